@@ -1,15 +1,19 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"nano-banana-qwen/internal/api"
+	"nano-banana-qwen/internal/app"
 	"nano-banana-qwen/internal/config"
-	"nano-banana-qwen/internal/services"
 )
 
 func main() {
@@ -17,17 +21,21 @@ func main() {
 
 	// 加载配置
 	cfg := config.LoadConfig()
-	if cfg.OpenRouterAPIKey == "" {
+	if cfg.ImageProvider == "openrouter" && cfg.OpenRouterAPIKey == "" {
 		log.Fatal("❌ OpenRouter API Key 未设置，请检查环境变量")
 	}
 
-	// 初始化数据库
-	if err := services.InitDatabase(); err != nil {
+	// 初始化应用（数据库连接、服务和后台处理器）
+	application, err := app.New(cfg)
+	if err != nil {
 		log.Fatal("❌ 数据库初始化失败:", err)
 	}
 
+	// 启动批量任务和异步生成处理器
+	application.Start(context.Background())
+
 	// 设置路由
-	router := api.SetupRouter()
+	router := api.SetupRouter(application)
 
 	// 启动服务器
 	address := fmt.Sprintf("%s:%s", cfg.ServerHost, cfg.ServerPort)
@@ -38,9 +46,14 @@ func main() {
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 
+	srv := &http.Server{
+		Addr:    address,
+		Handler: router,
+	}
+
 	// 在goroutine中启动服务器
 	go func() {
-		if err := router.Run(address); err != nil {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			log.Fatal("❌ 服务器启动失败:", err)
 		}
 	}()
@@ -49,9 +62,25 @@ func main() {
 
 	// 等待中断信号
 	<-quit
-	log.Println("🛑 收到停止信号，正在关闭服务器...")
+	log.Printf("🛑 收到停止信号，正在关闭服务器 (等待 %d 秒)...", cfg.ShutdownTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout)*time.Second)
+	defer cancel()
+
+	// 后台处理器不再领取新任务，超过等待时间后中断进行中的生成，任务重新入队
+	application.Stop()
+	context.AfterFunc(ctx, func() {
+		log.Println("⏸️ 等待超时，中断进行中的生成")
+		application.Interrupt()
+	})
+
+	// 停止接收新请求，等待进行中的请求完成
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("⚠️ HTTP服务未能在等待时间内关闭: %v", err)
+	}
 
-	// 清理资源
-	services.CloseDatabases()
+	// 等待进行中的生成结束，然后清理资源
+	application.Wait()
+	application.Close()
 	log.Println("👋 服务器已优雅关闭")
-}
\ No newline at end of file
+}
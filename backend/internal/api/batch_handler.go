@@ -2,31 +2,41 @@ package api
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
 	"time"
 
+	"nano-banana-qwen/internal/app"
 	"nano-banana-qwen/internal/models"
+	"nano-banana-qwen/internal/repository"
 	"nano-banana-qwen/internal/services"
 
 	"github.com/gin-gonic/gin"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type BatchHandler struct {
-	openRouterService *services.OpenRouterService
-	imageService      *services.ImageService
-	queueService      *services.QueueService
+	batchJobs    repository.BatchJobRepository
+	generations  repository.GenerationRepository
+	imageService *services.ImageService
+	queueService *services.QueueService
+	batchWorker  *services.BatchWorker
+	eventService *services.EventService
+	stopping     <-chan struct{}
 }
 
 // NewBatchHandler 创建批量任务处理器
-func NewBatchHandler() *BatchHandler {
+func NewBatchHandler(a *app.App) *BatchHandler {
 	return &BatchHandler{
-		openRouterService: services.NewOpenRouterService(),
-		imageService:      services.NewImageService(),
-		queueService:      services.NewQueueService(),
+		batchJobs:    a.Repos().BatchJobs,
+		generations:  a.Repos().Generations,
+		imageService: a.Images,
+		queueService: a.Queue,
+		batchWorker:  a.BatchWorker,
+		eventService: a.Events,
+		stopping:     a.Stopping(),
 	}
 }
 
@@ -50,11 +60,11 @@ func (h *BatchHandler) CreateBatchJob(c *gin.Context) {
 
 	// 计算总图片数量
 	totalImages := 0
-	for _, promptItem := range req.Prompts {
-		if promptItem.Count <= 0 {
-			promptItem.Count = 1
+	for i := range req.Prompts {
+		if req.Prompts[i].Count <= 0 {
+			req.Prompts[i].Count = 1
 		}
-		totalImages += promptItem.Count
+		totalImages += req.Prompts[i].Count
 	}
 
 	// 创建批量任务
@@ -66,26 +76,23 @@ func (h *BatchHandler) CreateBatchJob(c *gin.Context) {
 		CompletedImages:  0,
 		FailedImages:     0,
 		Status:           "pending",
+		Priority:         req.Priority,
 		CreatedAt:        time.Now(),
 		Deleted:          false,
 	}
 
 	// 保存到数据库
-	_, err := services.MongoDB.Collection("batch_jobs").InsertOne(context.Background(), batchJob)
-	if err != nil {
+	if err := h.batchJobs.Create(context.Background(), &batchJob); err != nil {
 		c.JSON(http.StatusInternalServerError, models.ErrorResponse(err.Error(), "保存批量任务失败"))
 		return
 	}
 
 	// 添加到队列
-	if err := h.queueService.AddBatchJob(batchJob.ID.Hex()); err != nil {
+	if err := h.queueService.AddBatchJob(&batchJob); err != nil {
 		c.JSON(http.StatusInternalServerError, models.ErrorResponse(err.Error(), "添加到队列失败"))
 		return
 	}
 
-	// 更新任务状态为处理中
-	h.updateBatchJobStatus(batchJob.ID, "processing", "开始处理批量任务")
-
 	c.JSON(http.StatusOK, models.SuccessResponse(batchJob, "批量任务创建成功"))
 }
 
@@ -108,38 +115,11 @@ func (h *BatchHandler) ListBatchJobs(c *gin.Context) {
 
 	status := c.Query("status")
 
-	// 构建查询条件
-	filter := bson.M{"deleted": false}
-	if status != "" {
-		filter["status"] = status
-	}
-
-	// 获取总数
-	total, err := services.MongoDB.Collection("batch_jobs").CountDocuments(context.Background(), filter)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, models.ErrorResponse(err.Error(), "获取总数失败"))
-		return
-	}
-
-	// 分页查询
-	skip := int64((page - 1) * pageSize)
-	limit := int64(pageSize)
-	cursor, err := services.MongoDB.Collection("batch_jobs").Find(context.Background(), filter, &options.FindOptions{
-		Skip:  &skip,
-		Limit: &limit,
-		Sort:  bson.D{{Key: "created_at", Value: -1}},
-	})
+	jobs, total, err := h.batchJobs.List(context.Background(), status, repository.Page{Page: page, PageSize: pageSize})
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, models.ErrorResponse(err.Error(), "查询失败"))
 		return
 	}
-	defer cursor.Close(context.Background())
-
-	var jobs []models.BatchJob
-	if err := cursor.All(context.Background(), &jobs); err != nil {
-		c.JSON(http.StatusInternalServerError, models.ErrorResponse(err.Error(), "解析结果失败"))
-		return
-	}
 
 	// 构建响应
 	totalPages := int((total + int64(pageSize) - 1) / int64(pageSize))
@@ -163,11 +143,7 @@ func (h *BatchHandler) GetBatchJob(c *gin.Context) {
 		return
 	}
 
-	var job models.BatchJob
-	err = services.MongoDB.Collection("batch_jobs").FindOne(context.Background(), bson.M{
-		"_id":     id,
-		"deleted": false,
-	}).Decode(&job)
+	job, err := h.batchJobs.GetByID(context.Background(), id)
 
 	if err != nil {
 		c.JSON(http.StatusNotFound, models.ErrorResponse(err.Error(), "批量任务不存在"))
@@ -186,34 +162,300 @@ func (h *BatchHandler) GetBatchJobStatus(c *gin.Context) {
 		return
 	}
 
+	status, err := h.loadJobStatus(id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, models.ErrorResponse(err.Error(), "批量任务不存在"))
+		return
+	}
+
+	c.JSON(http.StatusOK, models.SuccessResponse(status, "获取任务状态成功"))
+}
+
+// StreamBatchJobEvents 以SSE推送批量任务进度
+func (h *BatchHandler) StreamBatchJobEvents(c *gin.Context) {
+	idStr := c.Param("id")
+	id, err := primitive.ObjectIDFromHex(idStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse(err.Error(), "ID格式无效"))
+		return
+	}
+
+	// 先订阅再读取快照，避免遗漏两者之间的事件
+	pubsub, err := h.eventService.Subscribe(c.Request.Context(), services.JobEventChannel(idStr))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse(err.Error(), "订阅任务事件失败"))
+		return
+	}
+
+	status, err := h.loadJobStatus(id)
+	if err != nil {
+		pubsub.Close()
+		c.JSON(http.StatusNotFound, models.ErrorResponse(err.Error(), "批量任务不存在"))
+		return
+	}
+
+	streamStatusEvents(c, pubsub, h.stopping, status, status.Status, map[string]bool{
+		"completed": true,
+		"failed":    true,
+		"cancelled": true,
+	})
+}
+
+// loadJobStatus 获取任务实时状态，Redis中不存在时从数据库构建
+func (h *BatchHandler) loadJobStatus(id primitive.ObjectID) (*models.JobStatus, error) {
 	// 从Redis获取实时状态
-	status, err := h.queueService.GetJobStatus(idStr)
+	status, err := h.queueService.GetJobStatus(id.Hex())
+	if err == nil {
+		return status, nil
+	}
+
+	// 如果Redis中没有，从数据库获取
+	job, err := h.batchJobs.GetByID(context.Background(), id)
 	if err != nil {
-		// 如果Redis中没有，从数据库获取
-		var job models.BatchJob
-		err = services.MongoDB.Collection("batch_jobs").FindOne(context.Background(), bson.M{
-			"_id":     id,
-			"deleted": false,
-		}).Decode(&job)
-
-		if err != nil {
-			c.JSON(http.StatusNotFound, models.ErrorResponse(err.Error(), "批量任务不存在"))
-			return
-		}
+		return nil, err
+	}
 
-		status = &models.JobStatus{
-			JobID:           job.ID.Hex(),
-			Status:          job.Status,
-			TotalImages:     job.TotalImages,
-			CompletedImages: job.CompletedImages,
-			FailedImages:    job.FailedImages,
-			Progress:        h.calculateProgress(job.CompletedImages, job.TotalImages),
-			Message:         "任务状态",
-			UpdatedAt:       job.UpdatedAt,
-		}
+	return &models.JobStatus{
+		JobID:           job.ID.Hex(),
+		Status:          job.Status,
+		TotalImages:     job.TotalImages,
+		CompletedImages: job.CompletedImages,
+		FailedImages:    job.FailedImages,
+		Progress:        h.calculateProgress(job.CompletedImages, job.TotalImages),
+		Message:         "任务状态",
+		UpdatedAt:       job.UpdatedAt,
+	}, nil
+}
+
+// GetBatchDedupeReport 报告批量任务内互为近似的图片，max_distance 为最大汉明距离（0-64）
+func (h *BatchHandler) GetBatchDedupeReport(c *gin.Context) {
+	idStr := c.Param("id")
+	id, err := primitive.ObjectIDFromHex(idStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse(err.Error(), "ID格式无效"))
+		return
 	}
 
-	c.JSON(http.StatusOK, models.SuccessResponse(status, "获取任务状态成功"))
+	maxDistance, err := parseMaxDistance(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse(err.Error(), "max_distance 参数无效"))
+		return
+	}
+
+	if _, err := h.batchJobs.GetByID(context.Background(), id); err != nil {
+		c.JSON(http.StatusNotFound, models.ErrorResponse(err.Error(), "批量任务不存在"))
+		return
+	}
+
+	report, err := h.imageService.BatchDedupeReport(id, maxDistance)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse(err.Error(), "生成去重报告失败"))
+		return
+	}
+
+	c.JSON(http.StatusOK, models.SuccessResponse(report, "生成去重报告成功"))
+}
+
+// ExportBatchJob 将批量任务生成的全部图片导出为ZIP，thumbnails=true 时包含缩略图
+func (h *BatchHandler) ExportBatchJob(c *gin.Context) {
+	idStr := c.Param("id")
+	id, err := primitive.ObjectIDFromHex(idStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse(err.Error(), "ID格式无效"))
+		return
+	}
+
+	if _, err := h.batchJobs.GetByID(context.Background(), id); err != nil {
+		c.JSON(http.StatusNotFound, models.ErrorResponse(err.Error(), "批量任务不存在"))
+		return
+	}
+
+	images, err := h.imageService.ListBatchImages(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse(err.Error(), "查询任务图片失败"))
+		return
+	}
+
+	streamExport(c, h.imageService, images, c.Query("thumbnails") == "true", fmt.Sprintf("batch_%s.zip", id.Hex()))
+}
+
+// UpdateBatchJob 修改未结束任务的优先级，排队中的任务按新优先级调整位置，处理中的任务在后续图片生效
+func (h *BatchHandler) UpdateBatchJob(c *gin.Context) {
+	idStr := c.Param("id")
+	id, err := primitive.ObjectIDFromHex(idStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse(err.Error(), "ID格式无效"))
+		return
+	}
+
+	var req models.UpdateBatchJobRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse(err.Error(), "请求参数无效"))
+		return
+	}
+
+	job, err := h.batchJobs.GetByID(context.Background(), id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, models.ErrorResponse(err.Error(), "批量任务不存在"))
+		return
+	}
+
+	if job.Status == "completed" || job.Status == "failed" || job.Status == "cancelled" {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse("任务已完成或已取消", "无法修改任务"))
+		return
+	}
+
+	if err := h.batchJobs.UpdatePriority(context.Background(), id, *req.Priority); err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse(err.Error(), "修改优先级失败"))
+		return
+	}
+	if _, err := h.queueService.SetJobPriority(idStr, *req.Priority); err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse(err.Error(), "修改优先级失败"))
+		return
+	}
+
+	job.Priority = *req.Priority
+	c.JSON(http.StatusOK, models.SuccessResponse(job, "任务已更新"))
+}
+
+// ListBatchTasks 获取批量任务中已开始生成的图片，status 可按生成状态过滤
+func (h *BatchHandler) ListBatchTasks(c *gin.Context) {
+	idStr := c.Param("id")
+	id, err := primitive.ObjectIDFromHex(idStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse(err.Error(), "ID格式无效"))
+		return
+	}
+
+	if _, err := h.batchJobs.GetByID(context.Background(), id); err != nil {
+		c.JSON(http.StatusNotFound, models.ErrorResponse(err.Error(), "批量任务不存在"))
+		return
+	}
+
+	generations, _, err := h.generations.List(context.Background(), repository.GenerationFilter{
+		BatchJobID: &id,
+		Status:     c.Query("status"),
+	}, repository.Page{})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse(err.Error(), "查询图片任务失败"))
+		return
+	}
+
+	c.JSON(http.StatusOK, models.SuccessResponse(generations, "获取图片任务成功"))
+}
+
+// RetryBatchTask 重新生成批量任务中一张失败的图片，已结束的任务回到处理中
+func (h *BatchHandler) RetryBatchTask(c *gin.Context) {
+	idStr := c.Param("id")
+	if _, err := primitive.ObjectIDFromHex(idStr); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse(err.Error(), "ID格式无效"))
+		return
+	}
+	taskID := c.Param("task_id")
+
+	task, err := h.queueService.GetTask(taskID)
+	if err != nil && !errors.Is(err, services.ErrTaskNotFound) {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse(err.Error(), "读取图片任务失败"))
+		return
+	}
+	if err != nil || task.JobID != idStr {
+		c.JSON(http.StatusNotFound, models.ErrorResponse(services.ErrTaskNotFailed.Error(), "失败的图片任务不存在"))
+		return
+	}
+
+	retried, err := h.batchWorker.RetryTask(taskID)
+	if err != nil {
+		respondRetryError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, models.SuccessResponse(retried, "图片任务已重新入队"))
+}
+
+// respondRetryError 根据重试失败的原因返回对应的状态码
+func respondRetryError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrJobCancelled):
+		c.JSON(http.StatusBadRequest, models.ErrorResponse(err.Error(), "无法重试"))
+	case errors.Is(err, repository.ErrNotFound):
+		c.JSON(http.StatusNotFound, models.ErrorResponse(err.Error(), "批量任务不存在"))
+	case errors.Is(err, services.ErrTaskNotFailed), errors.Is(err, services.ErrTaskNotFound):
+		c.JSON(http.StatusNotFound, models.ErrorResponse(err.Error(), "失败的图片任务不存在"))
+	default:
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse(err.Error(), "重新入队失败"))
+	}
+}
+
+// PauseBatchJob 暂停批量任务，不再开始新的图片，已在生成的图片完成后照常计入结果
+func (h *BatchHandler) PauseBatchJob(c *gin.Context) {
+	idStr := c.Param("id")
+	id, err := primitive.ObjectIDFromHex(idStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse(err.Error(), "ID格式无效"))
+		return
+	}
+
+	job, err := h.batchJobs.GetByID(context.Background(), id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, models.ErrorResponse(err.Error(), "批量任务不存在"))
+		return
+	}
+
+	if job.Status != "pending" && job.Status != "processing" && job.Status != "interrupted" {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse("任务已暂停、完成或取消", "无法暂停任务"))
+		return
+	}
+
+	if err := h.queueService.PauseJob(idStr); err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse(err.Error(), "暂停任务失败"))
+		return
+	}
+	h.updateBatchJobStatus(id, "paused")
+
+	job.Status = "paused"
+	c.JSON(http.StatusOK, models.SuccessResponse(job, "任务已暂停"))
+}
+
+// ResumeBatchJob 恢复已暂停的批量任务，继续生成每个提示词剩余的图片
+func (h *BatchHandler) ResumeBatchJob(c *gin.Context) {
+	idStr := c.Param("id")
+	id, err := primitive.ObjectIDFromHex(idStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse(err.Error(), "ID格式无效"))
+		return
+	}
+
+	job, err := h.batchJobs.GetByID(context.Background(), id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, models.ErrorResponse(err.Error(), "批量任务不存在"))
+		return
+	}
+
+	if job.Status != "paused" {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse("任务未暂停", "无法恢复任务"))
+		return
+	}
+
+	// 暂停期间处理中的图片已全部结束时直接得出最终状态
+	status := "pending"
+	switch {
+	case job.CompletedImages+job.FailedImages >= job.TotalImages && job.CompletedImages == 0:
+		status = "failed"
+	case job.CompletedImages+job.FailedImages >= job.TotalImages:
+		status = "completed"
+	case job.StartedAt != nil:
+		status = "processing"
+	}
+
+	h.updateBatchJobStatus(id, status)
+	if err := h.queueService.ResumeJob(idStr, status); err != nil {
+		h.updateBatchJobStatus(id, "paused")
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse(err.Error(), "恢复任务失败"))
+		return
+	}
+
+	job.Status = status
+	c.JSON(http.StatusOK, models.SuccessResponse(job, "任务已恢复"))
 }
 
 // CancelBatchJob 取消批量任务
@@ -226,11 +468,7 @@ func (h *BatchHandler) CancelBatchJob(c *gin.Context) {
 	}
 
 	// 检查任务是否存在和可取消
-	var job models.BatchJob
-	err = services.MongoDB.Collection("batch_jobs").FindOne(context.Background(), bson.M{
-		"_id":     id,
-		"deleted": false,
-	}).Decode(&job)
+	job, err := h.batchJobs.GetByID(context.Background(), id)
 
 	if err != nil {
 		c.JSON(http.StatusNotFound, models.ErrorResponse(err.Error(), "批量任务不存在"))
@@ -249,7 +487,7 @@ func (h *BatchHandler) CancelBatchJob(c *gin.Context) {
 	}
 
 	// 更新任务状态
-	h.updateBatchJobStatus(id, "cancelled", "用户取消")
+	h.updateBatchJobStatus(id, "cancelled")
 
 	c.JSON(http.StatusOK, models.SuccessResponse(nil, "任务已取消"))
 }
@@ -264,29 +502,16 @@ func (h *BatchHandler) DeleteBatchJob(c *gin.Context) {
 	}
 
 	// 软删除
-	update := bson.M{
-		"$set": bson.M{
-			"deleted":        true,
-			"deleted_at":     time.Now(),
-			"deleted_reason": "用户删除",
-		},
+	err = h.batchJobs.SoftDelete(context.Background(), id, "用户删除")
+	if err == repository.ErrNotFound {
+		c.JSON(http.StatusNotFound, models.ErrorResponse("任务不存在", "删除失败"))
+		return
 	}
-
-	result, err := services.MongoDB.Collection("batch_jobs").UpdateOne(context.Background(), bson.M{
-		"_id":     id,
-		"deleted": false,
-	}, update)
-
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, models.ErrorResponse(err.Error(), "删除失败"))
 		return
 	}
 
-	if result.MatchedCount == 0 {
-		c.JSON(http.StatusNotFound, models.ErrorResponse("任务不存在", "删除失败"))
-		return
-	}
-
 	// 从队列中移除
 	h.queueService.CancelJob(idStr)
 
@@ -294,20 +519,8 @@ func (h *BatchHandler) DeleteBatchJob(c *gin.Context) {
 }
 
 // updateBatchJobStatus 更新批量任务状态
-func (h *BatchHandler) updateBatchJobStatus(id primitive.ObjectID, status string, message string) {
-	update := bson.M{
-		"$set": bson.M{
-			"status":     status,
-			"message":    message,
-			"updated_at": time.Now(),
-		},
-	}
-
-	if status == "completed" || status == "failed" || status == "cancelled" {
-		update["$set"].(bson.M)["completed_at"] = time.Now()
-	}
-
-	services.MongoDB.Collection("batch_jobs").UpdateOne(context.Background(), bson.M{"_id": id}, update)
+func (h *BatchHandler) updateBatchJobStatus(id primitive.ObjectID, status string) {
+	h.batchJobs.UpdateStatus(context.Background(), id, status)
 }
 
 // calculateProgress 计算进度百分比
@@ -0,0 +1,342 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"nano-banana-qwen/internal/imagemeta"
+	"nano-banana-qwen/internal/models"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestBatchDedupeReport(t *testing.T) {
+	router, repos := newTestRouter(t)
+	ctx := context.Background()
+
+	job := models.BatchJob{ID: primitive.NewObjectID(), Name: "去重", Status: "completed", CreatedAt: time.Now()}
+	if err := repos.BatchJobs.Create(ctx, &job); err != nil {
+		t.Fatalf("创建批量任务失败: %v", err)
+	}
+
+	// 两个属于任务的生成记录，另一个不属于任务
+	generationIDs := make([]primitive.ObjectID, 3)
+	for i := range generationIDs {
+		generation := models.Generation{ID: primitive.NewObjectID(), PromptText: "cat", Status: "completed", CreatedAt: time.Now()}
+		if i < 2 {
+			generation.BatchJobID = &job.ID
+		}
+		if err := repos.Generations.Create(ctx, &generation); err != nil {
+			t.Fatalf("创建生成记录失败: %v", err)
+		}
+		generationIDs[i] = generation.ID
+	}
+
+	// A-B、B-C 距离为2，A-C 距离为4，D 与其他图片都不相似，E 不属于任务
+	base := time.Now()
+	seeds := []struct {
+		generation int
+		phash      string
+	}{
+		{0, "0000000000000000"},
+		{0, "0000000000000003"},
+		{1, "000000000000000f"},
+		{1, "ffffffffffffffff"},
+		{2, "0000000000000000"},
+	}
+	ids := make([]primitive.ObjectID, len(seeds))
+	for i, seed := range seeds {
+		image := models.Image{
+			ID:           primitive.NewObjectID(),
+			PHash:        seed.phash,
+			GenerationID: &generationIDs[seed.generation],
+			CreatedAt:    base.Add(time.Duration(i) * time.Second),
+		}
+		if err := repos.Images.Create(ctx, &image); err != nil {
+			t.Fatalf("创建图片失败: %v", err)
+		}
+		ids[i] = image.ID
+	}
+
+	// 近似关系可以传递，A、B、C 合并为一组，以最早的 A 为基准
+	var report models.BatchDedupeReport
+	code, resp := doJSON(t, router, http.MethodGet, "/api/v1/batch/"+job.ID.Hex()+"/dedupe?max_distance=2", nil, &report)
+	if code != http.StatusOK {
+		t.Fatalf("去重报告: code = %d, resp = %+v", code, resp)
+	}
+	if report.TotalImages != 4 || report.DuplicateImages != 2 || len(report.Groups) != 1 {
+		t.Fatalf("去重报告 = %+v", report)
+	}
+	group := report.Groups[0].Images
+	if len(group) != 3 || group[0].Image.ID != ids[0] || group[1].Image.ID != ids[1] || group[2].Image.ID != ids[2] ||
+		group[0].Distance != 0 || group[1].Distance != 2 || group[2].Distance != 4 {
+		t.Errorf("重复分组 = %+v", group)
+	}
+
+	report = models.BatchDedupeReport{}
+	doJSON(t, router, http.MethodGet, "/api/v1/batch/"+job.ID.Hex()+"/dedupe?max_distance=0", nil, &report)
+	if report.DuplicateImages != 0 || len(report.Groups) != 0 {
+		t.Errorf("距离为0时不应有重复: %+v", report)
+	}
+
+	if code, _ := doJSON(t, router, http.MethodGet, "/api/v1/batch/"+primitive.NewObjectID().Hex()+"/dedupe", nil, nil); code != http.StatusNotFound {
+		t.Errorf("不存在的任务: code = %d, 期望 404", code)
+	}
+}
+
+func TestExportBatchJob(t *testing.T) {
+	router, repos := newTestRouter(t)
+	ctx := context.Background()
+
+	job := models.BatchJob{ID: primitive.NewObjectID(), Name: "导出", Status: "completed", CreatedAt: time.Now()}
+	if err := repos.BatchJobs.Create(ctx, &job); err != nil {
+		t.Fatalf("创建批量任务失败: %v", err)
+	}
+	params := models.GenerationParams{Provider: "mock", Model: "mock-v1", Size: "256x256"}
+	generation := models.Generation{ID: primitive.NewObjectID(), BatchJobID: &job.ID, PromptText: "红色的猫", GenerationParams: params, Status: "completed", CreatedAt: time.Now()}
+	if err := repos.Generations.Create(ctx, &generation); err != nil {
+		t.Fatalf("创建生成记录失败: %v", err)
+	}
+
+	// 借用上传的文件作为任务生成的图片
+	data := encodePNG(t, 4, 4)
+	code, resp := uploadFile(t, router, "cat.png", data)
+	if code != http.StatusOK {
+		t.Fatalf("上传图片: code = %d, resp = %+v", code, resp)
+	}
+	var uploaded models.Image
+	if err := json.Unmarshal(resp.Data, &uploaded); err != nil {
+		t.Fatalf("解析上传结果失败: %v", err)
+	}
+	generated := uploaded
+	generated.ID = primitive.NewObjectID()
+	generated.GenerationID = &generation.ID
+	if err := repos.Images.Create(ctx, &generated); err != nil {
+		t.Fatalf("创建图片失败: %v", err)
+	}
+
+	code, files, manifest := downloadZip(t, router, http.MethodGet, "/api/v1/batch/"+job.ID.Hex()+"/export.zip?thumbnails=true", nil)
+	if code != http.StatusOK {
+		t.Fatalf("导出批量任务: code = %d", code)
+	}
+	if len(manifest) != 1 {
+		t.Fatalf("manifest = %+v", manifest)
+	}
+	entry := manifest[0]
+	if entry.ImageID != generated.ID.Hex() || entry.GenerationID != generation.ID.Hex() || entry.Prompt != "红色的猫" ||
+		entry.Params == nil || *entry.Params != params {
+		t.Errorf("manifest 项 = %+v", entry)
+	}
+	if len(files[entry.File]) == 0 || bytes.Equal(files[entry.File], data) || len(files[entry.Thumbnail]) == 0 {
+		t.Errorf("压缩包文件 = %v", entry)
+	}
+	// 压缩包中的原图与下载一样带有生成信息
+	if meta, err := imagemeta.Extract(files[entry.File]); err != nil || meta.GenerationID != generation.ID.Hex() || meta.Prompt != "红色的猫" {
+		t.Errorf("压缩包中图片的生成信息 = %+v, %v", meta, err)
+	}
+
+	if code, _, _ := downloadZip(t, router, http.MethodGet, "/api/v1/batch/"+primitive.NewObjectID().Hex()+"/export.zip", nil); code != http.StatusNotFound {
+		t.Errorf("不存在的任务: code = %d, 期望 404", code)
+	}
+}
+
+func TestUpdateBatchJobPriority(t *testing.T) {
+	router, repos := newTestRouter(t)
+
+	var job models.BatchJob
+	code, resp := doJSON(t, router, http.MethodPost, "/api/v1/batch", map[string]interface{}{
+		"name":     "优先级",
+		"prompts":  []map[string]interface{}{{"prompt_text": "cat", "count": 1}},
+		"priority": 2,
+	}, &job)
+	if code != http.StatusOK || job.Priority != 2 {
+		t.Fatalf("创建批量任务: code = %d, job = %+v, resp = %+v", code, job, resp)
+	}
+
+	path := "/api/v1/batch/" + job.ID.Hex()
+	var updated models.BatchJob
+	if code, resp := doJSON(t, router, http.MethodPatch, path, map[string]int{"priority": 8}, &updated); code != http.StatusOK || updated.Priority != 8 {
+		t.Fatalf("修改优先级: code = %d, job = %+v, resp = %+v", code, updated, resp)
+	}
+	stored, err := repos.BatchJobs.GetByID(context.Background(), job.ID)
+	if err != nil || stored.Priority != 8 {
+		t.Errorf("保存的任务 = %+v, err = %v", stored, err)
+	}
+
+	for _, tc := range []struct {
+		path string
+		body interface{}
+		code int
+	}{
+		{path, map[string]int{"priority": 11}, http.StatusBadRequest},
+		{path, map[string]interface{}{}, http.StatusBadRequest},
+		{"/api/v1/batch/" + primitive.NewObjectID().Hex(), map[string]int{"priority": 1}, http.StatusNotFound},
+	} {
+		if code, _ := doJSON(t, router, http.MethodPatch, tc.path, tc.body, nil); code != tc.code {
+			t.Errorf("PATCH %s %v: code = %d, 期望 %d", tc.path, tc.body, code, tc.code)
+		}
+	}
+
+	// 已结束的任务不能修改
+	if err := repos.BatchJobs.UpdateStatus(context.Background(), job.ID, "completed"); err != nil {
+		t.Fatalf("更新任务状态失败: %v", err)
+	}
+	if code, _ := doJSON(t, router, http.MethodPatch, path, map[string]int{"priority": 1}, nil); code != http.StatusBadRequest {
+		t.Errorf("修改已完成任务: code = %d, 期望 400", code)
+	}
+}
+
+func TestRetryBatchTask(t *testing.T) {
+	router, a := newTestAppRouter(t)
+	repos := a.Repos()
+	ctx := context.Background()
+
+	var job models.BatchJob
+	code, resp := doJSON(t, router, http.MethodPost, "/api/v1/batch", map[string]interface{}{
+		"name":    "重试",
+		"prompts": []map[string]interface{}{{"prompt_text": "cat", "count": 1}, {"prompt_text": "dog", "count": 1}},
+	}, &job)
+	if code != http.StatusOK || job.Status != "pending" {
+		t.Fatalf("创建批量任务: code = %d, job = %+v, resp = %+v", code, job, resp)
+	}
+
+	// 按处理器的方式处理两张图片：第一张成功，第二张失败，任务结束
+	var failedTask *models.GenerationTask
+	for _, succeeded := range []bool{true, false} {
+		task, err := a.Queue.GetNextBatchTask()
+		if err != nil || task == nil {
+			t.Fatalf("领取图片任务 = %v, %v", task, err)
+		}
+		taskID, _ := primitive.ObjectIDFromHex(task.ID)
+		generation := models.Generation{ID: taskID, PromptText: task.Prompt, Status: "completed", BatchJobID: &job.ID, CreatedAt: time.Now()}
+		if succeeded {
+			repos.BatchJobs.RecordResult(ctx, job.ID, task.ID, task.PromptIndex, true)
+			a.Queue.CompleteBatchTask(task.ID)
+		} else {
+			generation.Status = "failed"
+			repos.BatchJobs.RecordResult(ctx, job.ID, task.ID, task.PromptIndex, false)
+			a.Queue.FailBatchTask(task)
+			failedTask = task
+		}
+		if err := repos.Generations.Create(ctx, &generation); err != nil {
+			t.Fatalf("保存生成记录失败: %v", err)
+		}
+	}
+	repos.BatchJobs.UpdateStatus(ctx, job.ID, "completed")
+
+	path := "/api/v1/batch/" + job.ID.Hex()
+	var generations []models.Generation
+	if code, _ := doJSON(t, router, http.MethodGet, path+"/tasks?status=failed", nil, &generations); code != http.StatusOK || len(generations) != 1 || generations[0].ID.Hex() != failedTask.ID {
+		t.Fatalf("失败的图片 = %+v, code = %d", generations, code)
+	}
+
+	var retried models.GenerationTask
+	if code, resp := doJSON(t, router, http.MethodPost, path+"/tasks/"+failedTask.ID+"/retry", nil, &retried); code != http.StatusOK || retried.RetryCount != 1 {
+		t.Fatalf("重试: code = %d, task = %+v, resp = %+v", code, retried, resp)
+	}
+
+	// 失败数量被扣除，任务回到处理中，图片重新入队
+	stored, err := repos.BatchJobs.GetByID(ctx, job.ID)
+	if err != nil {
+		t.Fatalf("读取批量任务失败: %v", err)
+	}
+	if stored.Status != "processing" || stored.FailedImages != 0 || stored.CompletedImages != 1 || stored.Prompts[failedTask.PromptIndex].Failed != 0 {
+		t.Errorf("重试后的任务 = %+v", stored)
+	}
+	if next, err := a.Queue.GetNextBatchTask(); err != nil || next == nil || next.ID != failedTask.ID {
+		t.Errorf("重新领取 = %+v, %v", next, err)
+	}
+	if code, _ := doJSON(t, router, http.MethodGet, path+"/tasks?status=failed", nil, &generations); code != http.StatusOK || len(generations) != 0 {
+		t.Errorf("重试后失败的图片 = %+v", generations)
+	}
+
+	for _, tc := range []struct {
+		path string
+		code int
+	}{
+		{path + "/tasks/" + failedTask.ID + "/retry", http.StatusNotFound},
+		{path + "/tasks/" + primitive.NewObjectID().Hex() + "/retry", http.StatusNotFound},
+		{"/api/v1/batch/" + primitive.NewObjectID().Hex() + "/tasks/" + failedTask.ID + "/retry", http.StatusNotFound},
+	} {
+		if code, _ := doJSON(t, router, http.MethodPost, tc.path, nil, nil); code != tc.code {
+			t.Errorf("POST %s: code = %d, 期望 %d", tc.path, code, tc.code)
+		}
+	}
+	if stored, _ := repos.BatchJobs.GetByID(ctx, job.ID); stored.FailedImages != 0 {
+		t.Errorf("重复重试后 failed_images = %d, 期望 0", stored.FailedImages)
+	}
+}
+
+func TestPauseResumeBatchJob(t *testing.T) {
+	router, a := newTestAppRouter(t)
+	repos := a.Repos()
+	ctx := context.Background()
+
+	var job models.BatchJob
+	code, resp := doJSON(t, router, http.MethodPost, "/api/v1/batch", map[string]interface{}{
+		"name":    "暂停",
+		"prompts": []map[string]interface{}{{"prompt_text": "cat", "count": 2}, {"prompt_text": "dog", "count": 2}},
+	}, &job)
+	if code != http.StatusOK {
+		t.Fatalf("创建批量任务: code = %d, resp = %+v", code, resp)
+	}
+	path := "/api/v1/batch/" + job.ID.Hex()
+
+	// 一张图片已开始生成时暂停
+	inflight, err := a.Queue.GetNextBatchTask()
+	if err != nil || inflight == nil {
+		t.Fatalf("领取图片任务 = %v, %v", inflight, err)
+	}
+	repos.BatchJobs.MarkStarted(ctx, job.ID)
+
+	if code, resp := doJSON(t, router, http.MethodPost, path+"/pause", nil, nil); code != http.StatusOK {
+		t.Fatalf("暂停: code = %d, resp = %+v", code, resp)
+	}
+	if code, _ := doJSON(t, router, http.MethodPost, path+"/pause", nil, nil); code != http.StatusBadRequest {
+		t.Errorf("重复暂停: code = %d, 期望 400", code)
+	}
+	if stored, _ := repos.BatchJobs.GetByID(ctx, job.ID); stored.Status != "paused" {
+		t.Errorf("数据库中的状态 = %s, 期望 paused", stored.Status)
+	}
+	if status, err := a.Queue.GetJobStatus(job.ID.Hex()); err != nil || status.Status != "paused" {
+		t.Errorf("队列中的状态 = %+v, %v", status, err)
+	}
+
+	// 暂停期间不再领取，被中断放回的图片也等到恢复后再处理
+	if err := a.Queue.RequeueBatchTask(inflight); err != nil {
+		t.Fatalf("重新入队失败: %v", err)
+	}
+	if next, err := a.Queue.GetNextBatchTask(); err != nil || next != nil {
+		t.Fatalf("暂停期间领取 = %+v, %v", next, err)
+	}
+
+	if code, resp := doJSON(t, router, http.MethodPost, path+"/resume", nil, nil); code != http.StatusOK {
+		t.Fatalf("恢复: code = %d, resp = %+v", code, resp)
+	}
+	if code, _ := doJSON(t, router, http.MethodPost, path+"/resume", nil, nil); code != http.StatusBadRequest {
+		t.Errorf("重复恢复: code = %d, 期望 400", code)
+	}
+	if stored, _ := repos.BatchJobs.GetByID(ctx, job.ID); stored.Status != "processing" {
+		t.Errorf("恢复后的状态 = %s, 期望 processing", stored.Status)
+	}
+
+	// 每个提示词剩余的图片都被领取，且只领取一次
+	remaining := map[int]int{}
+	for {
+		task, err := a.Queue.GetNextBatchTask()
+		if err != nil {
+			t.Fatalf("领取图片任务失败: %v", err)
+		}
+		if task == nil {
+			break
+		}
+		remaining[task.PromptIndex]++
+	}
+	if remaining[0] != 2 || remaining[1] != 2 {
+		t.Errorf("恢复后领取的图片 = %v, 期望每个提示词2张", remaining)
+	}
+}
@@ -0,0 +1,47 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"nano-banana-qwen/internal/models"
+	"nano-banana-qwen/internal/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+// serveBlob 从文件存储返回文件，支持 Range 和条件请求；presignExpiry 大于0且后端支持时重定向到预签名URL
+// downloadName 非空时以附件形式下载
+func serveBlob(c *gin.Context, blobs storage.BlobStore, presignExpiry time.Duration, key, downloadName string) {
+	ctx := c.Request.Context()
+
+	if presignExpiry > 0 {
+		url, err := blobs.PresignedURL(ctx, key, presignExpiry, downloadName)
+		if err == nil {
+			c.Redirect(http.StatusFound, url)
+			return
+		}
+		if !errors.Is(err, storage.ErrPresignNotSupported) {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse(err.Error(), "生成下载地址失败"))
+			return
+		}
+	}
+
+	blob, info, err := blobs.Get(ctx, key)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) || errors.Is(err, storage.ErrInvalidKey) {
+			c.JSON(http.StatusNotFound, models.ErrorResponse(err.Error(), "文件不存在"))
+			return
+		}
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse(err.Error(), "读取文件失败"))
+		return
+	}
+	defer blob.Close()
+
+	c.Header("Content-Type", info.ContentType)
+	if downloadName != "" {
+		c.Header("Content-Disposition", storage.AttachmentDisposition(downloadName))
+	}
+	http.ServeContent(c.Writer, c.Request, key, info.ModTime, blob)
+}
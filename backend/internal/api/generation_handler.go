@@ -3,28 +3,40 @@ package api
 import (
 	"context"
 	"net/http"
-	"strconv"
 	"time"
 
+	"nano-banana-qwen/internal/app"
 	"nano-banana-qwen/internal/models"
+	"nano-banana-qwen/internal/repository"
 	"nano-banana-qwen/internal/services"
 
 	"github.com/gin-gonic/gin"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type GenerationHandler struct {
-	openRouterService *services.OpenRouterService
-	imageService      *services.ImageService
+	generations  repository.GenerationRepository
+	providers    *services.ProviderRegistry
+	runner       *services.GenerationRunner
+	imageService *services.ImageService
+	queueService *services.QueueService
+	eventService *services.EventService
+	// workCtx 同步生成使用的上下文，服务强制停止时取消
+	workCtx  context.Context
+	stopping <-chan struct{}
 }
 
 // NewGenerationHandler 创建生成处理器
-func NewGenerationHandler() *GenerationHandler {
+func NewGenerationHandler(a *app.App) *GenerationHandler {
 	return &GenerationHandler{
-		openRouterService: services.NewOpenRouterService(),
-		imageService:      services.NewImageService(),
+		generations:  a.Repos().Generations,
+		providers:    a.Providers,
+		runner:       a.Runner,
+		imageService: a.Images,
+		queueService: a.Queue,
+		eventService: a.Events,
+		workCtx:      a.WorkContext(),
+		stopping:     a.Stopping(),
 	}
 }
 
@@ -46,69 +58,13 @@ func (h *GenerationHandler) GenerateText2Img(c *gin.Context) {
 	if req.Params.Quality == "" {
 		req.Params.Quality = "standard"
 	}
-	req.Params.Model = "google/gemini-2.5-flash-image-preview:free"
-
 	// 验证参数
-	if err := h.openRouterService.ValidateImageGeneration(req.Prompt, req.Params); err != nil {
+	if err := h.providers.Validate(req.Prompt, false, &req.Params); err != nil {
 		c.JSON(http.StatusBadRequest, models.ErrorResponse(err.Error(), "参数验证失败"))
 		return
 	}
 
-	var generations []models.Generation
-	
-	// 批量生成图片
-	for i := 0; i < req.Count; i++ {
-		generation := models.Generation{
-			ID:               primitive.NewObjectID(),
-			PromptText:       req.Prompt,
-			GenerationParams: req.Params,
-			Status:           "processing",
-			IsImg2Img:        false,
-			CreatedAt:        time.Now(),
-			Deleted:          false,
-		}
-
-		// 保存生成记录到数据库
-		if _, err := services.MongoDB.Collection("generations").InsertOne(context.Background(), generation); err != nil {
-			c.JSON(http.StatusInternalServerError, models.ErrorResponse(err.Error(), "保存生成记录失败"))
-			return
-		}
-
-		// 调用OpenRouter API生成图片
-		response, err := h.openRouterService.GenerateImage(req.Prompt, false, "", req.Params)
-		if err != nil {
-			// 更新状态为失败
-			h.updateGenerationStatus(generation.ID, "failed", err.Error(), 0)
-			continue
-		}
-
-		// 提取图片URL
-		imageURL, err := h.openRouterService.ExtractImageURL(response)
-		if err != nil {
-			h.updateGenerationStatus(generation.ID, "failed", err.Error(), 0)
-			continue
-		}
-
-		// 下载并保存图片
-		localPath, thumbnailPath, err := h.imageService.SaveImageFromURL(imageURL, generation.ID.Hex())
-		if err != nil {
-			h.updateGenerationStatus(generation.ID, "failed", err.Error(), 0)
-			continue
-		}
-
-		// 更新生成记录
-		generation.Status = "completed"
-		generation.ImageURL = localPath
-		generation.ThumbnailURL = thumbnailPath
-		generation.GenerationTime = time.Since(generation.CreatedAt).Seconds()
-
-		h.updateGenerationStatus(generation.ID, "completed", "", generation.GenerationTime)
-		generation.ImageURL = localPath
-		generation.ThumbnailURL = thumbnailPath
-		generations = append(generations, generation)
-	}
-
-	c.JSON(http.StatusOK, models.SuccessResponse(generations, "图片生成成功"))
+	h.generate(c, req.Prompt, false, "", nil, req.Count, req.Params)
 }
 
 // GenerateImg2Img 图片生成图片
@@ -132,67 +88,119 @@ func (h *GenerationHandler) GenerateImg2Img(c *gin.Context) {
 	if req.Params.Strength == 0 {
 		req.Params.Strength = 0.8
 	}
-	req.Params.Model = "google/gemini-2.5-flash-image-preview:free"
-
 	// 验证参数
-	if err := h.openRouterService.ValidateImageGeneration(req.Prompt, req.Params); err != nil {
+	if err := h.providers.Validate(req.Prompt, true, &req.Params); err != nil {
 		c.JSON(http.StatusBadRequest, models.ErrorResponse(err.Error(), "参数验证失败"))
 		return
 	}
 
+	// 源图片可以直接传base64，也可以引用已上传或已生成的图片
+	sourceImage := req.SourceImage
+	var sourceImageID *primitive.ObjectID
+	if req.SourceImageID != "" {
+		id, err := primitive.ObjectIDFromHex(req.SourceImageID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, models.ErrorResponse(err.Error(), "源图片ID格式无效"))
+			return
+		}
+
+		// 异步生成执行时才按图片ID读取源图片，这里只检查图片是否存在
+		if c.Query("async") == "true" {
+			if _, err := h.imageService.GetImageByID(id); err != nil {
+				c.JSON(http.StatusNotFound, models.ErrorResponse(err.Error(), "源图片不存在"))
+				return
+			}
+			sourceImageID = &id
+		} else {
+			image, dataURL, err := h.imageService.LoadSourceImage(id)
+			if err != nil {
+				c.JSON(http.StatusNotFound, models.ErrorResponse(err.Error(), "源图片不存在"))
+				return
+			}
+			sourceImage = dataURL
+			sourceImageID = &image.ID
+		}
+	}
+	if sourceImage == "" && sourceImageID == nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse("缺少源图片", "source_image 和 source_image_id 必须提供一个"))
+		return
+	}
+
+	h.generate(c, req.Prompt, true, sourceImage, sourceImageID, req.Count, req.Params)
+}
+
+// ListProviders 获取可用的图片生成服务商及其能力
+func (h *GenerationHandler) ListProviders(c *gin.Context) {
+	providers := make([]gin.H, 0)
+	for _, name := range h.providers.Names() {
+		provider, err := h.providers.Get(name)
+		if err != nil {
+			continue
+		}
+		providers = append(providers, gin.H{
+			"name":         name,
+			"capabilities": provider.Capabilities(),
+		})
+	}
+
+	c.JSON(http.StatusOK, models.SuccessResponse(providers, "获取服务商列表成功"))
+}
+
+// generate 创建生成记录并执行生成；async=true 时仅入队并立即返回202，由后台处理器完成生成
+func (h *GenerationHandler) generate(c *gin.Context, prompt string, isImg2Img bool, sourceImage string, sourceImageID *primitive.ObjectID, count int, params models.GenerationParams) {
+	async := c.Query("async") == "true"
+
+	// 队列中只保存生成记录ID，直接传入的源图片先保存，执行时按图片ID读取
+	if async && isImg2Img && sourceImageID == nil {
+		image, err := h.imageService.SaveSourceImage(sourceImage)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, models.ErrorResponse(err.Error(), "源图片无效"))
+			return
+		}
+		sourceImageID = &image.ID
+	}
+
 	var generations []models.Generation
-	
-	// 批量生成图片
-	for i := 0; i < req.Count; i++ {
+	for i := 0; i < count; i++ {
 		generation := models.Generation{
 			ID:               primitive.NewObjectID(),
-			PromptText:       req.Prompt,
-			GenerationParams: req.Params,
-			Status:           "processing",
-			IsImg2Img:        true,
+			PromptText:       prompt,
+			GenerationParams: params,
+			Status:           "pending",
+			IsImg2Img:        isImg2Img,
+			SourceImageID:    sourceImageID,
 			CreatedAt:        time.Now(),
 			Deleted:          false,
 		}
 
 		// 保存生成记录到数据库
-		if _, err := services.MongoDB.Collection("generations").InsertOne(context.Background(), generation); err != nil {
+		if err := h.generations.Create(context.Background(), &generation); err != nil {
 			c.JSON(http.StatusInternalServerError, models.ErrorResponse(err.Error(), "保存生成记录失败"))
 			return
 		}
 
-		// 调用OpenRouter API生成图片
-		response, err := h.openRouterService.GenerateImage(req.Prompt, true, req.SourceImage, req.Params)
-		if err != nil {
-			h.updateGenerationStatus(generation.ID, "failed", err.Error(), 0)
-			continue
-		}
-
-		// 提取图片URL
-		imageURL, err := h.openRouterService.ExtractImageURL(response)
-		if err != nil {
-			h.updateGenerationStatus(generation.ID, "failed", err.Error(), 0)
+		if async {
+			if err := h.queueService.AddGenerationTask(generation.ID.Hex()); err != nil {
+				h.updateGenerationStatus(&generation, "failed", err.Error())
+				c.JSON(http.StatusInternalServerError, models.ErrorResponse(err.Error(), "添加生成任务失败"))
+				return
+			}
+			generations = append(generations, generation)
 			continue
 		}
 
-		// 下载并保存图片
-		localPath, thumbnailPath, err := h.imageService.SaveImageFromURL(imageURL, generation.ID.Hex())
-		if err != nil {
-			h.updateGenerationStatus(generation.ID, "failed", err.Error(), 0)
+		// 同步调用模型生成图片，可以重试的失败在请求内等待后重试
+		if err := h.runner.RunWithRetry(h.workCtx, &generation, sourceImage); err != nil {
 			continue
 		}
-
-		// 更新生成记录
-		generation.Status = "completed"
-		generation.ImageURL = localPath
-		generation.ThumbnailURL = thumbnailPath
-		generation.GenerationTime = time.Since(generation.CreatedAt).Seconds()
-
-		h.updateGenerationStatus(generation.ID, "completed", "", generation.GenerationTime)
-		generation.ImageURL = localPath
-		generation.ThumbnailURL = thumbnailPath
 		generations = append(generations, generation)
 	}
 
+	if async {
+		c.JSON(http.StatusAccepted, models.SuccessResponse(generations, "生成任务已加入队列"))
+		return
+	}
+
 	c.JSON(http.StatusOK, models.SuccessResponse(generations, "图片生成成功"))
 }
 
@@ -213,64 +221,30 @@ func (h *GenerationHandler) ListGenerations(c *gin.Context) {
 	}
 
 	// 构建查询条件
-	filter := bson.M{"deleted": false}
-	
-	if req.Prompt != "" {
-		filter["prompt_text"] = bson.M{"$regex": req.Prompt, "$options": "i"}
-	}
-	
-	if req.Status != "" {
-		filter["status"] = req.Status
-	}
-	
-	if req.IsImg2Img {
-		filter["is_img2img"] = req.IsImg2Img
+	filter := repository.GenerationFilter{
+		Prompt:    req.Prompt,
+		Status:    req.Status,
+		IsImg2Img: req.IsImg2Img,
 	}
 
 	// 日期过滤
-	if req.DateFrom != "" || req.DateTo != "" {
-		dateFilter := bson.M{}
-		if req.DateFrom != "" {
-			if dateFrom, err := time.Parse("2006-01-02", req.DateFrom); err == nil {
-				dateFilter["$gte"] = dateFrom
-			}
-		}
-		if req.DateTo != "" {
-			if dateTo, err := time.Parse("2006-01-02", req.DateTo); err == nil {
-				dateFilter["$lte"] = dateTo.Add(24 * time.Hour)
-			}
-		}
-		if len(dateFilter) > 0 {
-			filter["created_at"] = dateFilter
+	if req.DateFrom != "" {
+		if dateFrom, err := time.Parse("2006-01-02", req.DateFrom); err == nil {
+			filter.DateFrom = &dateFrom
 		}
 	}
-
-	// 获取总数
-	total, err := services.MongoDB.Collection("generations").CountDocuments(context.Background(), filter)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, models.ErrorResponse(err.Error(), "获取总数失败"))
-		return
+	if req.DateTo != "" {
+		if dateTo, err := time.Parse("2006-01-02", req.DateTo); err == nil {
+			dateTo = dateTo.Add(24 * time.Hour)
+			filter.DateTo = &dateTo
+		}
 	}
 
-	// 分页查询
-	skip := (req.Page - 1) * req.PageSize
-	findOptions := options.Find()
-	findOptions.SetSkip(int64(skip))
-	findOptions.SetLimit(int64(req.PageSize))
-	findOptions.SetSort(bson.D{{Key: "created_at", Value: -1}})
-
-	cursor, err := services.MongoDB.Collection("generations").Find(context.Background(), filter, findOptions)
+	generations, total, err := h.generations.List(context.Background(), filter, repository.Page{Page: req.Page, PageSize: req.PageSize})
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, models.ErrorResponse(err.Error(), "查询失败"))
 		return
 	}
-	defer cursor.Close(context.Background())
-
-	var generations []models.Generation
-	if err := cursor.All(context.Background(), &generations); err != nil {
-		c.JSON(http.StatusInternalServerError, models.ErrorResponse(err.Error(), "解析结果失败"))
-		return
-	}
 
 	// 构建响应
 	totalPages := int((total + int64(req.PageSize) - 1) / int64(req.PageSize))
@@ -294,11 +268,7 @@ func (h *GenerationHandler) GetGeneration(c *gin.Context) {
 		return
 	}
 
-	var generation models.Generation
-	err = services.MongoDB.Collection("generations").FindOne(context.Background(), bson.M{
-		"_id":     id,
-		"deleted": false,
-	}).Decode(&generation)
+	generation, err := h.generations.GetByID(context.Background(), id)
 
 	if err != nil {
 		c.JSON(http.StatusNotFound, models.ErrorResponse(err.Error(), "生成记录不存在"))
@@ -308,8 +278,8 @@ func (h *GenerationHandler) GetGeneration(c *gin.Context) {
 	c.JSON(http.StatusOK, models.SuccessResponse(generation, "获取生成记录成功"))
 }
 
-// DeleteGeneration 删除生成记录
-func (h *GenerationHandler) DeleteGeneration(c *gin.Context) {
+// GetGenerationImages 获取生成记录产出的图片
+func (h *GenerationHandler) GetGenerationImages(c *gin.Context) {
 	idStr := c.Param("id")
 	id, err := primitive.ObjectIDFromHex(idStr)
 	if err != nil {
@@ -317,46 +287,77 @@ func (h *GenerationHandler) DeleteGeneration(c *gin.Context) {
 		return
 	}
 
-	// 软删除
-	update := bson.M{
-		"$set": bson.M{
-			"deleted":        true,
-			"deleted_at":     time.Now(),
-			"deleted_reason": "用户删除",
-		},
+	if _, err := h.generations.GetByID(context.Background(), id); err != nil {
+		c.JSON(http.StatusNotFound, models.ErrorResponse(err.Error(), "生成记录不存在"))
+		return
+	}
+
+	images, err := h.imageService.ListGenerationImages(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse(err.Error(), "获取生成图片失败"))
+		return
 	}
 
-	result, err := services.MongoDB.Collection("generations").UpdateOne(context.Background(), bson.M{
-		"_id":     id,
-		"deleted": false,
-	}, update)
+	c.JSON(http.StatusOK, models.SuccessResponse(images, "获取生成图片成功"))
+}
 
+// StreamGenerationEvents 以SSE推送生成记录状态
+func (h *GenerationHandler) StreamGenerationEvents(c *gin.Context) {
+	idStr := c.Param("id")
+	id, err := primitive.ObjectIDFromHex(idStr)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, models.ErrorResponse(err.Error(), "删除失败"))
+		c.JSON(http.StatusBadRequest, models.ErrorResponse(err.Error(), "ID格式无效"))
 		return
 	}
 
-	if result.MatchedCount == 0 {
-		c.JSON(http.StatusNotFound, models.ErrorResponse("记录不存在", "删除失败"))
+	// 先订阅再读取快照，避免遗漏两者之间的事件
+	pubsub, err := h.eventService.Subscribe(c.Request.Context(), services.GenerationEventChannel(idStr))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse(err.Error(), "订阅生成事件失败"))
 		return
 	}
 
-	c.JSON(http.StatusOK, models.SuccessResponse(nil, "删除成功"))
+	generation, err := h.generations.GetByID(context.Background(), id)
+	if err != nil {
+		pubsub.Close()
+		c.JSON(http.StatusNotFound, models.ErrorResponse(err.Error(), "生成记录不存在"))
+		return
+	}
+
+	streamStatusEvents(c, pubsub, h.stopping, generation, generation.Status, map[string]bool{
+		"completed": true,
+		"failed":    true,
+	})
 }
 
-// updateGenerationStatus 更新生成状态
-func (h *GenerationHandler) updateGenerationStatus(id primitive.ObjectID, status string, errorMsg string, generationTime float64) {
-	update := bson.M{
-		"$set": bson.M{
-			"status":          status,
-			"error_message":   errorMsg,
-			"generation_time": generationTime,
-		},
+// DeleteGeneration 删除生成记录
+func (h *GenerationHandler) DeleteGeneration(c *gin.Context) {
+	idStr := c.Param("id")
+	id, err := primitive.ObjectIDFromHex(idStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse(err.Error(), "ID格式无效"))
+		return
 	}
 
-	if status == "completed" || status == "failed" {
-		update["$set"].(bson.M)["updated_at"] = time.Now()
+	// 软删除
+	err = h.generations.SoftDelete(context.Background(), id, "用户删除")
+	if err == repository.ErrNotFound {
+		c.JSON(http.StatusNotFound, models.ErrorResponse("记录不存在", "删除失败"))
+		return
 	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse(err.Error(), "删除失败"))
+		return
+	}
+
+	c.JSON(http.StatusOK, models.SuccessResponse(nil, "删除成功"))
+}
 
-	services.MongoDB.Collection("generations").UpdateOne(context.Background(), bson.M{"_id": id}, update)
-}
\ No newline at end of file
+// updateGenerationStatus 更新生成状态
+func (h *GenerationHandler) updateGenerationStatus(generation *models.Generation, status string, errorMsg string) {
+	generation.Status = status
+	generation.ErrorMessage = errorMsg
+	generation.UpdatedAt = time.Now()
+
+	h.generations.Save(context.Background(), generation)
+}
@@ -0,0 +1,235 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"nano-banana-qwen/internal/models"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestGenerationHandlerListAndDelete(t *testing.T) {
+	router, repos := newTestRouter(t)
+
+	now := time.Now()
+	seed := []models.Generation{
+		{ID: primitive.NewObjectID(), PromptText: "a red fox", Status: "completed", CreatedAt: now.Add(-2 * time.Minute)},
+		{ID: primitive.NewObjectID(), PromptText: "a blue fox", Status: "failed", IsImg2Img: true, CreatedAt: now.Add(-time.Minute)},
+		{ID: primitive.NewObjectID(), PromptText: "a quiet lake", Status: "completed", CreatedAt: now},
+	}
+	for i := range seed {
+		if err := repos.Generations.Create(context.Background(), &seed[i]); err != nil {
+			t.Fatalf("写入生成记录失败: %v", err)
+		}
+	}
+
+	var list models.GenerationListResponse
+	doJSON(t, router, http.MethodGet, "/api/v1/generations?prompt=fox", nil, &list)
+	if list.Total != 2 || len(list.Generations) != 2 {
+		t.Fatalf("prompt过滤结果数量 = %d", list.Total)
+	}
+	// 按创建时间倒序
+	if list.Generations[0].ID != seed[1].ID {
+		t.Errorf("排序错误: 第一条为 %s", list.Generations[0].PromptText)
+	}
+
+	doJSON(t, router, http.MethodGet, "/api/v1/generations?status=completed&page_size=1", nil, &list)
+	if list.Total != 2 || len(list.Generations) != 1 || list.TotalPages != 2 {
+		t.Errorf("状态过滤分页结果 = total %d, len %d, pages %d", list.Total, len(list.Generations), list.TotalPages)
+	}
+
+	doJSON(t, router, http.MethodGet, "/api/v1/generations?is_img2img=true", nil, &list)
+	if list.Total != 1 || list.Generations[0].ID != seed[1].ID {
+		t.Errorf("图生图过滤结果 = %+v", list.Generations)
+	}
+
+	var generation models.Generation
+	code, _ := doJSON(t, router, http.MethodGet, "/api/v1/generations/"+seed[2].ID.Hex(), nil, &generation)
+	if code != http.StatusOK || generation.PromptText != "a quiet lake" {
+		t.Fatalf("获取生成记录: code = %d, generation = %+v", code, generation)
+	}
+
+	code, _ = doJSON(t, router, http.MethodDelete, "/api/v1/generations/"+seed[2].ID.Hex(), nil, nil)
+	if code != http.StatusOK {
+		t.Fatalf("删除生成记录: code = %d", code)
+	}
+
+	code, _ = doJSON(t, router, http.MethodDelete, "/api/v1/generations/"+seed[2].ID.Hex(), nil, nil)
+	if code != http.StatusNotFound {
+		t.Errorf("重复删除: code = %d, 期望 404", code)
+	}
+
+	code, _ = doJSON(t, router, http.MethodGet, "/api/v1/generations/"+seed[2].ID.Hex(), nil, nil)
+	if code != http.StatusNotFound {
+		t.Errorf("已删除的生成记录: code = %d, 期望 404", code)
+	}
+}
+
+func TestGenerationHandlerText2ImgWithMockProvider(t *testing.T) {
+	router, repos := newTestRouter(t)
+
+	var generations []models.Generation
+	code, resp := doJSON(t, router, http.MethodPost, "/api/v1/generate/text2img", models.Text2ImgRequest{
+		Prompt: "a red fox",
+		Count:  2,
+		Params: models.GenerationParams{Provider: "mock", Size: "256x256"},
+	}, &generations)
+	if code != http.StatusOK {
+		t.Fatalf("code = %d, resp = %+v", code, resp)
+	}
+	if len(generations) != 2 {
+		t.Fatalf("生成数量 = %d, 期望 2", len(generations))
+	}
+
+	stored, err := repos.Generations.GetByID(context.Background(), generations[0].ID)
+	if err != nil {
+		t.Fatalf("读取生成记录失败: %v", err)
+	}
+	if stored.Status != "completed" || stored.ImageURL == "" || stored.ThumbnailURL == "" {
+		t.Errorf("生成记录 = %+v", stored)
+	}
+}
+
+func TestGeneratedImagesAreLinked(t *testing.T) {
+	router, _ := newTestRouter(t)
+
+	var generations []models.Generation
+	code, resp := doJSON(t, router, http.MethodPost, "/api/v1/generate/text2img", models.Text2ImgRequest{
+		Prompt: "a red fox",
+		Params: models.GenerationParams{Provider: "mock", Size: "256x256"},
+	}, &generations)
+	if code != http.StatusOK || len(generations) != 1 {
+		t.Fatalf("code = %d, resp = %+v", code, resp)
+	}
+	generation := generations[0]
+	if generation.ImageID == nil || len(generation.ImageIDs) != 1 {
+		t.Fatalf("生成记录未关联图片: %+v", generation)
+	}
+
+	var images []models.Image
+	code, _ = doJSON(t, router, http.MethodGet, "/api/v1/generations/"+generation.ID.Hex()+"/images", nil, &images)
+	if code != http.StatusOK || len(images) != 1 {
+		t.Fatalf("获取生成图片: code = %d, images = %+v", code, images)
+	}
+	image := images[0]
+	if image.ID != *generation.ImageID || image.GenerationID == nil || *image.GenerationID != generation.ID || image.PromptText != "a red fox" {
+		t.Errorf("图片反向关联错误: %+v", image)
+	}
+
+	var linked models.Generation
+	code, _ = doJSON(t, router, http.MethodGet, "/api/v1/images/"+image.ID.Hex()+"/generation", nil, &linked)
+	if code != http.StatusOK || linked.ID != generation.ID {
+		t.Errorf("获取图片的生成记录: code = %d, generation = %+v", code, linked)
+	}
+
+	// 图库按提示词搜索
+	var list models.ImageListResponse
+	doJSON(t, router, http.MethodGet, "/api/v1/images?prompt=FOX", nil, &list)
+	if list.Total != 1 || list.Images[0].ID != image.ID {
+		t.Errorf("按提示词搜索图片 = %+v", list)
+	}
+}
+
+func TestGenerationHandlerAsync(t *testing.T) {
+	router, a := newTestAppRouter(t)
+	ctx := context.Background()
+
+	var queued []models.Generation
+	code, resp := doJSON(t, router, http.MethodPost, "/api/v1/generate/text2img?async=true", models.Text2ImgRequest{
+		Prompt: "a red fox",
+		Params: models.GenerationParams{Provider: "mock", Size: "256x256"},
+	}, &queued)
+	if code != http.StatusAccepted || len(queued) != 1 || queued[0].Status != "pending" {
+		t.Fatalf("异步文生图: code = %d, resp = %+v", code, resp)
+	}
+
+	// 直接传入的源图片先保存为上传图片，队列中只有生成记录ID
+	source := "data:image/png;base64," + base64.StdEncoding.EncodeToString(encodePNG(t, 32, 32))
+	code, resp = doJSON(t, router, http.MethodPost, "/api/v1/generate/img2img?async=true", models.Img2ImgRequest{
+		Prompt:      "a blue fox",
+		SourceImage: source,
+		Params:      models.GenerationParams{Provider: "mock", Size: "256x256"},
+	}, &queued)
+	if code != http.StatusAccepted || len(queued) != 1 || queued[0].SourceImageID == nil {
+		t.Fatalf("异步图生图: code = %d, resp = %+v", code, resp)
+	}
+	img2imgID := queued[0].ID
+
+	// 引用已上传图片时只检查图片存在，执行时才读取内容
+	code, resp = uploadFile(t, router, "photo.png", encodePNG(t, 32, 32))
+	var uploaded models.Image
+	if code != http.StatusOK || json.Unmarshal(resp.Data, &uploaded) != nil {
+		t.Fatalf("上传图片: code = %d, resp = %+v", code, resp)
+	}
+	code, resp = doJSON(t, router, http.MethodPost, "/api/v1/generate/img2img?async=true", models.Img2ImgRequest{
+		Prompt:        "a green fox",
+		SourceImageID: uploaded.ID.Hex(),
+		Params:        models.GenerationParams{Provider: "mock", Size: "256x256"},
+	}, &queued)
+	if code != http.StatusAccepted || len(queued) != 1 || queued[0].SourceImageID == nil || *queued[0].SourceImageID != uploaded.ID {
+		t.Fatalf("按图片ID异步图生图: code = %d, resp = %+v", code, resp)
+	}
+	if code, _ := doJSON(t, router, http.MethodPost, "/api/v1/generate/img2img?async=true", models.Img2ImgRequest{
+		Prompt:        "a green fox",
+		SourceImageID: primitive.NewObjectID().Hex(),
+		Params:        models.GenerationParams{Provider: "mock", Size: "256x256"},
+	}, nil); code != http.StatusNotFound {
+		t.Errorf("源图片不存在: code = %d, 期望 404", code)
+	}
+
+	entries, err := a.Redis().LRange(ctx, "generation_task_queue", 0, -1).Result()
+	if err != nil || len(entries) != 3 {
+		t.Fatalf("生成队列 = %v, %v", entries, err)
+	}
+	for _, entry := range entries {
+		if _, err := primitive.ObjectIDFromHex(entry); err != nil {
+			t.Errorf("队列中保存了生成记录ID以外的内容: %.40q", entry)
+		}
+	}
+
+	if code, _ := doJSON(t, router, http.MethodPost, "/api/v1/generate/img2img?async=true", models.Img2ImgRequest{
+		Prompt:      "a blue fox",
+		SourceImage: "not base64!",
+		Params:      models.GenerationParams{Provider: "mock", Size: "256x256"},
+	}, nil); code != http.StatusBadRequest {
+		t.Errorf("无效源图片: code = %d, 期望 400", code)
+	}
+
+	a.Start(ctx)
+	for _, entry := range entries {
+		id, _ := primitive.ObjectIDFromHex(entry)
+		var generation *models.Generation
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			generation, err = a.Repos().Generations.GetByID(ctx, id)
+			if err == nil && generation.Status == "completed" {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		if generation == nil || generation.Status != "completed" || generation.ImageID == nil {
+			t.Fatalf("异步生成未完成: %+v", generation)
+		}
+		if (id == img2imgID || id == queued[0].ID) && generation.SourceImageID == nil {
+			t.Errorf("图生图未记录源图片: %+v", generation)
+		}
+	}
+
+	// 生成记录先完成，随后才移出处理中队列
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		n, _ := a.Redis().LLen(ctx, "task_processing_queue").Result()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("处理中队列长度 = %d", n)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
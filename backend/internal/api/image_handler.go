@@ -1,26 +1,43 @@
 package api
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
 	"os"
 	"strconv"
+	"time"
 
+	"nano-banana-qwen/internal/app"
 	"nano-banana-qwen/internal/models"
+	"nano-banana-qwen/internal/repository"
 	"nano-banana-qwen/internal/services"
+	"nano-banana-qwen/internal/storage"
 
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 type ImageHandler struct {
-	imageService *services.ImageService
+	imageService  *services.ImageService
+	generations   repository.GenerationRepository
+	blobs         storage.BlobStore
+	presignExpiry time.Duration
+	maxUploadSize int64
 }
 
 // NewImageHandler 创建图片处理器
-func NewImageHandler() *ImageHandler {
+func NewImageHandler(a *app.App) *ImageHandler {
 	return &ImageHandler{
-		imageService: services.NewImageService(),
+		imageService:  a.Images,
+		generations:   a.Repos().Generations,
+		blobs:         a.Blobs(),
+		presignExpiry: time.Duration(a.Config.BlobPresignExpiry) * time.Second,
+		maxUploadSize: int64(a.Config.MaxUploadSize) << 20,
 	}
 }
 
@@ -41,9 +58,12 @@ func (h *ImageHandler) ListImages(c *gin.Context) {
 		}
 	}
 
-	prompt := c.Query("prompt")
+	filter := repository.ImageFilter{
+		Prompt: c.Query("prompt"),
+		SHA256: c.Query("sha256"),
+	}
 
-	images, total, err := h.imageService.ListImages(page, pageSize, prompt)
+	images, total, err := h.imageService.ListImages(page, pageSize, filter)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, models.ErrorResponse(err.Error(), "获取图片列表失败"))
 		return
@@ -62,6 +82,79 @@ func (h *ImageHandler) ListImages(c *gin.Context) {
 	c.JSON(http.StatusOK, models.SuccessResponse(response, "获取图片列表成功"))
 }
 
+// UploadImage 上传图片（multipart 字段 file），可作为图生图的源图片
+func (h *ImageHandler) UploadImage(c *gin.Context) {
+	imageData, filename, ok := h.readUploadedFile(c)
+	if !ok {
+		return
+	}
+
+	image, err := h.imageService.SaveUploadedImage(imageData, filename)
+	h.respondUploaded(c, image, err, "图片上传成功")
+}
+
+// ImportImage 导入之前下载的图片（multipart 字段 file），恢复文件中记录的提示词和生成参数
+func (h *ImageHandler) ImportImage(c *gin.Context) {
+	imageData, filename, ok := h.readUploadedFile(c)
+	if !ok {
+		return
+	}
+
+	image, err := h.imageService.ImportImage(imageData, filename)
+	h.respondUploaded(c, image, err, "图片导入成功")
+}
+
+// readUploadedFile 读取multipart字段 file 的内容，失败时已写入错误响应
+func (h *ImageHandler) readUploadedFile(c *gin.Context) ([]byte, string, bool) {
+	// 限制请求体大小，预留multipart分隔和表单字段的空间
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, h.maxUploadSize+1<<20)
+
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			c.JSON(http.StatusRequestEntityTooLarge, models.ErrorResponse(err.Error(), "图片文件过大"))
+			return nil, "", false
+		}
+		c.JSON(http.StatusBadRequest, models.ErrorResponse(err.Error(), "请上传图片文件"))
+		return nil, "", false
+	}
+
+	if fileHeader.Size > h.maxUploadSize {
+		c.JSON(http.StatusRequestEntityTooLarge, models.ErrorResponse(fmt.Sprintf("文件大小 %d 字节超过上限 %d 字节", fileHeader.Size, h.maxUploadSize), "图片文件过大"))
+		return nil, "", false
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse(err.Error(), "读取上传文件失败"))
+		return nil, "", false
+	}
+	defer file.Close()
+
+	imageData, err := io.ReadAll(file)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse(err.Error(), "读取上传文件失败"))
+		return nil, "", false
+	}
+
+	return imageData, fileHeader.Filename, true
+}
+
+// respondUploaded 返回上传或导入的结果
+func (h *ImageHandler) respondUploaded(c *gin.Context, image *models.Image, err error, message string) {
+	if err != nil {
+		if errors.Is(err, services.ErrUnsupportedImageFormat) {
+			c.JSON(http.StatusBadRequest, models.ErrorResponse(err.Error(), "仅支持PNG、JPEG和WebP图片"))
+			return
+		}
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse(err.Error(), "保存上传图片失败"))
+		return
+	}
+
+	c.JSON(http.StatusOK, models.SuccessResponse(image, message))
+}
+
 // GetImage 获取图片详情
 func (h *ImageHandler) GetImage(c *gin.Context) {
 	idStr := c.Param("id")
@@ -80,6 +173,150 @@ func (h *ImageHandler) GetImage(c *gin.Context) {
 	c.JSON(http.StatusOK, models.SuccessResponse(image, "获取图片详情成功"))
 }
 
+// GetImageGeneration 获取产出该图片的生成记录
+func (h *ImageHandler) GetImageGeneration(c *gin.Context) {
+	idStr := c.Param("id")
+	id, err := primitive.ObjectIDFromHex(idStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse(err.Error(), "ID格式无效"))
+		return
+	}
+
+	image, err := h.imageService.GetImageByID(id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, models.ErrorResponse(err.Error(), "图片不存在"))
+		return
+	}
+
+	if image.GenerationID == nil {
+		c.JSON(http.StatusNotFound, models.ErrorResponse("图片没有关联的生成记录", "生成记录不存在"))
+		return
+	}
+
+	generation, err := h.generations.GetByID(context.Background(), *image.GenerationID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, models.ErrorResponse(err.Error(), "生成记录不存在"))
+		return
+	}
+
+	c.JSON(http.StatusOK, models.SuccessResponse(generation, "获取生成记录成功"))
+}
+
+// GetImageLineage 获取图片的图生图血缘：祖先链和后代树
+func (h *ImageHandler) GetImageLineage(c *gin.Context) {
+	idStr := c.Param("id")
+	id, err := primitive.ObjectIDFromHex(idStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse(err.Error(), "ID格式无效"))
+		return
+	}
+
+	lineage, err := h.imageService.GetImageLineage(id)
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			c.JSON(http.StatusNotFound, models.ErrorResponse(err.Error(), "图片不存在"))
+			return
+		}
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse(err.Error(), "获取图片血缘失败"))
+		return
+	}
+
+	c.JSON(http.StatusOK, models.SuccessResponse(lineage, "获取图片血缘成功"))
+}
+
+// GetSimilarImages 按感知哈希查找近似图片，max_distance 为最大汉明距离（0-64），limit 为最多返回的数量
+func (h *ImageHandler) GetSimilarImages(c *gin.Context) {
+	idStr := c.Param("id")
+	id, err := primitive.ObjectIDFromHex(idStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse(err.Error(), "ID格式无效"))
+		return
+	}
+
+	maxDistance, err := parseMaxDistance(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse(err.Error(), "max_distance 参数无效"))
+		return
+	}
+
+	limit := services.DefaultSimilarLimit
+	if value := c.Query("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit <= 0 || limit > services.MaxSimilarLimit {
+			c.JSON(http.StatusBadRequest, models.ErrorResponse(fmt.Sprintf("limit 应为1到%d之间的整数: %s", services.MaxSimilarLimit, value), "limit 参数无效"))
+			return
+		}
+	}
+
+	similar, err := h.imageService.FindSimilarImages(id, maxDistance, limit)
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			c.JSON(http.StatusNotFound, models.ErrorResponse(err.Error(), "图片不存在"))
+			return
+		}
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse(err.Error(), "查找近似图片失败"))
+		return
+	}
+
+	c.JSON(http.StatusOK, models.SuccessResponse(similar, "查找近似图片成功"))
+}
+
+// parseMaxDistance 解析 max_distance 查询参数，未提供时使用默认值
+func parseMaxDistance(c *gin.Context) (int, error) {
+	value := c.Query("max_distance")
+	if value == "" {
+		return services.DefaultSimilarDistance, nil
+	}
+
+	distance, err := strconv.Atoi(value)
+	if err != nil || distance < 0 || distance > 64 {
+		return 0, fmt.Errorf("max_distance 应为0到64之间的整数: %s", value)
+	}
+	return distance, nil
+}
+
+// RenderImage 按需缩放、裁剪和转换格式，结果缓存后以 ETag 和 Range 支持返回
+func (h *ImageHandler) RenderImage(c *gin.Context) {
+	idStr := c.Param("id")
+	id, err := primitive.ObjectIDFromHex(idStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse(err.Error(), "ID格式无效"))
+		return
+	}
+
+	var req models.ImageRenderRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse(err.Error(), "渲染参数无效"))
+		return
+	}
+
+	rendered, err := h.imageService.RenderImage(id, req)
+	if err != nil {
+		switch {
+		case errors.Is(err, repository.ErrNotFound):
+			c.JSON(http.StatusNotFound, models.ErrorResponse(err.Error(), "图片不存在"))
+		case errors.Is(err, services.ErrInvalidRenderOptions):
+			c.JSON(http.StatusBadRequest, models.ErrorResponse(err.Error(), "渲染参数无效"))
+		default:
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse(err.Error(), "渲染图片失败"))
+		}
+		return
+	}
+
+	file, err := os.Open(rendered.Path)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse(err.Error(), "读取渲染结果失败"))
+		return
+	}
+	defer file.Close()
+
+	// 同一图片和参数的渲染结果不会变化，ServeContent 处理 If-None-Match 和 Range
+	c.Header("ETag", rendered.ETag)
+	c.Header("Cache-Control", "public, max-age=31536000, immutable")
+	c.Header("Content-Type", rendered.ContentType)
+	http.ServeContent(c.Writer, c.Request, "", rendered.ModTime, file)
+}
+
 // DownloadImage 下载图片
 func (h *ImageHandler) DownloadImage(c *gin.Context) {
 	idStr := c.Param("id")
@@ -95,18 +332,85 @@ func (h *ImageHandler) DownloadImage(c *gin.Context) {
 		return
 	}
 
-	// 检查文件是否存在
-	if _, err := os.Stat(image.FilePath); os.IsNotExist(err) {
-		c.JSON(http.StatusNotFound, models.ErrorResponse("文件不存在", "图片文件已被删除"))
+	// 没有生成信息的图片直接返回原图，可使用预签名URL
+	if image.GenerationID == nil && image.ImportedMetadata == nil {
+		serveBlob(c, h.blobs, h.presignExpiry, image.FilePath, image.Filename)
 		return
 	}
 
-	// 设置响应头
-	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", image.Filename))
-	c.Header("Content-Type", "application/octet-stream")
+	// 下载的文件带有提示词和生成参数，重新导入时可以恢复
+	h.serveWithMetadata(c, image, image.Filename)
+}
 
-	// 发送文件
-	c.File(image.FilePath)
+// serveWithMetadata 返回写入了生成信息的原图，downloadName 非空时以附件形式下载
+func (h *ImageHandler) serveWithMetadata(c *gin.Context, image *models.Image, downloadName string) {
+	imageData, err := h.imageService.ReadImageWithMetadata(image)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			c.JSON(http.StatusNotFound, models.ErrorResponse(err.Error(), "文件不存在"))
+			return
+		}
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse(err.Error(), "读取文件失败"))
+		return
+	}
+
+	c.Header("Content-Type", http.DetectContentType(imageData))
+	if downloadName != "" {
+		c.Header("Content-Disposition", storage.AttachmentDisposition(downloadName))
+	}
+	http.ServeContent(c.Writer, c.Request, image.Filename, image.CreatedAt, bytes.NewReader(imageData))
+}
+
+// ExportImages 按ID列表或过滤条件导出图片为ZIP
+func (h *ImageHandler) ExportImages(c *gin.Context) {
+	var req models.ImageExportRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse(err.Error(), "请求参数无效"))
+		return
+	}
+	if len(req.ImageIDs) == 0 && req.Filter == nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse("图片ID和过滤条件不能同时为空", "请指定图片ID或过滤条件"))
+		return
+	}
+
+	images, err := h.imageService.FindExportImages(req)
+	if err != nil {
+		switch {
+		case errors.Is(err, repository.ErrNotFound):
+			c.JSON(http.StatusNotFound, models.ErrorResponse(err.Error(), "图片不存在"))
+		case errors.Is(err, services.ErrTooManyImages):
+			c.JSON(http.StatusBadRequest, models.ErrorResponse(err.Error(), "导出图片过多，请缩小范围"))
+		default:
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse(err.Error(), "查询图片失败"))
+		}
+		return
+	}
+
+	streamExport(c, h.imageService, images, req.Thumbnails, fmt.Sprintf("images_%s.zip", time.Now().Format("20060102_150405")))
+}
+
+// streamExport 以附件形式边打包边返回ZIP，开始写入后出错只能中断连接
+func streamExport(c *gin.Context, imageService *services.ImageService, images []models.Image, thumbnails bool, filename string) {
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", storage.AttachmentDisposition(filename))
+	c.Status(http.StatusOK)
+
+	if err := imageService.WriteExport(c.Request.Context(), c.Writer, images, thumbnails); err != nil {
+		log.Printf("⚠️ 导出压缩包 %s 中断: %v", filename, err)
+		c.Abort()
+	}
+}
+
+// ServeFile 按文件key返回图片文件，key 即图片记录中的 file_path / thumbnail_path；
+// 原图与下载一样写入生成信息，缩略图等衍生图原样返回
+func (h *ImageHandler) ServeFile(c *gin.Context) {
+	key := c.Param("key")
+	if image, err := h.imageService.FileImage(key); err == nil && image != nil &&
+		(image.GenerationID != nil || image.ImportedMetadata != nil) {
+		h.serveWithMetadata(c, image, "")
+		return
+	}
+	serveBlob(c, h.blobs, h.presignExpiry, key, "")
 }
 
 // DeleteImage 删除图片
@@ -118,6 +422,21 @@ func (h *ImageHandler) DeleteImage(c *gin.Context) {
 		return
 	}
 
+	// permanent=true 时永久删除记录，文件在没有其他图片引用后移除
+	if c.Query("permanent") == "true" {
+		if err := h.imageService.PurgeImage(id); err != nil {
+			if errors.Is(err, repository.ErrNotFound) {
+				c.JSON(http.StatusNotFound, models.ErrorResponse(err.Error(), "图片不存在"))
+				return
+			}
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse(err.Error(), "删除图片失败"))
+			return
+		}
+
+		c.JSON(http.StatusOK, models.SuccessResponse(nil, "图片已永久删除"))
+		return
+	}
+
 	err = h.imageService.DeleteImage(id)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, models.ErrorResponse(err.Error(), "删除图片失败"))
@@ -0,0 +1,788 @@
+package api
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"nano-banana-qwen/internal/app"
+	"nano-banana-qwen/internal/config"
+	"nano-banana-qwen/internal/models"
+	"nano-banana-qwen/internal/services"
+	"nano-banana-qwen/internal/storage"
+
+	"github.com/HugoSmits86/nativewebp"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/image/webp"
+)
+
+// uploadFile 以multipart表单上传文件
+func uploadFile(t *testing.T, router *gin.Engine, filename string, data []byte) (int, testResponse) {
+	t.Helper()
+	return uploadFileTo(t, router, "/api/v1/images/upload", filename, data)
+}
+
+// uploadFileTo 以multipart表单向指定路径上传文件
+func uploadFileTo(t *testing.T, router *gin.Engine, path, filename string, data []byte) (int, testResponse) {
+	t.Helper()
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, err := writer.CreateFormFile("file", filename)
+	if err != nil {
+		t.Fatalf("创建表单失败: %v", err)
+	}
+	part.Write(data)
+	writer.Close()
+
+	req := httptest.NewRequest(http.MethodPost, path, &body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	var resp testResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("上传响应不是JSON: %s", w.Body.String())
+	}
+	return w.Code, resp
+}
+
+// encodePNG 生成指定尺寸的PNG图片
+func encodePNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatalf("编码PNG失败: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestUploadImageAndImg2ImgBySourceID(t *testing.T) {
+	router, _ := newTestRouter(t)
+
+	// 扩展名不可信，按内容识别为PNG
+	code, resp := uploadFile(t, router, "photo.jpg", encodePNG(t, 64, 48))
+	if code != http.StatusOK {
+		t.Fatalf("上传图片: code = %d, resp = %+v", code, resp)
+	}
+	var uploaded models.Image
+	if err := json.Unmarshal(resp.Data, &uploaded); err != nil {
+		t.Fatalf("解析上传结果失败: %v", err)
+	}
+	if !uploaded.Uploaded || uploaded.Format != "PNG" || uploaded.Width != 64 || uploaded.Height != 48 || uploaded.OriginalFilename != "photo.jpg" {
+		t.Errorf("上传图片记录 = %+v", uploaded)
+	}
+
+	var generations []models.Generation
+	code, resp = doJSON(t, router, http.MethodPost, "/api/v1/generate/img2img", models.Img2ImgRequest{
+		Prompt:        "make it blue",
+		SourceImageID: uploaded.ID.Hex(),
+		Params:        models.GenerationParams{Provider: "mock", Size: "256x256"},
+	}, &generations)
+	if code != http.StatusOK || len(generations) != 1 {
+		t.Fatalf("图生图: code = %d, resp = %+v", code, resp)
+	}
+	generation := generations[0]
+	if generation.SourceImageID == nil || *generation.SourceImageID != uploaded.ID || generation.Status != "completed" {
+		t.Fatalf("生成记录 = %+v", generation)
+	}
+
+	// 以生成的图片作为下一次图生图的源图片
+	generatedID := *generation.ImageID
+	generations = nil
+	code, resp = doJSON(t, router, http.MethodPost, "/api/v1/generate/img2img", models.Img2ImgRequest{
+		Prompt:        "make it green",
+		SourceImageID: generatedID.Hex(),
+		Params:        models.GenerationParams{Provider: "mock", Size: "256x256"},
+	}, &generations)
+	if code != http.StatusOK || *generations[0].SourceImageID != generatedID {
+		t.Fatalf("以生成图片图生图: code = %d, resp = %+v", code, resp)
+	}
+
+	var images []models.Image
+	doJSON(t, router, http.MethodGet, "/api/v1/generations/"+generations[0].ID.Hex()+"/images", nil, &images)
+	if len(images) != 1 || images[0].SourceImageID == nil || *images[0].SourceImageID != generatedID || !images[0].IsImg2Img {
+		t.Errorf("生成图片记录 = %+v", images)
+	}
+}
+
+func TestUploadImageValidation(t *testing.T) {
+	router, _ := newTestRouter(t)
+
+	code, _ := uploadFile(t, router, "notes.png", []byte("just some text"))
+	if code != http.StatusBadRequest {
+		t.Errorf("非图片文件: code = %d, 期望 400", code)
+	}
+
+	code, _ = uploadFile(t, router, "large.png", make([]byte, 2<<20))
+	if code != http.StatusRequestEntityTooLarge {
+		t.Errorf("超过大小上限: code = %d, 期望 413", code)
+	}
+
+	code, _ = doJSON(t, router, http.MethodPost, "/api/v1/generate/img2img", models.Img2ImgRequest{
+		Prompt: "make it blue",
+		Params: models.GenerationParams{Provider: "mock", Size: "256x256"},
+	}, nil)
+	if code != http.StatusBadRequest {
+		t.Errorf("缺少源图片: code = %d, 期望 400", code)
+	}
+}
+
+// img2img 以 sourceID 为源图片生成一张图片，返回生成的图片ID
+func img2img(t *testing.T, router *gin.Engine, prompt string, sourceID primitive.ObjectID) primitive.ObjectID {
+	t.Helper()
+
+	var generations []models.Generation
+	code, resp := doJSON(t, router, http.MethodPost, "/api/v1/generate/img2img", models.Img2ImgRequest{
+		Prompt:        prompt,
+		SourceImageID: sourceID.Hex(),
+		Params:        models.GenerationParams{Provider: "mock", Size: "256x256"},
+	}, &generations)
+	if code != http.StatusOK || len(generations) != 1 || generations[0].ImageID == nil {
+		t.Fatalf("图生图 %q: code = %d, resp = %+v", prompt, code, resp)
+	}
+	return *generations[0].ImageID
+}
+
+func TestImageLineage(t *testing.T) {
+	router, _ := newTestRouter(t)
+
+	code, resp := uploadFile(t, router, "cat.png", encodePNG(t, 32, 32))
+	if code != http.StatusOK {
+		t.Fatalf("上传图片: code = %d, resp = %+v", code, resp)
+	}
+	var uploaded models.Image
+	json.Unmarshal(resp.Data, &uploaded)
+
+	// uploaded -> a -> {b -> d, c}
+	a := img2img(t, router, "make it blue", uploaded.ID)
+	b := img2img(t, router, "add a hat", a)
+	c := img2img(t, router, "add glasses", a)
+	d := img2img(t, router, "night scene", b)
+
+	var lineage models.ImageLineage
+	code, _ = doJSON(t, router, http.MethodGet, "/api/v1/images/"+b.Hex()+"/lineage", nil, &lineage)
+	if code != http.StatusOK {
+		t.Fatalf("获取血缘: code = %d", code)
+	}
+	if len(lineage.Ancestors) != 2 || lineage.Ancestors[0].Image.ID != a || lineage.Ancestors[1].Image.ID != uploaded.ID {
+		t.Fatalf("祖先链 = %+v", lineage.Ancestors)
+	}
+	if lineage.Ancestors[0].GenerationParams == nil || lineage.Ancestors[0].Image.PromptText != "make it blue" || lineage.Ancestors[1].GenerationParams != nil {
+		t.Errorf("祖先节点参数 = %+v", lineage.Ancestors)
+	}
+	if lineage.Root.Image.ID != b || len(lineage.Root.Children) != 1 || lineage.Root.Children[0].Image.ID != d || lineage.Root.Children[0].Distance != 1 {
+		t.Errorf("后代树 = %+v", lineage.Root)
+	}
+
+	lineage = models.ImageLineage{}
+	doJSON(t, router, http.MethodGet, "/api/v1/images/"+uploaded.ID.Hex()+"/lineage", nil, &lineage)
+	if len(lineage.Ancestors) != 0 || len(lineage.Root.Children) != 1 {
+		t.Fatalf("源图片血缘 = %+v", lineage)
+	}
+	branches := lineage.Root.Children[0].Children
+	if len(branches) != 2 || branches[0].Image.ID != b || branches[1].Image.ID != c || branches[0].Children[0].Distance != 3 {
+		t.Errorf("分支 = %+v", branches)
+	}
+
+	code, _ = doJSON(t, router, http.MethodGet, "/api/v1/images/"+primitive.NewObjectID().Hex()+"/lineage", nil, nil)
+	if code != http.StatusNotFound {
+		t.Errorf("不存在的图片: code = %d, 期望 404", code)
+	}
+}
+
+func TestServeFileFromBlobStore(t *testing.T) {
+	router, _ := newTestRouter(t)
+
+	code, resp := uploadFile(t, router, "cat.png", encodePNG(t, 32, 32))
+	if code != http.StatusOK {
+		t.Fatalf("上传图片: code = %d, resp = %+v", code, resp)
+	}
+	var uploaded models.Image
+	json.Unmarshal(resp.Data, &uploaded)
+
+	// 记录中保存的是按内容哈希命名的文件key而不是本地路径
+	if uploaded.Filename != uploaded.SHA256+".png" ||
+		uploaded.FilePath != "uploads/"+uploaded.SHA256[:2]+"/"+uploaded.Filename ||
+		uploaded.ThumbnailPath != "thumbnails/"+uploaded.SHA256[:2]+"/"+uploaded.SHA256+"_32.webp" {
+		t.Fatalf("文件key = %q, %q", uploaded.FilePath, uploaded.ThumbnailPath)
+	}
+
+	// 透明图片的缩略图为WebP
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/files/"+uploaded.ThumbnailPath, nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/webp" {
+		t.Fatalf("获取缩略图: code = %d, headers = %v", w.Code, w.Header())
+	}
+	if _, err := webp.Decode(w.Body); err != nil {
+		t.Errorf("缩略图不是WebP: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/images/"+uploaded.ID.Hex()+"/download", nil)
+	req.Header.Set("Range", "bytes=0-7")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusPartialContent || w.Body.Len() != 8 || w.Header().Get("Content-Disposition") == "" {
+		t.Errorf("下载图片: code = %d, len = %d, headers = %v", w.Code, w.Body.Len(), w.Header())
+	}
+
+	for _, path := range []string{"/api/v1/files/uploads/missing.png", "/api/v1/files/../../etc/passwd"} {
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s: code = %d, 期望 404", path, w.Code)
+		}
+	}
+}
+
+func TestLegacyImagePaths(t *testing.T) {
+	// 旧版本只有本地存储
+	dir := t.TempDir()
+	cfg := &config.Config{
+		ImageProvider: "mock",
+		UploadPath:    filepath.Join(dir, "uploads"),
+		GeneratedPath: filepath.Join(dir, "generated"),
+		ThumbnailPath: filepath.Join(dir, "thumbnails"),
+		TempPath:      dir,
+		MaxUploadSize: 1,
+	}
+	db, err := services.NewMemoryDatabase()
+	if err != nil {
+		t.Fatalf("创建存储失败: %v", err)
+	}
+	if db.Blobs, err = storage.New(cfg); err != nil {
+		t.Fatalf("创建文件存储失败: %v", err)
+	}
+	a := app.NewWithDatabase(cfg, db)
+	t.Cleanup(a.Close)
+	router := SetupRouter(a)
+
+	// 旧版本记录中保存的是本地文件路径
+	filePath := filepath.Join(a.Config.GeneratedPath, "legacy.png")
+	thumbPath := filepath.Join(a.Config.ThumbnailPath, "thumb_legacy.png")
+	data := encodePNG(t, 32, 32)
+	for _, p := range []string{filePath, thumbPath} {
+		os.MkdirAll(filepath.Dir(p), 0755)
+		if err := os.WriteFile(p, data, 0644); err != nil {
+			t.Fatalf("写入旧版图片失败: %v", err)
+		}
+	}
+	legacy := models.Image{
+		ID:            primitive.NewObjectID(),
+		Filename:      "legacy.png",
+		FilePath:      filePath,
+		ThumbnailPath: thumbPath,
+		FileSize:      int64(len(data)),
+		CreatedAt:     time.Now(),
+	}
+	if err := a.Repos().Images.Create(context.Background(), &legacy); err != nil {
+		t.Fatalf("保存图片记录失败: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/images/"+legacy.ID.Hex()+"/download", nil))
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), data) {
+		t.Fatalf("下载旧版图片: code = %d, len = %d", w.Code, w.Body.Len())
+	}
+
+	// 永久删除时释放旧版文件
+	if code, resp := doJSON(t, router, http.MethodDelete, "/api/v1/images/"+legacy.ID.Hex()+"?permanent=true", nil, nil); code != http.StatusOK {
+		t.Fatalf("永久删除: code = %d, resp = %+v", code, resp)
+	}
+	for _, p := range []string{filePath, thumbPath} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("旧版文件未删除 %s: %v", p, err)
+		}
+	}
+}
+
+func TestDuplicateImagesShareContent(t *testing.T) {
+	router, _ := newTestRouter(t)
+
+	data := encodePNG(t, 40, 30)
+	var images [2]models.Image
+	for i := range images {
+		code, resp := uploadFile(t, router, "same.png", data)
+		if code != http.StatusOK {
+			t.Fatalf("上传图片: code = %d, resp = %+v", code, resp)
+		}
+		json.Unmarshal(resp.Data, &images[i])
+	}
+
+	first, second := images[0], images[1]
+	if first.ID == second.ID || first.SHA256 == "" || first.SHA256 != second.SHA256 || first.FilePath != second.FilePath {
+		t.Fatalf("相同内容的图片 = %+v, %+v", first, second)
+	}
+
+	// 哈希查询忽略大小写
+	var list models.ImageListResponse
+	code, resp := doJSON(t, router, http.MethodGet, "/api/v1/images?sha256="+strings.ToUpper(first.SHA256), nil, &list)
+	if code != http.StatusOK || list.Total != 2 {
+		t.Fatalf("按哈希查询: code = %d, total = %d, resp = %+v", code, list.Total, resp)
+	}
+
+	fileStatus := func() int {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/files/"+first.FilePath, nil))
+		return w.Code
+	}
+
+	// 软删除不影响文件，永久删除一张后另一张仍可访问
+	if code, resp := doJSON(t, router, http.MethodDelete, "/api/v1/images/"+first.ID.Hex(), nil, nil); code != http.StatusOK {
+		t.Fatalf("软删除: code = %d, resp = %+v", code, resp)
+	}
+	if code, resp := doJSON(t, router, http.MethodDelete, "/api/v1/images/"+first.ID.Hex()+"?permanent=true", nil, nil); code != http.StatusOK {
+		t.Fatalf("永久删除已软删除的图片: code = %d, resp = %+v", code, resp)
+	}
+	if code := fileStatus(); code != http.StatusOK {
+		t.Fatalf("仍被引用的文件: code = %d, 期望 200", code)
+	}
+
+	// 最后一个引用删除后文件被移除
+	if code, resp := doJSON(t, router, http.MethodDelete, "/api/v1/images/"+second.ID.Hex()+"?permanent=true", nil, nil); code != http.StatusOK {
+		t.Fatalf("永久删除: code = %d, resp = %+v", code, resp)
+	}
+	if code := fileStatus(); code != http.StatusNotFound {
+		t.Errorf("不再被引用的文件: code = %d, 期望 404", code)
+	}
+	if code, _ := doJSON(t, router, http.MethodDelete, "/api/v1/images/"+second.ID.Hex()+"?permanent=true", nil, nil); code != http.StatusNotFound {
+		t.Errorf("重复永久删除: code = %d, 期望 404", code)
+	}
+}
+
+func TestSharedContentWrittenWhenMissing(t *testing.T) {
+	router, a := newTestAppRouter(t)
+
+	// 另一张图片已登记引用，但文件写入失败或尚未完成
+	data := encodePNG(t, 40, 30)
+	digest := sha256.Sum256(data)
+	sum := hex.EncodeToString(digest[:])
+	if _, err := a.Repos().BlobRefs.Acquire(context.Background(), "uploads/"+sum[:2]+"/"+sum+".png"); err != nil {
+		t.Fatalf("登记文件引用失败: %v", err)
+	}
+
+	code, resp := uploadFile(t, router, "same.png", data)
+	var uploaded models.Image
+	if code != http.StatusOK || json.Unmarshal(resp.Data, &uploaded) != nil {
+		t.Fatalf("上传图片: code = %d, resp = %+v", code, resp)
+	}
+	for _, key := range []string{uploaded.FilePath, uploaded.ThumbnailPath} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/files/"+key, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("已有引用时缺少的文件 %s: code = %d, 期望 200", key, w.Code)
+		}
+	}
+}
+
+// encodeGradient 生成水平渐变的PNG图片，reverse 为true时从亮到暗
+func encodeGradient(t *testing.T, width, height int, reverse bool) []byte {
+	t.Helper()
+
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			value := uint8(x * 255 / (width - 1))
+			if reverse {
+				value = 255 - value
+			}
+			img.Pix[y*img.Stride+x] = value
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("编码PNG失败: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestSimilarImages(t *testing.T) {
+	router, _ := newTestRouter(t)
+
+	upload := func(data []byte) models.Image {
+		code, resp := uploadFile(t, router, "gradient.png", data)
+		if code != http.StatusOK {
+			t.Fatalf("上传图片: code = %d, resp = %+v", code, resp)
+		}
+		var image models.Image
+		json.Unmarshal(resp.Data, &image)
+		if len(image.PHash) != 16 {
+			t.Fatalf("感知哈希 = %q", image.PHash)
+		}
+		return image
+	}
+
+	original := upload(encodeGradient(t, 64, 48, false))
+	scaled := upload(encodeGradient(t, 160, 120, false))
+	upload(encodeGradient(t, 64, 48, true))
+
+	// 缩放后的图片内容哈希不同，但感知哈希相近；反向渐变不应出现
+	var similar []models.SimilarImage
+	code, resp := doJSON(t, router, http.MethodGet, "/api/v1/images/"+original.ID.Hex()+"/similar?max_distance=4", nil, &similar)
+	if code != http.StatusOK {
+		t.Fatalf("查找近似图片: code = %d, resp = %+v", code, resp)
+	}
+	if scaled.SHA256 == original.SHA256 || len(similar) != 1 || similar[0].Image.ID != scaled.ID || similar[0].Distance > 4 {
+		t.Fatalf("近似图片 = %+v", similar)
+	}
+
+	similar = nil
+	doJSON(t, router, http.MethodGet, "/api/v1/images/"+original.ID.Hex()+"/similar?max_distance=64", nil, &similar)
+	if len(similar) != 2 || similar[0].Image.ID != scaled.ID || similar[1].Distance <= similar[0].Distance {
+		t.Errorf("最大距离64时应按距离返回全部图片: %+v", similar)
+	}
+
+	// limit 只保留距离最近的图片
+	similar = nil
+	doJSON(t, router, http.MethodGet, "/api/v1/images/"+original.ID.Hex()+"/similar?max_distance=64&limit=1", nil, &similar)
+	if len(similar) != 1 || similar[0].Image.ID != scaled.ID {
+		t.Errorf("limit=1 时的近似图片 = %+v", similar)
+	}
+	for _, query := range []string{"limit=0", "limit=201", "limit=x"} {
+		if code, _ := doJSON(t, router, http.MethodGet, "/api/v1/images/"+original.ID.Hex()+"/similar?"+query, nil, nil); code != http.StatusBadRequest {
+			t.Errorf("%s: code = %d, 期望 400", query, code)
+		}
+	}
+
+	if code, _ := doJSON(t, router, http.MethodGet, "/api/v1/images/"+original.ID.Hex()+"/similar?max_distance=65", nil, nil); code != http.StatusBadRequest {
+		t.Errorf("非法距离: code = %d, 期望 400", code)
+	}
+	if code, _ := doJSON(t, router, http.MethodGet, "/api/v1/images/"+primitive.NewObjectID().Hex()+"/similar", nil, nil); code != http.StatusNotFound {
+		t.Errorf("不存在的图片: code = %d, 期望 404", code)
+	}
+}
+
+func TestImageFormatsAndVariants(t *testing.T) {
+	router, _ := newTestRouter(t)
+
+	// 竖图按长边缩放，保持宽高比，不放大原图
+	portrait := image.NewRGBA(image.Rect(0, 0, 300, 525))
+	for i := range portrait.Pix {
+		portrait.Pix[i] = 255
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, portrait, nil); err != nil {
+		t.Fatalf("编码JPEG失败: %v", err)
+	}
+	code, resp := uploadFile(t, router, "portrait.png", buf.Bytes())
+	if code != http.StatusOK {
+		t.Fatalf("上传JPEG: code = %d, resp = %+v", code, resp)
+	}
+	var saved models.Image
+	json.Unmarshal(resp.Data, &saved)
+
+	if saved.Format != "JPEG" || !strings.HasSuffix(saved.FilePath, ".jpg") {
+		t.Errorf("JPEG格式识别: format = %s, path = %s", saved.Format, saved.FilePath)
+	}
+	want := [][2]int{{114, 200}, {293, 512}, {300, 525}}
+	if len(saved.Variants) != len(want) || saved.ThumbnailPath != saved.Variants[0].Path {
+		t.Fatalf("衍生图 = %+v", saved.Variants)
+	}
+	for i, variant := range saved.Variants {
+		if variant.Width != want[i][0] || variant.Height != want[i][1] || variant.Format != "JPEG" {
+			t.Errorf("衍生图[%d] = %+v, 期望 %v", i, variant, want[i])
+		}
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/files/"+variant.Path, nil))
+		config, err := jpeg.DecodeConfig(w.Body)
+		if err != nil || config.Width != variant.Width || config.Height != variant.Height {
+			t.Errorf("衍生图[%d] 文件: code = %d, config = %+v, err = %v", i, w.Code, config, err)
+		}
+	}
+
+	// WebP 图片可以解码和保存
+	square := image.NewNRGBA(image.Rect(0, 0, 20, 20))
+	square.Set(5, 5, color.NRGBA{R: 255, A: 128})
+	buf.Reset()
+	if err := nativewebp.Encode(&buf, square, nil); err != nil {
+		t.Fatalf("编码WebP失败: %v", err)
+	}
+	code, resp = uploadFile(t, router, "square.webp", buf.Bytes())
+	if code != http.StatusOK {
+		t.Fatalf("上传WebP: code = %d, resp = %+v", code, resp)
+	}
+	json.Unmarshal(resp.Data, &saved)
+	if saved.Format != "WEBP" || saved.Width != 20 || len(saved.Variants) != 1 || saved.Variants[0].Format != "WEBP" {
+		t.Errorf("WebP图片记录 = %+v", saved)
+	}
+}
+
+func TestRenderImage(t *testing.T) {
+	router, _ := newTestRouter(t)
+
+	code, resp := uploadFile(t, router, "wide.png", encodeGradient(t, 300, 200, false))
+	if code != http.StatusOK {
+		t.Fatalf("上传图片: code = %d, resp = %+v", code, resp)
+	}
+	var uploaded models.Image
+	json.Unmarshal(resp.Data, &uploaded)
+	base := "/api/v1/images/" + uploaded.ID.Hex() + "/render"
+
+	render := func(query string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, base+query, nil)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// contain 只给宽度时等比缩放，默认保持原图格式
+	w := render("?w=100", nil)
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/png" || etag == "" || w.Header().Get("Cache-Control") == "" {
+		t.Fatalf("渲染: code = %d, headers = %v", w.Code, w.Header())
+	}
+	if config, err := png.DecodeConfig(w.Body); err != nil || config.Width != 100 || config.Height != 67 {
+		t.Errorf("contain 尺寸 = %+v, err = %v", config, err)
+	}
+
+	// 缓存命中时 ETag 相同，支持条件请求和 Range
+	if w := render("?w=100", map[string]string{"If-None-Match": etag}); w.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match: code = %d, 期望 304", w.Code)
+	}
+	if w := render("?w=100", map[string]string{"Range": "bytes=0-9"}); w.Code != http.StatusPartialContent || w.Body.Len() != 10 {
+		t.Errorf("Range: code = %d, len = %d", w.Code, w.Body.Len())
+	}
+
+	// cover 裁剪为指定尺寸并转换格式
+	w = render("?w=50&h=50&fit=cover&format=jpg&q=70", nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/jpeg" || w.Header().Get("ETag") == etag {
+		t.Fatalf("cover: code = %d, headers = %v", w.Code, w.Header())
+	}
+	if config, err := jpeg.DecodeConfig(w.Body); err != nil || config.Width != 50 || config.Height != 50 {
+		t.Errorf("cover 尺寸 = %+v, err = %v", config, err)
+	}
+
+	// contain 不放大原图，fill 拉伸为指定尺寸
+	w = render("?w=1000&h=1000&format=webp", nil)
+	if config, err := webp.DecodeConfig(w.Body); err != nil || config.Width != 300 || config.Height != 200 {
+		t.Errorf("contain 不放大: code = %d, config = %+v, err = %v", w.Code, config, err)
+	}
+	w = render("?w=60&h=80&fit=fill", nil)
+	if config, err := png.DecodeConfig(w.Body); err != nil || config.Width != 60 || config.Height != 80 {
+		t.Errorf("fill 尺寸 = %+v, err = %v", config, err)
+	}
+
+	for _, query := range []string{"?w=-1", "?w=5000", "?format=gif", "?fit=stretch", "?q=101&format=jpeg", "?w=abc"} {
+		if w := render(query, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: code = %d, 期望 400", query, w.Code)
+		}
+	}
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/images/"+primitive.NewObjectID().Hex()+"/render?w=10", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("不存在的图片: code = %d, 期望 404", w.Code)
+	}
+}
+
+func TestDownloadEmbedsMetadataAndImport(t *testing.T) {
+	router, a := newTestAppRouter(t)
+
+	params := models.GenerationParams{Provider: "mock", Model: "mock-v1", Size: "256x256", Quality: "hd"}
+	var generations []models.Generation
+	code, resp := doJSON(t, router, http.MethodPost, "/api/v1/generate/text2img", models.Text2ImgRequest{
+		Prompt: "雪山上的日出",
+		Params: params,
+	}, &generations)
+	if code != http.StatusOK || len(generations) != 1 || generations[0].ImageID == nil {
+		t.Fatalf("生成图片: code = %d, resp = %+v", code, resp)
+	}
+	generation := generations[0]
+
+	var stored models.Image
+	doJSON(t, router, http.MethodGet, "/api/v1/images/"+generation.ImageID.Hex(), nil, &stored)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/images/"+generation.ImageID.Hex()+"/download", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Disposition") != `attachment; filename=`+stored.Filename {
+		t.Fatalf("下载图片: code = %d, headers = %v", w.Code, w.Header())
+	}
+	downloaded := w.Body.Bytes()
+
+	// 文件存储中的原图不含生成信息
+	original, err := a.Images.ReadImageFile(stored.FilePath)
+	if err != nil || bytes.Equal(original, downloaded) {
+		t.Fatalf("下载的文件未写入生成信息: %v", err)
+	}
+
+	// 通过文件地址访问原图同样带有生成信息，缩略图原样返回
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/files/"+stored.FilePath, nil))
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), downloaded) || w.Header().Get("Content-Disposition") != "" {
+		t.Fatalf("文件地址访问原图: code = %d, headers = %v", w.Code, w.Header())
+	}
+	thumbnail, _ := a.Images.ReadImageFile(stored.ThumbnailPath)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/files/"+stored.ThumbnailPath, nil))
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), thumbnail) {
+		t.Errorf("缩略图: code = %d, len = %d", w.Code, w.Body.Len())
+	}
+
+	// 导入下载的文件恢复生成信息
+	code, resp = uploadFileTo(t, router, "/api/v1/images/import", "sunrise.png", downloaded)
+	if code != http.StatusOK {
+		t.Fatalf("导入图片: code = %d, resp = %+v", code, resp)
+	}
+	var imported models.Image
+	json.Unmarshal(resp.Data, &imported)
+	meta := imported.ImportedMetadata
+	if meta == nil || meta.GenerationID != generation.ID.Hex() || meta.Prompt != "雪山上的日出" || meta.Params.Model != params.Model ||
+		meta.Params.Size != params.Size || meta.Params.Quality != params.Quality || meta.Params.Provider != params.Provider {
+		t.Fatalf("导入的生成信息 = %+v", meta)
+	}
+	if !imported.Uploaded || imported.PromptText != "雪山上的日出" || imported.GenerationID != nil {
+		t.Errorf("导入的图片记录 = %+v", imported)
+	}
+
+	// 没有生成信息的图片按普通上传处理
+	code, resp = uploadFileTo(t, router, "/api/v1/images/import", "plain.png", encodePNG(t, 8, 8))
+	var plain models.Image
+	json.Unmarshal(resp.Data, &plain)
+	if code != http.StatusOK || plain.ImportedMetadata != nil {
+		t.Errorf("导入普通图片: code = %d, image = %+v", code, plain)
+	}
+}
+
+// exportEntry manifest.json 中的一项
+type exportEntry struct {
+	File         string                   `json:"file"`
+	Thumbnail    string                   `json:"thumbnail"`
+	ImageID      string                   `json:"image_id"`
+	GenerationID string                   `json:"generation_id"`
+	Prompt       string                   `json:"prompt"`
+	Params       *models.GenerationParams `json:"params"`
+	SHA256       string                   `json:"sha256"`
+}
+
+// downloadZip 请求导出接口并解压，成功时返回各文件内容和 manifest.json
+func downloadZip(t *testing.T, router *gin.Engine, method, path string, body interface{}) (int, map[string][]byte, []exportEntry) {
+	t.Helper()
+
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatalf("序列化请求失败: %v", err)
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	req := httptest.NewRequest(method, path, reqBody)
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		return w.Code, nil, nil
+	}
+
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/zip" {
+		t.Fatalf("Content-Type = %q", contentType)
+	}
+	archive, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatalf("解析ZIP失败: %v", err)
+	}
+	files := make(map[string][]byte)
+	for _, file := range archive.File {
+		r, err := file.Open()
+		if err != nil {
+			t.Fatalf("打开 %s 失败: %v", file.Name, err)
+		}
+		data, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("读取 %s 失败: %v", file.Name, err)
+		}
+		files[file.Name] = data
+	}
+
+	var manifest []exportEntry
+	if err := json.Unmarshal(files["manifest.json"], &manifest); err != nil {
+		t.Fatalf("manifest.json 无效: %v", err)
+	}
+	return w.Code, files, manifest
+}
+
+func TestExportImages(t *testing.T) {
+	router, _ := newTestRouter(t)
+
+	contents := [][]byte{encodePNG(t, 4, 4), encodeGradient(t, 8, 8, false)}
+	uploaded := make([]models.Image, len(contents))
+	for i, data := range contents {
+		code, resp := uploadFile(t, router, "export.png", data)
+		if code != http.StatusOK {
+			t.Fatalf("上传图片: code = %d, resp = %+v", code, resp)
+		}
+		if err := json.Unmarshal(resp.Data, &uploaded[i]); err != nil {
+			t.Fatalf("解析上传结果失败: %v", err)
+		}
+	}
+
+	// 按ID导出时保持请求中的顺序
+	code, files, manifest := downloadZip(t, router, http.MethodPost, "/api/v1/images/export", map[string]interface{}{
+		"image_ids": []string{uploaded[1].ID.Hex(), uploaded[0].ID.Hex()},
+	})
+	if code != http.StatusOK {
+		t.Fatalf("按ID导出: code = %d", code)
+	}
+	if len(manifest) != 2 || manifest[0].ImageID != uploaded[1].ID.Hex() || manifest[1].ImageID != uploaded[0].ID.Hex() {
+		t.Fatalf("manifest = %+v", manifest)
+	}
+	for i, entry := range manifest {
+		if !bytes.Equal(files[entry.File], contents[1-i]) {
+			t.Errorf("%s 与原图不一致", entry.File)
+		}
+		if entry.Thumbnail != "" {
+			t.Errorf("未要求缩略图时导出了 %s", entry.Thumbnail)
+		}
+	}
+	if csv := string(files["manifest.csv"]); !strings.HasPrefix(csv, "\ufefffile,thumbnail,image_id") || strings.Count(csv, "\n") != 3 {
+		t.Errorf("manifest.csv = %q", csv)
+	}
+
+	// 按过滤条件导出，包含缩略图
+	code, files, manifest = downloadZip(t, router, http.MethodPost, "/api/v1/images/export", map[string]interface{}{
+		"filter":     map[string]string{"sha256": uploaded[0].SHA256},
+		"thumbnails": true,
+	})
+	if code != http.StatusOK {
+		t.Fatalf("按过滤条件导出: code = %d", code)
+	}
+	if len(manifest) != 1 || manifest[0].ImageID != uploaded[0].ID.Hex() || manifest[0].Thumbnail == "" || len(files[manifest[0].Thumbnail]) == 0 {
+		t.Fatalf("manifest = %+v", manifest)
+	}
+
+	for _, tc := range []struct {
+		body interface{}
+		code int
+	}{
+		{map[string]interface{}{}, http.StatusBadRequest},
+		{map[string]interface{}{"image_ids": []string{"bad"}}, http.StatusBadRequest},
+		{map[string]interface{}{"image_ids": []string{primitive.NewObjectID().Hex()}}, http.StatusNotFound},
+	} {
+		if code, _, _ := downloadZip(t, router, http.MethodPost, "/api/v1/images/export", tc.body); code != tc.code {
+			t.Errorf("导出 %v: code = %d, 期望 %d", tc.body, code, tc.code)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"strconv"
 
+	"nano-banana-qwen/internal/app"
 	"nano-banana-qwen/internal/models"
 	"nano-banana-qwen/internal/services"
 
@@ -16,9 +17,9 @@ type PromptHandler struct {
 }
 
 // NewPromptHandler 创建提示词处理器
-func NewPromptHandler() *PromptHandler {
+func NewPromptHandler(a *app.App) *PromptHandler {
 	return &PromptHandler{
-		promptService: services.NewPromptService(),
+		promptService: a.Prompts,
 	}
 }
 
@@ -0,0 +1,159 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"nano-banana-qwen/internal/app"
+	"nano-banana-qwen/internal/config"
+	"nano-banana-qwen/internal/models"
+	"nano-banana-qwen/internal/repository"
+
+	"github.com/gin-gonic/gin"
+)
+
+// testResponse 与 models.APIResponse 对应，data 延迟解析
+type testResponse struct {
+	Success bool            `json:"success"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data"`
+	Error   string          `json:"error"`
+}
+
+// newTestRouter 基于独立的内存应用实例创建完整路由
+func newTestRouter(t *testing.T) (*gin.Engine, *repository.Repositories) {
+	t.Helper()
+
+	router, a := newTestAppRouter(t)
+	return router, a.Repos()
+}
+
+// newTestAppRouter 创建完整路由并返回应用实例，供需要直接操作队列的测试使用
+func newTestAppRouter(t *testing.T) (*gin.Engine, *app.App) {
+	t.Helper()
+
+	dir := t.TempDir()
+	cfg := &config.Config{
+		ImageProvider:       "mock",
+		UploadPath:          dir,
+		GeneratedPath:       dir,
+		ThumbnailPath:       dir,
+		TempPath:            dir,
+		MaxUploadSize:       1,
+		DefaultImageSize:    "1024x1024",
+		DefaultImageQuality: "standard",
+		JobLeaseTimeout:     60,
+		JobMaxAttempts:      5,
+	}
+
+	a, err := app.NewInMemory(cfg)
+	if err != nil {
+		t.Fatalf("创建应用失败: %v", err)
+	}
+	t.Cleanup(a.Close)
+
+	return SetupRouter(a), a
+}
+
+// doJSON 发送请求并解析统一响应格式，data 解析到 out（可为nil）
+func doJSON(t *testing.T, router *gin.Engine, method, path string, body interface{}, out interface{}) (int, testResponse) {
+	t.Helper()
+
+	var reader *bytes.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatalf("编码请求失败: %v", err)
+		}
+		reader = bytes.NewReader(data)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	req := httptest.NewRequest(method, path, reader)
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	var resp testResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("%s %s 响应不是JSON: %s", method, path, w.Body.String())
+	}
+	if out != nil && len(resp.Data) > 0 {
+		if err := json.Unmarshal(resp.Data, out); err != nil {
+			t.Fatalf("解析data失败: %v", err)
+		}
+	}
+
+	return w.Code, resp
+}
+
+func TestPromptHandlerCRUD(t *testing.T) {
+	router, _ := newTestRouter(t)
+
+	var created models.Prompt
+	code, _ := doJSON(t, router, http.MethodPost, "/api/v1/prompts", models.CreatePromptRequest{
+		Title:    "Red Fox",
+		Content:  "a red fox in the snow",
+		Category: "animals",
+		Tags:     []string{"fox", "winter"},
+	}, &created)
+	if code != http.StatusOK || created.ID.IsZero() {
+		t.Fatalf("创建提示词: code = %d, prompt = %+v", code, created)
+	}
+
+	doJSON(t, router, http.MethodPost, "/api/v1/prompts", models.CreatePromptRequest{
+		Title:    "City",
+		Content:  "a city at night",
+		Category: "urban",
+	}, nil)
+
+	// 关键字匹配忽略大小写
+	var list models.PromptListResponse
+	doJSON(t, router, http.MethodGet, "/api/v1/prompts?keyword=FOX", nil, &list)
+	if list.Total != 1 || len(list.Prompts) != 1 || list.Prompts[0].ID != created.ID {
+		t.Fatalf("关键字过滤结果 = %+v", list)
+	}
+
+	var categories []string
+	doJSON(t, router, http.MethodGet, "/api/v1/prompts/categories", nil, &categories)
+	if len(categories) != 2 || categories[0] != "animals" || categories[1] != "urban" {
+		t.Errorf("categories = %v", categories)
+	}
+
+	var updated models.Prompt
+	code, _ = doJSON(t, router, http.MethodPut, "/api/v1/prompts/"+created.ID.Hex(), models.UpdatePromptRequest{
+		Title:      "Arctic Fox",
+		IsFavorite: true,
+	}, &updated)
+	if code != http.StatusOK || updated.Title != "Arctic Fox" || !updated.IsFavorite || updated.Content != created.Content {
+		t.Fatalf("更新提示词: code = %d, prompt = %+v", code, updated)
+	}
+
+	code, _ = doJSON(t, router, http.MethodDelete, "/api/v1/prompts/"+created.ID.Hex(), nil, nil)
+	if code != http.StatusOK {
+		t.Fatalf("删除提示词: code = %d", code)
+	}
+
+	code, resp := doJSON(t, router, http.MethodGet, "/api/v1/prompts/"+created.ID.Hex(), nil, nil)
+	if code != http.StatusNotFound || resp.Success {
+		t.Errorf("已删除的提示词: code = %d, resp = %+v", code, resp)
+	}
+
+	doJSON(t, router, http.MethodGet, "/api/v1/prompts", nil, &list)
+	if list.Total != 1 {
+		t.Errorf("删除后总数 = %d, 期望 1", list.Total)
+	}
+}
+
+func TestPromptHandlerInvalidID(t *testing.T) {
+	router, _ := newTestRouter(t)
+
+	code, resp := doJSON(t, router, http.MethodGet, "/api/v1/prompts/not-an-id", nil, nil)
+	if code != http.StatusBadRequest || resp.Success {
+		t.Errorf("code = %d, resp = %+v", code, resp)
+	}
+}
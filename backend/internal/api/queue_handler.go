@@ -0,0 +1,139 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"nano-banana-qwen/internal/app"
+	"nano-banana-qwen/internal/models"
+	"nano-banana-qwen/internal/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// QueueHandler 队列管理接口，查看各队列内容并处理失败队列
+type QueueHandler struct {
+	queueService *services.QueueService
+	batchWorker  *services.BatchWorker
+}
+
+// NewQueueHandler 创建队列管理处理器
+func NewQueueHandler(a *app.App) *QueueHandler {
+	return &QueueHandler{
+		queueService: a.Queue,
+		batchWorker:  a.BatchWorker,
+	}
+}
+
+// GetQueueStats 获取各队列的数量
+func (h *QueueHandler) GetQueueStats(c *gin.Context) {
+	stats, err := h.queueService.GetQueueStats()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse(err.Error(), "获取队列统计失败"))
+		return
+	}
+
+	c.JSON(http.StatusOK, models.SuccessResponse(stats, "获取队列统计成功"))
+}
+
+// ListPendingJobs 按领取顺序列出待处理的批量任务
+func (h *QueueHandler) ListPendingJobs(c *gin.Context) {
+	jobs, err := h.queueService.ListPendingJobs()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse(err.Error(), "查询失败"))
+		return
+	}
+
+	c.JSON(http.StatusOK, models.SuccessResponse(jobs, "获取待处理队列成功"))
+}
+
+// ListProcessingTasks 列出处理中的图片任务
+func (h *QueueHandler) ListProcessingTasks(c *gin.Context) {
+	entries, err := h.queueService.ListProcessingTasks()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse(err.Error(), "查询失败"))
+		return
+	}
+
+	c.JSON(http.StatusOK, models.SuccessResponse(entries, "获取处理中队列成功"))
+}
+
+// ListDelayedTasks 列出等待自动重试的图片任务
+func (h *QueueHandler) ListDelayedTasks(c *gin.Context) {
+	entries, err := h.queueService.ListDelayedTasks()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse(err.Error(), "查询失败"))
+		return
+	}
+
+	c.JSON(http.StatusOK, models.SuccessResponse(entries, "获取延迟队列成功"))
+}
+
+// ListFailedTasks 分页列出失败队列，包含最后一次错误和尝试次数
+func (h *QueueHandler) ListFailedTasks(c *gin.Context) {
+	page := 1
+	pageSize := 20
+
+	if p := c.Query("page"); p != "" {
+		if parsed, err := strconv.Atoi(p); err == nil && parsed > 0 {
+			page = parsed
+		}
+	}
+
+	if ps := c.Query("page_size"); ps != "" {
+		if parsed, err := strconv.Atoi(ps); err == nil && parsed > 0 && parsed <= 100 {
+			pageSize = parsed
+		}
+	}
+
+	entries, total, err := h.queueService.ListFailedTasks(page, pageSize)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse(err.Error(), "查询失败"))
+		return
+	}
+
+	totalPages := int((total + int64(pageSize) - 1) / int64(pageSize))
+	response := models.QueueEntryListResponse{
+		Entries:    entries,
+		Total:      total,
+		Page:       page,
+		PageSize:   pageSize,
+		TotalPages: totalPages,
+	}
+
+	c.JSON(http.StatusOK, models.SuccessResponse(response, "获取失败队列成功"))
+}
+
+// RetryFailedTask 重试失败队列中的一个图片任务
+func (h *QueueHandler) RetryFailedTask(c *gin.Context) {
+	retried, err := h.batchWorker.RetryTask(c.Param("task_id"))
+	if err != nil {
+		respondRetryError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, models.SuccessResponse(retried, "图片任务已重新入队"))
+}
+
+// RetryAllFailedTasks 重试失败队列中的全部图片任务
+func (h *QueueHandler) RetryAllFailedTasks(c *gin.Context) {
+	retried, skipped, err := h.batchWorker.RetryAllTasks()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse(err.Error(), "重新入队失败"))
+		return
+	}
+
+	result := models.QueueRetryResult{Retried: retried, Skipped: skipped}
+	c.JSON(http.StatusOK, models.SuccessResponse(result, "失败的图片任务已重新入队"))
+}
+
+// PurgeFailedTasks 清空失败队列，已计入批量任务的失败数量不变
+func (h *QueueHandler) PurgeFailedTasks(c *gin.Context) {
+	purged, err := h.queueService.PurgeFailedTasks()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse(err.Error(), "清空失败队列失败"))
+		return
+	}
+
+	c.JSON(http.StatusOK, models.SuccessResponse(gin.H{"purged": purged}, "失败队列已清空"))
+}
@@ -0,0 +1,123 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"nano-banana-qwen/internal/models"
+)
+
+func TestQueueHandler(t *testing.T) {
+	router, a := newTestAppRouter(t)
+	repos := a.Repos()
+	ctx := context.Background()
+
+	var jobA, jobB models.BatchJob
+	for _, tc := range []struct {
+		job   *models.BatchJob
+		count int
+	}{{&jobA, 2}, {&jobB, 1}} {
+		body := map[string]interface{}{"prompts": []map[string]interface{}{{"prompt_text": "cat", "count": tc.count}}}
+		if code, resp := doJSON(t, router, http.MethodPost, "/api/v1/batch", body, tc.job); code != http.StatusOK {
+			t.Fatalf("创建批量任务: code = %d, resp = %+v", code, resp)
+		}
+	}
+
+	var pending []models.PendingJobEntry
+	if code, _ := doJSON(t, router, http.MethodGet, "/api/v1/queue/pending", nil, &pending); code != http.StatusOK ||
+		len(pending) != 2 || pending[0].JobID != jobA.ID.Hex() || pending[0].PendingTasks != 2 || len(pending[0].TaskIDs) != 2 {
+		t.Fatalf("待处理队列 = %+v, code = %d", pending, code)
+	}
+
+	// 按处理器的方式处理：第一张失败，第二张成功，第三张保持处理中
+	var tasks []*models.GenerationTask
+	for i := 0; i < 3; i++ {
+		task, err := a.Queue.GetNextBatchTask()
+		if err != nil || task == nil {
+			t.Fatalf("领取图片任务 = %v, %v", task, err)
+		}
+		tasks = append(tasks, task)
+	}
+	failTask := func(task *models.GenerationTask) {
+		jobID := jobA.ID
+		if task.JobID == jobB.ID.Hex() {
+			jobID = jobB.ID
+		}
+		task.LastError = "上游服务不可用"
+		repos.BatchJobs.RecordResult(ctx, jobID, task.ID, task.PromptIndex, false)
+		if err := a.Queue.FailBatchTask(task); err != nil {
+			t.Fatalf("移入失败队列失败: %v", err)
+		}
+	}
+	failed := tasks[0]
+	failTask(failed)
+	a.Queue.CompleteBatchTask(tasks[1].ID)
+
+	var stats models.QueueStats
+	if code, _ := doJSON(t, router, http.MethodGet, "/api/v1/queue/stats", nil, &stats); code != http.StatusOK ||
+		stats.PendingJobs != 0 || stats.ProcessingJobs != 1 || stats.FailedJobs != 1 || stats.CompletedJobs != 1 {
+		t.Fatalf("队列统计 = %+v, code = %d", stats, code)
+	}
+
+	var processing []models.QueueEntry
+	if code, _ := doJSON(t, router, http.MethodGet, "/api/v1/queue/processing", nil, &processing); code != http.StatusOK ||
+		len(processing) != 1 || processing[0].ID != tasks[2].ID || processing[0].Task == nil ||
+		processing[0].LeaseExpiresAt == nil || processing[0].Deliveries != 1 {
+		t.Fatalf("处理中队列 = %+v, code = %d", processing, code)
+	}
+
+	var list models.QueueEntryListResponse
+	if code, _ := doJSON(t, router, http.MethodGet, "/api/v1/queue/failed", nil, &list); code != http.StatusOK ||
+		list.Total != 1 || len(list.Entries) != 1 || list.Entries[0].ID != failed.ID ||
+		list.Entries[0].Task == nil || list.Entries[0].Task.LastError != "上游服务不可用" {
+		t.Fatalf("失败队列 = %+v, code = %d", list, code)
+	}
+
+	// 重试一个
+	var retried models.GenerationTask
+	if code, resp := doJSON(t, router, http.MethodPost, "/api/v1/queue/failed/"+failed.ID+"/retry", nil, &retried); code != http.StatusOK || retried.RetryCount != 1 {
+		t.Fatalf("重试: code = %d, task = %+v, resp = %+v", code, retried, resp)
+	}
+	if code, _ := doJSON(t, router, http.MethodPost, "/api/v1/queue/failed/"+failed.ID+"/retry", nil, nil); code != http.StatusNotFound {
+		t.Errorf("重复重试: code = %d, 期望 404", code)
+	}
+
+	// 重试全部
+	next, err := a.Queue.GetNextBatchTask()
+	if err != nil || next == nil || next.ID != failed.ID {
+		t.Fatalf("重新领取 = %+v, %v", next, err)
+	}
+	failTask(next)
+	var result models.QueueRetryResult
+	if code, _ := doJSON(t, router, http.MethodPost, "/api/v1/queue/failed/retry", nil, &result); code != http.StatusOK || result.Retried != 1 || result.Skipped != 0 {
+		t.Fatalf("重试全部: code = %d, result = %+v", code, result)
+	}
+
+	// 批量任务取消后失败的图片无法重试，只能清除
+	next, _ = a.Queue.GetNextBatchTask()
+	failTask(next)
+	cancelPath := "/api/v1/batch/" + next.JobID + "/cancel"
+	if code, resp := doJSON(t, router, http.MethodDelete, cancelPath, nil, nil); code != http.StatusOK {
+		t.Fatalf("取消任务: code = %d, resp = %+v", code, resp)
+	}
+	if code, _ := doJSON(t, router, http.MethodPost, "/api/v1/queue/failed/"+next.ID+"/retry", nil, nil); code != http.StatusBadRequest {
+		t.Errorf("重试已取消任务的图片: code = %d, 期望 400", code)
+	}
+	if code, _ := doJSON(t, router, http.MethodPost, "/api/v1/queue/failed/retry", nil, &result); code != http.StatusOK || result.Retried != 0 || result.Skipped != 1 {
+		t.Errorf("重试全部: code = %d, result = %+v", code, result)
+	}
+
+	var purged struct {
+		Purged int `json:"purged"`
+	}
+	if code, _ := doJSON(t, router, http.MethodDelete, "/api/v1/queue/failed", nil, &purged); code != http.StatusOK || purged.Purged != 1 {
+		t.Fatalf("清空失败队列: code = %d, purged = %+v", code, purged)
+	}
+	if _, err := a.Queue.GetTask(next.ID); err == nil {
+		t.Error("清空后任务内容仍存在")
+	}
+	if code, _ := doJSON(t, router, http.MethodGet, "/api/v1/queue/stats", nil, &stats); code != http.StatusOK || stats.FailedJobs != 0 || stats.CompletedJobs != 1 {
+		t.Errorf("清空后队列统计 = %+v", stats)
+	}
+}
@@ -3,19 +3,21 @@ package api
 import (
 	"time"
 
+	"nano-banana-qwen/internal/app"
+
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 )
 
-// SetupRouter 设置路由
-func SetupRouter() *gin.Engine {
+// SetupRouter 设置路由，各处理器共用 a 中的服务
+func SetupRouter(a *app.App) *gin.Engine {
 	// 设置Gin模式
 	gin.SetMode(gin.ReleaseMode)
 	
 	router := gin.Default()
 
 	// CORS配置 - 允许所有域名访问
-	config := cors.Config{
+	corsConfig := cors.Config{
 		AllowAllOrigins:  true,
 		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "PATCH", "HEAD", "OPTIONS"},
 		AllowHeaders:     []string{"*"},
@@ -23,13 +25,14 @@ func SetupRouter() *gin.Engine {
 		AllowCredentials: true,
 		MaxAge:           12 * time.Hour,
 	}
-	router.Use(cors.New(config))
+	router.Use(cors.New(corsConfig))
 
 	// 创建处理器实例
-	promptHandler := NewPromptHandler()
-	generationHandler := NewGenerationHandler()
-	batchHandler := NewBatchHandler()
-	imageHandler := NewImageHandler()
+	promptHandler := NewPromptHandler(a)
+	generationHandler := NewGenerationHandler(a)
+	batchHandler := NewBatchHandler(a)
+	imageHandler := NewImageHandler(a)
+	queueHandler := NewQueueHandler(a)
 
 	// API路由组
 	v1 := router.Group("/api/v1")
@@ -59,6 +62,7 @@ func SetupRouter() *gin.Engine {
 		{
 			generate.POST("/text2img", generationHandler.GenerateText2Img) // 文本生成图片
 			generate.POST("/img2img", generationHandler.GenerateImg2Img)   // 图片生成图片
+			generate.GET("/providers", generationHandler.ListProviders)    // 获取可用服务商
 		}
 
 		// 生成记录管理路由
@@ -66,6 +70,8 @@ func SetupRouter() *gin.Engine {
 		{
 			generations.GET("", generationHandler.ListGenerations)       // 获取生成记录列表
 			generations.GET("/:id", generationHandler.GetGeneration)     // 获取生成记录详情
+			generations.GET("/:id/events", generationHandler.StreamGenerationEvents) // 订阅生成状态(SSE)
+			generations.GET("/:id/images", generationHandler.GetGenerationImages)    // 获取生成的图片
 			generations.DELETE("/:id", generationHandler.DeleteGeneration) // 删除生成记录
 		}
 
@@ -75,23 +81,52 @@ func SetupRouter() *gin.Engine {
 			batch.POST("", batchHandler.CreateBatchJob)           // 创建批量任务
 			batch.GET("", batchHandler.ListBatchJobs)             // 获取批量任务列表
 			batch.GET("/:id", batchHandler.GetBatchJob)           // 获取批量任务详情
+			batch.PATCH("/:id", batchHandler.UpdateBatchJob)      // 修改任务优先级
 			batch.GET("/:id/status", batchHandler.GetBatchJobStatus) // 获取任务状态
+			batch.GET("/:id/events", batchHandler.StreamBatchJobEvents) // 订阅任务进度(SSE)
+			batch.GET("/:id/dedupe", batchHandler.GetBatchDedupeReport) // 任务内近似图片报告
+			batch.GET("/:id/export.zip", batchHandler.ExportBatchJob)   // 导出任务的全部图片
+			batch.GET("/:id/tasks", batchHandler.ListBatchTasks)        // 任务中每张图片的生成记录
+			batch.POST("/:id/tasks/:task_id/retry", batchHandler.RetryBatchTask) // 重试失败的图片
+			batch.POST("/:id/pause", batchHandler.PauseBatchJob)   // 暂停任务，处理中的图片照常完成
+			batch.POST("/:id/resume", batchHandler.ResumeBatchJob) // 恢复暂停的任务
 			batch.DELETE("/:id/cancel", batchHandler.CancelBatchJob) // 取消任务
 			batch.DELETE("/:id", batchHandler.DeleteBatchJob)     // 删除任务
 		}
 
+		// 队列管理路由
+		queue := v1.Group("/queue")
+		{
+			queue.GET("/stats", queueHandler.GetQueueStats)             // 各队列数量
+			queue.GET("/pending", queueHandler.ListPendingJobs)         // 待处理的批量任务
+			queue.GET("/processing", queueHandler.ListProcessingTasks)  // 处理中的图片任务及租约
+			queue.GET("/delayed", queueHandler.ListDelayedTasks)        // 等待自动重试的图片任务
+			queue.GET("/failed", queueHandler.ListFailedTasks)          // 失败队列
+			queue.POST("/failed/retry", queueHandler.RetryAllFailedTasks)         // 重试全部失败任务
+			queue.POST("/failed/:task_id/retry", queueHandler.RetryFailedTask)    // 重试一个失败任务
+			queue.DELETE("/failed", queueHandler.PurgeFailedTasks)      // 清空失败队列
+		}
+
 		// 图片管理路由
 		images := v1.Group("/images")
 		{
 			images.GET("", imageHandler.ListImages)           // 获取图片列表
+			images.POST("/upload", imageHandler.UploadImage)  // 上传图片
+			images.POST("/import", imageHandler.ImportImage)  // 导入下载过的图片，恢复生成信息
+			images.POST("/export", imageHandler.ExportImages) // 按ID或过滤条件导出ZIP
 			images.GET("/:id", imageHandler.GetImage)         // 获取图片详情
 			images.GET("/:id/download", imageHandler.DownloadImage) // 下载图片
-			images.DELETE("/:id", imageHandler.DeleteImage)   // 删除图片
+			images.GET("/:id/generation", imageHandler.GetImageGeneration) // 获取图片的生成记录
+			images.GET("/:id/lineage", imageHandler.GetImageLineage)       // 获取图片的图生图血缘
+			images.GET("/:id/similar", imageHandler.GetSimilarImages)      // 按感知哈希查找近似图片
+			images.GET("/:id/render", imageHandler.RenderImage)            // 按需缩放、裁剪和转换格式
+			images.HEAD("/:id/render", imageHandler.RenderImage)
+			images.DELETE("/:id", imageHandler.DeleteImage)   // 删除图片，permanent=true 时永久删除
 		}
 
-		// 静态文件服务
-		v1.Static("/files/generated", "./data/images/generated")
-		v1.Static("/files/thumbnails", "./data/images/thumbnails")
+		// 图片文件服务，从配置的文件存储读取
+		v1.GET("/files/*key", imageHandler.ServeFile)
+		v1.HEAD("/files/*key", imageHandler.ServeFile)
 	}
 
 	return router
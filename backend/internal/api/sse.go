@@ -0,0 +1,58 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// sseKeepAliveInterval SSE心跳间隔，防止代理关闭空闲连接
+const sseKeepAliveInterval = 15 * time.Second
+
+// streamStatusEvents 以SSE推送状态快照和后续的状态变更事件，状态进入终态、客户端断开或服务停止时结束
+func streamStatusEvents(c *gin.Context, pubsub *redis.PubSub, stopping <-chan struct{}, snapshot interface{}, snapshotStatus string, terminal map[string]bool) {
+	defer pubsub.Close()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+
+	c.SSEvent("status", snapshot)
+	c.Writer.Flush()
+	if terminal[snapshotStatus] {
+		return
+	}
+
+	messages := pubsub.Channel()
+	keepAlive := time.NewTicker(sseKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case <-stopping:
+			return false
+		case <-keepAlive.C:
+			c.SSEvent("ping", time.Now().Unix())
+			return true
+		case msg, ok := <-messages:
+			if !ok {
+				return false
+			}
+			c.SSEvent("status", json.RawMessage(msg.Payload))
+
+			var event struct {
+				Status string `json:"status"`
+			}
+			if err := json.Unmarshal([]byte(msg.Payload), &event); err == nil && terminal[event.Status] {
+				return false
+			}
+			return true
+		}
+	})
+}
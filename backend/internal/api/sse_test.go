@@ -0,0 +1,157 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"nano-banana-qwen/internal/models"
+	"nano-banana-qwen/internal/services"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// sseStream 读取SSE响应中的事件
+type sseStream struct {
+	reader *bufio.Reader
+}
+
+// openEvents 订阅SSE接口，整个连接超过 5 秒未结束时读取失败
+func openEvents(t *testing.T, server *httptest.Server, path string) *sseStream {
+	t.Helper()
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(server.URL + path)
+	if err != nil {
+		t.Fatalf("订阅 %s 失败: %v", path, err)
+	}
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		resp.Body.Close()
+		t.Fatalf("订阅 %s: code = %d, content-type = %s", path, resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+
+	return &sseStream{reader: bufio.NewReader(resp.Body)}
+}
+
+// next 读取下一个事件的名称和状态，连接结束时返回 io.EOF
+func (s *sseStream) next() (string, string, error) {
+	var event, data string
+	for {
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			return "", "", err
+		}
+		line = strings.TrimRight(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimPrefix(line, "event:")
+		case strings.HasPrefix(line, "data:"):
+			data = strings.TrimPrefix(line, "data:")
+		case line == "" && event != "":
+			var payload struct {
+				Status string `json:"status"`
+			}
+			if err := json.Unmarshal([]byte(data), &payload); err != nil {
+				return "", "", err
+			}
+			return event, payload.Status, nil
+		}
+	}
+}
+
+// expectStatus 下一个事件应为指定状态
+func (s *sseStream) expectStatus(t *testing.T, want string) {
+	t.Helper()
+
+	event, status, err := s.next()
+	if err != nil || event != "status" || status != want {
+		t.Fatalf("事件 = %q %q, %v, 期望 status %q", event, status, err, want)
+	}
+}
+
+// expectClosed 终态事件之后服务端应关闭连接
+func (s *sseStream) expectClosed(t *testing.T) {
+	t.Helper()
+
+	if event, status, err := s.next(); err != io.EOF {
+		t.Fatalf("终态后连接未关闭: 事件 = %q %q, %v", event, status, err)
+	}
+}
+
+func TestStreamGenerationEvents(t *testing.T) {
+	router, a := newTestAppRouter(t)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	generation := models.Generation{
+		ID:               primitive.NewObjectID(),
+		PromptText:       "a red fox",
+		GenerationParams: models.GenerationParams{Provider: "mock", Size: "256x256"},
+		Status:           "pending",
+		CreatedAt:        time.Now(),
+	}
+	if err := a.Repos().Generations.Create(context.Background(), &generation); err != nil {
+		t.Fatalf("写入生成记录失败: %v", err)
+	}
+	channel := services.GenerationEventChannel(generation.ID.Hex())
+
+	// 先推送快照，之后的状态变更逐个推送，等待重试不是终态
+	stream := openEvents(t, server, "/api/v1/generations/"+generation.ID.Hex()+"/events")
+	stream.expectStatus(t, "pending")
+	for _, status := range []string{"processing", "retrying", "completed"} {
+		generation.Status = status
+		if err := a.Events.Publish(channel, generation); err != nil {
+			t.Fatalf("发布事件失败: %v", err)
+		}
+		stream.expectStatus(t, status)
+	}
+	stream.expectClosed(t)
+
+	// 已结束的生成只推送快照
+	if err := a.Repos().Generations.Save(context.Background(), &generation); err != nil {
+		t.Fatalf("保存生成记录失败: %v", err)
+	}
+	stream = openEvents(t, server, "/api/v1/generations/"+generation.ID.Hex()+"/events")
+	stream.expectStatus(t, "completed")
+	stream.expectClosed(t)
+
+	resp, err := http.Get(server.URL + "/api/v1/generations/" + primitive.NewObjectID().Hex() + "/events")
+	if err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("订阅不存在的生成: resp = %+v, %v", resp, err)
+	}
+	if resp != nil {
+		resp.Body.Close()
+	}
+}
+
+func TestStreamBatchJobEvents(t *testing.T) {
+	router, a := newTestAppRouter(t)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	var job models.BatchJob
+	body := map[string]interface{}{"prompts": []map[string]interface{}{{"prompt_text": "cat", "count": 2}}}
+	if code, resp := doJSON(t, router, http.MethodPost, "/api/v1/batch", body, &job); code != http.StatusOK {
+		t.Fatalf("创建批量任务: code = %d, resp = %+v", code, resp)
+	}
+	jobID := job.ID.Hex()
+
+	stream := openEvents(t, server, "/api/v1/batch/"+jobID+"/events")
+	stream.expectStatus(t, "pending")
+	if started, err := a.Queue.MarkJobStarted(jobID, "正在处理任务"); err != nil || !started {
+		t.Fatalf("MarkJobStarted = %v, %v", started, err)
+	}
+	stream.expectStatus(t, "processing")
+	if err := a.Queue.UpdateJobState(jobID, "cancelled", "任务已取消"); err != nil {
+		t.Fatalf("更新任务状态失败: %v", err)
+	}
+	stream.expectStatus(t, "cancelled")
+	stream.expectClosed(t)
+}
@@ -0,0 +1,177 @@
+package app
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"nano-banana-qwen/internal/config"
+	"nano-banana-qwen/internal/repository"
+	"nano-banana-qwen/internal/services"
+	"nano-banana-qwen/internal/storage"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// App 应用容器，持有一个实例的配置、存储连接、服务和后台处理器
+// 同一进程内可以创建多个互不影响的实例
+type App struct {
+	Config *config.Config
+	DB     *services.Database
+
+	Providers *services.ProviderRegistry
+	Prompts   *services.PromptService
+	Images    *services.ImageService
+	Queue     *services.QueueService
+	Events    *services.EventService
+	Runner    *services.GenerationRunner
+
+	BatchWorker      *services.BatchWorker
+	GenerationWorker *services.GenerationWorker
+
+	// stopCtx 取消后后台处理器不再领取新任务
+	stopCtx context.Context
+	stop    context.CancelFunc
+	// workCtx 取消后进行中的生成被中断
+	workCtx   context.Context
+	interrupt context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+// New 按配置连接数据库并创建应用
+func New(cfg *config.Config) (*App, error) {
+	db, err := services.InitDatabase(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	a := NewWithDatabase(cfg, db)
+
+	// 嵌入式模式的队列在进程内，重启后按存储中未结束的任务重建
+	if db.InProcessQueue() {
+		if err := a.BatchWorker.RestoreQueue(); err != nil {
+			a.Close()
+			return nil, err
+		}
+		if err := a.GenerationWorker.RestoreQueue(); err != nil {
+			a.Close()
+			return nil, err
+		}
+	}
+
+	return a, nil
+}
+
+// NewInMemory 创建使用内存存储和进程内Redis的应用，多个实例之间互不共享数据
+func NewInMemory(cfg *config.Config) (*App, error) {
+	db, err := services.NewMemoryDatabase()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewWithDatabase(cfg, db), nil
+}
+
+// NewWithDatabase 在已建立的存储连接上创建应用，测试中可传入内存存储
+func NewWithDatabase(cfg *config.Config, db *services.Database) *App {
+	repos := db.Repos
+
+	providers := services.NewProviderRegistry(cfg)
+	images := services.NewImageService(cfg, db.Blobs, repos.Images, repos.Generations, repos.BlobRefs)
+	queue := services.NewQueueService(db.Redis, cfg)
+	events := services.NewEventService(db.Redis)
+	runner := services.NewGenerationRunner(cfg, repos.Generations, providers, images, events)
+
+	stopCtx, stop := context.WithCancel(context.Background())
+	workCtx, interrupt := context.WithCancel(context.Background())
+
+	return &App{
+		Config:           cfg,
+		DB:               db,
+		Providers:        providers,
+		Prompts:          services.NewPromptService(repos.Prompts),
+		Images:           images,
+		Queue:            queue,
+		Events:           events,
+		Runner:           runner,
+		BatchWorker:      services.NewBatchWorker(cfg, repos, runner, queue),
+		GenerationWorker: services.NewGenerationWorker(cfg, repos.Generations, runner, images, queue),
+		stopCtx:          stopCtx,
+		stop:             stop,
+		workCtx:          workCtx,
+		interrupt:        interrupt,
+	}
+}
+
+// Repos 应用使用的存储
+func (a *App) Repos() *repository.Repositories {
+	return a.DB.Repos
+}
+
+// Blobs 应用使用的文件存储
+func (a *App) Blobs() storage.BlobStore {
+	return a.DB.Blobs
+}
+
+// Redis 应用使用的Redis客户端
+func (a *App) Redis() *redis.Client {
+	return a.DB.Redis
+}
+
+// Start 启动后台处理器，ctx 被取消等同于调用 Stop
+func (a *App) Start(ctx context.Context) {
+	context.AfterFunc(ctx, a.stop)
+
+	a.wg.Add(2)
+	go func() {
+		defer a.wg.Done()
+		a.BatchWorker.Start(a.stopCtx, a.workCtx)
+	}()
+	go func() {
+		defer a.wg.Done()
+		a.GenerationWorker.Start(a.stopCtx, a.workCtx)
+	}()
+
+	// 渲染缓存等临时文件过期后删除
+	if a.Config.RenderCacheTTL > 0 {
+		a.wg.Add(1)
+		go func() {
+			defer a.wg.Done()
+			a.Images.RunTempCleanup(a.stopCtx, time.Duration(a.Config.RenderCacheTTL)*time.Second)
+		}()
+	}
+}
+
+// WorkContext 生成调用使用的上下文，Interrupt 后被取消
+func (a *App) WorkContext() context.Context {
+	return a.workCtx
+}
+
+// Stopping 调用 Stop 后关闭的通道，用于结束长连接
+func (a *App) Stopping() <-chan struct{} {
+	return a.stopCtx.Done()
+}
+
+// Stop 后台处理器不再领取新任务，进行中的生成继续执行
+func (a *App) Stop() {
+	a.stop()
+}
+
+// Interrupt 中断进行中的生成，生成记录标记为 interrupted，队列任务重新入队
+func (a *App) Interrupt() {
+	a.interrupt()
+}
+
+// Wait 等待后台处理器退出和所有进行中的生成结束
+func (a *App) Wait() {
+	a.wg.Wait()
+	a.Runner.Wait()
+}
+
+// Close 中断所有处理并关闭存储连接
+func (a *App) Close() {
+	a.Stop()
+	a.Interrupt()
+	a.Wait()
+	a.DB.Close()
+}
@@ -0,0 +1,171 @@
+package app
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"nano-banana-qwen/internal/config"
+	"nano-banana-qwen/internal/models"
+	"nano-banana-qwen/internal/repository"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func newTestApp(t *testing.T) *App {
+	t.Helper()
+
+	dir := t.TempDir()
+	a, err := NewInMemory(&config.Config{
+		ImageProvider:            "mock",
+		UploadPath:               dir,
+		GeneratedPath:            dir,
+		ThumbnailPath:            dir,
+		TempPath:                 dir,
+		DefaultImageSize:         "256x256",
+		DefaultImageQuality:      "standard",
+		MaxConcurrentGenerations: 2,
+		WorkerID:                 t.Name(),
+		JobLeaseTimeout:          60,
+		JobMaxAttempts:           5,
+	})
+	if err != nil {
+		t.Fatalf("创建应用失败: %v", err)
+	}
+	t.Cleanup(a.Close)
+	return a
+}
+
+func TestInstancesAreIsolated(t *testing.T) {
+	first := newTestApp(t)
+	second := newTestApp(t)
+	ctx := context.Background()
+
+	job := models.BatchJob{
+		ID:          primitive.NewObjectID(),
+		Name:        "isolated",
+		Prompts:     []models.BatchPrompt{{PromptText: "a red fox", Count: 2}},
+		TotalImages: 2,
+		Status:      "pending",
+		CreatedAt:   time.Now(),
+	}
+	if err := first.Repos().BatchJobs.Create(ctx, &job); err != nil {
+		t.Fatalf("保存批量任务失败: %v", err)
+	}
+	if err := first.Queue.AddBatchJob(&job); err != nil {
+		t.Fatalf("任务入队失败: %v", err)
+	}
+
+	first.Start(ctx)
+	second.Start(ctx)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		stored, err := first.Repos().BatchJobs.GetByID(ctx, job.ID)
+		if err != nil {
+			t.Fatalf("读取批量任务失败: %v", err)
+		}
+		if stored.Status == "completed" {
+			if stored.CompletedImages != 2 {
+				t.Errorf("completed_images = %d, 期望 2", stored.CompletedImages)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("批量任务未在期限内完成, 状态 = %s", stored.Status)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// 第二个实例既看不到任务，也没有处理任何生成
+	if _, err := second.Repos().BatchJobs.GetByID(ctx, job.ID); err != repository.ErrNotFound {
+		t.Errorf("第二个实例读取任务: err = %v, 期望 ErrNotFound", err)
+	}
+	_, total, err := second.Repos().Generations.List(ctx, repository.GenerationFilter{}, repository.Page{Page: 1, PageSize: 10})
+	if err != nil || total != 0 {
+		t.Errorf("第二个实例生成记录数 = %d, err = %v", total, err)
+	}
+	if _, err := second.Queue.GetJobStatus(job.ID.Hex()); err == nil {
+		t.Error("第二个实例的队列中不应存在该任务状态")
+	}
+}
+
+func TestEmbeddedRestartRestoresQueue(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &config.Config{
+		StorageMode:         "embedded",
+		EmbeddedDBPath:      filepath.Join(dir, "test.db"),
+		ImageProvider:       "mock",
+		UploadPath:          dir,
+		GeneratedPath:       dir,
+		ThumbnailPath:       dir,
+		TempPath:            dir,
+		DefaultImageSize:    "256x256",
+		DefaultImageQuality: "standard",
+		JobLeaseTimeout:     60,
+		JobMaxAttempts:      5,
+	}
+	ctx := context.Background()
+
+	first, err := New(cfg)
+	if err != nil {
+		t.Fatalf("创建应用失败: %v", err)
+	}
+	repos := first.Repos()
+	job := models.BatchJob{
+		ID:          primitive.NewObjectID(),
+		Prompts:     []models.BatchPrompt{{PromptText: "a red fox", Count: 3, Completed: 1}},
+		TotalImages: 3,
+		Status:      "processing",
+		CreatedAt:   time.Now(),
+	}
+	paused := models.BatchJob{
+		ID:          primitive.NewObjectID(),
+		Prompts:     []models.BatchPrompt{{PromptText: "a blue fox", Count: 1}},
+		TotalImages: 1,
+		Status:      "paused",
+		CreatedAt:   time.Now(),
+	}
+	async := models.Generation{ID: primitive.NewObjectID(), PromptText: "a green fox", Status: "pending", CreatedAt: time.Now()}
+	inFlight := models.Generation{ID: primitive.NewObjectID(), PromptText: "a red fox", Status: "processing", BatchJobID: &job.ID, CreatedAt: time.Now()}
+	done := models.Generation{ID: primitive.NewObjectID(), PromptText: "a red fox", Status: "completed", CreatedAt: time.Now()}
+	for _, j := range []*models.BatchJob{&job, &paused} {
+		if err := repos.BatchJobs.Create(ctx, j); err != nil {
+			t.Fatalf("保存批量任务失败: %v", err)
+		}
+	}
+	for _, g := range []*models.Generation{&async, &inFlight, &done} {
+		if err := repos.Generations.Create(ctx, g); err != nil {
+			t.Fatalf("保存生成记录失败: %v", err)
+		}
+	}
+	first.Close()
+
+	// 重启后进程内队列为空，按存储中未结束的任务重建
+	second, err := New(cfg)
+	if err != nil {
+		t.Fatalf("重启应用失败: %v", err)
+	}
+	defer second.Close()
+
+	pending, err := second.Queue.ListPendingJobs()
+	if err != nil || len(pending) != 1 || pending[0].JobID != job.ID.Hex() || pending[0].PendingTasks != 2 {
+		t.Fatalf("恢复的批量任务 = %+v, %v", pending, err)
+	}
+	if status, err := second.Queue.GetJobStatus(job.ID.Hex()); err != nil || status.Status != "processing" {
+		t.Errorf("恢复后队列状态 = %+v, %v, 期望 processing", status, err)
+	}
+	if !second.Queue.IsJobPaused(paused.ID.Hex()) {
+		t.Error("暂停的任务恢复后应保持暂停")
+	}
+	if id, err := second.Queue.GetNextGeneration(); err != nil || id != async.ID.Hex() {
+		t.Errorf("恢复的异步生成 = %q, %v", id, err)
+	}
+	if id, _ := second.Queue.GetNextGeneration(); id != "" {
+		t.Errorf("多余的异步生成 = %q", id)
+	}
+	if stored, err := second.Repos().Generations.GetByID(ctx, inFlight.ID); err != nil || stored.Status != "interrupted" {
+		t.Errorf("批量任务遗留的生成记录 = %+v, %v", stored, err)
+	}
+}
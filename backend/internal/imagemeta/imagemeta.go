@@ -0,0 +1,95 @@
+// Package imagemeta 在图片文件中读写生成信息：PNG 使用 tEXt/iTXt 文本块，JPEG 使用 EXIF 和 XMP
+package imagemeta
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+
+	"nano-banana-qwen/internal/models"
+)
+
+// Software 写入文件的生成软件名称
+const Software = "nano-banana-qwen"
+
+var (
+	// ErrUnsupportedFormat 不支持写入或读取生成信息的图片格式
+	ErrUnsupportedFormat = errors.New("该图片格式不支持生成信息")
+	// ErrNoMetadata 图片中没有生成信息
+	ErrNoMetadata = errors.New("图片中没有生成信息")
+	// ErrMalformed 图片结构损坏，无法解析
+	ErrMalformed = errors.New("图片结构损坏")
+)
+
+var (
+	pngSignature = []byte("\x89PNG\r\n\x1a\n")
+	jpegSOI      = []byte{0xFF, 0xD8}
+)
+
+// field 一项生成信息及其在PNG文本块和XMP中的名称
+type field struct {
+	pngKeyword string
+	xmpName    string
+	get        func(meta *models.ImageMetadata) string
+	set        func(meta *models.ImageMetadata, value string)
+}
+
+// fields 除提示词外的生成信息，提示词写入 PNG 的 Description 和 XMP 的 dc:description
+var fields = []field{
+	{"Generation ID", "GenerationID",
+		func(m *models.ImageMetadata) string { return m.GenerationID },
+		func(m *models.ImageMetadata, v string) { m.GenerationID = v }},
+	{"Provider", "Provider",
+		func(m *models.ImageMetadata) string { return m.Params.Provider },
+		func(m *models.ImageMetadata, v string) { m.Params.Provider = v }},
+	{"Model", "Model",
+		func(m *models.ImageMetadata) string { return m.Params.Model },
+		func(m *models.ImageMetadata, v string) { m.Params.Model = v }},
+	{"Size", "Size",
+		func(m *models.ImageMetadata) string { return m.Params.Size },
+		func(m *models.ImageMetadata, v string) { m.Params.Size = v }},
+	{"Quality", "Quality",
+		func(m *models.ImageMetadata) string { return m.Params.Quality },
+		func(m *models.ImageMetadata, v string) { m.Params.Quality = v }},
+	{"Strength", "Strength",
+		func(m *models.ImageMetadata) string {
+			if m.Params.Strength == 0 {
+				return ""
+			}
+			return strconv.FormatFloat(m.Params.Strength, 'f', -1, 64)
+		},
+		func(m *models.ImageMetadata, v string) {
+			if strength, err := strconv.ParseFloat(v, 64); err == nil {
+				m.Params.Strength = strength
+			}
+		}},
+}
+
+// Embed 将生成信息写入图片文件，原有的同名信息会被替换，不修改 data
+func Embed(data []byte, meta *models.ImageMetadata) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(data, pngSignature):
+		return embedPNG(data, meta)
+	case bytes.HasPrefix(data, jpegSOI):
+		return embedJPEG(data, meta)
+	default:
+		return nil, ErrUnsupportedFormat
+	}
+}
+
+// Extract 读取 Embed 写入的生成信息，没有时返回 ErrNoMetadata
+func Extract(data []byte) (*models.ImageMetadata, error) {
+	switch {
+	case bytes.HasPrefix(data, pngSignature):
+		return extractPNG(data)
+	case bytes.HasPrefix(data, jpegSOI):
+		return extractJPEG(data)
+	default:
+		return nil, ErrUnsupportedFormat
+	}
+}
+
+// empty 判断是否没有读到任何生成信息
+func empty(meta *models.ImageMetadata) bool {
+	return *meta == models.ImageMetadata{}
+}
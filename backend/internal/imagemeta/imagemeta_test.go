@@ -0,0 +1,104 @@
+package imagemeta
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"nano-banana-qwen/internal/models"
+)
+
+func testMetadata() *models.ImageMetadata {
+	return &models.ImageMetadata{
+		GenerationID: "66f1c2aa0000000000000001",
+		Prompt:       "一只戴帽子的猫 <cat & \"hat\">",
+		Params: models.GenerationParams{
+			Provider: "mock",
+			Model:    "mock-v1",
+			Size:     "256x256",
+			Quality:  "hd",
+			Strength: 0.65,
+		},
+	}
+}
+
+func TestEmbedAndExtract(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 16, 8))
+
+	var pngData, jpegData bytes.Buffer
+	png.Encode(&pngData, img)
+	jpeg.Encode(&jpegData, img, nil)
+
+	decoders := map[string]func([]byte) error{
+		"png": func(data []byte) error {
+			_, err := png.Decode(bytes.NewReader(data))
+			return err
+		},
+		"jpeg": func(data []byte) error {
+			_, err := jpeg.Decode(bytes.NewReader(data))
+			return err
+		},
+	}
+
+	for name, data := range map[string][]byte{"png": pngData.Bytes(), "jpeg": jpegData.Bytes()} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := Extract(data); !errors.Is(err, ErrNoMetadata) {
+				t.Fatalf("原图 Extract err = %v, 期望 ErrNoMetadata", err)
+			}
+
+			// 写入后图片仍可解码，信息完整读回
+			embedded, err := Embed(data, testMetadata())
+			if err != nil {
+				t.Fatalf("Embed: %v", err)
+			}
+			if err := decoders[name](embedded); err != nil {
+				t.Fatalf("写入后无法解码: %v", err)
+			}
+			meta, err := Extract(embedded)
+			if err != nil || *meta != *testMetadata() {
+				t.Fatalf("Extract = %+v, err = %v", meta, err)
+			}
+
+			// 再次写入替换原有信息而不是追加
+			updated := &models.ImageMetadata{Prompt: "a dog", Params: models.GenerationParams{Model: "other"}}
+			reembedded, err := Embed(embedded, updated)
+			if err != nil {
+				t.Fatalf("再次 Embed: %v", err)
+			}
+			meta, err = Extract(reembedded)
+			if err != nil || *meta != *updated {
+				t.Errorf("再次写入后 Extract = %+v, err = %v", meta, err)
+			}
+			if len(reembedded) >= len(embedded) {
+				t.Errorf("再次写入后文件变大: %d -> %d", len(embedded), len(reembedded))
+			}
+		})
+	}
+
+	if _, err := Embed([]byte("GIF89a..."), testMetadata()); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("GIF Embed err = %v, 期望 ErrUnsupportedFormat", err)
+	}
+	if _, err := Extract(append([]byte(nil), pngData.Bytes()[:20]...)); !errors.Is(err, ErrMalformed) {
+		t.Errorf("截断的PNG Extract err = %v, 期望 ErrMalformed", err)
+	}
+}
+
+func TestExtractEXIFOnly(t *testing.T) {
+	var data bytes.Buffer
+	jpeg.Encode(&data, image.NewGray(image.Rect(0, 0, 8, 8)), nil)
+
+	// 只保留EXIF时仍能恢复提示词
+	exif := buildEXIF(&models.ImageMetadata{Prompt: "sunset over the sea"})
+	var buf bytes.Buffer
+	buf.Write(jpegSOI)
+	writeJPEGSegment(&buf, jpegSegment{marker: jpegAPP1, payload: exif})
+	buf.Write(data.Bytes()[len(jpegSOI):])
+
+	meta, err := Extract(buf.Bytes())
+	if err != nil || meta.Prompt != "sunset over the sea" || meta.Params != (models.GenerationParams{}) {
+		t.Errorf("Extract = %+v, err = %v", meta, err)
+	}
+}
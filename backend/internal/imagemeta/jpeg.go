@@ -0,0 +1,314 @@
+package imagemeta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"strings"
+
+	"nano-banana-qwen/internal/models"
+)
+
+const (
+	jpegAPP0 = 0xE0
+	jpegAPP1 = 0xE1
+	jpegSOS  = 0xDA
+	jpegEOI  = 0xD9
+
+	// maxSegmentPayload JPEG段的最大内容长度（长度字段为16位且包含自身）
+	maxSegmentPayload = 0xFFFF - 2
+
+	// xmpNamespace 自定义XMP属性的命名空间
+	xmpNamespace = "http://nano-banana-qwen/ns/1.0/"
+
+	exifImageDescription = 0x010E
+	exifSoftware         = 0x0131
+)
+
+var (
+	exifHeader = []byte("Exif\x00\x00")
+	xmpHeader  = []byte("http://ns.adobe.com/xap/1.0/\x00")
+)
+
+// jpegSegment SOS之前的JPEG段，payload 不含标记和长度
+type jpegSegment struct {
+	marker  byte
+	payload []byte
+}
+
+// readJPEGSegments 拆分SOS之前的段，tail 为从SOS开始的剩余数据
+func readJPEGSegments(data []byte) (segments []jpegSegment, tail []byte, err error) {
+	pos := len(jpegSOI)
+	for {
+		if pos+2 > len(data) || data[pos] != 0xFF {
+			return nil, nil, fmt.Errorf("%w: JPEG段标记无效", ErrMalformed)
+		}
+		marker := data[pos+1]
+		switch {
+		case marker == 0xFF:
+			pos++ // 填充字节
+			continue
+		case marker == jpegSOS || marker == jpegEOI:
+			return segments, data[pos:], nil
+		case marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7):
+			segments = append(segments, jpegSegment{marker: marker})
+			pos += 2
+			continue
+		}
+
+		if pos+4 > len(data) {
+			return nil, nil, fmt.Errorf("%w: JPEG段不完整", ErrMalformed)
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2 : pos+4]))
+		if length < 2 || pos+2+length > len(data) {
+			return nil, nil, fmt.Errorf("%w: JPEG段长度越界", ErrMalformed)
+		}
+		segments = append(segments, jpegSegment{marker: marker, payload: data[pos+4 : pos+2+length]})
+		pos += 2 + length
+	}
+}
+
+// writeJPEGSegment 写入一个段
+func writeJPEGSegment(buf *bytes.Buffer, segment jpegSegment) {
+	buf.Write([]byte{0xFF, segment.marker})
+	if segment.marker == 0x01 || (segment.marker >= 0xD0 && segment.marker <= 0xD7) {
+		return
+	}
+	binary.Write(buf, binary.BigEndian, uint16(len(segment.payload)+2))
+	buf.Write(segment.payload)
+}
+
+func embedJPEG(data []byte, meta *models.ImageMetadata) ([]byte, error) {
+	segments, tail, err := readJPEGSegments(data)
+	if err != nil {
+		return nil, err
+	}
+
+	exif := buildEXIF(meta)
+	xmp := buildXMP(meta)
+	if len(exif) > maxSegmentPayload || len(xmp) > maxSegmentPayload {
+		return nil, fmt.Errorf("生成信息过长，无法写入JPEG")
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(len(data) + len(exif) + len(xmp) + 8)
+	buf.Write(jpegSOI)
+
+	// JFIF 要求 APP0 在最前，EXIF 和 XMP 紧随其后；原有的 EXIF 和 XMP 被替换
+	inserted := false
+	for _, segment := range segments {
+		if segment.marker == jpegAPP1 && (bytes.HasPrefix(segment.payload, exifHeader) || bytes.HasPrefix(segment.payload, xmpHeader)) {
+			continue
+		}
+		if !inserted && segment.marker != jpegAPP0 {
+			writeJPEGSegment(&buf, jpegSegment{marker: jpegAPP1, payload: exif})
+			writeJPEGSegment(&buf, jpegSegment{marker: jpegAPP1, payload: xmp})
+			inserted = true
+		}
+		writeJPEGSegment(&buf, segment)
+	}
+	if !inserted {
+		writeJPEGSegment(&buf, jpegSegment{marker: jpegAPP1, payload: exif})
+		writeJPEGSegment(&buf, jpegSegment{marker: jpegAPP1, payload: xmp})
+	}
+	buf.Write(tail)
+
+	return buf.Bytes(), nil
+}
+
+func extractJPEG(data []byte) (*models.ImageMetadata, error) {
+	segments, _, err := readJPEGSegments(data)
+	if err != nil {
+		return nil, err
+	}
+
+	// 优先读取完整的XMP，只有EXIF时至少恢复提示词
+	meta := &models.ImageMetadata{}
+	for _, segment := range segments {
+		if segment.marker == jpegAPP1 && bytes.HasPrefix(segment.payload, xmpHeader) {
+			if parsed, err := parseXMP(segment.payload[len(xmpHeader):]); err == nil && !empty(parsed) {
+				return parsed, nil
+			}
+		}
+	}
+	for _, segment := range segments {
+		if segment.marker == jpegAPP1 && bytes.HasPrefix(segment.payload, exifHeader) {
+			meta.Prompt = parseEXIFDescription(segment.payload[len(exifHeader):])
+		}
+	}
+
+	if empty(meta) {
+		return nil, ErrNoMetadata
+	}
+	return meta, nil
+}
+
+// buildEXIF 生成只含 IFD0 的EXIF：ImageDescription 为提示词（UTF-8），Software 为本软件
+func buildEXIF(meta *models.ImageMetadata) []byte {
+	type entry struct {
+		tag   uint16
+		value string
+	}
+	var entries []entry
+	if meta.Prompt != "" {
+		entries = append(entries, entry{exifImageDescription, meta.Prompt})
+	}
+	entries = append(entries, entry{exifSoftware, Software})
+
+	var ifd, values bytes.Buffer
+	valueOffset := uint32(8 + 2 + 12*len(entries) + 4)
+	binary.Write(&ifd, binary.BigEndian, uint16(len(entries)))
+	for _, e := range entries {
+		value := append([]byte(e.value), 0)
+		binary.Write(&ifd, binary.BigEndian, e.tag)
+		binary.Write(&ifd, binary.BigEndian, uint16(2)) // ASCII
+		binary.Write(&ifd, binary.BigEndian, uint32(len(value)))
+		if len(value) <= 4 {
+			ifd.Write(append(value, make([]byte, 4-len(value))...))
+			continue
+		}
+		binary.Write(&ifd, binary.BigEndian, valueOffset+uint32(values.Len()))
+		values.Write(value)
+		if values.Len()%2 == 1 {
+			values.WriteByte(0)
+		}
+	}
+	binary.Write(&ifd, binary.BigEndian, uint32(0)) // 没有下一个IFD
+
+	var buf bytes.Buffer
+	buf.Write(exifHeader)
+	buf.Write([]byte{'M', 'M', 0x00, 0x2A, 0x00, 0x00, 0x00, 0x08})
+	buf.Write(ifd.Bytes())
+	buf.Write(values.Bytes())
+	return buf.Bytes()
+}
+
+// parseEXIFDescription 从EXIF的 IFD0 读取 ImageDescription，解析失败时返回空字符串
+func parseEXIFDescription(tiff []byte) string {
+	if len(tiff) < 8 {
+		return ""
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "MM":
+		order = binary.BigEndian
+	case "II":
+		order = binary.LittleEndian
+	default:
+		return ""
+	}
+
+	offset := int(order.Uint32(tiff[4:8]))
+	if offset+2 > len(tiff) {
+		return ""
+	}
+	count := int(order.Uint16(tiff[offset : offset+2]))
+	for i := 0; i < count; i++ {
+		start := offset + 2 + 12*i
+		if start+12 > len(tiff) {
+			return ""
+		}
+		entry := tiff[start : start+12]
+		if order.Uint16(entry[0:2]) != exifImageDescription || order.Uint16(entry[2:4]) != 2 {
+			continue
+		}
+
+		size := int(order.Uint32(entry[4:8]))
+		value := entry[8:12]
+		if size > 4 {
+			valueOffset := int(order.Uint32(entry[8:12]))
+			if valueOffset+size > len(tiff) {
+				return ""
+			}
+			value = tiff[valueOffset : valueOffset+size]
+		} else {
+			value = value[:size]
+		}
+		return strings.TrimRight(string(value), "\x00")
+	}
+	return ""
+}
+
+// buildXMP 生成XMP：提示词写入 dc:description，其余信息为自定义命名空间的属性
+func buildXMP(meta *models.ImageMetadata) []byte {
+	var attrs strings.Builder
+	for _, f := range fields {
+		if value := f.get(meta); value != "" {
+			fmt.Fprintf(&attrs, "\n    nb:%s=\"%s\"", f.xmpName, xmlEscape(value))
+		}
+	}
+
+	var description string
+	if meta.Prompt != "" {
+		description = fmt.Sprintf("\n   <dc:description><rdf:Alt><rdf:li xml:lang=\"x-default\">%s</rdf:li></rdf:Alt></dc:description>", xmlEscape(meta.Prompt))
+	}
+
+	var buf bytes.Buffer
+	buf.Write(xmpHeader)
+	fmt.Fprintf(&buf, `<?xpacket begin="%s" id="W5M0MpCehiHzreSzNTczkc9d"?>
+<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about=""
+    xmlns:dc="http://purl.org/dc/elements/1.1/"
+    xmlns:xmp="http://ns.adobe.com/xap/1.0/"
+    xmlns:nb="%s"
+    xmp:CreatorTool="%s"%s>%s
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>
+<?xpacket end="w"?>`, "\ufeff", xmpNamespace, Software, attrs.String(), description)
+	return buf.Bytes()
+}
+
+// xmpDescription rdf:Description 元素，自定义信息可能是属性，也可能被其他工具改写为子元素
+type xmpDescription struct {
+	Attrs       []xml.Attr `xml:",any,attr"`
+	Description []string   `xml:"description>Alt>li"`
+	Elements    []struct {
+		XMLName xml.Name
+		Value   string `xml:",chardata"`
+	} `xml:",any"`
+}
+
+// parseXMP 从XMP读取生成信息
+func parseXMP(packet []byte) (*models.ImageMetadata, error) {
+	var doc struct {
+		Descriptions []xmpDescription `xml:"RDF>Description"`
+	}
+	if err := xml.Unmarshal(packet, &doc); err != nil {
+		return nil, fmt.Errorf("%w: XMP解析失败: %v", ErrMalformed, err)
+	}
+
+	values := make(map[string]string)
+	meta := &models.ImageMetadata{}
+	for _, d := range doc.Descriptions {
+		for _, attr := range d.Attrs {
+			if attr.Name.Space == xmpNamespace {
+				values[attr.Name.Local] = attr.Value
+			}
+		}
+		for _, element := range d.Elements {
+			if element.XMLName.Space == xmpNamespace {
+				values[element.XMLName.Local] = strings.TrimSpace(element.Value)
+			}
+		}
+		if len(d.Description) > 0 && meta.Prompt == "" {
+			meta.Prompt = d.Description[0]
+		}
+	}
+
+	for _, f := range fields {
+		if value, ok := values[f.xmpName]; ok {
+			f.set(meta, value)
+		}
+	}
+	return meta, nil
+}
+
+// xmlEscape 转义XML文本和属性值
+func xmlEscape(s string) string {
+	var buf strings.Builder
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
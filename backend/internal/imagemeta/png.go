@@ -0,0 +1,171 @@
+package imagemeta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+
+	"nano-banana-qwen/internal/models"
+)
+
+// pngDescription 提示词使用的PNG标准关键字
+const pngDescription = "Description"
+
+// pngChunk PNG数据块
+type pngChunk struct {
+	typ  string
+	data []byte
+}
+
+// readPNGChunks 拆分PNG数据块，不校验CRC
+func readPNGChunks(data []byte) ([]pngChunk, error) {
+	var chunks []pngChunk
+	rest := data[len(pngSignature):]
+	for len(rest) > 0 {
+		if len(rest) < 12 {
+			return nil, fmt.Errorf("%w: PNG数据块不完整", ErrMalformed)
+		}
+		length := binary.BigEndian.Uint32(rest[:4])
+		if uint64(length)+12 > uint64(len(rest)) {
+			return nil, fmt.Errorf("%w: PNG数据块长度越界", ErrMalformed)
+		}
+		chunks = append(chunks, pngChunk{typ: string(rest[4:8]), data: rest[8 : 8+length]})
+		rest = rest[12+length:]
+	}
+	if len(chunks) == 0 || chunks[0].typ != "IHDR" {
+		return nil, fmt.Errorf("%w: 缺少IHDR", ErrMalformed)
+	}
+	return chunks, nil
+}
+
+// writePNGChunk 写入一个带CRC的数据块
+func writePNGChunk(buf *bytes.Buffer, typ string, data []byte) {
+	binary.Write(buf, binary.BigEndian, uint32(len(data)))
+	buf.WriteString(typ)
+	buf.Write(data)
+
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(typ))
+	crc.Write(data)
+	binary.Write(buf, binary.BigEndian, crc.Sum32())
+}
+
+// pngText 解析 tEXt/iTXt 数据块，返回关键字和文本；压缩的 iTXt 不处理
+func pngText(chunk pngChunk) (keyword, text string, ok bool) {
+	keywordBytes, rest, found := bytes.Cut(chunk.data, []byte{0})
+	if !found {
+		return "", "", false
+	}
+
+	switch chunk.typ {
+	case "tEXt":
+		// tEXt 为 Latin-1 编码
+		runes := make([]rune, len(rest))
+		for i, b := range rest {
+			runes[i] = rune(b)
+		}
+		return string(keywordBytes), string(runes), true
+	case "iTXt":
+		if len(rest) < 2 || rest[0] != 0 {
+			return "", "", false
+		}
+		rest = rest[2:]
+		// 跳过语言标签和翻译后的关键字
+		for i := 0; i < 2; i++ {
+			_, after, found := bytes.Cut(rest, []byte{0})
+			if !found {
+				return "", "", false
+			}
+			rest = after
+		}
+		return string(keywordBytes), string(rest), true
+	}
+	return "", "", false
+}
+
+// pngTextChunk 生成文本块，纯ASCII时用 tEXt，否则用UTF-8的 iTXt
+func pngTextChunk(keyword, text string) pngChunk {
+	ascii := true
+	for i := 0; i < len(text) && ascii; i++ {
+		ascii = text[i] < 0x80
+	}
+
+	var data bytes.Buffer
+	data.WriteString(keyword)
+	data.WriteByte(0)
+	if ascii {
+		data.WriteString(text)
+		return pngChunk{typ: "tEXt", data: data.Bytes()}
+	}
+
+	// 未压缩，语言标签和翻译关键字为空
+	data.Write([]byte{0, 0, 0, 0})
+	data.WriteString(text)
+	return pngChunk{typ: "iTXt", data: data.Bytes()}
+}
+
+func embedPNG(data []byte, meta *models.ImageMetadata) ([]byte, error) {
+	chunks, err := readPNGChunks(data)
+	if err != nil {
+		return nil, err
+	}
+
+	owned := map[string]bool{pngDescription: true, "Software": true}
+	for _, f := range fields {
+		owned[f.pngKeyword] = true
+	}
+
+	var text []pngChunk
+	if meta.Prompt != "" {
+		text = append(text, pngTextChunk(pngDescription, meta.Prompt))
+	}
+	for _, f := range fields {
+		if value := f.get(meta); value != "" {
+			text = append(text, pngTextChunk(f.pngKeyword, value))
+		}
+	}
+	text = append(text, pngTextChunk("Software", Software))
+
+	var buf bytes.Buffer
+	buf.Grow(len(data) + 512)
+	buf.Write(pngSignature)
+	for i, chunk := range chunks {
+		if keyword, _, ok := pngText(chunk); ok && owned[keyword] {
+			continue
+		}
+		writePNGChunk(&buf, chunk.typ, chunk.data)
+		// 文本块紧跟在IHDR之后，读取方不必扫描整个图像数据
+		if i == 0 {
+			for _, t := range text {
+				writePNGChunk(&buf, t.typ, t.data)
+			}
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func extractPNG(data []byte) (*models.ImageMetadata, error) {
+	chunks, err := readPNGChunks(data)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string)
+	for _, chunk := range chunks {
+		if keyword, text, ok := pngText(chunk); ok {
+			values[keyword] = text
+		}
+	}
+
+	meta := &models.ImageMetadata{Prompt: values[pngDescription]}
+	for _, f := range fields {
+		if value, ok := values[f.pngKeyword]; ok {
+			f.set(meta, value)
+		}
+	}
+	if empty(meta) {
+		return nil, ErrNoMetadata
+	}
+	return meta, nil
+}
@@ -5,6 +5,12 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+// 批量任务优先级范围，默认为0，同一优先级内先入队的先处理
+const (
+	MinPriority = -10
+	MaxPriority = 10
+)
+
 // BatchJob 批量任务模型
 type BatchJob struct {
 	ID              primitive.ObjectID `json:"id" bson:"_id,omitempty"`
@@ -13,10 +19,13 @@ type BatchJob struct {
 	TotalImages     int               `json:"total_images" bson:"total_images"`
 	CompletedImages int               `json:"completed_images" bson:"completed_images"`
 	FailedImages    int               `json:"failed_images" bson:"failed_images"`
-	Status          string            `json:"status" bson:"status"` // pending, processing, completed, failed, cancelled
+	RecordedTasks   []string          `json:"-" bson:"recorded_tasks,omitempty"` // 已计入结果的图片任务ID，防止重复投递时重复累加
+	Status          string            `json:"status" bson:"status"` // pending, processing, paused, completed, failed, cancelled, interrupted
+	Priority        int               `json:"priority" bson:"priority"` // 优先级，越大越先处理，见 MinPriority/MaxPriority
 	StartedAt       *time.Time        `json:"started_at" bson:"started_at"`
 	CompletedAt     *time.Time        `json:"completed_at" bson:"completed_at"`
 	CreatedAt       time.Time         `json:"created_at" bson:"created_at"`
+	UpdatedAt       time.Time         `json:"updated_at" bson:"updated_at"`
 	Deleted         bool              `json:"deleted" bson:"deleted"`
 	DeletedAt       *time.Time        `json:"deleted_at" bson:"deleted_at"`
 	DeletedReason   string            `json:"deleted_reason" bson:"deleted_reason"`
@@ -77,8 +86,14 @@ type BatchJobStatus struct {
 
 // BatchJobRequest 批量任务请求 (修复命名)
 type BatchJobRequest struct {
-	Name    string        `json:"name"`
-	Prompts []BatchPrompt `json:"prompts" binding:"required,min=1"`
+	Name     string        `json:"name"`
+	Prompts  []BatchPrompt `json:"prompts" binding:"required,min=1"`
+	Priority int           `json:"priority" binding:"min=-10,max=10"`
+}
+
+// UpdateBatchJobRequest 修改批量任务请求
+type UpdateBatchJobRequest struct {
+	Priority *int `json:"priority" binding:"required,min=-10,max=10"`
 }
 
 // JobStatus 任务状态信息
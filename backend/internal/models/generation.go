@@ -12,27 +12,51 @@ type Generation struct {
 	PromptText       string             `json:"prompt_text" bson:"prompt_text"`
 	ImageURL         string             `json:"image_url" bson:"image_url"`
 	ThumbnailURL     string             `json:"thumbnail_url" bson:"thumbnail_url"`
+	ImageURLs        []string           `json:"image_urls,omitempty" bson:"image_urls,omitempty"` // 模型返回多张图片时的全部本地路径
+	ImageID          *primitive.ObjectID `json:"image_id" bson:"image_id"`                        // 主图的图片记录ID
+	ImageIDs         []primitive.ObjectID `json:"image_ids,omitempty" bson:"image_ids,omitempty"` // 全部图片记录ID，与 ImageURLs 一一对应
+	ResponseText     string             `json:"response_text,omitempty" bson:"response_text,omitempty"`
+	Usage            *TokenUsage        `json:"usage,omitempty" bson:"usage,omitempty"`
 	GenerationParams GenerationParams   `json:"generation_params" bson:"generation_params"`
-	Status           string             `json:"status" bson:"status"` // pending, processing, completed, failed
+	Status           string             `json:"status" bson:"status"` // pending, processing, retrying, completed, failed, interrupted
 	ErrorMessage     string             `json:"error_message" bson:"error_message"`
+	Attempts         []GenerationAttempt `json:"attempts,omitempty" bson:"attempts,omitempty"` // 每次失败的调用记录
 	GenerationTime   float64            `json:"generation_time" bson:"generation_time"`
 	BatchJobID       *primitive.ObjectID `json:"batch_job_id" bson:"batch_job_id"`
 	IsImg2Img        bool               `json:"is_img2img" bson:"is_img2img"`
 	SourceImageID    *primitive.ObjectID `json:"source_image_id" bson:"source_image_id"`
 	CreatedAt        time.Time          `json:"created_at" bson:"created_at"`
+	UpdatedAt        time.Time          `json:"updated_at" bson:"updated_at"`
 	Deleted          bool               `json:"deleted" bson:"deleted"`
 	DeletedAt        *time.Time         `json:"deleted_at" bson:"deleted_at"`
 	DeletedReason    string             `json:"deleted_reason" bson:"deleted_reason"`
 }
 
+// GenerationAttempt 一次失败的模型调用
+type GenerationAttempt struct {
+	Error      string     `json:"error" bson:"error"`
+	ErrorKind  string     `json:"error_kind" bson:"error_kind"` // rate_limited, server_error, timeout, network, content_policy, invalid_request, unknown
+	StatusCode int        `json:"status_code,omitempty" bson:"status_code,omitempty"`
+	FailedAt   time.Time  `json:"failed_at" bson:"failed_at"`
+	RetryAt    *time.Time `json:"retry_at,omitempty" bson:"retry_at,omitempty"` // 安排了自动重试时的计划执行时间
+}
+
 // GenerationParams 生成参数
 type GenerationParams struct {
-	Model    string  `json:"model" bson:"model"`
+	Provider string  `json:"provider,omitempty" bson:"provider,omitempty"` // 图片生成服务商，为空时使用默认服务商
+	Model    string  `json:"model" bson:"model"`                           // 模型名称，可用 "provider:model" 同时指定服务商
 	Size     string  `json:"size" bson:"size"`
 	Quality  string  `json:"quality" bson:"quality"`
 	Strength float64 `json:"strength,omitempty" bson:"strength,omitempty"` // 图生图强度
 }
 
+// TokenUsage 模型调用的token用量
+type TokenUsage struct {
+	PromptTokens     int `json:"prompt_tokens" bson:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens" bson:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens" bson:"total_tokens"`
+}
+
 // Text2ImgRequest 文本生成图片请求
 type Text2ImgRequest struct {
 	Prompt string           `json:"prompt" binding:"required"`
@@ -42,10 +66,11 @@ type Text2ImgRequest struct {
 
 // Img2ImgRequest 图片生成图片请求
 type Img2ImgRequest struct {
-	Prompt      string           `json:"prompt" binding:"required"`
-	SourceImage string           `json:"source_image" binding:"required"` // base64编码
-	Count       int              `json:"count"`
-	Params      GenerationParams `json:"params"`
+	Prompt        string           `json:"prompt" binding:"required"`
+	SourceImage   string           `json:"source_image"`    // base64编码，与 source_image_id 二选一
+	SourceImageID string           `json:"source_image_id"` // 已上传或已生成图片的ID
+	Count         int              `json:"count"`
+	Params        GenerationParams `json:"params"`
 }
 
 // GenerationListRequest 生成记录列表请求
@@ -13,19 +13,96 @@ type Image struct {
 	FilePath         string             `json:"file_path" bson:"file_path"`
 	ThumbnailPath    string             `json:"thumbnail_path" bson:"thumbnail_path"`
 	FileSize         int64              `json:"file_size" bson:"file_size"`
+	SHA256           string             `json:"sha256" bson:"sha256"` // 原图内容哈希，相同内容的图片共用同一个文件
+	PHash            string             `json:"phash" bson:"phash"`   // dHash感知哈希（16位十六进制），用于查找近似图片
 	Width            int                `json:"width" bson:"width"`
 	Height           int                `json:"height" bson:"height"`
-	Format           string             `json:"format" bson:"format"`
+	Format           string             `json:"format" bson:"format"` // 按文件内容识别：PNG、JPEG、WEBP
+	Variants         []ImageVariant     `json:"variants" bson:"variants"` // 保持宽高比的衍生图，从小到大，第一张即缩略图
 	GenerationID     *primitive.ObjectID `json:"generation_id" bson:"generation_id"`
 	PromptText       string             `json:"prompt_text" bson:"prompt_text"`
 	IsImg2Img        bool               `json:"is_img2img" bson:"is_img2img"`
 	SourceImageID    *primitive.ObjectID `json:"source_image_id" bson:"source_image_id"`
+	Uploaded         bool               `json:"uploaded" bson:"uploaded"` // 用户上传的图片，可作为图生图的源图片
+	ImportedMetadata *ImageMetadata     `json:"imported_metadata,omitempty" bson:"imported_metadata,omitempty"` // 导入时从文件中读到的生成信息
 	CreatedAt        time.Time          `json:"created_at" bson:"created_at"`
 	Deleted          bool               `json:"deleted" bson:"deleted"`
 	DeletedAt        *time.Time         `json:"deleted_at" bson:"deleted_at"`
 	DeletedReason    string             `json:"deleted_reason" bson:"deleted_reason"`
 }
 
+// ImageMetadata 下载时写入图片文件的生成信息，图片重新导入时据此恢复生成参数
+type ImageMetadata struct {
+	GenerationID string           `json:"generation_id,omitempty" bson:"generation_id,omitempty"`
+	Prompt       string           `json:"prompt" bson:"prompt"`
+	Params       GenerationParams `json:"params" bson:"params"`
+}
+
+// ImageRenderRequest 按需渲染参数，宽高为0表示按另一边等比缩放，都为0时保持原尺寸
+type ImageRenderRequest struct {
+	Width   int    `form:"w"`
+	Height  int    `form:"h"`
+	Fit     string `form:"fit"`    // contain (默认，缩放到框内且不放大)、cover (缩放后居中裁剪为指定尺寸)、fill (拉伸)
+	Format  string `form:"format"` // jpeg、png、webp，默认与原图相同
+	Quality int    `form:"q"`      // JPEG质量 1-100，默认85
+}
+
+// ImageExportRequest 图片导出请求，给出 image_ids 时按ID导出，否则按 filter 过滤
+type ImageExportRequest struct {
+	ImageIDs   []primitive.ObjectID `json:"image_ids"`
+	Filter     *ImageExportFilter   `json:"filter"`
+	Thumbnails bool                 `json:"thumbnails"` // 同时导出缩略图
+}
+
+// ImageExportFilter 图片导出过滤条件
+type ImageExportFilter struct {
+	Prompt       string              `json:"prompt"`
+	GenerationID *primitive.ObjectID `json:"generation_id"`
+	SHA256       string              `json:"sha256"`
+}
+
+// ImageVariant 按长边缩放的衍生图，供前端 srcset 使用
+type ImageVariant struct {
+	Width  int    `json:"width" bson:"width"`
+	Height int    `json:"height" bson:"height"`
+	Format string `json:"format" bson:"format"` // JPEG，带透明通道时为 WEBP
+	Path   string `json:"path" bson:"path"`     // 文件key
+}
+
+// SimilarImage 近似图片及其与参照图片的汉明距离
+type SimilarImage struct {
+	Image    Image `json:"image"`
+	Distance int   `json:"distance"`
+}
+
+// DuplicateGroup 批量任务中一组互为近似的图片，第一张为最早生成的图片，Distance 为与它的距离
+type DuplicateGroup struct {
+	Images []SimilarImage `json:"images"`
+}
+
+// BatchDedupeReport 批量任务内的近似图片报告
+type BatchDedupeReport struct {
+	BatchJobID      primitive.ObjectID `json:"batch_job_id"`
+	MaxDistance     int                `json:"max_distance"`
+	TotalImages     int                `json:"total_images"`
+	DuplicateImages int                `json:"duplicate_images"` // 除每组第一张外被标记为重复的图片数
+	Groups          []DuplicateGroup   `json:"groups"`
+}
+
+// ImageLineageNode 血缘图中的一张图片，附带生成它时使用的参数
+type ImageLineageNode struct {
+	Image            Image               `json:"image"`
+	GenerationParams *GenerationParams   `json:"generation_params,omitempty"` // 上传的图片没有生成参数
+	Distance         int                 `json:"distance"`                    // 与查询图片相隔的图生图步数
+	Children         []*ImageLineageNode `json:"children,omitempty"`          // 以该图片为源图片生成的图片
+}
+
+// ImageLineage 图片血缘：祖先链和后代树
+type ImageLineage struct {
+	Ancestors []ImageLineageNode `json:"ancestors"` // 从直接来源到最初的源图片
+	Root      *ImageLineageNode  `json:"root"`      // 查询的图片，Children 为后代树
+}
+
 // ImageListRequest 图片列表请求
 type ImageListRequest struct {
 	Page      int    `json:"page" form:"page"`
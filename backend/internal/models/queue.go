@@ -1,35 +1,77 @@
 package models
 
-import "time"
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
 
 // QueueStats 队列统计信息
 type QueueStats struct {
 	PendingJobs    int       `json:"pending_jobs"`
 	ProcessingJobs int       `json:"processing_jobs"`
 	FailedJobs     int       `json:"failed_jobs"`
+	DelayedJobs    int       `json:"delayed_jobs"` // 等待自动重试的图片任务
 	CompletedJobs  int       `json:"completed_jobs"`
 	UpdatedAt      time.Time `json:"updated_at"`
 }
 
+// QueueEntry 处理中、延迟或失败队列中的一个图片任务，Task 为空表示旧版本留下的批量任务ID或任务内容已删除
+type QueueEntry struct {
+	ID             string          `json:"id"`
+	Task           *GenerationTask `json:"task,omitempty"`
+	Owner          string          `json:"owner,omitempty"`            // 处理中任务所属的工作节点
+	LeaseExpiresAt *time.Time      `json:"lease_expires_at,omitempty"` // 处理中任务的租约到期时间
+	Deliveries     int             `json:"deliveries,omitempty"`       // 本轮被领取的次数
+}
+
+// QueueEntryListResponse 失败队列分页响应
+type QueueEntryListResponse struct {
+	Entries    []QueueEntry `json:"entries"`
+	Total      int64        `json:"total"`
+	Page       int          `json:"page"`
+	PageSize   int          `json:"page_size"`
+	TotalPages int          `json:"total_pages"`
+}
+
+// QueueRetryResult 批量重试失败队列的结果
+type QueueRetryResult struct {
+	Retried int `json:"retried"`
+	Skipped int `json:"skipped"` // 批量任务已取消或删除、无法重试而保留在失败队列中的数量
+}
+
+// PendingJobEntry generation_queue 中的一个批量任务，按领取顺序排列
+type PendingJobEntry struct {
+	JobID        string   `json:"job_id"`
+	Priority     int      `json:"priority"`
+	PendingTasks int      `json:"pending_tasks"`
+	TaskIDs      []string `json:"task_ids"` // 最先领取的至多100个图片任务ID
+}
+
 // QueueJob 队列任务
 type QueueJob struct {
 	ID        string                 `json:"id"`
 	Type      string                 `json:"type"` // single, batch
 	Priority  int                    `json:"priority"`
 	Data      map[string]interface{} `json:"data"`
-	CreatedAt time.Time             `json:"created_at"`
-	UpdatedAt time.Time             `json:"updated_at"`
+	CreatedAt time.Time              `json:"created_at"`
+	UpdatedAt time.Time              `json:"updated_at"`
 }
 
-// GenerationTask 生成任务
+// GenerationTask 生成任务，批量任务中的每张图片对应一个任务，ID 即生成记录ID
 type GenerationTask struct {
-	ID         string           `json:"id"`
-	JobID      string           `json:"job_id"`
-	Prompt     string           `json:"prompt"`
-	IsImg2Img  bool             `json:"is_img2img"`
-	SourceImg  string           `json:"source_img,omitempty"`
-	Params     GenerationParams `json:"params"`
-	Status     string           `json:"status"`
-	RetryCount int              `json:"retry_count"`
-	CreatedAt  time.Time        `json:"created_at"`
-}
\ No newline at end of file
+	ID          string              `json:"id"`
+	JobID       string              `json:"job_id"`
+	PromptID    *primitive.ObjectID `json:"prompt_id,omitempty"`
+	PromptIndex int                 `json:"prompt_index"` // 在 BatchJob.Prompts 中的下标
+	Prompt      string              `json:"prompt"`
+	IsImg2Img   bool                `json:"is_img2img"`
+	SourceImg   string              `json:"source_img,omitempty"`
+	Params      GenerationParams    `json:"params"`
+	Status      string              `json:"status"`
+	RetryCount  int                 `json:"retry_count"` // 手动重试次数
+	Attempts    int                 `json:"attempts"`    // 本轮失败的生成次数，手动重试时清零
+	LastError   string              `json:"last_error,omitempty"`
+	RetryAt     *time.Time          `json:"retry_at,omitempty"` // 等待自动重试时的计划执行时间
+	CreatedAt   time.Time           `json:"created_at"`
+}
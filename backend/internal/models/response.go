@@ -32,18 +32,36 @@ func ErrorResponse(error string, message string) APIResponse {
 	}
 }
 
-// OpenRouterRequest OpenRouter API请求格式
+// OpenRouterRequest OpenRouter Chat Completions 请求格式
 type OpenRouterRequest struct {
-	Model  string                 `json:"model"`
-	Prompt string                 `json:"prompt"`
-	Images []OpenRouterImage      `json:"images,omitempty"` // 图生图
-	Extra  map[string]interface{} `json:"extra,omitempty"`
+	Model       string                 `json:"model"`
+	Messages    []OpenRouterMessage    `json:"messages"`
+	Modalities  []string               `json:"modalities,omitempty"`   // ["image", "text"]
+	ImageConfig *OpenRouterImageConfig `json:"image_config,omitempty"` // 图片输出配置
 }
 
-// OpenRouterImage 图片数据
-type OpenRouterImage struct {
-	Type      string `json:"type"`       // "image_url"
-	ImageURL  string `json:"image_url"`  // data:image/jpeg;base64,xxx
+// OpenRouterImageConfig 图片输出配置
+type OpenRouterImageConfig struct {
+	AspectRatio string `json:"aspect_ratio,omitempty"` // 如 "1:1", "16:9"
+}
+
+// OpenRouterMessage 请求消息
+type OpenRouterMessage struct {
+	Role    string                  `json:"role"`
+	Content []OpenRouterContentItem `json:"content"`
+}
+
+// OpenRouterContentItem 多模态内容项（text 或 image_url）
+type OpenRouterContentItem struct {
+	Type     string              `json:"type"`
+	Text     string              `json:"text,omitempty"`
+	ImageURL *OpenRouterImageURL `json:"image_url,omitempty"`
+}
+
+// OpenRouterImageURL 图片URL
+type OpenRouterImageURL struct {
+	URL    string `json:"url"` // data:image/png;base64,xxx 或 HTTP URL
+	Detail string `json:"detail,omitempty"`
 }
 
 // OpenRouterResponse OpenRouter API响应格式
@@ -59,28 +77,16 @@ type OpenRouterResponse struct {
 
 // OpenRouterChoice 选择项
 type OpenRouterChoice struct {
-	Index        int                    `json:"index"`
-	Message      OpenRouterMessage      `json:"message"`
-	FinishReason string                 `json:"finish_reason"`
+	Index        int                       `json:"index"`
+	Message      OpenRouterResponseMessage `json:"message"`
+	FinishReason string                    `json:"finish_reason"`
 }
 
-// OpenRouterMessage 消息
-type OpenRouterMessage struct {
-	Role    string                   `json:"role"`
-	Content []OpenRouterContentItem  `json:"content"`
-}
-
-// OpenRouterContentItem 内容项
-type OpenRouterContentItem struct {
-	Type     string              `json:"type"`
-	Text     string              `json:"text,omitempty"`
-	ImageURL *OpenRouterImageURL `json:"image_url,omitempty"`
-}
-
-// OpenRouterImageURL 图片URL
-type OpenRouterImageURL struct {
-	URL    string `json:"url"`
-	Detail string `json:"detail,omitempty"`
+// OpenRouterResponseMessage 响应消息，图片在 images 中返回
+type OpenRouterResponseMessage struct {
+	Role    string                  `json:"role"`
+	Content string                  `json:"content"`
+	Images  []OpenRouterContentItem `json:"images,omitempty"`
 }
 
 // OpenRouterUsage 使用情况
@@ -94,5 +100,5 @@ type OpenRouterUsage struct {
 type OpenRouterError struct {
 	Message string `json:"message"`
 	Type    string `json:"type"`
-	Code    string `json:"code"`
-}
\ No newline at end of file
+	Code    int    `json:"code"`
+}
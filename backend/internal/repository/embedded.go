@@ -0,0 +1,197 @@
+package repository
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"go.etcd.io/bbolt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// kvBucket 嵌入式存储中的一个桶，*bbolt.Bucket 直接满足该接口
+type kvBucket interface {
+	Get(key []byte) []byte
+	Put(key, value []byte) error
+	Delete(key []byte) error
+	ForEach(fn func(k, v []byte) error) error
+}
+
+// kvBackend 嵌入式存储的键值后端，Update 之间互斥，保证读改写的原子性
+type kvBackend interface {
+	View(bucket string, fn func(b kvBucket) error) error
+	Update(bucket string, fn func(b kvBucket) error) error
+	Close() error
+}
+
+// boltBackend 基于bbolt文件数据库的键值后端
+type boltBackend struct {
+	db *bbolt.DB
+}
+
+// openBoltBackend 打开（不存在时创建）bbolt数据库文件
+func openBoltBackend(path string, buckets []string) (*boltBackend, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("创建数据目录失败: %v", err)
+	}
+
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("打开嵌入式数据库失败: %v", err)
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range buckets {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("初始化嵌入式数据库失败: %v", err)
+	}
+
+	return &boltBackend{db: db}, nil
+}
+
+func (b *boltBackend) View(bucket string, fn func(b kvBucket) error) error {
+	return b.db.View(func(tx *bbolt.Tx) error {
+		return fn(tx.Bucket([]byte(bucket)))
+	})
+}
+
+func (b *boltBackend) Update(bucket string, fn func(b kvBucket) error) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		return fn(tx.Bucket([]byte(bucket)))
+	})
+}
+
+func (b *boltBackend) Close() error {
+	return b.db.Close()
+}
+
+// embeddedBuckets 嵌入式存储使用的桶，与MongoDB集合同名
+var embeddedBuckets = []string{"prompts", "generations", "batch_jobs", "images", "blob_refs"}
+
+// NewEmbeddedRepositories 创建基于本地bbolt文件的存储，无需MongoDB
+func NewEmbeddedRepositories(path string) (*Repositories, error) {
+	backend, err := openBoltBackend(path, embeddedBuckets)
+	if err != nil {
+		return nil, err
+	}
+
+	return newKVRepositories(backend), nil
+}
+
+// newKVRepositories 在任意键值后端上构建全部存储
+func newKVRepositories(backend kvBackend) *Repositories {
+	return &Repositories{
+		Prompts:     &kvPromptRepository{table: &table{backend: backend, bucket: "prompts"}},
+		Generations: &kvGenerationRepository{table: &table{backend: backend, bucket: "generations"}},
+		BatchJobs:   &kvBatchJobRepository{table: &table{backend: backend, bucket: "batch_jobs"}},
+		Images:      &kvImageRepository{table: &table{backend: backend, bucket: "images"}},
+		BlobRefs:    &kvBlobRefRepository{backend: backend, bucket: "blob_refs"},
+		close:       backend.Close,
+	}
+}
+
+// table 以BSON编码保存文档的桶，键为文档的ObjectID
+type table struct {
+	backend kvBackend
+	bucket  string
+}
+
+// insert 保存新文档
+func (t *table) insert(id primitive.ObjectID, doc interface{}) error {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return fmt.Errorf("编码文档失败: %v", err)
+	}
+
+	return t.backend.Update(t.bucket, func(b kvBucket) error {
+		return b.Put(id[:], data)
+	})
+}
+
+// get 读取文档，不存在时返回 ErrNotFound
+func (t *table) get(id primitive.ObjectID, doc interface{}) error {
+	return t.backend.View(t.bucket, func(b kvBucket) error {
+		data := b.Get(id[:])
+		if data == nil {
+			return ErrNotFound
+		}
+		return bson.Unmarshal(data, doc)
+	})
+}
+
+// update 在一个写事务中读取、修改并写回文档
+// doc 为用于解码的零值指针，fn 返回 ErrNotFound 等错误时放弃写入
+func (t *table) update(id primitive.ObjectID, doc interface{}, fn func() error) error {
+	return t.backend.Update(t.bucket, func(b kvBucket) error {
+		data := b.Get(id[:])
+		if data == nil {
+			return ErrNotFound
+		}
+		if err := bson.Unmarshal(data, doc); err != nil {
+			return err
+		}
+
+		if err := fn(); err != nil {
+			return err
+		}
+
+		updated, err := bson.Marshal(doc)
+		if err != nil {
+			return fmt.Errorf("编码文档失败: %v", err)
+		}
+		return b.Put(id[:], updated)
+	})
+}
+
+// remove 删除文档并解码被删除的内容，不存在时返回 ErrNotFound
+func (t *table) remove(id primitive.ObjectID, doc interface{}) error {
+	return t.backend.Update(t.bucket, func(b kvBucket) error {
+		data := b.Get(id[:])
+		if data == nil {
+			return ErrNotFound
+		}
+		if err := bson.Unmarshal(data, doc); err != nil {
+			return err
+		}
+		return b.Delete(id[:])
+	})
+}
+
+// scan 遍历全部文档，decode 负责解码单条记录
+func (t *table) scan(decode func(data []byte) error) error {
+	return t.backend.View(t.bucket, func(b kvBucket) error {
+		return b.ForEach(func(_, v []byte) error {
+			return decode(v)
+		})
+	})
+}
+
+// paginate 按创建时间倒序排序并截取一页
+func paginate[T any](items []T, createdAt func(*T) time.Time, page Page) ([]T, int64) {
+	sort.SliceStable(items, func(i, j int) bool {
+		return createdAt(&items[i]).After(createdAt(&items[j]))
+	})
+
+	total := int64(len(items))
+	start := page.Skip()
+	if start >= len(items) {
+		return []T{}, total
+	}
+
+	end := len(items)
+	if page.PageSize > 0 && start+page.PageSize < end {
+		end = start + page.PageSize
+	}
+
+	return items[start:end], total
+}
@@ -0,0 +1,581 @@
+package repository
+
+import (
+	"context"
+	"encoding/binary"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"nano-banana-qwen/internal/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// textMatcher 与MongoDB的 {$regex, $options: "i"} 行为一致的匹配器，非法正则退化为子串匹配
+func textMatcher(pattern string) func(string) bool {
+	if pattern == "" {
+		return func(string) bool { return true }
+	}
+
+	if re, err := regexp.Compile("(?i)" + pattern); err == nil {
+		return re.MatchString
+	}
+
+	lower := strings.ToLower(pattern)
+	return func(s string) bool {
+		return strings.Contains(strings.ToLower(s), lower)
+	}
+}
+
+// markDeleted 设置软删除字段
+func markDeleted(deleted *bool, deletedAt **time.Time, deletedReason *string, reason string) error {
+	if *deleted {
+		return ErrNotFound
+	}
+
+	now := time.Now()
+	*deleted = true
+	*deletedAt = &now
+	*deletedReason = reason
+	return nil
+}
+
+type kvPromptRepository struct {
+	table *table
+}
+
+func (r *kvPromptRepository) Create(ctx context.Context, prompt *models.Prompt) error {
+	return r.table.insert(prompt.ID, prompt)
+}
+
+func (r *kvPromptRepository) GetByID(ctx context.Context, id primitive.ObjectID) (*models.Prompt, error) {
+	var prompt models.Prompt
+	if err := r.table.get(id, &prompt); err != nil {
+		return nil, err
+	}
+	if prompt.Deleted {
+		return nil, ErrNotFound
+	}
+	return &prompt, nil
+}
+
+func (r *kvPromptRepository) Update(ctx context.Context, id primitive.ObjectID, req models.UpdatePromptRequest) error {
+	var prompt models.Prompt
+	return r.table.update(id, &prompt, func() error {
+		if prompt.Deleted {
+			return ErrNotFound
+		}
+
+		// 只更新非空字段
+		if req.Title != "" {
+			prompt.Title = req.Title
+		}
+		if req.Content != "" {
+			prompt.Content = req.Content
+		}
+		if req.Category != "" {
+			prompt.Category = req.Category
+		}
+		if req.Tags != nil {
+			prompt.Tags = req.Tags
+		}
+		prompt.IsFavorite = req.IsFavorite
+		prompt.UpdatedAt = time.Now()
+		return nil
+	})
+}
+
+func (r *kvPromptRepository) SoftDelete(ctx context.Context, id primitive.ObjectID, reason string) error {
+	var prompt models.Prompt
+	return r.table.update(id, &prompt, func() error {
+		prompt.UpdatedAt = time.Now()
+		return markDeleted(&prompt.Deleted, &prompt.DeletedAt, &prompt.DeletedReason, reason)
+	})
+}
+
+func (r *kvPromptRepository) List(ctx context.Context, filter PromptFilter, page Page) ([]models.Prompt, int64, error) {
+	matchKeyword := textMatcher(filter.Keyword)
+
+	prompts, err := r.all(func(p *models.Prompt) bool {
+		if filter.Keyword != "" && !matchKeyword(p.Title) && !matchKeyword(p.Content) {
+			return false
+		}
+		if filter.Category != "" && p.Category != filter.Category {
+			return false
+		}
+		if filter.Tag != "" && !containsTag(p.Tags, filter.Tag) {
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	result, total := paginate(prompts, func(p *models.Prompt) time.Time { return p.CreatedAt }, page)
+	return result, total, nil
+}
+
+func (r *kvPromptRepository) IncrementUsage(ctx context.Context, id primitive.ObjectID) error {
+	var prompt models.Prompt
+	err := r.table.update(id, &prompt, func() error {
+		if prompt.Deleted {
+			return ErrNotFound
+		}
+		prompt.UsageCount++
+		prompt.UpdatedAt = time.Now()
+		return nil
+	})
+	if err == ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+func (r *kvPromptRepository) Categories(ctx context.Context) ([]string, error) {
+	prompts, err := r.all(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var values []string
+	for _, prompt := range prompts {
+		values = append(values, prompt.Category)
+	}
+	return uniqueSorted(values), nil
+}
+
+func (r *kvPromptRepository) Tags(ctx context.Context) ([]string, error) {
+	prompts, err := r.all(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var values []string
+	for _, prompt := range prompts {
+		values = append(values, prompt.Tags...)
+	}
+	return uniqueSorted(values), nil
+}
+
+// all 返回满足条件的未删除提示词
+func (r *kvPromptRepository) all(match func(*models.Prompt) bool) ([]models.Prompt, error) {
+	var prompts []models.Prompt
+	err := r.table.scan(func(data []byte) error {
+		var prompt models.Prompt
+		if err := bson.Unmarshal(data, &prompt); err != nil {
+			return err
+		}
+		if !prompt.Deleted && (match == nil || match(&prompt)) {
+			prompts = append(prompts, prompt)
+		}
+		return nil
+	})
+	return prompts, err
+}
+
+type kvGenerationRepository struct {
+	table *table
+}
+
+func (r *kvGenerationRepository) Create(ctx context.Context, generation *models.Generation) error {
+	return r.table.insert(generation.ID, generation)
+}
+
+func (r *kvGenerationRepository) GetByID(ctx context.Context, id primitive.ObjectID) (*models.Generation, error) {
+	var generation models.Generation
+	if err := r.table.get(id, &generation); err != nil {
+		return nil, err
+	}
+	if generation.Deleted {
+		return nil, ErrNotFound
+	}
+	return &generation, nil
+}
+
+func (r *kvGenerationRepository) Save(ctx context.Context, generation *models.Generation) error {
+	return r.table.insert(generation.ID, generation)
+}
+
+func (r *kvGenerationRepository) SoftDelete(ctx context.Context, id primitive.ObjectID, reason string) error {
+	var generation models.Generation
+	return r.table.update(id, &generation, func() error {
+		return markDeleted(&generation.Deleted, &generation.DeletedAt, &generation.DeletedReason, reason)
+	})
+}
+
+func (r *kvGenerationRepository) List(ctx context.Context, filter GenerationFilter, page Page) ([]models.Generation, int64, error) {
+	matchPrompt := textMatcher(filter.Prompt)
+
+	var generations []models.Generation
+	err := r.table.scan(func(data []byte) error {
+		var g models.Generation
+		if err := bson.Unmarshal(data, &g); err != nil {
+			return err
+		}
+
+		switch {
+		case g.Deleted:
+		case !matchPrompt(g.PromptText):
+		case filter.Status != "" && g.Status != filter.Status:
+		case filter.IsImg2Img && !g.IsImg2Img:
+		case filter.BatchJobID != nil && (g.BatchJobID == nil || *g.BatchJobID != *filter.BatchJobID):
+		case filter.DateFrom != nil && g.CreatedAt.Before(*filter.DateFrom):
+		case filter.DateTo != nil && g.CreatedAt.After(*filter.DateTo):
+		default:
+			generations = append(generations, g)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	result, total := paginate(generations, func(g *models.Generation) time.Time { return g.CreatedAt }, page)
+	return result, total, nil
+}
+
+type kvBatchJobRepository struct {
+	table *table
+}
+
+func (r *kvBatchJobRepository) Create(ctx context.Context, job *models.BatchJob) error {
+	return r.table.insert(job.ID, job)
+}
+
+func (r *kvBatchJobRepository) GetByID(ctx context.Context, id primitive.ObjectID) (*models.BatchJob, error) {
+	var job models.BatchJob
+	if err := r.table.get(id, &job); err != nil {
+		return nil, err
+	}
+	if job.Deleted {
+		return nil, ErrNotFound
+	}
+	return &job, nil
+}
+
+func (r *kvBatchJobRepository) List(ctx context.Context, status string, page Page) ([]models.BatchJob, int64, error) {
+	var jobs []models.BatchJob
+	err := r.table.scan(func(data []byte) error {
+		var job models.BatchJob
+		if err := bson.Unmarshal(data, &job); err != nil {
+			return err
+		}
+		if !job.Deleted && (status == "" || job.Status == status) {
+			jobs = append(jobs, job)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	result, total := paginate(jobs, func(j *models.BatchJob) time.Time { return j.CreatedAt }, page)
+	return result, total, nil
+}
+
+func (r *kvBatchJobRepository) SoftDelete(ctx context.Context, id primitive.ObjectID, reason string) error {
+	var job models.BatchJob
+	return r.table.update(id, &job, func() error {
+		return markDeleted(&job.Deleted, &job.DeletedAt, &job.DeletedReason, reason)
+	})
+}
+
+func (r *kvBatchJobRepository) UpdateStatus(ctx context.Context, id primitive.ObjectID, status string) error {
+	var job models.BatchJob
+	return r.table.update(id, &job, func() error {
+		now := time.Now()
+		job.Status = status
+		job.UpdatedAt = now
+		if isTerminalStatus(status) {
+			job.CompletedAt = &now
+		}
+		return nil
+	})
+}
+
+func (r *kvBatchJobRepository) UpdatePriority(ctx context.Context, id primitive.ObjectID, priority int) error {
+	var job models.BatchJob
+	return r.table.update(id, &job, func() error {
+		job.Priority = priority
+		job.UpdatedAt = time.Now()
+		return nil
+	})
+}
+
+func (r *kvBatchJobRepository) MarkStarted(ctx context.Context, id primitive.ObjectID) error {
+	var job models.BatchJob
+	return r.table.update(id, &job, func() error {
+		if job.Status != "pending" && job.Status != "interrupted" {
+			return nil
+		}
+		now := time.Now()
+		job.Status = "processing"
+		job.StartedAt = &now
+		job.UpdatedAt = now
+		return nil
+	})
+}
+
+func (r *kvBatchJobRepository) MarkInterrupted(ctx context.Context, id primitive.ObjectID) error {
+	var job models.BatchJob
+	return r.table.update(id, &job, func() error {
+		if job.Status != "pending" && job.Status != "processing" {
+			return nil
+		}
+		job.Status = "interrupted"
+		job.UpdatedAt = time.Now()
+		return nil
+	})
+}
+
+func (r *kvBatchJobRepository) RecordResult(ctx context.Context, id primitive.ObjectID, taskID string, promptIndex int, succeeded bool) (*models.BatchJob, error) {
+	var job models.BatchJob
+	err := r.table.update(id, &job, func() error {
+		for _, recorded := range job.RecordedTasks {
+			if recorded == taskID {
+				return ErrResultRecorded
+			}
+		}
+		job.RecordedTasks = append(job.RecordedTasks, taskID)
+		if succeeded {
+			incrementResult(&job, promptIndex, 1, 0)
+		} else {
+			incrementResult(&job, promptIndex, 0, 1)
+		}
+		return nil
+	})
+	if err == ErrResultRecorded {
+		return &job, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (r *kvBatchJobRepository) RevokeFailure(ctx context.Context, id primitive.ObjectID, taskID string, promptIndex int) (*models.BatchJob, error) {
+	var job models.BatchJob
+	err := r.table.update(id, &job, func() error {
+		for i, recorded := range job.RecordedTasks {
+			if recorded == taskID {
+				job.RecordedTasks = append(job.RecordedTasks[:i], job.RecordedTasks[i+1:]...)
+				incrementResult(&job, promptIndex, 0, -1)
+				return nil
+			}
+		}
+		return ErrNotFound
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// incrementResult 累加某个提示词的完成和失败数量
+func incrementResult(job *models.BatchJob, promptIndex int, completed, failed int) {
+	if promptIndex >= 0 && promptIndex < len(job.Prompts) {
+		job.Prompts[promptIndex].Completed += completed
+		job.Prompts[promptIndex].Failed += failed
+	}
+	job.CompletedImages += completed
+	job.FailedImages += failed
+	job.UpdatedAt = time.Now()
+}
+
+type kvImageRepository struct {
+	table *table
+}
+
+func (r *kvImageRepository) Create(ctx context.Context, image *models.Image) error {
+	return r.table.insert(image.ID, image)
+}
+
+func (r *kvImageRepository) GetByID(ctx context.Context, id primitive.ObjectID) (*models.Image, error) {
+	var image models.Image
+	if err := r.table.get(id, &image); err != nil {
+		return nil, err
+	}
+	if image.Deleted {
+		return nil, ErrNotFound
+	}
+	return &image, nil
+}
+
+func (r *kvImageRepository) SoftDelete(ctx context.Context, id primitive.ObjectID, reason string) error {
+	var image models.Image
+	return r.table.update(id, &image, func() error {
+		return markDeleted(&image.Deleted, &image.DeletedAt, &image.DeletedReason, reason)
+	})
+}
+
+func (r *kvImageRepository) List(ctx context.Context, filter ImageFilter, page Page) ([]models.Image, int64, error) {
+	matchPrompt := textMatcher(filter.Prompt)
+
+	var images []models.Image
+	err := r.table.scan(func(data []byte) error {
+		var image models.Image
+		if err := bson.Unmarshal(data, &image); err != nil {
+			return err
+		}
+		switch {
+		case image.Deleted:
+		case !matchPrompt(image.PromptText):
+		case filter.GenerationID != nil && (image.GenerationID == nil || *image.GenerationID != *filter.GenerationID):
+		case filter.SHA256 != "" && image.SHA256 != filter.SHA256:
+		default:
+			images = append(images, image)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	result, total := paginate(images, func(i *models.Image) time.Time { return i.CreatedAt }, page)
+	return result, total, nil
+}
+
+func (r *kvImageRepository) Purge(ctx context.Context, id primitive.ObjectID) (*models.Image, error) {
+	var image models.Image
+	if err := r.table.remove(id, &image); err != nil {
+		return nil, err
+	}
+	return &image, nil
+}
+
+func (r *kvImageRepository) Lineage(ctx context.Context, id primitive.ObjectID) ([]LineageImage, []LineageImage, error) {
+	images := make(map[primitive.ObjectID]models.Image)
+	children := make(map[primitive.ObjectID][]primitive.ObjectID)
+	err := r.table.scan(func(data []byte) error {
+		var image models.Image
+		if err := bson.Unmarshal(data, &image); err != nil {
+			return err
+		}
+		images[image.ID] = image
+		if image.SourceImageID != nil {
+			children[*image.SourceImageID] = append(children[*image.SourceImageID], image.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	start, ok := images[id]
+	if !ok {
+		return nil, nil, ErrNotFound
+	}
+
+	// 祖先: 沿 source_image_id 向上查找
+	visited := map[primitive.ObjectID]bool{id: true}
+	var ancestors []LineageImage
+	for parentID, depth := start.SourceImageID, 0; parentID != nil && !visited[*parentID]; depth++ {
+		parent, ok := images[*parentID]
+		if !ok {
+			break
+		}
+		visited[parent.ID] = true
+		ancestors = append(ancestors, LineageImage{Image: parent, Depth: depth})
+		parentID = parent.SourceImageID
+	}
+
+	// 后代: 按层广度优先展开
+	var descendants []LineageImage
+	level := children[id]
+	for depth := 0; len(level) > 0; depth++ {
+		var next []primitive.ObjectID
+		for _, childID := range level {
+			if visited[childID] {
+				continue
+			}
+			visited[childID] = true
+			descendants = append(descendants, LineageImage{Image: images[childID], Depth: depth})
+			next = append(next, children[childID]...)
+		}
+		level = next
+	}
+
+	return ancestors, descendants, nil
+}
+
+func (r *kvImageRepository) ListHashes(ctx context.Context) ([]ImageHash, error) {
+	var hashes []ImageHash
+	err := r.table.scan(func(data []byte) error {
+		// 只解码需要的字段
+		var image struct {
+			ImageHash `bson:",inline"`
+			Deleted   bool `bson:"deleted"`
+		}
+		if err := bson.Unmarshal(data, &image); err != nil {
+			return err
+		}
+		if !image.Deleted && image.PHash != "" {
+			hashes = append(hashes, image.ImageHash)
+		}
+		return nil
+	})
+	return hashes, err
+}
+
+// kvBlobRefRepository 引用计数以8字节大端整数保存，键为文件key
+type kvBlobRefRepository struct {
+	backend kvBackend
+	bucket  string
+}
+
+func (r *kvBlobRefRepository) Acquire(ctx context.Context, key string) (int64, error) {
+	return r.add(key, 1)
+}
+
+func (r *kvBlobRefRepository) Release(ctx context.Context, key string) (int64, error) {
+	return r.add(key, -1)
+}
+
+// add 在一个写事务中调整引用数，结果不大于0时删除计数
+func (r *kvBlobRefRepository) add(key string, delta int64) (int64, error) {
+	var count int64
+	err := r.backend.Update(r.bucket, func(b kvBucket) error {
+		if data := b.Get([]byte(key)); len(data) == 8 {
+			count = int64(binary.BigEndian.Uint64(data))
+		}
+		count += delta
+
+		if count <= 0 {
+			count = 0
+			return b.Delete([]byte(key))
+		}
+
+		data := make([]byte, 8)
+		binary.BigEndian.PutUint64(data, uint64(count))
+		return b.Put([]byte(key), data)
+	})
+	return count, err
+}
+
+// containsTag 判断标签列表是否包含指定标签
+func containsTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// uniqueSorted 去重、去空并排序
+func uniqueSorted(values []string) []string {
+	seen := make(map[string]bool)
+	result := make([]string, 0)
+	for _, value := range values {
+		if value != "" && !seen[value] {
+			seen[value] = true
+			result = append(result, value)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
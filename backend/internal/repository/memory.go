@@ -0,0 +1,71 @@
+package repository
+
+import (
+	"sort"
+	"sync"
+)
+
+// memoryBackend 纯内存的键值后端，进程退出后数据丢失，主要用于测试
+type memoryBackend struct {
+	mu      sync.RWMutex
+	buckets map[string]memoryBucket
+}
+
+// memoryBucket 内存桶，ForEach 按键排序遍历以与bbolt保持一致
+type memoryBucket map[string][]byte
+
+func (b memoryBucket) Get(key []byte) []byte {
+	return b[string(key)]
+}
+
+func (b memoryBucket) Put(key, value []byte) error {
+	// 复制一份，避免调用方复用缓冲区
+	b[string(key)] = append([]byte(nil), value...)
+	return nil
+}
+
+func (b memoryBucket) Delete(key []byte) error {
+	delete(b, string(key))
+	return nil
+}
+
+func (b memoryBucket) ForEach(fn func(k, v []byte) error) error {
+	keys := make([]string, 0, len(b))
+	for key := range b {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if err := fn([]byte(key), b[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memoryBackend) View(bucket string, fn func(b kvBucket) error) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return fn(m.buckets[bucket])
+}
+
+func (m *memoryBackend) Update(bucket string, fn func(b kvBucket) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return fn(m.buckets[bucket])
+}
+
+func (m *memoryBackend) Close() error {
+	return nil
+}
+
+// NewMemoryRepositories 创建基于内存的存储，每次调用得到相互隔离的空存储
+func NewMemoryRepositories() *Repositories {
+	backend := &memoryBackend{buckets: make(map[string]memoryBucket)}
+	for _, name := range embeddedBuckets {
+		backend.buckets[name] = make(memoryBucket)
+	}
+
+	return newKVRepositories(backend)
+}
@@ -0,0 +1,558 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"nano-banana-qwen/internal/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// NewMongoRepositories 创建基于MongoDB的存储
+func NewMongoRepositories(db *mongo.Database) *Repositories {
+	return &Repositories{
+		Prompts:     &mongoPromptRepository{collection: db.Collection("prompts")},
+		Generations: &mongoGenerationRepository{collection: db.Collection("generations")},
+		BatchJobs:   &mongoBatchJobRepository{collection: db.Collection("batch_jobs")},
+		Images:      &mongoImageRepository{collection: db.Collection("images")},
+		BlobRefs:    &mongoBlobRefRepository{collection: db.Collection("blob_refs")},
+	}
+}
+
+// findOne 查询未删除的单条记录
+func findOne(ctx context.Context, collection *mongo.Collection, id primitive.ObjectID, result interface{}) error {
+	err := collection.FindOne(ctx, bson.M{
+		"_id":     id,
+		"deleted": false,
+	}).Decode(result)
+	if err == mongo.ErrNoDocuments {
+		return ErrNotFound
+	}
+	return err
+}
+
+// softDelete 软删除单条记录
+func softDelete(ctx context.Context, collection *mongo.Collection, id primitive.ObjectID, reason string, extra bson.M) error {
+	now := time.Now()
+	set := bson.M{
+		"deleted":        true,
+		"deleted_at":     &now,
+		"deleted_reason": reason,
+	}
+	for k, v := range extra {
+		set[k] = v
+	}
+
+	result, err := collection.UpdateOne(ctx, bson.M{
+		"_id":     id,
+		"deleted": false,
+	}, bson.M{"$set": set})
+	if err != nil {
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// findPage 按创建时间倒序分页查询
+func findPage(ctx context.Context, collection *mongo.Collection, filter bson.M, page Page, results interface{}) (int64, error) {
+	total, err := collection.CountDocuments(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+
+	findOptions := options.Find().
+		SetSkip(int64(page.Skip())).
+		SetLimit(int64(page.PageSize)).
+		SetSort(bson.D{{Key: "created_at", Value: -1}})
+
+	cursor, err := collection.Find(ctx, filter, findOptions)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	if err := cursor.All(ctx, results); err != nil {
+		return 0, err
+	}
+
+	return total, nil
+}
+
+// distinctStrings 聚合查询某字段的全部非空取值
+func distinctStrings(ctx context.Context, collection *mongo.Collection, field string, unwind bool) ([]string, error) {
+	pipeline := []bson.M{
+		{"$match": bson.M{"deleted": false}},
+	}
+	if unwind {
+		pipeline = append(pipeline, bson.M{"$unwind": "$" + field})
+	}
+	pipeline = append(pipeline,
+		bson.M{"$group": bson.M{"_id": "$" + field}},
+		bson.M{"$match": bson.M{"_id": bson.M{"$ne": ""}}},
+		bson.M{"$sort": bson.M{"_id": 1}},
+	)
+
+	cursor, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var results []bson.M
+	if err = cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+
+	values := make([]string, 0, len(results))
+	for _, result := range results {
+		if value, ok := result["_id"].(string); ok && value != "" {
+			values = append(values, value)
+		}
+	}
+
+	return values, nil
+}
+
+type mongoPromptRepository struct {
+	collection *mongo.Collection
+}
+
+func (r *mongoPromptRepository) Create(ctx context.Context, prompt *models.Prompt) error {
+	_, err := r.collection.InsertOne(ctx, prompt)
+	return err
+}
+
+func (r *mongoPromptRepository) GetByID(ctx context.Context, id primitive.ObjectID) (*models.Prompt, error) {
+	var prompt models.Prompt
+	if err := findOne(ctx, r.collection, id, &prompt); err != nil {
+		return nil, err
+	}
+	return &prompt, nil
+}
+
+func (r *mongoPromptRepository) Update(ctx context.Context, id primitive.ObjectID, req models.UpdatePromptRequest) error {
+	set := bson.M{
+		"updated_at":  time.Now(),
+		"is_favorite": req.IsFavorite,
+	}
+
+	// 只更新非空字段
+	if req.Title != "" {
+		set["title"] = req.Title
+	}
+	if req.Content != "" {
+		set["content"] = req.Content
+	}
+	if req.Category != "" {
+		set["category"] = req.Category
+	}
+	if req.Tags != nil {
+		set["tags"] = req.Tags
+	}
+
+	result, err := r.collection.UpdateOne(ctx, bson.M{
+		"_id":     id,
+		"deleted": false,
+	}, bson.M{"$set": set})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *mongoPromptRepository) SoftDelete(ctx context.Context, id primitive.ObjectID, reason string) error {
+	return softDelete(ctx, r.collection, id, reason, bson.M{"updated_at": time.Now()})
+}
+
+func (r *mongoPromptRepository) List(ctx context.Context, filter PromptFilter, page Page) ([]models.Prompt, int64, error) {
+	query := bson.M{"deleted": false}
+
+	if filter.Keyword != "" {
+		query["$or"] = []bson.M{
+			{"title": bson.M{"$regex": filter.Keyword, "$options": "i"}},
+			{"content": bson.M{"$regex": filter.Keyword, "$options": "i"}},
+		}
+	}
+	if filter.Category != "" {
+		query["category"] = filter.Category
+	}
+	if filter.Tag != "" {
+		query["tags"] = bson.M{"$in": []string{filter.Tag}}
+	}
+
+	var prompts []models.Prompt
+	total, err := findPage(ctx, r.collection, query, page, &prompts)
+	return prompts, total, err
+}
+
+func (r *mongoPromptRepository) IncrementUsage(ctx context.Context, id primitive.ObjectID) error {
+	_, err := r.collection.UpdateOne(ctx, bson.M{
+		"_id":     id,
+		"deleted": false,
+	}, bson.M{
+		"$inc": bson.M{"usage_count": 1},
+		"$set": bson.M{"updated_at": time.Now()},
+	})
+	return err
+}
+
+func (r *mongoPromptRepository) Categories(ctx context.Context) ([]string, error) {
+	return distinctStrings(ctx, r.collection, "category", false)
+}
+
+func (r *mongoPromptRepository) Tags(ctx context.Context) ([]string, error) {
+	return distinctStrings(ctx, r.collection, "tags", true)
+}
+
+type mongoGenerationRepository struct {
+	collection *mongo.Collection
+}
+
+func (r *mongoGenerationRepository) Create(ctx context.Context, generation *models.Generation) error {
+	_, err := r.collection.InsertOne(ctx, generation)
+	return err
+}
+
+func (r *mongoGenerationRepository) GetByID(ctx context.Context, id primitive.ObjectID) (*models.Generation, error) {
+	var generation models.Generation
+	if err := findOne(ctx, r.collection, id, &generation); err != nil {
+		return nil, err
+	}
+	return &generation, nil
+}
+
+func (r *mongoGenerationRepository) Save(ctx context.Context, generation *models.Generation) error {
+	_, err := r.collection.ReplaceOne(ctx, bson.M{"_id": generation.ID}, generation)
+	return err
+}
+
+func (r *mongoGenerationRepository) SoftDelete(ctx context.Context, id primitive.ObjectID, reason string) error {
+	return softDelete(ctx, r.collection, id, reason, nil)
+}
+
+func (r *mongoGenerationRepository) List(ctx context.Context, filter GenerationFilter, page Page) ([]models.Generation, int64, error) {
+	query := bson.M{"deleted": false}
+
+	if filter.Prompt != "" {
+		query["prompt_text"] = bson.M{"$regex": filter.Prompt, "$options": "i"}
+	}
+	if filter.Status != "" {
+		query["status"] = filter.Status
+	}
+	if filter.IsImg2Img {
+		query["is_img2img"] = true
+	}
+	if filter.BatchJobID != nil {
+		query["batch_job_id"] = *filter.BatchJobID
+	}
+
+	// 日期过滤
+	if filter.DateFrom != nil || filter.DateTo != nil {
+		dateFilter := bson.M{}
+		if filter.DateFrom != nil {
+			dateFilter["$gte"] = *filter.DateFrom
+		}
+		if filter.DateTo != nil {
+			dateFilter["$lte"] = *filter.DateTo
+		}
+		query["created_at"] = dateFilter
+	}
+
+	var generations []models.Generation
+	total, err := findPage(ctx, r.collection, query, page, &generations)
+	return generations, total, err
+}
+
+type mongoBatchJobRepository struct {
+	collection *mongo.Collection
+}
+
+func (r *mongoBatchJobRepository) Create(ctx context.Context, job *models.BatchJob) error {
+	_, err := r.collection.InsertOne(ctx, job)
+	return err
+}
+
+func (r *mongoBatchJobRepository) GetByID(ctx context.Context, id primitive.ObjectID) (*models.BatchJob, error) {
+	var job models.BatchJob
+	if err := findOne(ctx, r.collection, id, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (r *mongoBatchJobRepository) List(ctx context.Context, status string, page Page) ([]models.BatchJob, int64, error) {
+	query := bson.M{"deleted": false}
+	if status != "" {
+		query["status"] = status
+	}
+
+	var jobs []models.BatchJob
+	total, err := findPage(ctx, r.collection, query, page, &jobs)
+	return jobs, total, err
+}
+
+func (r *mongoBatchJobRepository) SoftDelete(ctx context.Context, id primitive.ObjectID, reason string) error {
+	return softDelete(ctx, r.collection, id, reason, nil)
+}
+
+func (r *mongoBatchJobRepository) UpdateStatus(ctx context.Context, id primitive.ObjectID, status string) error {
+	now := time.Now()
+	set := bson.M{
+		"status":     status,
+		"updated_at": now,
+	}
+	if isTerminalStatus(status) {
+		set["completed_at"] = now
+	}
+
+	_, err := r.collection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": set})
+	return err
+}
+
+func (r *mongoBatchJobRepository) UpdatePriority(ctx context.Context, id primitive.ObjectID, priority int) error {
+	_, err := r.collection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{
+		"$set": bson.M{"priority": priority, "updated_at": time.Now()},
+	})
+	return err
+}
+
+func (r *mongoBatchJobRepository) MarkStarted(ctx context.Context, id primitive.ObjectID) error {
+	now := time.Now()
+	_, err := r.collection.UpdateOne(ctx, bson.M{"_id": id, "status": bson.M{"$in": []string{"pending", "interrupted"}}}, bson.M{
+		"$set": bson.M{
+			"status":     "processing",
+			"started_at": now,
+			"updated_at": now,
+		},
+	})
+	return err
+}
+
+func (r *mongoBatchJobRepository) MarkInterrupted(ctx context.Context, id primitive.ObjectID) error {
+	_, err := r.collection.UpdateOne(ctx, bson.M{"_id": id, "status": bson.M{"$in": []string{"pending", "processing"}}}, bson.M{
+		"$set": bson.M{"status": "interrupted", "updated_at": time.Now()},
+	})
+	return err
+}
+
+func (r *mongoBatchJobRepository) RecordResult(ctx context.Context, id primitive.ObjectID, taskID string, promptIndex int, succeeded bool) (*models.BatchJob, error) {
+	completed, failed := 1, 0
+	if !succeeded {
+		completed, failed = 0, 1
+	}
+
+	job, err := r.incrementResult(ctx, bson.M{"_id": id, "recorded_tasks": bson.M{"$ne": taskID}}, promptIndex, completed, failed,
+		bson.M{"$push": bson.M{"recorded_tasks": taskID}})
+	if err != ErrNotFound {
+		return job, err
+	}
+
+	// 任务存在说明该图片已计入
+	var current models.BatchJob
+	if err := r.collection.FindOne(ctx, bson.M{"_id": id}).Decode(&current); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return &current, ErrResultRecorded
+}
+
+func (r *mongoBatchJobRepository) RevokeFailure(ctx context.Context, id primitive.ObjectID, taskID string, promptIndex int) (*models.BatchJob, error) {
+	return r.incrementResult(ctx, bson.M{"_id": id, "recorded_tasks": taskID}, promptIndex, 0, -1,
+		bson.M{"$pull": bson.M{"recorded_tasks": taskID}})
+}
+
+// incrementResult 对匹配 filter 的任务累加某个提示词的完成和失败数量，并同时执行 extra 中的更新
+func (r *mongoBatchJobRepository) incrementResult(ctx context.Context, filter bson.M, promptIndex int, completed, failed int, extra bson.M) (*models.BatchJob, error) {
+	update := bson.M{
+		"$inc": bson.M{
+			fmt.Sprintf("prompts.%d.completed", promptIndex): completed,
+			fmt.Sprintf("prompts.%d.failed", promptIndex):    failed,
+			"completed_images": completed,
+			"failed_images":    failed,
+		},
+		"$set": bson.M{"updated_at": time.Now()},
+	}
+	for op, value := range extra {
+		update[op] = value
+	}
+
+	var job models.BatchJob
+	err := r.collection.FindOneAndUpdate(ctx, filter, update, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&job)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+type mongoImageRepository struct {
+	collection *mongo.Collection
+}
+
+func (r *mongoImageRepository) Create(ctx context.Context, image *models.Image) error {
+	_, err := r.collection.InsertOne(ctx, image)
+	return err
+}
+
+func (r *mongoImageRepository) GetByID(ctx context.Context, id primitive.ObjectID) (*models.Image, error) {
+	var image models.Image
+	if err := findOne(ctx, r.collection, id, &image); err != nil {
+		return nil, err
+	}
+	return &image, nil
+}
+
+func (r *mongoImageRepository) SoftDelete(ctx context.Context, id primitive.ObjectID, reason string) error {
+	return softDelete(ctx, r.collection, id, reason, nil)
+}
+
+func (r *mongoImageRepository) List(ctx context.Context, filter ImageFilter, page Page) ([]models.Image, int64, error) {
+	query := bson.M{"deleted": false}
+	if filter.Prompt != "" {
+		query["prompt_text"] = bson.M{"$regex": filter.Prompt, "$options": "i"}
+	}
+	if filter.GenerationID != nil {
+		query["generation_id"] = *filter.GenerationID
+	}
+	if filter.SHA256 != "" {
+		query["sha256"] = filter.SHA256
+	}
+
+	var images []models.Image
+	total, err := findPage(ctx, r.collection, query, page, &images)
+	return images, total, err
+}
+
+func (r *mongoImageRepository) Purge(ctx context.Context, id primitive.ObjectID) (*models.Image, error) {
+	var image models.Image
+	err := r.collection.FindOneAndDelete(ctx, bson.M{"_id": id}).Decode(&image)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &image, nil
+}
+
+func (r *mongoImageRepository) Lineage(ctx context.Context, id primitive.ObjectID) ([]LineageImage, []LineageImage, error) {
+	pipeline := []bson.M{
+		{"$match": bson.M{"_id": id}},
+		// 祖先: 沿 source_image_id 向上查找
+		{"$graphLookup": bson.M{
+			"from":             r.collection.Name(),
+			"startWith":        "$source_image_id",
+			"connectFromField": "source_image_id",
+			"connectToField":   "_id",
+			"as":               "ancestors",
+			"depthField":       "depth",
+		}},
+		// 后代: 查找以当前图片为源图片的图片
+		{"$graphLookup": bson.M{
+			"from":             r.collection.Name(),
+			"startWith":        "$_id",
+			"connectFromField": "_id",
+			"connectToField":   "source_image_id",
+			"as":               "descendants",
+			"depthField":       "depth",
+		}},
+		{"$project": bson.M{"ancestors": 1, "descendants": 1}},
+	}
+
+	cursor, err := r.collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var results []struct {
+		Ancestors   []LineageImage `bson:"ancestors"`
+		Descendants []LineageImage `bson:"descendants"`
+	}
+	if err := cursor.All(ctx, &results); err != nil {
+		return nil, nil, err
+	}
+	if len(results) == 0 {
+		return nil, nil, ErrNotFound
+	}
+
+	return results[0].Ancestors, results[0].Descendants, nil
+}
+
+func (r *mongoImageRepository) ListHashes(ctx context.Context) ([]ImageHash, error) {
+	cursor, err := r.collection.Find(ctx,
+		bson.M{"deleted": false, "phash": bson.M{"$gt": ""}},
+		options.Find().SetProjection(bson.M{"_id": 1, "phash": 1}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var hashes []ImageHash
+	if err := cursor.All(ctx, &hashes); err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
+
+type mongoBlobRefRepository struct {
+	collection *mongo.Collection
+}
+
+// blobRef 引用计数文档，_id 为文件key
+type blobRef struct {
+	Key   string `bson:"_id"`
+	Count int64  `bson:"count"`
+}
+
+func (r *mongoBlobRefRepository) Acquire(ctx context.Context, key string) (int64, error) {
+	var ref blobRef
+	err := r.collection.FindOneAndUpdate(ctx,
+		bson.M{"_id": key},
+		bson.M{"$inc": bson.M{"count": 1}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&ref)
+	return ref.Count, err
+}
+
+func (r *mongoBlobRefRepository) Release(ctx context.Context, key string) (int64, error) {
+	var ref blobRef
+	err := r.collection.FindOneAndUpdate(ctx,
+		bson.M{"_id": key},
+		bson.M{"$inc": bson.M{"count": -1}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&ref)
+	if err == mongo.ErrNoDocuments {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if ref.Count <= 0 {
+		// 只删除仍为0的计数，避免删掉并发增加的引用
+		if _, err := r.collection.DeleteOne(ctx, bson.M{"_id": key, "count": bson.M{"$lte": 0}}); err != nil {
+			return 0, err
+		}
+		return 0, nil
+	}
+	return ref.Count, nil
+}
@@ -0,0 +1,156 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"nano-banana-qwen/internal/models"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ErrNotFound 记录不存在或已被删除
+var ErrNotFound = errors.New("记录不存在")
+
+// ErrResultRecorded 批量任务中的图片结果已经计入，重复投递的图片任务不再累加
+var ErrResultRecorded = errors.New("图片结果已计入")
+
+// PromptFilter 提示词列表过滤条件
+type PromptFilter struct {
+	Keyword  string // 匹配标题或内容，忽略大小写
+	Category string
+	Tag      string
+}
+
+// GenerationFilter 生成记录列表过滤条件
+type GenerationFilter struct {
+	Prompt     string // 匹配提示词，忽略大小写
+	Status     string
+	IsImg2Img  bool // 为true时只返回图生图记录
+	DateFrom   *time.Time
+	DateTo     *time.Time
+	BatchJobID *primitive.ObjectID
+}
+
+// ImageFilter 图片列表过滤条件
+type ImageFilter struct {
+	Prompt       string // 匹配提示词，忽略大小写
+	GenerationID *primitive.ObjectID
+	SHA256       string // 按内容哈希精确匹配
+}
+
+// Page 分页参数，Page 从1开始，PageSize 为0时返回全部
+type Page struct {
+	Page     int
+	PageSize int
+}
+
+// Skip 跳过的记录数
+func (p Page) Skip() int {
+	if p.Page <= 1 {
+		return 0
+	}
+	return (p.Page - 1) * p.PageSize
+}
+
+// PromptRepository 提示词存储
+type PromptRepository interface {
+	Create(ctx context.Context, prompt *models.Prompt) error
+	GetByID(ctx context.Context, id primitive.ObjectID) (*models.Prompt, error)
+	Update(ctx context.Context, id primitive.ObjectID, req models.UpdatePromptRequest) error
+	SoftDelete(ctx context.Context, id primitive.ObjectID, reason string) error
+	List(ctx context.Context, filter PromptFilter, page Page) ([]models.Prompt, int64, error)
+	IncrementUsage(ctx context.Context, id primitive.ObjectID) error
+	Categories(ctx context.Context) ([]string, error)
+	Tags(ctx context.Context) ([]string, error)
+}
+
+// GenerationRepository 生成记录存储
+type GenerationRepository interface {
+	Create(ctx context.Context, generation *models.Generation) error
+	GetByID(ctx context.Context, id primitive.ObjectID) (*models.Generation, error)
+	// Save 覆盖保存生成记录的全部字段
+	Save(ctx context.Context, generation *models.Generation) error
+	SoftDelete(ctx context.Context, id primitive.ObjectID, reason string) error
+	List(ctx context.Context, filter GenerationFilter, page Page) ([]models.Generation, int64, error)
+}
+
+// BatchJobRepository 批量任务存储
+type BatchJobRepository interface {
+	Create(ctx context.Context, job *models.BatchJob) error
+	GetByID(ctx context.Context, id primitive.ObjectID) (*models.BatchJob, error)
+	List(ctx context.Context, status string, page Page) ([]models.BatchJob, int64, error)
+	SoftDelete(ctx context.Context, id primitive.ObjectID, reason string) error
+	// UpdateStatus 更新任务状态，进入终态时记录完成时间
+	UpdateStatus(ctx context.Context, id primitive.ObjectID, status string) error
+	// UpdatePriority 修改任务优先级
+	UpdatePriority(ctx context.Context, id primitive.ObjectID, priority int) error
+	// MarkStarted 将等待中或已中断的任务标记为开始处理，其他状态不变
+	MarkStarted(ctx context.Context, id primitive.ObjectID) error
+	// MarkInterrupted 将等待中或处理中的任务标记为已中断，已暂停、取消或结束的任务不变
+	MarkInterrupted(ctx context.Context, id primitive.ObjectID) error
+	// RecordResult 原子地计入一张图片的成功或失败并返回累加后的任务，同一图片任务只计入一次，
+	// 已计入时返回当前任务和 ErrResultRecorded
+	RecordResult(ctx context.Context, id primitive.ObjectID, taskID string, promptIndex int, succeeded bool) (*models.BatchJob, error)
+	// RevokeFailure 撤销一张已计入的失败图片以便重新生成，返回扣除后的任务，未计入时返回 ErrNotFound
+	RevokeFailure(ctx context.Context, id primitive.ObjectID, taskID string, promptIndex int) (*models.BatchJob, error)
+}
+
+// ImageRepository 图片元数据存储
+type ImageRepository interface {
+	Create(ctx context.Context, image *models.Image) error
+	GetByID(ctx context.Context, id primitive.ObjectID) (*models.Image, error)
+	SoftDelete(ctx context.Context, id primitive.ObjectID, reason string) error
+	// Purge 永久删除记录（包括已软删除的记录）并返回被删除的记录
+	Purge(ctx context.Context, id primitive.ObjectID) (*models.Image, error)
+	List(ctx context.Context, filter ImageFilter, page Page) ([]models.Image, int64, error)
+	// Lineage 沿 source_image_id 查询图片的全部祖先和后代，已删除的图片也会返回以保持链路完整
+	Lineage(ctx context.Context, id primitive.ObjectID) (ancestors, descendants []LineageImage, err error)
+	// ListHashes 返回全部未删除且有感知哈希的图片ID和哈希，不读取其他字段
+	ListHashes(ctx context.Context) ([]ImageHash, error)
+}
+
+// ImageHash 查找近似图片时只需要的字段
+type ImageHash struct {
+	ID    primitive.ObjectID `bson:"_id"`
+	PHash string             `bson:"phash"`
+}
+
+// LineageImage 血缘查询结果中的图片，Depth 为与起点相隔的步数减一，直接来源或直接派生为0
+type LineageImage struct {
+	models.Image `bson:",inline"`
+	Depth        int `bson:"depth"`
+}
+
+// BlobRefRepository 文件引用计数，内容相同的图片共用同一个文件
+type BlobRefRepository interface {
+	// Acquire 增加一次引用，返回增加后的引用数
+	Acquire(ctx context.Context, key string) (int64, error)
+	// Release 释放一次引用，返回剩余引用数，归零时删除计数
+	Release(ctx context.Context, key string) (int64, error)
+}
+
+// Repositories 全部存储的集合
+type Repositories struct {
+	Prompts     PromptRepository
+	Generations GenerationRepository
+	BatchJobs   BatchJobRepository
+	Images      ImageRepository
+	BlobRefs    BlobRefRepository
+
+	close func() error
+}
+
+// Close 释放底层存储资源
+func (r *Repositories) Close() error {
+	if r.close == nil {
+		return nil
+	}
+	return r.close()
+}
+
+// isTerminalStatus 判断任务状态是否为终态
+func isTerminalStatus(status string) bool {
+	return status == "completed" || status == "failed" || status == "cancelled"
+}
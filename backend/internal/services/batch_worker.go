@@ -0,0 +1,451 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"nano-banana-qwen/internal/config"
+	"nano-banana-qwen/internal/models"
+	"nano-banana-qwen/internal/repository"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// BatchWorker 批量任务后台处理器，从队列中逐张领取批量任务的图片任务：
+// 优先级高的任务先处理，同优先级的任务轮流生成，多个节点可以同时处理同一个批量任务
+type BatchWorker struct {
+	config       *config.Config
+	batchJobs    repository.BatchJobRepository
+	generations  repository.GenerationRepository
+	runner       *GenerationRunner
+	queueService *QueueService
+	concurrency  int
+	leaseTimeout time.Duration
+}
+
+// NewBatchWorker 创建批量任务处理器
+func NewBatchWorker(cfg *config.Config, repos *repository.Repositories, runner *GenerationRunner, queueService *QueueService) *BatchWorker {
+	concurrency := cfg.MaxConcurrentGenerations
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	return &BatchWorker{
+		config:       cfg,
+		batchJobs:    repos.BatchJobs,
+		generations:  repos.Generations,
+		runner:       runner,
+		queueService: queueService,
+		concurrency:  concurrency,
+		leaseTimeout: cfg.LeaseTimeout(),
+	}
+}
+
+// Start 启动处理循环，ctx 取消后不再领取新任务，等待进行中的生成结束后返回
+// workCtx 取消时中断进行中的生成，被中断的图片任务重新入队
+func (w *BatchWorker) Start(ctx, workCtx context.Context) {
+	log.Printf("🛠️ 批量任务处理器已启动 (并发数: %d)", w.concurrency)
+
+	w.requeueLegacyJobs()
+
+	// 启动恢复：回收上次进程崩溃或重启时遗留在 processing_queue 中、租约已过期的图片任务
+	if failed, err := w.queueService.RecoverProcessingTasks(); err != nil {
+		log.Printf("❌ 恢复处理中任务失败: %v", err)
+	} else {
+		w.recordFailures(failed)
+	}
+
+	go w.reapLoop(ctx)
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, w.concurrency)
+
+	for {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			log.Println("🛑 批量任务处理器已停止")
+			return
+		case sem <- struct{}{}:
+		}
+
+		task, err := w.queueService.GetNextBatchTask()
+		if err != nil || task == nil {
+			<-sem
+			if err != nil {
+				log.Printf("❌ 获取队列任务失败: %v", err)
+			}
+			select {
+			case <-ctx.Done():
+			case <-time.After(queuePollTimeout):
+			}
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			w.processTask(workCtx, task)
+		}()
+	}
+}
+
+// processTask 生成图片任务对应的一张图片并将结果累加到批量任务
+func (w *BatchWorker) processTask(ctx context.Context, task *models.GenerationTask) {
+	jobID, err := primitive.ObjectIDFromHex(task.JobID)
+	if err != nil {
+		log.Printf("❌ 任务ID格式无效: %s", task.JobID)
+		w.queueService.DropBatchTask(task.ID)
+		return
+	}
+
+	// 批量任务已删除或取消时丢弃
+	job, err := w.batchJobs.GetByID(context.Background(), jobID)
+	if err != nil || job.Status == "cancelled" || w.isCancelled(task.JobID) {
+		w.queueService.DropBatchTask(task.ID)
+		return
+	}
+
+	if job.Status == "pending" || job.Status == "interrupted" {
+		log.Printf("📦 开始处理批量任务: %s (%s, 优先级 %d)", job.Name, task.JobID, job.Priority)
+		w.batchJobs.MarkStarted(context.Background(), jobID)
+		w.queueService.MarkJobStarted(task.JobID, "正在处理任务")
+	}
+
+	// 处理期间持续续租，租约丢失时中断生成
+	taskCtx, cancel := context.WithCancel(ctx)
+	leaseLost := make(chan struct{})
+	heartbeatCtx, stopHeartbeat := context.WithCancel(context.Background())
+	go w.queueService.KeepLease(heartbeatCtx, task.ID, cancel, leaseLost)
+
+	generation, genErr := w.generate(taskCtx, jobID, task)
+	stopHeartbeat()
+	cancel()
+
+	select {
+	case <-leaseLost:
+		log.Printf("⚠️ 图片任务 %s 租约已丢失，交由其他节点继续处理", task.ID)
+		return
+	default:
+	}
+
+	// 被中断的图片不计入结果，放回队首等待重新生成；生成期间批量任务已被取消或删除时丢弃，不能让已取消的任务重新入队
+	if errors.Is(genErr, ErrGenerationInterrupted) {
+		if job, err := w.batchJobs.GetByID(context.Background(), jobID); err != nil || job.Status == "cancelled" || w.isCancelled(task.JobID) {
+			w.queueService.DropBatchTask(task.ID)
+			return
+		}
+		if err := w.queueService.RequeueBatchTask(task); err != nil {
+			log.Printf("❌ 图片任务 %s 重新入队失败: %v", task.ID, err)
+			return
+		}
+		// 只有等待中或处理中的任务标记为已中断，暂停、取消或已结束的任务保持原状态
+		w.batchJobs.MarkInterrupted(context.Background(), jobID)
+		w.queueService.MarkJobInterrupted(task.JobID, "服务停止，任务已重新入队")
+		return
+	}
+
+	// 限流、服务端错误等暂时性失败延迟后重试，不计入结果
+	if genErr != nil && w.retryLater(task, generation, genErr) {
+		return
+	}
+
+	// 先累加结果再移出处理中队列，节点在两步之间停止时任务会被重新投递
+	w.recordResult(task, genErr == nil)
+	if genErr != nil {
+		log.Printf("⚠️ 批量任务 %s 生成失败: %v", task.JobID, genErr)
+		w.queueService.FailBatchTask(task)
+		return
+	}
+	w.queueService.CompleteBatchTask(task.ID)
+}
+
+// generate 生成单张图片，生成记录ID即图片任务ID，重新投递或重试的任务复用已有的生成记录
+func (w *BatchWorker) generate(ctx context.Context, jobID primitive.ObjectID, task *models.GenerationTask) (*models.Generation, error) {
+	id, err := primitive.ObjectIDFromHex(task.ID)
+	if err != nil {
+		return nil, fmt.Errorf("任务ID格式无效: %v", err)
+	}
+
+	generation, err := w.generations.GetByID(context.Background(), id)
+	if err == nil {
+		// 上次已生成完成，只是结果未来得及计入
+		if generation.Status == "completed" {
+			return generation, nil
+		}
+		return generation, w.runner.Run(ctx, generation, "")
+	}
+	if err != repository.ErrNotFound {
+		return nil, fmt.Errorf("读取生成记录失败: %v", err)
+	}
+
+	generation = &models.Generation{
+		ID:         id,
+		PromptID:   task.PromptID,
+		PromptText: task.Prompt,
+		GenerationParams: models.GenerationParams{
+			Size:    w.config.DefaultImageSize,
+			Quality: w.config.DefaultImageQuality,
+		},
+		Status:     "pending",
+		BatchJobID: &jobID,
+		CreatedAt:  time.Now(),
+		Deleted:    false,
+	}
+
+	if err := w.generations.Create(context.Background(), generation); err != nil {
+		return nil, fmt.Errorf("保存生成记录失败: %v", err)
+	}
+
+	return generation, w.runner.Run(ctx, generation, "")
+}
+
+// retryLater 生成执行器已安排自动重试时按计划时间延迟重新入队，返回true表示已安排重试
+func (w *BatchWorker) retryLater(task *models.GenerationTask, generation *models.Generation, genErr error) bool {
+	task.Attempts++
+	task.LastError = genErr.Error()
+
+	var retry *RetryScheduledError
+	if !errors.As(genErr, &retry) {
+		return false
+	}
+	if err := w.queueService.DelayBatchTask(task, retry.RetryAt); err != nil {
+		log.Printf("❌ 图片任务 %s 安排重试失败: %v", task.ID, err)
+		w.runner.AbandonRetry(generation)
+		return false
+	}
+
+	log.Printf("🔁 图片任务 %s 第 %d 次生成失败 (%s)，%v 后重试", task.ID, task.Attempts, ClassifyError(genErr).Kind, time.Until(retry.RetryAt).Round(time.Millisecond))
+	return true
+}
+
+// recordResult 原子地累加图片结果，同一图片任务只计入一次，全部图片结束后由累加后的数量决定批量任务的最终状态
+func (w *BatchWorker) recordResult(task *models.GenerationTask, succeeded bool) {
+	jobID, err := primitive.ObjectIDFromHex(task.JobID)
+	if err != nil {
+		return
+	}
+
+	job, err := w.batchJobs.RecordResult(context.Background(), jobID, task.ID, task.PromptIndex, succeeded)
+	switch {
+	case errors.Is(err, repository.ErrResultRecorded):
+		// 节点在计入结果后、移出处理中队列前停止，任务被重新投递：不重复累加，只补上可能未完成的状态更新
+		log.Printf("♻️ 图片任务 %s 的结果已计入，跳过重复累加", task.ID)
+		if job.Status == "completed" || job.Status == "failed" {
+			return
+		}
+	case err != nil:
+		log.Printf("❌ 批量任务 %s 累加结果失败: %v", task.JobID, err)
+		return
+	}
+
+	message := fmt.Sprintf("已完成 %d/%d，失败 %d", job.CompletedImages, job.TotalImages, job.FailedImages)
+	w.queueService.UpdateJobProgress(task.JobID, job.CompletedImages, job.FailedImages, job.TotalImages, message)
+
+	// 只有计入最后一张图片的节点会看到全部结束
+	if job.CompletedImages+job.FailedImages < job.TotalImages || job.Status == "cancelled" {
+		return
+	}
+
+	if job.CompletedImages == 0 {
+		w.updateJobStatus(jobID, "failed")
+		w.queueService.FailJob(task.JobID, "所有图片生成失败")
+		return
+	}
+
+	w.updateJobStatus(jobID, "completed")
+	w.queueService.CompleteJob(task.JobID)
+	log.Printf("✅ 批量任务 %s 处理完成: 成功 %d, 失败 %d", task.JobID, job.CompletedImages, job.FailedImages)
+}
+
+// RetryTask 将失败队列中的图片任务重新入队：扣除失败数量、生成记录回到等待状态，已结束的批量任务回到处理中
+func (w *BatchWorker) RetryTask(taskID string) (*models.GenerationTask, error) {
+	task, err := w.queueService.GetTask(taskID)
+	if err != nil {
+		return nil, err
+	}
+	if task.Status != "failed" {
+		return nil, ErrTaskNotFailed
+	}
+
+	jobID, err := primitive.ObjectIDFromHex(task.JobID)
+	if err != nil {
+		return nil, fmt.Errorf("任务ID格式无效: %v", err)
+	}
+	job, err := w.batchJobs.GetByID(context.Background(), jobID)
+	if err != nil {
+		return nil, err
+	}
+	if job.Status == "cancelled" {
+		return nil, ErrJobCancelled
+	}
+
+	// 先扣除失败数量再重新入队，避免重试的图片先于扣除完成而使任务被提前判定结束
+	updated, err := w.batchJobs.RevokeFailure(context.Background(), jobID, taskID, task.PromptIndex)
+	revoked := err == nil
+	switch {
+	case errors.Is(err, repository.ErrNotFound):
+		// 失败未计入结果（节点在计入前停止），直接重新入队
+		updated = job
+	case err != nil:
+		return nil, fmt.Errorf("更新任务失败: %v", err)
+	}
+
+	retried, err := w.queueService.RetryFailedTask(taskID)
+	if err != nil {
+		if revoked {
+			w.batchJobs.RecordResult(context.Background(), jobID, taskID, task.PromptIndex, false)
+		}
+		return nil, err
+	}
+
+	// 生成记录回到等待状态
+	if generationID, err := primitive.ObjectIDFromHex(taskID); err == nil {
+		if generation, err := w.generations.GetByID(context.Background(), generationID); err == nil {
+			generation.Status = "pending"
+			generation.ErrorMessage = ""
+			generation.UpdatedAt = time.Now()
+			w.generations.Save(context.Background(), generation)
+		}
+	}
+
+	if updated.Status == "completed" || updated.Status == "failed" {
+		w.updateJobStatus(jobID, "processing")
+		w.queueService.UpdateJobState(task.JobID, "processing", "失败的图片已重新入队")
+	}
+	return retried, nil
+}
+
+// RetryAllTasks 重试失败队列中的全部图片任务，返回重试和跳过的数量；
+// 批量任务已取消或删除的图片以及旧版本留下的项保留在失败队列中
+func (w *BatchWorker) RetryAllTasks() (retried, skipped int, err error) {
+	taskIDs, err := w.queueService.FailedTaskIDs()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, taskID := range taskIDs {
+		_, err := w.RetryTask(taskID)
+		switch {
+		case err == nil:
+			retried++
+		case errors.Is(err, ErrTaskNotFound), errors.Is(err, ErrTaskNotFailed),
+			errors.Is(err, ErrJobCancelled), errors.Is(err, repository.ErrNotFound):
+			skipped++
+		default:
+			return retried, skipped, err
+		}
+	}
+	return retried, skipped, nil
+}
+
+// recordFailures 将超过最大尝试次数的图片任务计为失败
+func (w *BatchWorker) recordFailures(tasks []*models.GenerationTask) {
+	for _, task := range tasks {
+		w.recordResult(task, false)
+	}
+}
+
+// requeueLegacyJobs 将旧版本以整个批量任务为单位排队的任务按剩余数量重新展开为图片任务
+func (w *BatchWorker) requeueLegacyJobs() {
+	jobIDs, err := w.queueService.TakeLegacyJobs()
+	if err != nil {
+		log.Printf("❌ 迁移待处理队列失败: %v", err)
+		return
+	}
+
+	for _, jobID := range jobIDs {
+		id, err := primitive.ObjectIDFromHex(jobID)
+		if err != nil {
+			continue
+		}
+		job, err := w.batchJobs.GetByID(context.Background(), id)
+		if err != nil || job.Status == "cancelled" || job.Status == "completed" || job.Status == "failed" {
+			continue
+		}
+		if err := w.requeueJob(job); err != nil {
+			log.Printf("❌ 批量任务 %s 重新入队失败: %v", jobID, err)
+			continue
+		}
+		log.Printf("♻️ 批量任务 %s 已迁移为按图片排队", jobID)
+	}
+}
+
+// RestoreQueue 按存储中未结束的批量任务重建队列，用于进程内队列随进程退出丢失后的启动恢复；
+// 已计入结果的图片不会重新生成，暂停的任务恢复后仍保持暂停
+func (w *BatchWorker) RestoreQueue() error {
+	for _, status := range []string{"pending", "processing", "interrupted", "paused"} {
+		jobs, _, err := w.batchJobs.List(context.Background(), status, repository.Page{})
+		if err != nil {
+			return fmt.Errorf("读取未完成的批量任务失败: %v", err)
+		}
+
+		for i := range jobs {
+			job := &jobs[i]
+			jobID := job.ID.Hex()
+			if err := w.requeueJob(job); err != nil {
+				log.Printf("❌ 批量任务 %s 恢复入队失败: %v", jobID, err)
+				continue
+			}
+			log.Printf("♻️ 批量任务 %s 已恢复入队", jobID)
+		}
+	}
+
+	return nil
+}
+
+// requeueJob 按剩余数量重新展开批量任务的图片任务；入队时队列状态重置为 pending，随后按数据库中的状态恢复
+func (w *BatchWorker) requeueJob(job *models.BatchJob) error {
+	jobID := job.ID.Hex()
+	if err := w.queueService.AddBatchJob(job); err != nil {
+		return err
+	}
+
+	switch job.Status {
+	case "paused":
+		return w.queueService.PauseJob(jobID)
+	case "processing", "interrupted":
+		return w.queueService.UpdateJobState(jobID, job.Status, "任务已恢复入队")
+	}
+	return nil
+}
+
+// reapLoop 定期回收租约过期的图片任务
+func (w *BatchWorker) reapLoop(ctx context.Context) {
+	ticker := time.NewTicker(w.leaseTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			failed, err := w.queueService.ReapExpiredTasks()
+			if err != nil {
+				log.Printf("❌ 回收过期任务失败: %v", err)
+			}
+			w.recordFailures(failed)
+		}
+	}
+}
+
+// isCancelled 检查任务是否已被取消
+func (w *BatchWorker) isCancelled(jobID string) bool {
+	status, err := w.queueService.GetJobStatus(jobID)
+	if err != nil {
+		return false
+	}
+	return status.Status == "cancelled"
+}
+
+// updateJobStatus 更新批量任务在数据库中的状态
+func (w *BatchWorker) updateJobStatus(id primitive.ObjectID, status string) {
+	w.batchJobs.UpdateStatus(context.Background(), id, status)
+}
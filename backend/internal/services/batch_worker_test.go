@@ -0,0 +1,579 @@
+package services
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"nano-banana-qwen/internal/config"
+	"nano-banana-qwen/internal/models"
+	"nano-banana-qwen/internal/repository"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestQueueServicePriority(t *testing.T) {
+	db := newTestDatabase(t)
+	queue := NewQueueService(db.Redis, &config.Config{WorkerID: "worker-1", JobLeaseTimeout: 60, JobMaxAttempts: 5})
+
+	// 同优先级先入队的先处理，高优先级插到前面
+	names := map[string]string{}
+	ids := map[string]string{}
+	for _, spec := range []struct {
+		name     string
+		priority int
+	}{{"low", -1}, {"first", 0}, {"second", 0}, {"high", 5}} {
+		job := &models.BatchJob{
+			ID:          primitive.NewObjectID(),
+			Prompts:     []models.BatchPrompt{{PromptText: spec.name, Count: 1}},
+			TotalImages: 1,
+			Priority:    spec.priority,
+		}
+		if err := queue.AddBatchJob(job); err != nil {
+			t.Fatalf("任务入队失败: %v", err)
+		}
+		names[job.ID.Hex()] = spec.name
+		ids[spec.name] = job.ID.Hex()
+	}
+
+	// 提高排队中任务的优先级
+	queued, err := queue.SetJobPriority(ids["low"], 3)
+	if err != nil || !queued {
+		t.Fatalf("SetJobPriority = %v, %v", queued, err)
+	}
+
+	var order []string
+	tasks := map[string]*models.GenerationTask{}
+	for {
+		task, err := queue.GetNextBatchTask()
+		if err != nil {
+			t.Fatalf("GetNextBatchTask 失败: %v", err)
+		}
+		if task == nil {
+			break
+		}
+		order = append(order, names[task.JobID])
+		tasks[names[task.JobID]] = task
+	}
+	want := []string{"high", "low", "first", "second"}
+	if len(order) != len(want) {
+		t.Fatalf("出队顺序 = %v, 期望 %v", order, want)
+	}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("出队顺序 = %v, 期望 %v", order, want)
+		}
+	}
+
+	// 中断的图片回到同优先级的队首
+	later := &models.BatchJob{ID: primitive.NewObjectID(), Prompts: []models.BatchPrompt{{PromptText: "later", Count: 1}}, TotalImages: 1}
+	if err := queue.AddBatchJob(later); err != nil {
+		t.Fatalf("任务入队失败: %v", err)
+	}
+	if err := queue.RequeueBatchTask(tasks["second"]); err != nil {
+		t.Fatalf("重新入队失败: %v", err)
+	}
+	if task, _ := queue.GetNextBatchTask(); task == nil || task.JobID != ids["second"] {
+		t.Errorf("重新入队后领取 = %+v, 期望 second", task)
+	}
+}
+
+func TestBatchWorkerInterleavesJobs(t *testing.T) {
+	db := newTestDatabase(t)
+	dir := t.TempDir()
+	cfg := &config.Config{
+		ImageProvider:            "mock",
+		UploadPath:               dir,
+		GeneratedPath:            dir,
+		ThumbnailPath:            dir,
+		TempPath:                 dir,
+		DefaultImageSize:         "256x256",
+		DefaultImageQuality:      "standard",
+		MaxConcurrentGenerations: 1,
+		WorkerID:                 "worker-1",
+		JobLeaseTimeout:          60,
+		JobMaxAttempts:           5,
+	}
+	queue := NewQueueService(db.Redis, cfg)
+	runner := NewGenerationRunner(cfg, db.Repos.Generations, NewProviderRegistry(cfg), NewImageService(cfg, db.Blobs, db.Repos.Images, db.Repos.Generations, db.Repos.BlobRefs), NewEventService(db.Redis))
+	worker := NewBatchWorker(cfg, db.Repos, runner, queue)
+	ctx := context.Background()
+
+	// 大任务先入队，小任务和高优先级任务随后入队
+	names := map[primitive.ObjectID]string{}
+	var jobIDs []primitive.ObjectID
+	for _, spec := range []struct {
+		name     string
+		count    int
+		priority int
+	}{{"A", 3, 0}, {"B", 2, 0}, {"C", 1, 5}} {
+		job := models.BatchJob{
+			ID:          primitive.NewObjectID(),
+			Name:        spec.name,
+			Prompts:     []models.BatchPrompt{{PromptText: "prompt " + spec.name, Count: spec.count}},
+			TotalImages: spec.count,
+			Status:      "pending",
+			Priority:    spec.priority,
+			CreatedAt:   time.Now(),
+		}
+		if err := db.Repos.BatchJobs.Create(ctx, &job); err != nil {
+			t.Fatalf("保存批量任务失败: %v", err)
+		}
+		if err := queue.AddBatchJob(&job); err != nil {
+			t.Fatalf("任务入队失败: %v", err)
+		}
+		names[job.ID] = spec.name
+		jobIDs = append(jobIDs, job.ID)
+	}
+
+	workerCtx, stop := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		worker.Start(workerCtx, ctx)
+		close(done)
+	}()
+	defer func() {
+		stop()
+		<-done
+	}()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for _, id := range jobIDs {
+		for {
+			stored, err := db.Repos.BatchJobs.GetByID(ctx, id)
+			if err != nil {
+				t.Fatalf("读取批量任务失败: %v", err)
+			}
+			if stored.Status == "completed" {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("批量任务 %s 未在期限内完成, 状态 = %s", names[id], stored.Status)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	// 并发数为1时生成记录的创建顺序即调度顺序：高优先级的C最先，A和B轮流
+	generations, _, err := db.Repos.Generations.List(ctx, repository.GenerationFilter{}, repository.Page{})
+	if err != nil {
+		t.Fatalf("查询生成记录失败: %v", err)
+	}
+	sort.Slice(generations, func(i, j int) bool { return generations[i].CreatedAt.Before(generations[j].CreatedAt) })
+	var order string
+	for _, generation := range generations {
+		order += names[*generation.BatchJobID]
+	}
+	if order != "CABABA" {
+		t.Errorf("调度顺序 = %s, 期望 CABABA", order)
+	}
+}
+
+func TestBatchWorkerAggregatesFailedTasks(t *testing.T) {
+	db := newTestDatabase(t)
+	dir := t.TempDir()
+	cfg := &config.Config{
+		ImageProvider:            "unavailable", // 未注册的服务商，每张图片都会失败
+		UploadPath:               dir,
+		GeneratedPath:            dir,
+		ThumbnailPath:            dir,
+		TempPath:                 dir,
+		DefaultImageSize:         "256x256",
+		DefaultImageQuality:      "standard",
+		MaxConcurrentGenerations: 2,
+		WorkerID:                 "worker-1",
+		JobLeaseTimeout:          60,
+		JobMaxAttempts:           5,
+	}
+	queue := NewQueueService(db.Redis, cfg)
+	runner := NewGenerationRunner(cfg, db.Repos.Generations, NewProviderRegistry(cfg), NewImageService(cfg, db.Blobs, db.Repos.Images, db.Repos.Generations, db.Repos.BlobRefs), NewEventService(db.Redis))
+	worker := NewBatchWorker(cfg, db.Repos, runner, queue)
+	ctx := context.Background()
+
+	job := models.BatchJob{
+		ID:          primitive.NewObjectID(),
+		Name:        "failing",
+		Prompts:     []models.BatchPrompt{{PromptText: "cat", Count: 2}, {PromptText: "dog", Count: 1}},
+		TotalImages: 3,
+		Status:      "pending",
+		CreatedAt:   time.Now(),
+	}
+	if err := db.Repos.BatchJobs.Create(ctx, &job); err != nil {
+		t.Fatalf("保存批量任务失败: %v", err)
+	}
+	if err := queue.AddBatchJob(&job); err != nil {
+		t.Fatalf("任务入队失败: %v", err)
+	}
+
+	workerCtx, stop := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		worker.Start(workerCtx, ctx)
+		close(done)
+	}()
+	stopWorker := func() {
+		stop()
+		<-done
+	}
+	defer stopWorker()
+
+	// 全部图片失败后任务由累加结果判定为失败
+	var stored *models.BatchJob
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var err error
+		stored, err = db.Repos.BatchJobs.GetByID(ctx, job.ID)
+		if err != nil {
+			t.Fatalf("读取批量任务失败: %v", err)
+		}
+		if stored.Status == "failed" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("批量任务未在期限内结束, 状态 = %s", stored.Status)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if stored.FailedImages != 3 || stored.CompletedImages != 0 || stored.Prompts[0].Failed != 2 || stored.Prompts[1].Failed != 1 {
+		t.Errorf("累加结果 = %+v", stored)
+	}
+
+	// 结果先于移入失败队列累加，停止处理器后再检查
+	stopWorker()
+
+	// 每张失败的图片都在失败队列中，可以单独重试
+	failed, err := db.Redis.LRange(ctx, "failed_queue", 0, -1).Result()
+	if err != nil || len(failed) != 3 {
+		t.Fatalf("失败队列 = %v, %v", failed, err)
+	}
+	for _, taskID := range failed {
+		task, err := queue.GetTask(taskID)
+		if err != nil || task.Status != "failed" || task.JobID != job.ID.Hex() {
+			t.Errorf("失败的图片任务 = %+v, %v", task, err)
+		}
+	}
+}
+
+// flakyProvider 按提示词返回预设错误的服务商：retry 先失败两次，refused 被内容审核拒绝，down 始终不可用
+type flakyProvider struct {
+	MockProvider
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func (p *flakyProvider) Name() string {
+	return "flaky"
+}
+
+func (p *flakyProvider) Generate(ctx context.Context, prompt string, params models.GenerationParams) (*ImageResult, error) {
+	p.mu.Lock()
+	p.calls[prompt]++
+	calls := p.calls[prompt]
+	p.mu.Unlock()
+
+	switch {
+	case prompt == "refused":
+		return nil, &ProviderError{Kind: ErrorContentPolicy, StatusCode: 400, Message: "content policy violation"}
+	case prompt == "down", prompt == "retry" && calls <= 2:
+		return nil, &ProviderError{Kind: ErrorServer, StatusCode: 503, Message: "service unavailable"}
+	}
+	return p.MockProvider.Generate(ctx, prompt, params)
+}
+
+func TestBatchWorkerRetriesTransientErrors(t *testing.T) {
+	db := newTestDatabase(t)
+	dir := t.TempDir()
+	cfg := &config.Config{
+		ImageProvider:            "flaky",
+		UploadPath:               dir,
+		GeneratedPath:            dir,
+		ThumbnailPath:            dir,
+		TempPath:                 dir,
+		DefaultImageSize:         "256x256",
+		DefaultImageQuality:      "standard",
+		MaxConcurrentGenerations: 2,
+		MaxRetryCount:            2,
+		RetryBaseDelay:           0,
+		WorkerID:                 "worker-1",
+		JobLeaseTimeout:          60,
+		JobMaxAttempts:           5,
+	}
+	provider := &flakyProvider{calls: map[string]int{}}
+	registry := NewProviderRegistry(cfg)
+	registry.Register(provider)
+	queue := NewQueueService(db.Redis, cfg)
+	runner := NewGenerationRunner(cfg, db.Repos.Generations, registry, NewImageService(cfg, db.Blobs, db.Repos.Images, db.Repos.Generations, db.Repos.BlobRefs), NewEventService(db.Redis))
+	worker := NewBatchWorker(cfg, db.Repos, runner, queue)
+	ctx := context.Background()
+
+	jobs := map[string]primitive.ObjectID{}
+	for _, prompt := range []string{"retry", "refused", "down"} {
+		job := models.BatchJob{
+			ID:          primitive.NewObjectID(),
+			Name:        prompt,
+			Prompts:     []models.BatchPrompt{{PromptText: prompt, Count: 1}},
+			TotalImages: 1,
+			Status:      "pending",
+			CreatedAt:   time.Now(),
+		}
+		if err := db.Repos.BatchJobs.Create(ctx, &job); err != nil {
+			t.Fatalf("保存批量任务失败: %v", err)
+		}
+		if err := queue.AddBatchJob(&job); err != nil {
+			t.Fatalf("任务入队失败: %v", err)
+		}
+		jobs[prompt] = job.ID
+	}
+
+	workerCtx, stop := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		worker.Start(workerCtx, ctx)
+		close(done)
+	}()
+	stopWorker := func() {
+		stop()
+		<-done
+	}
+	defer stopWorker()
+
+	want := map[string]struct {
+		status   string
+		calls    int
+		attempts int
+		kind     ErrorKind
+	}{
+		"retry":   {"completed", 3, 2, ErrorServer},
+		"refused": {"failed", 1, 1, ErrorContentPolicy},
+		"down":    {"failed", 3, 3, ErrorServer},
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for prompt, id := range jobs {
+		for {
+			stored, err := db.Repos.BatchJobs.GetByID(ctx, id)
+			if err != nil {
+				t.Fatalf("读取批量任务失败: %v", err)
+			}
+			if stored.Status == want[prompt].status {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("批量任务 %s 状态 = %s, 期望 %s", prompt, stored.Status, want[prompt].status)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	stopWorker()
+
+	// 每次失败的调用及其分类都记录在生成记录上
+	for prompt, id := range jobs {
+		generations, _, err := db.Repos.Generations.List(ctx, repository.GenerationFilter{BatchJobID: &id}, repository.Page{})
+		if err != nil || len(generations) != 1 {
+			t.Fatalf("%s 的生成记录 = %d, %v", prompt, len(generations), err)
+		}
+		generation := generations[0]
+		if provider.calls[prompt] != want[prompt].calls || len(generation.Attempts) != want[prompt].attempts {
+			t.Errorf("%s: 调用 %d 次, 失败记录 %d 条, 期望 %d/%d", prompt, provider.calls[prompt], len(generation.Attempts), want[prompt].calls, want[prompt].attempts)
+			continue
+		}
+		for i, attempt := range generation.Attempts {
+			if attempt.ErrorKind != string(want[prompt].kind) {
+				t.Errorf("%s 第 %d 次失败分类 = %s, 期望 %s", prompt, i+1, attempt.ErrorKind, want[prompt].kind)
+			}
+			// 最后一次失败之前的每次失败都安排了重试
+			if scheduled := attempt.RetryAt != nil; scheduled != (i < want[prompt].attempts-1 || prompt == "retry") {
+				t.Errorf("%s 第 %d 次失败 retry_at = %v", prompt, i+1, attempt.RetryAt)
+			}
+		}
+	}
+
+	if stats, err := queue.GetQueueStats(); err != nil || stats.DelayedJobs != 0 || stats.FailedJobs != 2 {
+		t.Errorf("队列统计 = %+v, %v", stats, err)
+	}
+}
+
+// blockingProvider 一直等到 ctx 取消才返回的服务商，started 在每次调用开始时收到提示词
+type blockingProvider struct {
+	MockProvider
+	started chan string
+}
+
+func (p *blockingProvider) Name() string {
+	return "blocking"
+}
+
+func (p *blockingProvider) Generate(ctx context.Context, prompt string, params models.GenerationParams) (*ImageResult, error) {
+	p.started <- prompt
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestBatchWorkerInterruptedTask(t *testing.T) {
+	db := newTestDatabase(t)
+	dir := t.TempDir()
+	cfg := &config.Config{
+		ImageProvider:       "blocking",
+		UploadPath:          dir,
+		GeneratedPath:       dir,
+		ThumbnailPath:       dir,
+		TempPath:            dir,
+		DefaultImageSize:    "256x256",
+		DefaultImageQuality: "standard",
+		WorkerID:            "worker-1",
+		JobLeaseTimeout:     60,
+		JobMaxAttempts:      5,
+	}
+	provider := &blockingProvider{started: make(chan string, 1)}
+	registry := NewProviderRegistry(cfg)
+	registry.Register(provider)
+	queue := NewQueueService(db.Redis, cfg)
+	runner := NewGenerationRunner(cfg, db.Repos.Generations, registry, NewImageService(cfg, db.Blobs, db.Repos.Images, db.Repos.Generations, db.Repos.BlobRefs), NewEventService(db.Redis))
+	worker := NewBatchWorker(cfg, db.Repos, runner, queue)
+	ctx := context.Background()
+
+	// interrupt 领取一张图片，生成开始后执行 during，再模拟服务停止
+	interrupt := func(name string, during func(job *models.BatchJob)) (*models.BatchJob, *models.GenerationTask) {
+		job := &models.BatchJob{
+			ID:          primitive.NewObjectID(),
+			Name:        name,
+			Prompts:     []models.BatchPrompt{{PromptText: name, Count: 1}},
+			TotalImages: 1,
+			Status:      "pending",
+			CreatedAt:   time.Now(),
+		}
+		if err := db.Repos.BatchJobs.Create(ctx, job); err != nil {
+			t.Fatalf("保存批量任务失败: %v", err)
+		}
+		if err := queue.AddBatchJob(job); err != nil {
+			t.Fatalf("任务入队失败: %v", err)
+		}
+		task, err := queue.GetNextBatchTask()
+		if err != nil || task == nil {
+			t.Fatalf("领取图片任务 = %v, %v", task, err)
+		}
+
+		workCtx, stop := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func() {
+			worker.processTask(workCtx, task)
+			close(done)
+		}()
+		<-provider.started
+		during(job)
+		stop()
+		<-done
+		return job, task
+	}
+
+	// 普通中断：图片放回队列，任务标记为已中断
+	job, task := interrupt("stopped", func(*models.BatchJob) {})
+	if stored, _ := db.Repos.BatchJobs.GetByID(ctx, job.ID); stored.Status != "interrupted" {
+		t.Errorf("中断后任务状态 = %s", stored.Status)
+	}
+	if status, _ := queue.GetJobStatus(job.ID.Hex()); status.Status != "interrupted" {
+		t.Errorf("中断后队列状态 = %s", status.Status)
+	}
+	if next, err := queue.GetNextBatchTask(); err != nil || next == nil || next.ID != task.ID {
+		t.Fatalf("重新领取 = %+v, %v", next, err)
+	}
+	queue.DropBatchTask(task.ID)
+
+	// 生成期间任务被取消：丢弃图片，不能恢复为已中断
+	job, task = interrupt("cancelled", func(job *models.BatchJob) {
+		db.Repos.BatchJobs.UpdateStatus(ctx, job.ID, "cancelled")
+		queue.CancelJob(job.ID.Hex())
+	})
+	if stored, _ := db.Repos.BatchJobs.GetByID(ctx, job.ID); stored.Status != "cancelled" {
+		t.Errorf("取消后任务状态 = %s", stored.Status)
+	}
+	if status, _ := queue.GetJobStatus(job.ID.Hex()); status.Status != "cancelled" {
+		t.Errorf("取消后队列状态 = %s", status.Status)
+	}
+	if next, err := queue.GetNextBatchTask(); err != nil || next != nil {
+		t.Errorf("取消后仍可领取图片: %+v, %v", next, err)
+	}
+	if _, err := queue.GetTask(task.ID); err != ErrTaskNotFound {
+		t.Errorf("取消后任务内容: err = %v, 期望 ErrTaskNotFound", err)
+	}
+	if stats, _ := queue.GetQueueStats(); stats.ProcessingJobs != 0 {
+		t.Errorf("处理中任务数 = %d", stats.ProcessingJobs)
+	}
+}
+
+func TestBatchWorkerRedeliveredTaskCountedOnce(t *testing.T) {
+	db := newTestDatabase(t)
+	dir := t.TempDir()
+	cfg := &config.Config{
+		ImageProvider:       "mock",
+		UploadPath:          dir,
+		GeneratedPath:       dir,
+		ThumbnailPath:       dir,
+		TempPath:            dir,
+		DefaultImageSize:    "256x256",
+		DefaultImageQuality: "standard",
+		WorkerID:            "worker-1",
+		JobLeaseTimeout:     10,
+		JobMaxAttempts:      5,
+	}
+	queue := NewQueueService(db.Redis, cfg)
+	runner := NewGenerationRunner(cfg, db.Repos.Generations, NewProviderRegistry(cfg), NewImageService(cfg, db.Blobs, db.Repos.Images, db.Repos.Generations, db.Repos.BlobRefs), NewEventService(db.Redis))
+	worker := NewBatchWorker(cfg, db.Repos, runner, queue)
+	ctx := context.Background()
+
+	job := models.BatchJob{
+		ID:          primitive.NewObjectID(),
+		Name:        "redelivery",
+		Prompts:     []models.BatchPrompt{{PromptText: "cat", Count: 2}},
+		TotalImages: 2,
+		Status:      "pending",
+		CreatedAt:   time.Now(),
+	}
+	if err := db.Repos.BatchJobs.Create(ctx, &job); err != nil {
+		t.Fatalf("保存批量任务失败: %v", err)
+	}
+	if err := queue.AddBatchJob(&job); err != nil {
+		t.Fatalf("任务入队失败: %v", err)
+	}
+
+	// 生成并计入结果后、移出处理中队列前节点停止
+	task, err := queue.GetNextBatchTask()
+	if err != nil || task == nil {
+		t.Fatalf("领取图片任务 = %v, %v", task, err)
+	}
+	if _, err := worker.generate(ctx, job.ID, task); err != nil {
+		t.Fatalf("生成失败: %v", err)
+	}
+	worker.recordResult(task, true)
+
+	// 租约过期后重新投递，已完成的生成不再重复计入
+	db.embeddedRedis.FastForward(11 * time.Second)
+	if failed, err := queue.ReapExpiredTasks(); err != nil || len(failed) != 0 {
+		t.Fatalf("ReapExpiredTasks = %v, %v", failed, err)
+	}
+	redelivered, err := queue.GetNextBatchTask()
+	if err != nil || redelivered == nil || redelivered.ID != task.ID {
+		t.Fatalf("重新投递 = %+v, %v", redelivered, err)
+	}
+	worker.processTask(ctx, redelivered)
+
+	stored, err := db.Repos.BatchJobs.GetByID(ctx, job.ID)
+	if err != nil || stored.CompletedImages != 1 || stored.FailedImages != 0 || stored.Prompts[0].Completed != 1 || stored.Status == "completed" {
+		t.Fatalf("重新投递后任务 = %+v, %v", stored, err)
+	}
+
+	// 剩余的图片正常计入，任务结束时结果数量等于图片数量
+	next, err := queue.GetNextBatchTask()
+	if err != nil || next == nil || next.ID == task.ID {
+		t.Fatalf("领取第二张 = %+v, %v", next, err)
+	}
+	worker.processTask(ctx, next)
+	stored, err = db.Repos.BatchJobs.GetByID(ctx, job.ID)
+	if err != nil || stored.Status != "completed" || stored.CompletedImages != 2 || stored.Prompts[0].Completed != 2 {
+		t.Errorf("任务结束后 = %+v, %v", stored, err)
+	}
+	if stats, _ := queue.GetQueueStats(); stats.ProcessingJobs != 0 {
+		t.Errorf("处理中任务数 = %d", stats.ProcessingJobs)
+	}
+}
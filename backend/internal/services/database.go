@@ -7,39 +7,112 @@ import (
 	"time"
 
 	"nano-banana-qwen/internal/config"
+	"nano-banana-qwen/internal/repository"
+	"nano-banana-qwen/internal/storage"
 
+	"github.com/alicebob/miniredis/v2"
 	"github.com/redis/go-redis/v9"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-var (
-	MongoDB    *mongo.Database
-	RedisClient *redis.Client
-)
+// Database 一个应用实例持有的全部存储连接
+type Database struct {
+	Mongo *mongo.Database
+	Redis *redis.Client
+	Repos *repository.Repositories
+	Blobs storage.BlobStore
+
+	// embeddedRedis 嵌入式模式下的进程内Redis
+	embeddedRedis *miniredis.Miniredis
+}
+
+// InitDatabase 根据存储模式初始化数据库连接
+func InitDatabase(cfg *config.Config) (*Database, error) {
+	if cfg.StorageMode == "embedded" {
+		return initEmbedded(cfg)
+	}
+
+	db := &Database{}
 
-// InitDatabase 初始化数据库连接
-func InitDatabase() error {
 	// 初始化MongoDB
-	if err := initMongoDB(); err != nil {
-		return fmt.Errorf("MongoDB连接失败: %v", err)
+	if err := db.initMongoDB(cfg); err != nil {
+		return nil, fmt.Errorf("MongoDB连接失败: %v", err)
 	}
 
 	// 初始化Redis
-	if err := initRedis(); err != nil {
-		return fmt.Errorf("Redis连接失败: %v", err)
+	if err := db.initRedis(cfg); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Redis连接失败: %v", err)
+	}
+
+	db.Repos = repository.NewMongoRepositories(db.Mongo)
+
+	// 初始化文件存储
+	blobs, err := storage.New(cfg)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("文件存储初始化失败: %v", err)
 	}
+	db.Blobs = blobs
 
 	log.Println("✅ 数据库连接初始化成功")
-	return nil
+	return db, nil
+}
+
+// initEmbedded 初始化无需外部数据库的嵌入式存储和进程内队列
+func initEmbedded(cfg *config.Config) (*Database, error) {
+	blobs, err := storage.New(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("文件存储初始化失败: %v", err)
+	}
+
+	repos, err := repository.NewEmbeddedRepositories(cfg.EmbeddedDBPath)
+	if err != nil {
+		return nil, err
+	}
+
+	server, err := miniredis.Run()
+	if err != nil {
+		repos.Close()
+		return nil, fmt.Errorf("启动进程内队列失败: %v", err)
+	}
+
+	log.Printf("✅ 嵌入式存储初始化成功: %s", cfg.EmbeddedDBPath)
+	return &Database{
+		Redis:         redis.NewClient(&redis.Options{Addr: server.Addr()}),
+		Repos:         repos,
+		Blobs:         blobs,
+		embeddedRedis: server,
+	}, nil
+}
+
+// NewMemoryDatabase 创建纯内存存储、内存文件存储和进程内Redis，每次调用得到相互隔离的实例，用于测试
+func NewMemoryDatabase() (*Database, error) {
+	server, err := miniredis.Run()
+	if err != nil {
+		return nil, fmt.Errorf("启动进程内队列失败: %v", err)
+	}
+
+	return &Database{
+		Redis:         redis.NewClient(&redis.Options{Addr: server.Addr()}),
+		Repos:         repository.NewMemoryRepositories(),
+		Blobs:         storage.NewMemoryStore(),
+		embeddedRedis: server,
+	}, nil
+}
+
+// InProcessQueue 队列是否运行在进程内，进程退出后队列内容丢失
+func (d *Database) InProcessQueue() bool {
+	return d.embeddedRedis != nil
 }
 
 // initMongoDB 初始化MongoDB连接
-func initMongoDB() error {
+func (d *Database) initMongoDB(cfg *config.Config) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	clientOptions := options.Client().ApplyURI(config.AppConfig.MongoURL)
+	clientOptions := options.Client().ApplyURI(cfg.MongoURL)
 	client, err := mongo.Connect(ctx, clientOptions)
 	if err != nil {
 		return err
@@ -47,46 +120,57 @@ func initMongoDB() error {
 
 	// 测试连接
 	if err = client.Ping(ctx, nil); err != nil {
+		client.Disconnect(context.Background())
 		return err
 	}
 
-	MongoDB = client.Database(config.AppConfig.MongoDatabase)
-	log.Printf("✅ MongoDB连接成功: %s", config.AppConfig.MongoDatabase)
+	d.Mongo = client.Database(cfg.MongoDatabase)
+	log.Printf("✅ MongoDB连接成功: %s", cfg.MongoDatabase)
 	return nil
 }
 
 // initRedis 初始化Redis连接
-func initRedis() error {
-	opt, err := redis.ParseURL(config.AppConfig.RedisURL)
+func (d *Database) initRedis(cfg *config.Config) error {
+	opt, err := redis.ParseURL(cfg.RedisURL)
 	if err != nil {
 		return err
 	}
 
-	RedisClient = redis.NewClient(opt)
+	d.Redis = redis.NewClient(opt)
 
 	// 测试连接
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	if err := RedisClient.Ping(ctx).Err(); err != nil {
+	if err := d.Redis.Ping(ctx).Err(); err != nil {
 		return err
 	}
 
-	log.Printf("✅ Redis连接成功: %s", config.AppConfig.RedisURL)
+	log.Printf("✅ Redis连接成功: %s", cfg.RedisURL)
 	return nil
 }
 
-// CloseDatabases 关闭数据库连接
-func CloseDatabases() {
-	if MongoDB != nil {
-		if err := MongoDB.Client().Disconnect(context.Background()); err != nil {
+// Close 关闭数据库连接
+func (d *Database) Close() {
+	if d.Mongo != nil {
+		if err := d.Mongo.Client().Disconnect(context.Background()); err != nil {
 			log.Printf("MongoDB断开连接错误: %v", err)
 		}
 	}
 
-	if RedisClient != nil {
-		if err := RedisClient.Close(); err != nil {
+	if d.Redis != nil {
+		if err := d.Redis.Close(); err != nil {
 			log.Printf("Redis断开连接错误: %v", err)
 		}
 	}
-}
\ No newline at end of file
+
+	if d.embeddedRedis != nil {
+		d.embeddedRedis.Close()
+	}
+
+	if d.Repos != nil {
+		if err := d.Repos.Close(); err != nil {
+			log.Printf("嵌入式存储关闭错误: %v", err)
+		}
+	}
+}
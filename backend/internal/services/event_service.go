@@ -0,0 +1,58 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// EventService 基于Redis发布订阅的进度事件服务，多实例部署时每个实例都能收到全部事件
+type EventService struct {
+	redis *redis.Client
+}
+
+// NewEventService 创建事件服务实例
+func NewEventService(rdb *redis.Client) *EventService {
+	return &EventService{
+		redis: rdb,
+	}
+}
+
+// JobEventChannel 批量任务事件频道
+func JobEventChannel(jobID string) string {
+	return fmt.Sprintf("job_events:%s", jobID)
+}
+
+// GenerationEventChannel 生成记录事件频道
+func GenerationEventChannel(generationID string) string {
+	return fmt.Sprintf("generation_events:%s", generationID)
+}
+
+// Publish 发布事件，payload 会被序列化为JSON
+func (s *EventService) Publish(channel string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("序列化事件失败: %v", err)
+	}
+
+	if err := s.redis.Publish(context.Background(), channel, data).Err(); err != nil {
+		return fmt.Errorf("发布事件失败: %v", err)
+	}
+
+	return nil
+}
+
+// Subscribe 订阅事件频道，调用方负责关闭返回的订阅
+func (s *EventService) Subscribe(ctx context.Context, channel string) (*redis.PubSub, error) {
+	pubsub := s.redis.Subscribe(ctx, channel)
+
+	// 等待订阅确认，保证之后发布的事件不会丢失
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return nil, fmt.Errorf("订阅事件失败: %v", err)
+	}
+
+	return pubsub, nil
+}
@@ -0,0 +1,184 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"nano-banana-qwen/internal/config"
+	"nano-banana-qwen/internal/models"
+	"nano-banana-qwen/internal/repository"
+)
+
+// ErrGenerationInterrupted 服务停止导致生成被中断，生成记录状态为 interrupted，可重新执行
+var ErrGenerationInterrupted = errors.New("服务停止，生成已中断")
+
+// RetryScheduledError 生成失败但已安排自动重试，生成记录状态为 retrying，由调用方在 RetryAt 之后重新执行
+type RetryScheduledError struct {
+	Err     error
+	RetryAt time.Time
+}
+
+func (e *RetryScheduledError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RetryScheduledError) Unwrap() error {
+	return e.Err
+}
+
+// GenerationRunner 执行单次图片生成并回写生成记录，供同步接口和后台处理器共用
+type GenerationRunner struct {
+	generations  repository.GenerationRepository
+	providers    *ProviderRegistry
+	imageService *ImageService
+	eventService *EventService
+
+	maxRetryCount  int
+	retryBaseDelay time.Duration
+
+	inflight sync.WaitGroup
+}
+
+// NewGenerationRunner 创建生成执行器
+func NewGenerationRunner(cfg *config.Config, generations repository.GenerationRepository, providers *ProviderRegistry, imageService *ImageService, eventService *EventService) *GenerationRunner {
+	return &GenerationRunner{
+		generations:    generations,
+		providers:      providers,
+		imageService:   imageService,
+		eventService:   eventService,
+		maxRetryCount:  cfg.MaxRetryCount,
+		retryBaseDelay: time.Duration(cfg.RetryBaseDelay) * time.Second,
+	}
+}
+
+// Run 为已入库的生成记录调用模型生成图片，并将结果写回 generation
+// ctx 被取消时中断模型调用，生成记录标记为 interrupted 并返回 ErrGenerationInterrupted；
+// 失败可以自动重试时生成记录标记为 retrying 并返回 *RetryScheduledError，否则标记为 failed
+func (r *GenerationRunner) Run(ctx context.Context, generation *models.Generation, sourceImage string) error {
+	r.inflight.Add(1)
+	defer r.inflight.Done()
+
+	if ctx.Err() != nil {
+		r.updateGeneration(generation, "interrupted", ErrGenerationInterrupted.Error(), 0)
+		return ErrGenerationInterrupted
+	}
+
+	startTime := time.Now()
+	r.updateGeneration(generation, "processing", "", 0)
+
+	result, err := r.providers.GenerateWith(ctx, generation.PromptText, generation.IsImg2Img, sourceImage, &generation.GenerationParams)
+	if err != nil {
+		if ctx.Err() != nil {
+			r.updateGeneration(generation, "interrupted", ErrGenerationInterrupted.Error(), time.Since(startTime).Seconds())
+			return ErrGenerationInterrupted
+		}
+		return r.fail(generation, err, time.Since(startTime).Seconds())
+	}
+
+	generation.ResponseText = result.Text
+	generation.Usage = result.Usage
+
+	// 保存全部返回的图片，第一张作为生成记录的主图
+	for _, imageURL := range result.Images {
+		image, err := r.imageService.SaveImage(imageURL, generation)
+		if err != nil {
+			return r.fail(generation, err, time.Since(startTime).Seconds())
+		}
+
+		if generation.ImageID == nil {
+			generation.ImageID = &image.ID
+			generation.ImageURL = image.FilePath
+			generation.ThumbnailURL = image.ThumbnailPath
+		}
+		generation.ImageIDs = append(generation.ImageIDs, image.ID)
+		generation.ImageURLs = append(generation.ImageURLs, image.FilePath)
+	}
+
+	r.updateGeneration(generation, "completed", "", time.Since(startTime).Seconds())
+	return nil
+}
+
+// RunWithRetry 执行生成并在原地等待自动重试，直到成功、不再重试或 ctx 被取消，供同步接口使用
+func (r *GenerationRunner) RunWithRetry(ctx context.Context, generation *models.Generation, sourceImage string) error {
+	for {
+		err := r.Run(ctx, generation, sourceImage)
+		var retry *RetryScheduledError
+		if !errors.As(err, &retry) {
+			return err
+		}
+
+		timer := time.NewTimer(time.Until(retry.RetryAt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			r.updateGeneration(generation, "interrupted", ErrGenerationInterrupted.Error(), generation.GenerationTime)
+			return ErrGenerationInterrupted
+		case <-timer.C:
+		}
+	}
+}
+
+// AbandonRetry 已安排的自动重试无法入队时放弃重试，生成记录标记为 failed
+func (r *GenerationRunner) AbandonRetry(generation *models.Generation) {
+	if n := len(generation.Attempts); n > 0 {
+		generation.Attempts[n-1].RetryAt = nil
+	}
+	r.updateGeneration(generation, "failed", generation.ErrorMessage, generation.GenerationTime)
+}
+
+// Wait 等待所有正在执行的生成结束
+func (r *GenerationRunner) Wait() {
+	r.inflight.Wait()
+}
+
+// recordAttempt 在生成记录中追加一次失败的调用及其错误分类
+func (r *GenerationRunner) recordAttempt(generation *models.Generation, err error) {
+	classified := ClassifyError(err)
+	generation.Attempts = append(generation.Attempts, models.GenerationAttempt{
+		Error:      err.Error(),
+		ErrorKind:  string(classified.Kind),
+		StatusCode: classified.StatusCode,
+		FailedAt:   time.Now(),
+	})
+}
+
+// fail 记录失败的调用并决定是否自动重试，先决定再保存，失败状态不会在安排重试前被推送
+// 连续安排了重试的失败次数超过 MaxRetryCount 后不再重试，手动重试后重新计数
+func (r *GenerationRunner) fail(generation *models.Generation, err error, generationTime float64) error {
+	r.recordAttempt(generation, err)
+
+	classified := ClassifyError(err)
+	if attempt := r.consecutiveFailures(generation); classified.Retryable() && attempt <= r.maxRetryCount {
+		retryAt := time.Now().Add(retryDelay(r.retryBaseDelay, attempt, classified.RetryAfter))
+		generation.Attempts[len(generation.Attempts)-1].RetryAt = &retryAt
+		r.updateGeneration(generation, "retrying", err.Error(), generationTime)
+		return &RetryScheduledError{Err: err, RetryAt: retryAt}
+	}
+
+	r.updateGeneration(generation, "failed", err.Error(), generationTime)
+	return err
+}
+
+// consecutiveFailures 最近一次失败及其之前连续安排了自动重试的失败次数
+func (r *GenerationRunner) consecutiveFailures(generation *models.Generation) int {
+	count := 1
+	for i := len(generation.Attempts) - 2; i >= 0 && generation.Attempts[i].RetryAt != nil; i-- {
+		count++
+	}
+	return count
+}
+
+// updateGeneration 更新生成记录的状态和结果
+func (r *GenerationRunner) updateGeneration(generation *models.Generation, status, errorMsg string, generationTime float64) {
+	generation.Status = status
+	generation.ErrorMessage = errorMsg
+	generation.GenerationTime = generationTime
+	generation.UpdatedAt = time.Now()
+
+	r.generations.Save(context.Background(), generation)
+
+	// 推送生成状态变更事件
+	r.eventService.Publish(GenerationEventChannel(generation.ID.Hex()), generation)
+}
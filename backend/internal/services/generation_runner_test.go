@@ -0,0 +1,243 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"nano-banana-qwen/internal/config"
+	"nano-banana-qwen/internal/models"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// newTestDatabase 创建内存存储，测试结束时关闭
+func newTestDatabase(t *testing.T) *Database {
+	t.Helper()
+
+	db, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatalf("创建内存存储失败: %v", err)
+	}
+	t.Cleanup(db.Close)
+	return db
+}
+
+func TestGenerationRunnerInterrupted(t *testing.T) {
+	db := newTestDatabase(t)
+	dir := t.TempDir()
+	cfg := &config.Config{
+		ImageProvider:       "mock",
+		UploadPath:          dir,
+		GeneratedPath:       dir,
+		ThumbnailPath:       dir,
+		TempPath:            dir,
+		DefaultImageSize:    "256x256",
+		DefaultImageQuality: "standard",
+	}
+	runner := NewGenerationRunner(cfg, db.Repos.Generations, NewProviderRegistry(cfg), NewImageService(cfg, db.Blobs, db.Repos.Images, db.Repos.Generations, db.Repos.BlobRefs), NewEventService(db.Redis))
+
+	generation := models.Generation{
+		ID:               primitive.NewObjectID(),
+		PromptText:       "a red fox",
+		GenerationParams: models.GenerationParams{Provider: "mock", Size: "256x256"},
+		Status:           "pending",
+		CreatedAt:        time.Now(),
+	}
+	if err := db.Repos.Generations.Create(context.Background(), &generation); err != nil {
+		t.Fatalf("写入生成记录失败: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := runner.Run(ctx, &generation, ""); !errors.Is(err, ErrGenerationInterrupted) {
+		t.Fatalf("err = %v, 期望 ErrGenerationInterrupted", err)
+	}
+
+	stored, err := db.Repos.Generations.GetByID(context.Background(), generation.ID)
+	if err != nil {
+		t.Fatalf("读取生成记录失败: %v", err)
+	}
+	if stored.Status != "interrupted" || stored.ImageURL != "" {
+		t.Errorf("生成记录 = %+v", stored)
+	}
+
+	// 恢复后可以重新执行
+	if err := runner.Run(context.Background(), stored, ""); err != nil {
+		t.Fatalf("重新执行失败: %v", err)
+	}
+	if stored.Status != "completed" {
+		t.Errorf("重新执行后状态 = %s", stored.Status)
+	}
+}
+
+func TestGenerationRetriesTransientErrors(t *testing.T) {
+	db := newTestDatabase(t)
+	dir := t.TempDir()
+	cfg := &config.Config{
+		ImageProvider:            "flaky",
+		UploadPath:               dir,
+		GeneratedPath:            dir,
+		ThumbnailPath:            dir,
+		TempPath:                 dir,
+		DefaultImageSize:         "256x256",
+		DefaultImageQuality:      "standard",
+		MaxConcurrentGenerations: 1,
+		MaxRetryCount:            2,
+		RetryBaseDelay:           0,
+		WorkerID:                 "worker-1",
+		JobLeaseTimeout:          60,
+		JobMaxAttempts:           5,
+	}
+	provider := &flakyProvider{calls: map[string]int{}}
+	registry := NewProviderRegistry(cfg)
+	registry.Register(provider)
+	events := NewEventService(db.Redis)
+	images := NewImageService(cfg, db.Blobs, db.Repos.Images, db.Repos.Generations, db.Repos.BlobRefs)
+	runner := NewGenerationRunner(cfg, db.Repos.Generations, registry, images, events)
+	queue := NewQueueService(db.Redis, cfg)
+	ctx := context.Background()
+
+	newGeneration := func(prompt string) *models.Generation {
+		generation := &models.Generation{
+			ID:               primitive.NewObjectID(),
+			PromptText:       prompt,
+			GenerationParams: models.GenerationParams{Provider: "flaky", Size: "256x256"},
+			Status:           "pending",
+			CreatedAt:        time.Now(),
+		}
+		if err := db.Repos.Generations.Create(ctx, generation); err != nil {
+			t.Fatalf("写入生成记录失败: %v", err)
+		}
+		return generation
+	}
+
+	// 同步生成在请求内重试，安排重试时推送 retrying，不会先推送 failed
+	generation := newGeneration("retry")
+	pubsub, err := events.Subscribe(ctx, GenerationEventChannel(generation.ID.Hex()))
+	if err != nil {
+		t.Fatalf("订阅状态事件失败: %v", err)
+	}
+	defer pubsub.Close()
+	if err := runner.RunWithRetry(ctx, generation, ""); err != nil {
+		t.Fatalf("同步生成失败: %v", err)
+	}
+	if generation.Status != "completed" || len(generation.Attempts) != 2 || generation.Attempts[1].RetryAt == nil {
+		t.Errorf("同步生成记录 = %+v", generation)
+	}
+	var statuses []string
+	messages := pubsub.Channel()
+	for len(statuses) == 0 || statuses[len(statuses)-1] != "completed" {
+		select {
+		case msg := <-messages:
+			var event models.Generation
+			if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+				t.Fatalf("解析状态事件失败: %v", err)
+			}
+			statuses = append(statuses, event.Status)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("未收到 completed 事件, 已收到 %v", statuses)
+		}
+	}
+	for _, status := range statuses {
+		if status == "failed" {
+			t.Errorf("安排重试前推送了 failed: %v", statuses)
+		}
+	}
+
+	// 内容审核拒绝不重试
+	refused := newGeneration("refused")
+	if err := runner.RunWithRetry(ctx, refused, ""); err == nil || refused.Status != "failed" || len(refused.Attempts) != 1 || refused.Attempts[0].RetryAt != nil {
+		t.Errorf("内容审核拒绝 = %+v, %v", refused, err)
+	}
+
+	// 异步生成延迟后重新入队，超过 MaxRetryCount 后标记失败
+	worker := NewGenerationWorker(cfg, db.Repos.Generations, runner, images, queue)
+	down := newGeneration("down")
+	if err := queue.AddGenerationTask(down.ID.Hex()); err != nil {
+		t.Fatalf("生成入队失败: %v", err)
+	}
+	workerCtx, stop := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		worker.Start(workerCtx, ctx)
+		close(done)
+	}()
+	defer func() {
+		stop()
+		<-done
+	}()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		stored, err := db.Repos.Generations.GetByID(ctx, down.ID)
+		if err == nil && stored.Status == "failed" {
+			if len(stored.Attempts) != 3 || stored.Attempts[0].RetryAt == nil || stored.Attempts[1].RetryAt == nil || stored.Attempts[2].RetryAt != nil {
+				t.Errorf("异步生成失败记录 = %+v", stored.Attempts)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("异步生成未在期限内结束: %+v, %v", stored, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if n, _ := db.Redis.ZCard(ctx, delayedGenerationsKey).Result(); n != 0 {
+		t.Errorf("等待重试的生成 = %d", n)
+	}
+}
+
+func TestQueueServiceRequeueTask(t *testing.T) {
+	db := newTestDatabase(t)
+	queue := NewQueueService(db.Redis, &config.Config{WorkerID: "worker-1", JobLeaseTimeout: 60, JobMaxAttempts: 5})
+
+	job := &models.BatchJob{ID: primitive.NewObjectID(), Prompts: []models.BatchPrompt{{PromptText: "cat", Count: 2}}, TotalImages: 2}
+	if err := queue.AddBatchJob(job); err != nil {
+		t.Fatalf("任务入队失败: %v", err)
+	}
+	task, err := queue.GetNextBatchTask()
+	if err != nil || task == nil || task.JobID != job.ID.Hex() {
+		t.Fatalf("GetNextBatchTask = %+v, %v", task, err)
+	}
+
+	if err := queue.RequeueBatchTask(task); err != nil {
+		t.Fatalf("重新入队失败: %v", err)
+	}
+
+	// 被中断的图片排在同一任务剩余图片之前，重新领取时不计入尝试次数
+	next, err := queue.GetNextBatchTask()
+	if err != nil || next == nil || next.ID != task.ID {
+		t.Fatalf("重新领取 = %+v, %v", next, err)
+	}
+	if n, _ := db.Redis.HGet(context.Background(), attemptsKey, next.ID).Int(); n != 1 {
+		t.Errorf("尝试次数 = %d, 期望 1", n)
+	}
+
+	// 完成后删除任务内容，失败的任务保留并可以重试一次
+	if err := queue.CompleteBatchTask(next.ID); err != nil {
+		t.Fatalf("完成任务失败: %v", err)
+	}
+	if _, err := queue.GetTask(next.ID); err != ErrTaskNotFound {
+		t.Errorf("完成后读取任务: err = %v, 期望 ErrTaskNotFound", err)
+	}
+
+	last, err := queue.GetNextBatchTask()
+	if err != nil || last == nil {
+		t.Fatalf("领取第二张 = %+v, %v", last, err)
+	}
+	if err := queue.FailBatchTask(last); err != nil {
+		t.Fatalf("任务失败处理出错: %v", err)
+	}
+	if retried, err := queue.RetryFailedTask(last.ID); err != nil || retried.RetryCount != 1 {
+		t.Fatalf("重试 = %+v, %v", retried, err)
+	}
+	if _, err := queue.RetryFailedTask(last.ID); err != ErrTaskNotFailed {
+		t.Errorf("重复重试: err = %v, 期望 ErrTaskNotFailed", err)
+	}
+	if again, err := queue.GetNextBatchTask(); err != nil || again == nil || again.ID != last.ID {
+		t.Errorf("重试后领取 = %+v, %v", again, err)
+	}
+}
@@ -0,0 +1,239 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"nano-banana-qwen/internal/config"
+	"nano-banana-qwen/internal/repository"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// GenerationWorker 异步生成任务处理器，消费 generation_task_queue 中的生成记录ID
+type GenerationWorker struct {
+	generations  repository.GenerationRepository
+	runner       *GenerationRunner
+	imageService *ImageService
+	queueService *QueueService
+	concurrency  int
+	leaseTimeout time.Duration
+}
+
+// NewGenerationWorker 创建异步生成任务处理器
+func NewGenerationWorker(cfg *config.Config, generations repository.GenerationRepository, runner *GenerationRunner, imageService *ImageService, queueService *QueueService) *GenerationWorker {
+	concurrency := cfg.MaxConcurrentGenerations
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	return &GenerationWorker{
+		generations:  generations,
+		runner:       runner,
+		imageService: imageService,
+		queueService: queueService,
+		concurrency:  concurrency,
+		leaseTimeout: cfg.LeaseTimeout(),
+	}
+}
+
+// Start 启动处理循环，ctx 取消后不再领取新任务，等待进行中的生成结束后返回
+// workCtx 取消时中断进行中的生成，被中断的任务重新入队
+func (w *GenerationWorker) Start(ctx, workCtx context.Context) {
+	log.Printf("🛠️ 异步生成处理器已启动 (并发数: %d)", w.concurrency)
+
+	// 启动恢复：回收上次进程崩溃或重启时遗留、租约已过期的异步生成
+	w.reapExpired()
+	go w.reapLoop(ctx)
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, w.concurrency)
+
+	for {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			log.Println("🛑 异步生成处理器已停止")
+			return
+		case sem <- struct{}{}:
+		}
+
+		id, err := w.queueService.GetNextGeneration()
+		if err != nil || id == "" {
+			<-sem
+			if err != nil {
+				log.Printf("❌ 获取生成任务失败: %v", err)
+			}
+			select {
+			case <-ctx.Done():
+			case <-time.After(queuePollTimeout):
+			}
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			w.processTask(workCtx, id)
+		}()
+	}
+}
+
+// processTask 执行一个异步生成，生成参数和源图片都从生成记录读取
+func (w *GenerationWorker) processTask(ctx context.Context, generationID string) {
+	id, err := primitive.ObjectIDFromHex(generationID)
+	if err != nil {
+		log.Printf("❌ 生成任务ID格式无效: %s", generationID)
+		w.queueService.CompleteGeneration(generationID)
+		return
+	}
+
+	generation, err := w.generations.GetByID(context.Background(), id)
+	if err != nil {
+		log.Printf("⚠️ 生成记录 %s 不存在，跳过: %v", generationID, err)
+		w.queueService.CompleteGeneration(generationID)
+		return
+	}
+
+	// 上次停止时被中断、到期自动重试、或租约过期后重新投递的生成可以继续执行
+	switch generation.Status {
+	case "pending", "interrupted", "retrying", "processing":
+	default:
+		w.queueService.CompleteGeneration(generationID)
+		return
+	}
+
+	var sourceImage string
+	if generation.IsImg2Img && generation.SourceImageID != nil {
+		_, dataURL, err := w.imageService.LoadSourceImage(*generation.SourceImageID)
+		if err != nil {
+			log.Printf("❌ 异步生成 %s 读取源图片失败: %v", generationID, err)
+			w.runner.updateGeneration(generation, "failed", "读取源图片失败: "+err.Error(), 0)
+			w.queueService.CompleteGeneration(generationID)
+			return
+		}
+		sourceImage = dataURL
+	}
+
+	// 处理期间持续续租，租约丢失时中断生成
+	taskCtx, cancel := context.WithCancel(ctx)
+	leaseLost := make(chan struct{})
+	heartbeatCtx, stopHeartbeat := context.WithCancel(context.Background())
+	go w.queueService.KeepLease(heartbeatCtx, generationID, cancel, leaseLost)
+
+	runErr := w.runner.Run(taskCtx, generation, sourceImage)
+	stopHeartbeat()
+	cancel()
+
+	select {
+	case <-leaseLost:
+		log.Printf("⚠️ 异步生成 %s 租约已丢失，交由其他节点继续处理", generationID)
+		return
+	default:
+	}
+
+	if errors.Is(runErr, ErrGenerationInterrupted) {
+		if err := w.queueService.RequeueGeneration(generationID); err != nil {
+			log.Printf("❌ 异步生成 %s 重新入队失败: %v", generationID, err)
+			return
+		}
+		log.Printf("⏸️ 异步生成 %s 已中断并重新入队", generationID)
+		return
+	}
+
+	// 限流、服务端错误等暂时性失败延迟后重试
+	var retry *RetryScheduledError
+	if errors.As(runErr, &retry) {
+		err := w.queueService.DelayGeneration(generationID, retry.RetryAt)
+		if err == nil {
+			log.Printf("🔁 异步生成 %s 生成失败 (%s)，%v 后重试", generationID, ClassifyError(runErr).Kind, time.Until(retry.RetryAt).Round(time.Millisecond))
+			return
+		}
+		log.Printf("❌ 异步生成 %s 安排重试失败: %v", generationID, err)
+		w.runner.AbandonRetry(generation)
+	}
+
+	w.queueService.CompleteGeneration(generationID)
+	if runErr != nil {
+		log.Printf("❌ 异步生成 %s 失败: %v", generationID, runErr)
+		return
+	}
+	log.Printf("✅ 异步生成 %s 完成", generationID)
+}
+
+// reapLoop 定期回收租约过期的异步生成
+func (w *GenerationWorker) reapLoop(ctx context.Context) {
+	ticker := time.NewTicker(w.leaseTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.reapExpired()
+		}
+	}
+}
+
+// reapExpired 回收租约过期的异步生成，超过最大尝试次数的生成标记为失败
+func (w *GenerationWorker) reapExpired() {
+	abandoned, err := w.queueService.ReapExpiredGenerations()
+	if err != nil {
+		log.Printf("❌ 回收过期生成任务失败: %v", err)
+		return
+	}
+
+	for _, generationID := range abandoned {
+		id, err := primitive.ObjectIDFromHex(generationID)
+		if err != nil {
+			continue
+		}
+		generation, err := w.generations.GetByID(context.Background(), id)
+		if err != nil {
+			continue
+		}
+		w.runner.updateGeneration(generation, "failed", "任务租约多次过期，超过最大尝试次数", 0)
+	}
+}
+
+// RestoreQueue 按存储中未结束的生成记录重建队列，用于进程内队列随进程退出丢失后的启动恢复；
+// 等待自动重试的生成按原计划时间重新安排，批量任务的图片由 BatchWorker.RestoreQueue 重新展开，遗留的生成记录标记为 interrupted
+func (w *GenerationWorker) RestoreQueue() error {
+	for _, status := range []string{"pending", "processing", "interrupted", "retrying"} {
+		generations, _, err := w.generations.List(context.Background(), repository.GenerationFilter{Status: status}, repository.Page{})
+		if err != nil {
+			return fmt.Errorf("读取未完成的生成记录失败: %v", err)
+		}
+
+		for i := range generations {
+			generation := &generations[i]
+			if generation.BatchJobID != nil {
+				if status != "interrupted" {
+					w.runner.updateGeneration(generation, "interrupted", ErrGenerationInterrupted.Error(), generation.GenerationTime)
+				}
+				continue
+			}
+			if n := len(generation.Attempts); status == "retrying" && n > 0 && generation.Attempts[n-1].RetryAt != nil {
+				if err := w.queueService.DelayGeneration(generation.ID.Hex(), *generation.Attempts[n-1].RetryAt); err != nil {
+					log.Printf("❌ 生成 %s 恢复重试失败: %v", generation.ID.Hex(), err)
+				}
+				continue
+			}
+			if err := w.queueService.AddGenerationTask(generation.ID.Hex()); err != nil {
+				log.Printf("❌ 生成 %s 恢复入队失败: %v", generation.ID.Hex(), err)
+				continue
+			}
+			log.Printf("♻️ 异步生成 %s 已恢复入队", generation.ID.Hex())
+		}
+	}
+
+	return nil
+}
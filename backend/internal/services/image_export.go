@@ -0,0 +1,217 @@
+package services
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"time"
+
+	"nano-banana-qwen/internal/models"
+	"nano-banana-qwen/internal/repository"
+)
+
+// MaxExportImages 单次导出的图片数量上限
+const MaxExportImages = 1000
+
+// ErrTooManyImages 导出的图片超过上限
+var ErrTooManyImages = fmt.Errorf("导出图片数量超过上限 %d", MaxExportImages)
+
+// FindExportImages 按ID列表或过滤条件查找要导出的图片，ID不存在时返回 repository.ErrNotFound
+func (s *ImageService) FindExportImages(req models.ImageExportRequest) ([]models.Image, error) {
+	if len(req.ImageIDs) > 0 {
+		if len(req.ImageIDs) > MaxExportImages {
+			return nil, ErrTooManyImages
+		}
+		images := make([]models.Image, 0, len(req.ImageIDs))
+		for _, id := range req.ImageIDs {
+			image, err := s.images.GetByID(context.Background(), id)
+			if err != nil {
+				return nil, fmt.Errorf("图片 %s: %w", id.Hex(), err)
+			}
+			images = append(images, *image)
+		}
+		return images, nil
+	}
+
+	filter := repository.ImageFilter{}
+	if req.Filter != nil {
+		filter = repository.ImageFilter{
+			Prompt:       req.Filter.Prompt,
+			GenerationID: req.Filter.GenerationID,
+			SHA256:       req.Filter.SHA256,
+		}
+	}
+	images, total, err := s.ListImages(1, MaxExportImages, filter)
+	if err != nil {
+		return nil, err
+	}
+	if total > MaxExportImages {
+		return nil, ErrTooManyImages
+	}
+	return images, nil
+}
+
+// exportEntry manifest 中的一项
+type exportEntry struct {
+	File         string                   `json:"file"`
+	Thumbnail    string                   `json:"thumbnail,omitempty"`
+	ImageID      string                   `json:"image_id"`
+	GenerationID string                   `json:"generation_id,omitempty"`
+	Prompt       string                   `json:"prompt"`
+	Params       *models.GenerationParams `json:"params,omitempty"`
+	Width        int                      `json:"width"`
+	Height       int                      `json:"height"`
+	Format       string                   `json:"format"`
+	SHA256       string                   `json:"sha256"`
+	CreatedAt    time.Time                `json:"created_at"`
+	Error        string                   `json:"error,omitempty"` // 文件读取失败时的原因，此时压缩包中没有该文件
+}
+
+// WriteExport 将图片原图（可选缩略图）和 manifest.json/manifest.csv 逐个写入ZIP，
+// 文件内容直接从文件存储复制到 w，不在内存中缓存整个压缩包
+func (s *ImageService) WriteExport(ctx context.Context, w io.Writer, images []models.Image, thumbnails bool) error {
+	archive := zip.NewWriter(w)
+	entries := make([]exportEntry, 0, len(images))
+
+	for _, image := range images {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		entry := s.exportEntry(&image)
+
+		// 图片已经压缩过，不再deflate；与下载一样写入生成信息
+		var err error
+		if image.GenerationID != nil || image.ImportedMetadata != nil {
+			err = s.writeImageToZip(archive, &image, entry.File)
+		} else {
+			err = s.copyBlobToZip(ctx, archive, image.FilePath, entry.File, image.CreatedAt)
+		}
+		if err != nil {
+			entry.Error = err.Error()
+			entry.File = ""
+			entries = append(entries, entry)
+			continue
+		}
+
+		if thumbnails && image.ThumbnailPath != "" {
+			entry.Thumbnail = "thumbnails/" + image.ID.Hex() + path.Ext(image.ThumbnailPath)
+			if err := s.copyBlobToZip(ctx, archive, image.ThumbnailPath, entry.Thumbnail, image.CreatedAt); err != nil {
+				entry.Thumbnail = ""
+			}
+		}
+		entries = append(entries, entry)
+	}
+
+	if err := writeManifestJSON(archive, entries); err != nil {
+		return err
+	}
+	if err := writeManifestCSV(archive, entries); err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+// exportEntry 组装manifest项，生成参数来自生成记录或导入的生成信息
+func (s *ImageService) exportEntry(image *models.Image) exportEntry {
+	entry := exportEntry{
+		File:      "images/" + image.ID.Hex() + path.Ext(image.FilePath),
+		ImageID:   image.ID.Hex(),
+		Prompt:    image.PromptText,
+		Width:     image.Width,
+		Height:    image.Height,
+		Format:    image.Format,
+		SHA256:    image.SHA256,
+		CreatedAt: image.CreatedAt,
+	}
+
+	if meta, err := s.imageMetadata(image); err == nil && meta != nil {
+		entry.GenerationID = meta.GenerationID
+		entry.Params = &meta.Params
+		if meta.Prompt != "" {
+			entry.Prompt = meta.Prompt
+		}
+	}
+	return entry
+}
+
+// copyBlobToZip 以不压缩的方式把文件存储中的文件复制为压缩包中的一项
+func (s *ImageService) copyBlobToZip(ctx context.Context, archive *zip.Writer, key, name string, modTime time.Time) error {
+	blob, _, err := s.blobs.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	header := &zip.FileHeader{Name: name, Method: zip.Store, Modified: modTime}
+	writer, err := archive.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(writer, blob)
+	return err
+}
+
+// writeImageToZip 将写入了生成信息的原图以不压缩的方式写为压缩包中的一项
+func (s *ImageService) writeImageToZip(archive *zip.Writer, image *models.Image, name string) error {
+	imageData, err := s.ReadImageWithMetadata(image)
+	if err != nil {
+		return err
+	}
+
+	writer, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: image.CreatedAt})
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(imageData)
+	return err
+}
+
+func writeManifestJSON(archive *zip.Writer, entries []exportEntry) error {
+	writer, err := archive.CreateHeader(&zip.FileHeader{Name: "manifest.json", Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(entries)
+}
+
+func writeManifestCSV(archive *zip.Writer, entries []exportEntry) error {
+	writer, err := archive.CreateHeader(&zip.FileHeader{Name: "manifest.csv", Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+
+	// 带BOM，Excel 才能正确识别UTF-8的中文提示词
+	if _, err := writer.Write([]byte("\ufeff")); err != nil {
+		return err
+	}
+
+	out := csv.NewWriter(writer)
+	out.Write([]string{"file", "thumbnail", "image_id", "generation_id", "prompt", "provider", "model", "size", "quality", "strength", "width", "height", "format", "sha256", "created_at", "error"})
+	for _, entry := range entries {
+		var params models.GenerationParams
+		if entry.Params != nil {
+			params = *entry.Params
+		}
+		strength := ""
+		if params.Strength != 0 {
+			strength = strconv.FormatFloat(params.Strength, 'f', -1, 64)
+		}
+		out.Write([]string{
+			entry.File, entry.Thumbnail, entry.ImageID, entry.GenerationID, entry.Prompt,
+			params.Provider, params.Model, params.Size, params.Quality, strength,
+			strconv.Itoa(entry.Width), strconv.Itoa(entry.Height), entry.Format, entry.SHA256,
+			entry.CreatedAt.Format(time.RFC3339), entry.Error,
+		})
+	}
+	out.Flush()
+	return out.Error()
+}
@@ -0,0 +1,114 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	_ "image/png"
+	"net/http"
+
+	"nano-banana-qwen/internal/models"
+	"nano-banana-qwen/internal/storage"
+
+	"github.com/HugoSmits86/nativewebp"
+	"github.com/nfnt/resize"
+	_ "golang.org/x/image/webp"
+)
+
+// imageFormat 支持的图片格式
+type imageFormat struct {
+	name string // 记录在 Image.Format 中的名称
+	ext  string
+}
+
+// imageFormats 支持保存的图片类型，按文件内容识别，键为MIME类型
+var imageFormats = map[string]imageFormat{
+	"image/png":  {name: "PNG", ext: ".png"},
+	"image/jpeg": {name: "JPEG", ext: ".jpg"},
+	"image/webp": {name: "WEBP", ext: ".webp"},
+}
+
+// variantSizes 衍生图的长边尺寸，从小到大，最小的一张作为缩略图
+var variantSizes = []int{200, 512, 1024}
+
+// decodeImage 按文件内容识别格式并解码，不信任扩展名和服务商声明的类型
+func decodeImage(imageData []byte) (image.Image, imageFormat, error) {
+	mimeType := http.DetectContentType(imageData)
+	format, ok := imageFormats[mimeType]
+	if !ok {
+		return nil, imageFormat{}, fmt.Errorf("%w: %s", ErrUnsupportedImageFormat, mimeType)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(imageData))
+	if err != nil {
+		return nil, imageFormat{}, fmt.Errorf("%w: 图片内容无法解析", ErrUnsupportedImageFormat)
+	}
+	return img, format, nil
+}
+
+// planVariants 计算衍生图的尺寸和文件key，保持宽高比且不放大原图。
+// 结果只取决于图片内容，相同内容的图片共用同一组衍生图
+func planVariants(img image.Image, sum string) []models.ImageVariant {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	longEdge := max(width, height)
+
+	// 不透明的图片用JPEG，带透明通道的用无损WebP
+	format, ext := "JPEG", ".jpg"
+	if !isOpaque(img) {
+		format, ext = "WEBP", ".webp"
+	}
+
+	var variants []models.ImageVariant
+	for _, size := range variantSizes {
+		w, h := width, height
+		if size < longEdge {
+			w = max(1, (width*size+longEdge/2)/longEdge)
+			h = max(1, (height*size+longEdge/2)/longEdge)
+		}
+
+		name := fmt.Sprintf("%s/%s_%d%s", sum[:2], sum, max(w, h), ext)
+		variants = append(variants, models.ImageVariant{
+			Width:  w,
+			Height: h,
+			Format: format,
+			Path:   storage.Key(storage.ThumbnailPrefix, name),
+		})
+
+		// 原图已不大于该尺寸，更大的衍生图没有意义
+		if size >= longEdge {
+			break
+		}
+	}
+	return variants
+}
+
+// encodeVariant 按计划缩放并编码衍生图
+func encodeVariant(img image.Image, variant models.ImageVariant) ([]byte, error) {
+	scaled := img
+	if bounds := img.Bounds(); bounds.Dx() != variant.Width || bounds.Dy() != variant.Height {
+		scaled = resize.Resize(uint(variant.Width), uint(variant.Height), img, resize.Lanczos3)
+	}
+
+	var buf bytes.Buffer
+	var err error
+	switch variant.Format {
+	case "WEBP":
+		err = nativewebp.Encode(&buf, scaled, nil)
+	default:
+		err = jpeg.Encode(&buf, scaled, &jpeg.Options{Quality: 85})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// isOpaque 判断图片是否不含透明像素，无法判断时按含透明处理
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	return false
+}
@@ -0,0 +1,53 @@
+package services
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math/bits"
+	"strconv"
+
+	"github.com/nfnt/resize"
+)
+
+// DefaultSimilarDistance 相似图片默认的最大汉明距离，64位dHash相差不超过10位时通常是同一画面
+const DefaultSimilarDistance = 10
+
+// DefaultSimilarLimit 查找近似图片默认返回的最大数量，MaxSimilarLimit 为允许的上限
+const (
+	DefaultSimilarLimit = 50
+	MaxSimilarLimit     = 200
+)
+
+// perceptualHash 计算图片的dHash感知哈希，返回16位十六进制字符串。
+// 缩放到9x8灰度图后比较每行相邻像素的亮度，对缩放、压缩和轻微调色不敏感
+func perceptualHash(img image.Image) string {
+	small := resize.Resize(9, 8, img, resize.Bilinear)
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			left := color.GrayModel.Convert(small.At(x, y)).(color.Gray).Y
+			right := color.GrayModel.Convert(small.At(x+1, y)).(color.Gray).Y
+			hash <<= 1
+			if left > right {
+				hash |= 1
+			}
+		}
+	}
+
+	return fmt.Sprintf("%016x", hash)
+}
+
+// hashDistance 计算两个感知哈希的汉明距离
+func hashDistance(a, b string) (int, error) {
+	x, err := strconv.ParseUint(a, 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("感知哈希格式无效: %s", a)
+	}
+	y, err := strconv.ParseUint(b, 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("感知哈希格式无效: %s", b)
+	}
+	return bits.OnesCount64(x ^ y), nil
+}
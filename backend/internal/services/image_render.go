@@ -0,0 +1,239 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"nano-banana-qwen/internal/models"
+
+	"github.com/HugoSmits86/nativewebp"
+	"github.com/nfnt/resize"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ErrInvalidRenderOptions 渲染参数无效
+var ErrInvalidRenderOptions = errors.New("渲染参数无效")
+
+// maxRenderSize 渲染结果的最大边长
+const maxRenderSize = 4096
+
+// renderFormats 渲染输出格式，键为 format 参数
+var renderFormats = map[string]struct {
+	ext         string
+	contentType string
+}{
+	"jpeg": {ext: ".jpg", contentType: "image/jpeg"},
+	"png":  {ext: ".png", contentType: "image/png"},
+	"webp": {ext: ".webp", contentType: "image/webp"},
+}
+
+// RenderedImage 渲染结果，文件缓存在 TempPath 中
+type RenderedImage struct {
+	Path        string
+	ETag        string
+	ContentType string
+	ModTime     time.Time
+}
+
+// normalizeRenderRequest 校验渲染参数并补全默认值，sourceFormat 为原图格式
+func normalizeRenderRequest(req models.ImageRenderRequest, sourceFormat string) (models.ImageRenderRequest, error) {
+	if req.Width < 0 || req.Height < 0 || req.Width > maxRenderSize || req.Height > maxRenderSize {
+		return req, fmt.Errorf("%w: 宽高应在0到%d之间", ErrInvalidRenderOptions, maxRenderSize)
+	}
+
+	req.Fit = strings.ToLower(req.Fit)
+	switch req.Fit {
+	case "":
+		req.Fit = "contain"
+	case "contain", "cover", "fill":
+	default:
+		return req, fmt.Errorf("%w: 不支持的 fit: %s", ErrInvalidRenderOptions, req.Fit)
+	}
+	// 只给一边时裁剪和拉伸都退化为等比缩放
+	if req.Width == 0 || req.Height == 0 {
+		req.Fit = "contain"
+	}
+
+	req.Format = strings.ToLower(req.Format)
+	switch req.Format {
+	case "":
+		req.Format = strings.ToLower(sourceFormat)
+	case "jpg":
+		req.Format = "jpeg"
+	}
+	if _, ok := renderFormats[req.Format]; !ok {
+		return req, fmt.Errorf("%w: 不支持的 format: %s", ErrInvalidRenderOptions, req.Format)
+	}
+
+	if req.Quality == 0 {
+		req.Quality = 85
+	}
+	if req.Quality < 1 || req.Quality > 100 {
+		return req, fmt.Errorf("%w: q 应在1到100之间", ErrInvalidRenderOptions)
+	}
+	if req.Format != "jpeg" {
+		req.Quality = 0 // 无损格式不使用质量参数，避免产生重复的缓存
+	}
+
+	return req, nil
+}
+
+// RenderImage 按参数从原图缩放、裁剪和转换格式，结果按原图内容和参数缓存在 TempPath 中
+func (s *ImageService) RenderImage(id primitive.ObjectID, req models.ImageRenderRequest) (*RenderedImage, error) {
+	image, err := s.GetImageByID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err = normalizeRenderRequest(req, image.Format)
+	if err != nil {
+		return nil, err
+	}
+	format := renderFormats[req.Format]
+
+	// 原图内容不变时参数相同的渲染结果也不变，旧记录没有内容哈希时用文件key代替
+	source := image.SHA256
+	if source == "" {
+		source = image.FilePath
+	}
+	digest := sha256.Sum256([]byte(fmt.Sprintf("%s|%d|%d|%s|%s|%d", source, req.Width, req.Height, req.Fit, req.Format, req.Quality)))
+	cacheKey := fmt.Sprintf("%x", digest[:16])
+	cachePath := filepath.Join(s.config.TempPath, "render_"+cacheKey+format.ext)
+
+	rendered := &RenderedImage{
+		Path:        cachePath,
+		ETag:        `"` + cacheKey + `"`,
+		ContentType: format.contentType,
+	}
+	if info, err := os.Stat(cachePath); err == nil {
+		rendered.ModTime = info.ModTime()
+		return rendered, nil
+	}
+
+	imageData, err := s.ReadImageFile(image.FilePath)
+	if err != nil {
+		return nil, fmt.Errorf("读取原图失败: %v", err)
+	}
+	img, _, err := decodeImage(imageData)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeRenderCache(cachePath, transformImage(img, req), req); err != nil {
+		return nil, fmt.Errorf("写入渲染缓存失败: %v", err)
+	}
+	log.Printf("🖼️ 已渲染图片 %s: %dx%d %s %s", id.Hex(), req.Width, req.Height, req.Fit, req.Format)
+
+	rendered.ModTime = time.Now()
+	return rendered, nil
+}
+
+// transformImage 按 fit 模式缩放图片
+func transformImage(img image.Image, req models.ImageRenderRequest) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	switch req.Fit {
+	case "fill":
+		return resize.Resize(uint(req.Width), uint(req.Height), img, resize.Lanczos3)
+
+	case "cover":
+		// 按较大的缩放比例铺满目标尺寸，再居中裁剪
+		scale := max(float64(req.Width)/float64(width), float64(req.Height)/float64(height))
+		w := max(req.Width, int(float64(width)*scale+0.5))
+		h := max(req.Height, int(float64(height)*scale+0.5))
+		scaled := resize.Resize(uint(w), uint(h), img, resize.Lanczos3)
+
+		x := (w - req.Width) / 2
+		y := (h - req.Height) / 2
+		return scaled.(interface {
+			SubImage(r image.Rectangle) image.Image
+		}).SubImage(image.Rect(x, y, x+req.Width, y+req.Height))
+
+	default:
+		// contain: 缩放到框内，不放大原图
+		if req.Width == 0 && req.Height == 0 {
+			return img
+		}
+		scale := 1.0
+		if req.Width > 0 && float64(req.Width)/float64(width) < scale {
+			scale = float64(req.Width) / float64(width)
+		}
+		if req.Height > 0 && float64(req.Height)/float64(height) < scale {
+			scale = float64(req.Height) / float64(height)
+		}
+		if scale >= 1 {
+			return img
+		}
+		w := max(1, int(float64(width)*scale+0.5))
+		h := max(1, int(float64(height)*scale+0.5))
+		return resize.Resize(uint(w), uint(h), img, resize.Lanczos3)
+	}
+}
+
+// writeRenderCache 编码渲染结果并写入缓存文件，先写临时文件再重命名，并发请求不会读到写了一半的文件
+func writeRenderCache(cachePath string, img image.Image, req models.ImageRenderRequest) error {
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(cachePath), ".render-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := encodeRender(tmp, img, req); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), cachePath)
+}
+
+// encodeRender 按输出格式编码
+func encodeRender(w io.Writer, img image.Image, req models.ImageRenderRequest) error {
+	switch req.Format {
+	case "jpeg":
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: req.Quality})
+	case "webp":
+		return nativewebp.Encode(w, img, nil)
+	default:
+		return png.Encode(w, img)
+	}
+}
+
+// RunTempCleanup 定期清理 TempPath 中超过 maxAge 的文件（包括渲染缓存），直到 ctx 取消
+func (s *ImageService) RunTempCleanup(ctx context.Context, maxAge time.Duration) {
+	interval := time.Hour
+	if maxAge < interval {
+		interval = maxAge
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.CleanupTempFiles(maxAge); err != nil && !errors.Is(err, os.ErrNotExist) {
+				log.Printf("⚠️ 清理临时文件失败: %v", err)
+			}
+		}
+	}
+}
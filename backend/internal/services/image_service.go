@@ -3,296 +3,665 @@ package services
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"image"
-	"image/jpeg"
-	"image/png"
 	"io"
+	"log"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
 	"nano-banana-qwen/internal/config"
+	"nano-banana-qwen/internal/imagemeta"
 	"nano-banana-qwen/internal/models"
+	"nano-banana-qwen/internal/repository"
+	"nano-banana-qwen/internal/storage"
 
-	"github.com/nfnt/resize"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+// ErrUnsupportedImageFormat 图片不是支持的格式（PNG、JPEG、WebP）或内容无法解析
+var ErrUnsupportedImageFormat = errors.New("不支持的图片格式")
+
 type ImageService struct {
+	config      *config.Config
+	blobs       storage.BlobStore
+	images      repository.ImageRepository
+	generations repository.GenerationRepository
+	blobRefs    repository.BlobRefRepository
 }
 
-// NewImageService 创建图片服务实例
-func NewImageService() *ImageService {
-	return &ImageService{}
+// NewImageService 创建图片服务实例，图片文件按内容哈希保存在 blobs 中，FilePath/ThumbnailPath 记录文件key，
+// 相同内容的图片共用文件，由 blobRefs 记录引用数
+func NewImageService(cfg *config.Config, blobs storage.BlobStore, images repository.ImageRepository, generations repository.GenerationRepository, blobRefs repository.BlobRefRepository) *ImageService {
+	return &ImageService{
+		config:      cfg,
+		blobs:       blobs,
+		images:      images,
+		generations: generations,
+		blobRefs:    blobRefs,
+	}
 }
 
-// SaveImageFromURL 从URL下载并保存图片
-func (s *ImageService) SaveImageFromURL(imageURL, generationID string) (localPath, thumbnailPath string, err error) {
-	// 确保目录存在
-	if err := s.ensureDirectories(); err != nil {
-		return "", "", fmt.Errorf("创建目录失败: %v", err)
+// SaveImage 保存生成结果，自动区分data URL和HTTP URL
+func (s *ImageService) SaveImage(imageURL string, generation *models.Generation) (*models.Image, error) {
+	if strings.HasPrefix(imageURL, "data:") {
+		return s.SaveImageFromBase64(imageURL, generation)
 	}
+	return s.SaveImageFromURL(imageURL, generation)
+}
 
+// SaveImageFromURL 从URL下载并保存图片
+func (s *ImageService) SaveImageFromURL(imageURL string, generation *models.Generation) (*models.Image, error) {
 	// 下载图片
 	resp, err := http.Get(imageURL)
 	if err != nil {
-		return "", "", fmt.Errorf("下载图片失败: %v", err)
+		return nil, fmt.Errorf("下载图片失败: %v", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return "", "", fmt.Errorf("下载图片失败，状态码: %d", resp.StatusCode)
+		return nil, fmt.Errorf("下载图片失败，状态码: %d", resp.StatusCode)
 	}
 
 	// 读取图片数据
 	imageData, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return "", "", fmt.Errorf("读取图片数据失败: %v", err)
+		return nil, fmt.Errorf("读取图片数据失败: %v", err)
 	}
 
-	// 生成文件名
-	timestamp := time.Now().Format("20060102_150405")
-	filename := fmt.Sprintf("generated_%s_%s.png", timestamp, generationID[:8])
-	
-	// 保存原图
-	localPath = filepath.Join(config.AppConfig.GeneratedPath, filename)
-	if err := s.saveImageFile(localPath, imageData); err != nil {
-		return "", "", fmt.Errorf("保存原图失败: %v", err)
+	return s.saveGeneratedImage(imageData, generation)
+}
+
+// SaveImageFromBase64 从base64数据保存图片
+func (s *ImageService) SaveImageFromBase64(base64Data string, generation *models.Generation) (*models.Image, error) {
+	// 处理base64数据（去除data:image/xxx;base64,前缀）
+	if strings.Contains(base64Data, ",") {
+		parts := strings.Split(base64Data, ",")
+		if len(parts) > 1 {
+			base64Data = parts[1]
+		}
+	}
+
+	// 解码base64
+	imageData, err := base64.StdEncoding.DecodeString(base64Data)
+	if err != nil {
+		return nil, fmt.Errorf("base64解码失败: %v", err)
+	}
+
+	return s.saveGeneratedImage(imageData, generation)
+}
+
+// saveGeneratedImage 保存原图和衍生图，并写入关联到生成记录的图片元数据
+func (s *ImageService) saveGeneratedImage(imageData []byte, generation *models.Generation) (*models.Image, error) {
+	// 服务商返回的可能是PNG、JPEG或WebP，按内容识别
+	img, format, err := decodeImage(imageData)
+	if err != nil {
+		return nil, err
 	}
 
-	// 生成缩略图
-	thumbnailFilename := fmt.Sprintf("thumb_%s", filename)
-	thumbnailPath = filepath.Join(config.AppConfig.ThumbnailPath, thumbnailFilename)
-	if err := s.generateThumbnail(imageData, thumbnailPath); err != nil {
-		return "", "", fmt.Errorf("生成缩略图失败: %v", err)
+	// 按内容哈希保存原图和衍生图，相同的输出只存一份
+	sum, fileKey, variants, err := s.storeContent(storage.GeneratedPrefix, imageData, img, format)
+	if err != nil {
+		return nil, err
 	}
 
 	// 保存图片元数据到数据库
+	filename := path.Base(fileKey)
+	generationID := generation.ID
 	imageInfo := models.Image{
 		ID:               primitive.NewObjectID(),
 		Filename:         filename,
 		OriginalFilename: filename,
-		FilePath:         localPath,
-		ThumbnailPath:    thumbnailPath,
+		FilePath:         fileKey,
+		ThumbnailPath:    variants[0].Path,
 		FileSize:         int64(len(imageData)),
-		Format:           "PNG",
+		SHA256:           sum,
+		PHash:            perceptualHash(img),
+		Width:            img.Bounds().Dx(),
+		Height:           img.Bounds().Dy(),
+		Format:           format.name,
+		Variants:         variants,
+		GenerationID:     &generationID,
+		PromptText:       generation.PromptText,
+		IsImg2Img:        generation.IsImg2Img,
+		SourceImageID:    generation.SourceImageID,
 		CreatedAt:        time.Now(),
 		Deleted:          false,
 	}
 
-	// 获取图片尺寸
-	if width, height, err := s.getImageDimensions(imageData); err == nil {
-		imageInfo.Width = width
-		imageInfo.Height = height
-	}
-
 	// 保存到数据库
-	_, err = MongoDB.Collection("images").InsertOne(context.Background(), imageInfo)
-	if err != nil {
-		return "", "", fmt.Errorf("保存图片信息到数据库失败: %v", err)
+	if err := s.images.Create(context.Background(), &imageInfo); err != nil {
+		s.releaseContent(fileKey, imageBlobKeys(&imageInfo)...)
+		return nil, fmt.Errorf("保存图片信息到数据库失败: %v", err)
 	}
 
-	return localPath, thumbnailPath, nil
+	return &imageInfo, nil
 }
 
-// SaveImageFromBase64 从base64数据保存图片
-func (s *ImageService) SaveImageFromBase64(base64Data, generationID string) (localPath, thumbnailPath string, err error) {
-	// 处理base64数据（去除data:image/xxx;base64,前缀）
-	if strings.Contains(base64Data, ",") {
-		parts := strings.Split(base64Data, ",")
-		if len(parts) > 1 {
-			base64Data = parts[1]
+// SaveUploadedImage 校验并保存用户上传的图片，写入标记为 uploaded 的图片元数据
+func (s *ImageService) SaveUploadedImage(imageData []byte, originalFilename string) (*models.Image, error) {
+	return s.saveUploadedImage(imageData, originalFilename, nil)
+}
+
+// ImportImage 导入之前下载的图片，读取文件中的生成信息记录在 imported_metadata 上；
+// 没有生成信息的图片按普通上传处理
+func (s *ImageService) ImportImage(imageData []byte, originalFilename string) (*models.Image, error) {
+	meta, err := imagemeta.Extract(imageData)
+	if err != nil {
+		if !errors.Is(err, imagemeta.ErrNoMetadata) && !errors.Is(err, imagemeta.ErrUnsupportedFormat) {
+			log.Printf("⚠️ 读取图片生成信息失败 %s: %v", originalFilename, err)
 		}
+		meta = nil
 	}
 
-	// 解码base64
-	imageData, err := base64.StdEncoding.DecodeString(base64Data)
+	return s.saveUploadedImage(imageData, originalFilename, meta)
+}
+
+// saveUploadedImage 保存上传的图片，meta 非空时记录导入的生成信息和提示词
+func (s *ImageService) saveUploadedImage(imageData []byte, originalFilename string, meta *models.ImageMetadata) (*models.Image, error) {
+	// 按文件内容识别类型，不信任扩展名和请求头
+	img, format, err := decodeImage(imageData)
 	if err != nil {
-		return "", "", fmt.Errorf("base64解码失败: %v", err)
+		return nil, err
 	}
 
-	// 确保目录存在
-	if err := s.ensureDirectories(); err != nil {
-		return "", "", fmt.Errorf("创建目录失败: %v", err)
+	sum, fileKey, variants, err := s.storeContent(storage.UploadPrefix, imageData, img, format)
+	if err != nil {
+		return nil, err
 	}
 
-	// 生成文件名
-	timestamp := time.Now().Format("20060102_150405")
-	filename := fmt.Sprintf("generated_%s_%s.png", timestamp, generationID[:8])
-	
-	// 保存原图
-	localPath = filepath.Join(config.AppConfig.GeneratedPath, filename)
-	if err := s.saveImageFile(localPath, imageData); err != nil {
-		return "", "", fmt.Errorf("保存原图失败: %v", err)
+	imageInfo := models.Image{
+		ID:               primitive.NewObjectID(),
+		Filename:         path.Base(fileKey),
+		OriginalFilename: filepath.Base(originalFilename),
+		FilePath:         fileKey,
+		ThumbnailPath:    variants[0].Path,
+		FileSize:         int64(len(imageData)),
+		SHA256:           sum,
+		PHash:            perceptualHash(img),
+		Width:            img.Bounds().Dx(),
+		Height:           img.Bounds().Dy(),
+		Format:           format.name,
+		Variants:         variants,
+		Uploaded:         true,
+		ImportedMetadata: meta,
+		CreatedAt:        time.Now(),
+		Deleted:          false,
+	}
+	if meta != nil {
+		imageInfo.PromptText = meta.Prompt
 	}
 
-	// 生成缩略图
-	thumbnailFilename := fmt.Sprintf("thumb_%s", filename)
-	thumbnailPath = filepath.Join(config.AppConfig.ThumbnailPath, thumbnailFilename)
-	if err := s.generateThumbnail(imageData, thumbnailPath); err != nil {
-		return "", "", fmt.Errorf("生成缩略图失败: %v", err)
+	if err := s.images.Create(context.Background(), &imageInfo); err != nil {
+		s.releaseContent(fileKey, imageBlobKeys(&imageInfo)...)
+		return nil, fmt.Errorf("保存图片信息到数据库失败: %v", err)
 	}
 
-	return localPath, thumbnailPath, nil
+	return &imageInfo, nil
 }
 
-// ensureDirectories 确保必要的目录存在
-func (s *ImageService) ensureDirectories() error {
-	dirs := []string{
-		config.AppConfig.GeneratedPath,
-		config.AppConfig.ThumbnailPath,
-		config.AppConfig.TempPath,
-		config.AppConfig.UploadPath,
+// SaveSourceImage 保存图生图请求中直接传入的base64源图片，异步生成执行时再按图片ID读取
+func (s *ImageService) SaveSourceImage(sourceImage string) (*models.Image, error) {
+	imageData, err := decodeDataURL(sourceImage)
+	if err != nil {
+		return nil, err
 	}
+	return s.SaveUploadedImage(imageData, "source_image")
+}
 
-	for _, dir := range dirs {
-		if err := os.MkdirAll(dir, 0755); err != nil {
-			return fmt.Errorf("创建目录 %s 失败: %v", dir, err)
-		}
+// LoadSourceImage 读取已上传或已生成的图片，返回图片记录和供图生图使用的 data URL
+func (s *ImageService) LoadSourceImage(id primitive.ObjectID) (*models.Image, string, error) {
+	image, err := s.images.GetByID(context.Background(), id)
+	if err != nil {
+		return nil, "", err
 	}
 
-	return nil
+	imageData, err := s.ReadImageFile(image.FilePath)
+	if err != nil {
+		return nil, "", fmt.Errorf("读取源图片失败: %v", err)
+	}
+
+	dataURL := fmt.Sprintf("data:%s;base64,%s", http.DetectContentType(imageData), base64.StdEncoding.EncodeToString(imageData))
+	return image, dataURL, nil
 }
 
-// saveImageFile 保存图片文件
-func (s *ImageService) saveImageFile(filePath string, imageData []byte) error {
-	file, err := os.Create(filePath)
+// ReadImageWithMetadata 读取原图并写入生成信息，用于下载、/files 和 ZIP 导出。
+// 生成信息在读取时写入而不是保存时写入：原图以内容哈希命名并按哈希去重、计算感知哈希，
+// 写入各自的提示词和生成记录ID后相同内容的图片会变成不同的文件，无法再共用存储；
+// 对外提供原图的入口都经过这里，取得的文件与保存时写入的效果相同。没有生成记录或格式不支持时返回原图
+func (s *ImageService) ReadImageWithMetadata(image *models.Image) ([]byte, error) {
+	imageData, err := s.ReadImageFile(image.FilePath)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer file.Close()
 
-	_, err = file.Write(imageData)
-	return err
+	meta, err := s.imageMetadata(image)
+	if err != nil || meta == nil {
+		return imageData, nil
+	}
+
+	embedded, err := imagemeta.Embed(imageData, meta)
+	if err != nil {
+		if !errors.Is(err, imagemeta.ErrUnsupportedFormat) {
+			log.Printf("⚠️ 写入图片生成信息失败 %s: %v", image.ID.Hex(), err)
+		}
+		return imageData, nil
+	}
+	return embedded, nil
 }
 
-// generateThumbnail 生成缩略图
-func (s *ImageService) generateThumbnail(imageData []byte, thumbnailPath string) error {
-	// 解码图片
-	img, _, err := image.Decode(bytes.NewReader(imageData))
+// FileImage 返回以 key 为原图的图片记录，内容相同的图片共用同一个文件，此时返回最近保存的一张；
+// key 不是原图文件或没有图片引用时返回nil
+func (s *ImageService) FileImage(key string) (*models.Image, error) {
+	key = strings.TrimPrefix(key, "/")
+	prefix, _, _ := strings.Cut(key, "/")
+	if prefix != storage.GeneratedPrefix && prefix != storage.UploadPrefix {
+		return nil, nil
+	}
+
+	// 原图以内容哈希命名
+	sum := strings.TrimSuffix(path.Base(key), path.Ext(key))
+	if len(sum) != sha256.Size*2 {
+		return nil, nil
+	}
+
+	images, _, err := s.images.List(context.Background(), repository.ImageFilter{SHA256: sum}, repository.Page{Page: 1, PageSize: 1})
 	if err != nil {
-		return fmt.Errorf("解码图片失败: %v", err)
+		return nil, err
+	}
+	if len(images) == 0 || images[0].FilePath != key {
+		return nil, nil
 	}
+	return &images[0], nil
+}
 
-	// 调整尺寸为200x200
-	thumbnail := resize.Resize(200, 200, img, resize.Lanczos3)
+// imageMetadata 由图片的生成记录组装生成信息，导入的图片沿用导入时读到的信息
+func (s *ImageService) imageMetadata(image *models.Image) (*models.ImageMetadata, error) {
+	if image.GenerationID == nil {
+		return image.ImportedMetadata, nil
+	}
 
-	// 保存缩略图
-	file, err := os.Create(thumbnailPath)
+	generation, err := s.generations.GetByID(context.Background(), *image.GenerationID)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer file.Close()
+	return &models.ImageMetadata{
+		GenerationID: generation.ID.Hex(),
+		Prompt:       generation.PromptText,
+		Params:       generation.GenerationParams,
+	}, nil
+}
 
-	// 根据文件扩展名决定编码格式
-	ext := strings.ToLower(filepath.Ext(thumbnailPath))
-	switch ext {
-	case ".jpg", ".jpeg":
-		err = jpeg.Encode(file, thumbnail, &jpeg.Options{Quality: 85})
-	case ".png":
-		err = png.Encode(file, thumbnail)
-	default:
-		err = png.Encode(file, thumbnail) // 默认PNG
+// ReadImageFile 读取文件存储中的完整文件内容
+func (s *ImageService) ReadImageFile(key string) ([]byte, error) {
+	blob, _, err := s.blobs.Get(context.Background(), key)
+	if err != nil {
+		return nil, err
 	}
+	defer blob.Close()
 
-	return err
+	return io.ReadAll(blob)
 }
 
-// getImageDimensions 获取图片尺寸
-func (s *ImageService) getImageDimensions(imageData []byte) (width, height int, err error) {
-	config, _, err := image.DecodeConfig(bytes.NewReader(imageData))
+// storeContent 以内容哈希为文件名保存原图和衍生图，返回哈希、原图key和衍生图。
+// 文件已被其他图片引用时不重复写入，但首次写入可能失败或尚未完成，缺少的文件由本次补写；
+// 各存储后端的写入对读取方都是原子的，已存在的文件一定完整
+func (s *ImageService) storeContent(prefix string, imageData []byte, img image.Image, format imageFormat) (sum, fileKey string, variants []models.ImageVariant, err error) {
+	digest := sha256.Sum256(imageData)
+	sum = hex.EncodeToString(digest[:])
+
+	// 按哈希前两位分目录，避免单个目录文件过多
+	fileKey = storage.Key(prefix, sum[:2]+"/"+sum+format.ext)
+	variants = planVariants(img, sum)
+
+	ctx := context.Background()
+	refs, err := s.blobRefs.Acquire(ctx, fileKey)
 	if err != nil {
-		return 0, 0, err
+		return "", "", nil, fmt.Errorf("更新文件引用失败: %v", err)
+	}
+	shared := refs > 1
+
+	variantKeys := make([]string, 0, len(variants))
+	for _, variant := range variants {
+		variantKeys = append(variantKeys, variant.Path)
+	}
+	if !shared || !s.blobExists(ctx, fileKey) {
+		if err := s.saveImageFile(fileKey, imageData); err != nil {
+			s.releaseContent(fileKey, variantKeys...)
+			return "", "", nil, fmt.Errorf("保存原图失败: %v", err)
+		}
 	}
-	return config.Width, config.Height, nil
+	for _, variant := range variants {
+		if shared && s.blobExists(ctx, variant.Path) {
+			continue
+		}
+		data, err := encodeVariant(img, variant)
+		if err == nil {
+			err = s.saveImageFile(variant.Path, data)
+		}
+		if err != nil {
+			s.releaseContent(fileKey, variantKeys...)
+			return "", "", nil, fmt.Errorf("生成缩略图失败: %v", err)
+		}
+	}
+
+	return sum, fileKey, variants, nil
 }
 
-// GetImageByID 根据ID获取图片信息
-func (s *ImageService) GetImageByID(id primitive.ObjectID) (*models.Image, error) {
-	var image models.Image
-	err := MongoDB.Collection("images").FindOne(context.Background(), bson.M{
-		"_id":     id,
-		"deleted": false,
-	}).Decode(&image)
+// blobExists 文件是否已写入文件存储
+func (s *ImageService) blobExists(ctx context.Context, key string) bool {
+	blob, _, err := s.blobs.Get(ctx, key)
+	if err != nil {
+		return false
+	}
+	blob.Close()
+	return true
+}
 
+// releaseContent 释放一次文件引用，没有图片再引用时删除原图和衍生图
+func (s *ImageService) releaseContent(fileKey string, derivedKeys ...string) {
+	ctx := context.Background()
+	refs, err := s.blobRefs.Release(ctx, fileKey)
 	if err != nil {
-		return nil, err
+		log.Printf("⚠️ 释放文件引用失败 %s: %v", fileKey, err)
+		return
 	}
+	if refs > 0 {
+		return
+	}
+
+	for _, key := range append([]string{fileKey}, derivedKeys...) {
+		if key == "" {
+			continue
+		}
+		if err := s.blobs.Delete(ctx, key); err != nil {
+			log.Printf("⚠️ 删除文件失败 %s: %v", key, err)
+		}
+	}
+}
+
+// imageBlobKeys 图片的全部衍生文件key，兼容只有 ThumbnailPath 的旧记录
+func imageBlobKeys(image *models.Image) []string {
+	keys := make([]string, 0, len(image.Variants)+1)
+	for _, variant := range image.Variants {
+		keys = append(keys, variant.Path)
+	}
+	if len(image.Variants) == 0 {
+		keys = append(keys, image.ThumbnailPath)
+	}
+	return keys
+}
+
+// saveImageFile 保存图片文件到文件存储
+func (s *ImageService) saveImageFile(key string, imageData []byte) error {
+	return s.blobs.Put(context.Background(), key, bytes.NewReader(imageData), int64(len(imageData)), http.DetectContentType(imageData))
+}
 
-	return &image, nil
+// GetImageByID 根据ID获取图片信息
+func (s *ImageService) GetImageByID(id primitive.ObjectID) (*models.Image, error) {
+	return s.images.GetByID(context.Background(), id)
 }
 
 // DeleteImage 删除图片（软删除）
 func (s *ImageService) DeleteImage(id primitive.ObjectID) error {
-	update := bson.M{
-		"$set": bson.M{
-			"deleted":        true,
-			"deleted_at":     time.Now(),
-			"deleted_reason": "用户删除",
-		},
+	err := s.images.SoftDelete(context.Background(), id, "用户删除")
+	if err == repository.ErrNotFound {
+		return fmt.Errorf("图片不存在")
 	}
 
-	result, err := MongoDB.Collection("images").UpdateOne(context.Background(), bson.M{
-		"_id":     id,
-		"deleted": false,
-	}, update)
+	return err
+}
 
+// PurgeImage 永久删除图片记录（包括已软删除的图片），文件在最后一个引用删除后才会移除
+func (s *ImageService) PurgeImage(id primitive.ObjectID) error {
+	image, err := s.images.Purge(context.Background(), id)
 	if err != nil {
 		return err
 	}
 
-	if result.MatchedCount == 0 {
-		return fmt.Errorf("图片不存在")
+	s.releaseContent(image.FilePath, imageBlobKeys(image)...)
+	return nil
+}
+
+// ListImages 获取图片列表，可按提示词和内容哈希过滤
+func (s *ImageService) ListImages(page, pageSize int, filter repository.ImageFilter) ([]models.Image, int64, error) {
+	filter.SHA256 = strings.ToLower(filter.SHA256)
+	return s.images.List(context.Background(), filter, repository.Page{Page: page, PageSize: pageSize})
+}
+
+// ListGenerationImages 获取生成记录产出的全部图片
+func (s *ImageService) ListGenerationImages(generationID primitive.ObjectID) ([]models.Image, error) {
+	images, _, err := s.images.List(context.Background(), repository.ImageFilter{GenerationID: &generationID}, repository.Page{})
+	return images, err
+}
+
+// ListBatchImages 获取批量任务生成的全部图片，按创建时间排序
+func (s *ImageService) ListBatchImages(jobID primitive.ObjectID) ([]models.Image, error) {
+	generations, _, err := s.generations.List(context.Background(), repository.GenerationFilter{BatchJobID: &jobID}, repository.Page{})
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
+	var images []models.Image
+	for _, generation := range generations {
+		generationImages, err := s.ListGenerationImages(generation.ID)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, generationImages...)
+	}
+	sort.SliceStable(images, func(i, j int) bool { return images[i].CreatedAt.Before(images[j].CreatedAt) })
+	return images, nil
 }
 
-// ListImages 获取图片列表
-func (s *ImageService) ListImages(page, pageSize int, prompt string) ([]models.Image, int64, error) {
-	// 构建查询条件
-	filter := bson.M{"deleted": false}
-	
-	if prompt != "" {
-		filter["prompt_text"] = bson.M{"$regex": prompt, "$options": "i"}
+// FindSimilarImages 查找与指定图片感知哈希距离不超过 maxDistance 的图片，按距离从近到远排序，最多返回 limit 张。
+// 比较时只读取各图片的哈希，命中的图片再读取完整记录
+func (s *ImageService) FindSimilarImages(id primitive.ObjectID, maxDistance, limit int) ([]models.SimilarImage, error) {
+	ctx := context.Background()
+
+	image, err := s.images.GetByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	// 早期保存的图片没有感知哈希，临时从文件计算
+	phash := image.PHash
+	if phash == "" {
+		imageData, err := s.ReadImageFile(image.FilePath)
+		if err != nil {
+			return nil, fmt.Errorf("读取图片失败: %v", err)
+		}
+		img, _, err := decodeImage(imageData)
+		if err != nil {
+			return nil, err
+		}
+		phash = perceptualHash(img)
 	}
 
-	// 获取总数
-	total, err := MongoDB.Collection("images").CountDocuments(context.Background(), filter)
+	hashes, err := s.images.ListHashes(ctx)
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
 
-	// 分页查询
-	skip := int64((page - 1) * pageSize)
-	limit := int64(pageSize)
-	cursor, err := MongoDB.Collection("images").Find(context.Background(), filter, &options.FindOptions{
-		Skip:  &skip,
-		Limit: &limit,
-		Sort:  bson.D{{Key: "created_at", Value: -1}},
-	})
+	type match struct {
+		id       primitive.ObjectID
+		distance int
+	}
+	var matches []match
+	for _, candidate := range hashes {
+		if candidate.ID == image.ID {
+			continue
+		}
+		distance, err := hashDistance(phash, candidate.PHash)
+		if err != nil || distance > maxDistance {
+			continue
+		}
+		matches = append(matches, match{id: candidate.ID, distance: distance})
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].distance < matches[j].distance })
+	if len(matches) > limit {
+		matches = matches[:limit]
+	}
+
+	similar := make([]models.SimilarImage, 0, len(matches))
+	for _, m := range matches {
+		candidate, err := s.images.GetByID(ctx, m.id)
+		if err != nil {
+			// 比较期间被删除
+			continue
+		}
+		similar = append(similar, models.SimilarImage{Image: *candidate, Distance: m.distance})
+	}
+	return similar, nil
+}
+
+// BatchDedupeReport 找出批量任务生成的图片中互为近似的分组。
+// 距离不超过 maxDistance 的图片连成一组，组内按创建时间排序，第一张之后的图片视为重复
+func (s *ImageService) BatchDedupeReport(jobID primitive.ObjectID, maxDistance int) (*models.BatchDedupeReport, error) {
+	batchImages, err := s.ListBatchImages(jobID)
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
-	defer cursor.Close(context.Background())
 
 	var images []models.Image
-	if err := cursor.All(context.Background(), &images); err != nil {
-		return nil, 0, err
+	for _, image := range batchImages {
+		if image.PHash != "" {
+			images = append(images, image)
+		}
+	}
+
+	// 并查集合并近似图片，根节点始终是组内最早的图片
+	parent := make([]int, len(images))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	for i := range images {
+		for j := i + 1; j < len(images); j++ {
+			distance, err := hashDistance(images[i].PHash, images[j].PHash)
+			if err != nil || distance > maxDistance {
+				continue
+			}
+			if ri, rj := find(i), find(j); ri != rj {
+				if ri < rj {
+					parent[rj] = ri
+				} else {
+					parent[ri] = rj
+				}
+			}
+		}
+	}
+
+	report := &models.BatchDedupeReport{
+		BatchJobID:  jobID,
+		MaxDistance: maxDistance,
+		TotalImages: len(images),
+		Groups:      make([]models.DuplicateGroup, 0),
+	}
+
+	members := make(map[int][]int)
+	for i := range images {
+		root := find(i)
+		members[root] = append(members[root], i)
+	}
+	for i := range images {
+		group := members[i]
+		if len(group) < 2 {
+			continue
+		}
+		duplicate := models.DuplicateGroup{Images: make([]models.SimilarImage, 0, len(group))}
+		for _, member := range group {
+			distance, _ := hashDistance(images[i].PHash, images[member].PHash)
+			duplicate.Images = append(duplicate.Images, models.SimilarImage{Image: images[member], Distance: distance})
+		}
+		report.Groups = append(report.Groups, duplicate)
+		report.DuplicateImages += len(group) - 1
+	}
+
+	return report, nil
+}
+
+// GetImageLineage 获取图片在图生图链路中的祖先链和后代树，每个节点附带生成参数
+func (s *ImageService) GetImageLineage(id primitive.ObjectID) (*models.ImageLineage, error) {
+	ctx := context.Background()
+
+	image, err := s.images.GetByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	ancestors, descendants, err := s.images.Lineage(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	// 生成参数保存在生成记录上，同一生成记录只查询一次
+	params := make(map[primitive.ObjectID]*models.GenerationParams)
+	newNode := func(image models.Image, distance int) *models.ImageLineageNode {
+		node := &models.ImageLineageNode{Image: image, Distance: distance}
+		if image.GenerationID == nil {
+			return node
+		}
+		p, ok := params[*image.GenerationID]
+		if !ok {
+			if generation, err := s.generations.GetByID(ctx, *image.GenerationID); err == nil {
+				p = &generation.GenerationParams
+			}
+			params[*image.GenerationID] = p
+		}
+		node.GenerationParams = p
+		return node
+	}
+
+	lineage := &models.ImageLineage{
+		Ancestors: make([]models.ImageLineageNode, 0, len(ancestors)),
+		Root:      newNode(*image, 0),
+	}
+
+	sort.Slice(ancestors, func(i, j int) bool { return ancestors[i].Depth < ancestors[j].Depth })
+	for _, ancestor := range ancestors {
+		lineage.Ancestors = append(lineage.Ancestors, *newNode(ancestor.Image, ancestor.Depth+1))
+	}
+
+	// 按层级和创建时间挂到各自的源图片下
+	sort.Slice(descendants, func(i, j int) bool {
+		if descendants[i].Depth != descendants[j].Depth {
+			return descendants[i].Depth < descendants[j].Depth
+		}
+		return descendants[i].CreatedAt.Before(descendants[j].CreatedAt)
+	})
+	nodes := map[primitive.ObjectID]*models.ImageLineageNode{image.ID: lineage.Root}
+	for _, descendant := range descendants {
+		parent, ok := nodes[*descendant.SourceImageID]
+		if !ok {
+			continue
+		}
+		node := newNode(descendant.Image, descendant.Depth+1)
+		parent.Children = append(parent.Children, node)
+		nodes[descendant.ID] = node
 	}
 
-	return images, total, nil
+	return lineage, nil
 }
 
 // CleanupTempFiles 清理临时文件
 func (s *ImageService) CleanupTempFiles(olderThan time.Duration) error {
-	tempDir := config.AppConfig.TempPath
+	tempDir := s.config.TempPath
 	
 	files, err := os.ReadDir(tempDir)
 	if err != nil {
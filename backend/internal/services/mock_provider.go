@@ -0,0 +1,108 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"strconv"
+	"strings"
+
+	"nano-banana-qwen/internal/models"
+)
+
+// MockProvider 本地模拟服务商，根据提示词生成确定性的渐变图片，无需网络和API Key
+type MockProvider struct{}
+
+// NewMockProvider 创建模拟服务商
+func NewMockProvider() *MockProvider {
+	return &MockProvider{}
+}
+
+// Name 服务商名称
+func (p *MockProvider) Name() string {
+	return "mock"
+}
+
+// Capabilities 服务商能力
+func (p *MockProvider) Capabilities() ProviderCapabilities {
+	return ProviderCapabilities{
+		Text2Img:     true,
+		Img2Img:      true,
+		DefaultModel: "gradient",
+		Sizes:        []string{"256x256", "512x512", "1024x1024", "1024x1792", "1792x1024"},
+		Qualities:    []string{"standard", "hd"},
+	}
+}
+
+// Generate 文本生成图片
+func (p *MockProvider) Generate(ctx context.Context, prompt string, params models.GenerationParams) (*ImageResult, error) {
+	return p.render(prompt, params)
+}
+
+// Edit 图生图，模拟实现中源图片只参与颜色计算
+func (p *MockProvider) Edit(ctx context.Context, prompt string, sourceImage string, params models.GenerationParams) (*ImageResult, error) {
+	return p.render(prompt+sourceImage, params)
+}
+
+// render 根据种子字符串生成渐变图片并编码为PNG data URL
+func (p *MockProvider) render(seed string, params models.GenerationParams) (*ImageResult, error) {
+	width, height := parseImageSize(params.Size, 512, 512)
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	// 根据提示词生成不同的颜色
+	hash := 0
+	for _, char := range seed {
+		hash += int(char)
+	}
+
+	r := uint8((hash * 123) % 256)
+	g := uint8((hash * 456) % 256)
+	b := uint8((hash * 789) % 256)
+
+	// 创建渐变效果
+	for y := 0; y < height; y++ {
+		brightness := float64(y) / float64(height)
+		c := color.RGBA{
+			R: uint8(float64(r) * brightness),
+			G: uint8(float64(g) * brightness),
+			B: uint8(float64(b) * brightness),
+			A: 255,
+		}
+		for x := 0; x < width; x++ {
+			img.SetRGBA(x, y, c)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("编码模拟图片失败: %v", err)
+	}
+
+	return &ImageResult{
+		Images: []string{"data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())},
+		Text:   "mock image",
+	}, nil
+}
+
+// parseImageSize 解析 "宽x高" 格式的尺寸，无法解析时返回默认值
+func parseImageSize(size string, defaultWidth, defaultHeight int) (int, int) {
+	w, h, found := strings.Cut(size, "x")
+	if !found {
+		return defaultWidth, defaultHeight
+	}
+
+	width, err := strconv.Atoi(w)
+	if err != nil || width <= 0 {
+		return defaultWidth, defaultHeight
+	}
+	height, err := strconv.Atoi(h)
+	if err != nil || height <= 0 {
+		return defaultWidth, defaultHeight
+	}
+
+	return width, height
+}
@@ -0,0 +1,180 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"nano-banana-qwen/internal/config"
+	"nano-banana-qwen/internal/models"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// OpenAIProvider 兼容 OpenAI /v1/images 接口的服务商
+type OpenAIProvider struct {
+	client  *resty.Client
+	baseURL string
+	model   string
+}
+
+// openAIImageRequest /images/generations 请求
+type openAIImageRequest struct {
+	Model   string `json:"model"`
+	Prompt  string `json:"prompt"`
+	N       int    `json:"n"`
+	Size    string `json:"size,omitempty"`
+	Quality string `json:"quality,omitempty"`
+}
+
+// openAIImageResponse /images/generations 和 /images/edits 响应
+type openAIImageResponse struct {
+	Data []struct {
+		URL           string `json:"url"`
+		B64JSON       string `json:"b64_json"`
+		RevisedPrompt string `json:"revised_prompt"`
+	} `json:"data"`
+	Error *struct {
+		Message string `json:"message"`
+		Type    string `json:"type"`
+		Code    string `json:"code"`
+	} `json:"error,omitempty"`
+}
+
+// NewOpenAIProvider 创建OpenAI兼容服务商
+func NewOpenAIProvider(cfg *config.Config) *OpenAIProvider {
+	client := resty.New().
+		SetTimeout(time.Duration(cfg.GenerationTimeout)*time.Second).
+		SetHeader("Authorization", "Bearer "+cfg.OpenAIAPIKey)
+
+	return &OpenAIProvider{
+		client:  client,
+		baseURL: strings.TrimRight(cfg.OpenAIAPIURL, "/"),
+		model:   cfg.OpenAIModelName,
+	}
+}
+
+// Name 服务商名称
+func (p *OpenAIProvider) Name() string {
+	return "openai"
+}
+
+// Capabilities 服务商能力
+func (p *OpenAIProvider) Capabilities() ProviderCapabilities {
+	return ProviderCapabilities{
+		Text2Img:     true,
+		Img2Img:      true,
+		DefaultModel: p.model,
+		Sizes:        []string{"256x256", "512x512", "1024x1024", "1024x1792", "1792x1024"},
+		Qualities:    []string{"standard", "hd"},
+	}
+}
+
+// Generate 文本生成图片
+func (p *OpenAIProvider) Generate(ctx context.Context, prompt string, params models.GenerationParams) (*ImageResult, error) {
+	log.Printf("🎨 开始生成图片: %s (模型: %s)", prompt[:min(50, len(prompt))], p.modelFor(params))
+
+	var response openAIImageResponse
+	resp, err := p.client.R().
+		SetContext(ctx).
+		SetHeader("Content-Type", "application/json").
+		SetBody(openAIImageRequest{
+			Model:   p.modelFor(params),
+			Prompt:  prompt,
+			N:       1,
+			Size:    params.Size,
+			Quality: params.Quality,
+		}).
+		SetResult(&response).
+		SetError(&response).
+		Post(p.baseURL + "/images/generations")
+
+	return p.parseResponse(resp, err, &response)
+}
+
+// Edit 图生图，通过 /images/edits 上传源图片
+func (p *OpenAIProvider) Edit(ctx context.Context, prompt string, sourceImage string, params models.GenerationParams) (*ImageResult, error) {
+	imageData, err := decodeDataURL(sourceImage)
+	if err != nil {
+		return nil, err
+	}
+
+	formData := map[string]string{
+		"model":  p.modelFor(params),
+		"prompt": prompt,
+		"n":      "1",
+	}
+	if params.Size != "" {
+		formData["size"] = params.Size
+	}
+
+	var response openAIImageResponse
+	resp, err := p.client.R().
+		SetContext(ctx).
+		SetFileReader("image", "source.png", bytes.NewReader(imageData)).
+		SetFormData(formData).
+		SetResult(&response).
+		SetError(&response).
+		Post(p.baseURL + "/images/edits")
+
+	return p.parseResponse(resp, err, &response)
+}
+
+// parseResponse 检查响应并提取图片
+func (p *OpenAIProvider) parseResponse(resp *resty.Response, err error, response *openAIImageResponse) (*ImageResult, error) {
+	if err != nil {
+		return nil, newRequestError(err)
+	}
+
+	if response.Error != nil {
+		message := fmt.Sprintf("OpenAI API错误: %s", response.Error.Message)
+		if response.Error.Code == "content_policy_violation" {
+			return nil, &ProviderError{Kind: ErrorContentPolicy, StatusCode: resp.StatusCode(), Message: message}
+		}
+		return nil, newResponseError(resp, resp.StatusCode(), message)
+	}
+
+	if resp.StatusCode() != 200 {
+		return nil, newResponseError(resp, resp.StatusCode(), fmt.Sprintf("API返回错误状态: %d, 响应: %s", resp.StatusCode(), resp.String()))
+	}
+
+	result := &ImageResult{}
+	for _, item := range response.Data {
+		switch {
+		case item.B64JSON != "":
+			result.Images = append(result.Images, "data:image/png;base64,"+item.B64JSON)
+		case item.URL != "":
+			result.Images = append(result.Images, item.URL)
+		}
+		if item.RevisedPrompt != "" {
+			result.Text = item.RevisedPrompt
+		}
+	}
+
+	return result, nil
+}
+
+// modelFor 返回请求使用的模型
+func (p *OpenAIProvider) modelFor(params models.GenerationParams) string {
+	if params.Model != "" {
+		return params.Model
+	}
+	return p.model
+}
+
+// decodeDataURL 解码 data URL 或纯base64字符串
+func decodeDataURL(data string) ([]byte, error) {
+	if _, payload, found := strings.Cut(data, ","); found && strings.HasPrefix(data, "data:") {
+		data = payload
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, fmt.Errorf("base64解码失败: %v", err)
+	}
+	return decoded, nil
+}
@@ -1,8 +1,10 @@
 package services
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 
 	"nano-banana-qwen/internal/config"
@@ -12,74 +14,62 @@ import (
 )
 
 type OpenRouterService struct {
-	client *resty.Client
+	client       *resty.Client
+	apiURL       string
+	defaultModel string
 }
 
 // NewOpenRouterService 创建OpenRouter服务实例
-func NewOpenRouterService() *OpenRouterService {
+func NewOpenRouterService(cfg *config.Config) *OpenRouterService {
 	client := resty.New().
-		SetTimeout(30*time.Second).
-		SetRetryCount(4).
-		SetRetryWaitTime(2*time.Second).
-		SetHeader("Authorization", "Bearer "+config.AppConfig.OpenRouterAPIKey).
+		SetTimeout(time.Duration(cfg.GenerationTimeout)*time.Second).
+		SetHeader("Authorization", "Bearer "+cfg.OpenRouterAPIKey).
 		SetHeader("Content-Type", "application/json")
 
 	return &OpenRouterService{
-		client: client,
+		client:       client,
+		apiURL:       cfg.OpenRouterAPIURL,
+		defaultModel: cfg.OpenRouterModelName,
 	}
 }
 
-// GenerateImage 生成图片
-func (s *OpenRouterService) GenerateImage(prompt string, isImg2Img bool, sourceImageBase64 string, params models.GenerationParams) (*models.OpenRouterResponse, error) {
+// GenerateImage 生成图片，ctx 取消时中止请求
+func (s *OpenRouterService) GenerateImage(ctx context.Context, prompt string, isImg2Img bool, sourceImageBase64 string, params models.GenerationParams) (*models.OpenRouterResponse, error) {
 	startTime := time.Now()
 
-	// 构建请求
-	request := models.OpenRouterRequest{
-		Model:  config.AppConfig.OpenRouterModelName,
-		Prompt: prompt,
-		Extra:  make(map[string]interface{}),
+	model := params.Model
+	if model == "" {
+		model = s.defaultModel
 	}
 
-	// 如果是图生图，添加源图片
-	if isImg2Img && sourceImageBase64 != "" {
-		request.Images = []models.OpenRouterImage{
-			{
-				Type:     "image_url",
-				ImageURL: sourceImageBase64,
-			},
-		}
-		// 添加强度参数
-		if params.Strength > 0 {
-			request.Extra["strength"] = params.Strength
-		}
-	}
-
-	// 添加其他参数
-	if params.Size != "" {
-		request.Extra["size"] = params.Size
-	}
-	if params.Quality != "" {
-		request.Extra["quality"] = params.Quality
-	}
+	request := s.BuildRequest(model, prompt, isImg2Img, sourceImageBase64, params)
 
 	log.Printf("🎨 开始生成图片: %s (模型: %s)", prompt[:min(50, len(prompt))], request.Model)
 
 	var response models.OpenRouterResponse
 	resp, err := s.client.R().
+		SetContext(ctx).
 		SetBody(request).
 		SetResult(&response).
-		Post(config.AppConfig.OpenRouterAPIURL + "/chat/completions")
+		SetError(&response).
+		Post(s.apiURL + "/chat/completions")
 
+	// 不在客户端内重试，由队列根据错误分类决定是否延迟重试
 	if err != nil {
-		return nil, fmt.Errorf("API请求失败: %v", err)
+		return nil, newRequestError(err)
 	}
 
-	if resp.StatusCode() != 200 {
-		return nil, fmt.Errorf("API返回错误状态: %d, 响应: %s", resp.StatusCode(), resp.String())
+	if response.Error != nil {
+		// 流式错误等情况下HTTP状态为200，错误码在响应体中
+		status := resp.StatusCode()
+		if response.Error.Code >= 400 {
+			status = response.Error.Code
+		}
+		return nil, newResponseError(resp, status, fmt.Sprintf("OpenRouter API错误: %s", response.Error.Message))
 	}
 
-	if response.Error != nil {
-		return nil, fmt.Errorf("OpenRouter API错误: %s", response.Error.Message)
+	if resp.StatusCode() != 200 {
+		return nil, newResponseError(resp, resp.StatusCode(), fmt.Sprintf("API返回错误状态: %d, 响应: %s", resp.StatusCode(), resp.String()))
 	}
 
 	duration := time.Since(startTime)
@@ -88,61 +78,125 @@ func (s *OpenRouterService) GenerateImage(prompt string, isImg2Img bool, sourceI
 	return &response, nil
 }
 
-// ExtractImageURL 从OpenRouter响应中提取图片URL
-func (s *OpenRouterService) ExtractImageURL(response *models.OpenRouterResponse) (string, error) {
-	if len(response.Choices) == 0 {
-		return "", fmt.Errorf("响应中没有选择项")
+// BuildRequest 构建多模态 chat/completions 请求：文本提示词 + 可选的源图片
+func (s *OpenRouterService) BuildRequest(model, prompt string, isImg2Img bool, sourceImageBase64 string, params models.GenerationParams) models.OpenRouterRequest {
+	content := []models.OpenRouterContentItem{
+		{Type: "text", Text: prompt},
 	}
 
-	choice := response.Choices[0]
-	if len(choice.Message.Content) == 0 {
-		return "", fmt.Errorf("响应中没有内容")
+	// 如果是图生图，添加源图片
+	if isImg2Img && sourceImageBase64 != "" {
+		sourceURL := sourceImageBase64
+		if !strings.HasPrefix(sourceURL, "data:") && !strings.HasPrefix(sourceURL, "http") {
+			sourceURL = "data:image/png;base64," + sourceURL
+		}
+		content = append(content, models.OpenRouterContentItem{
+			Type:     "image_url",
+			ImageURL: &models.OpenRouterImageURL{URL: sourceURL},
+		})
 	}
 
-	// 遍历内容项找到图片
-	for _, content := range choice.Message.Content {
-		if content.Type == "image_url" && content.ImageURL != nil {
-			return content.ImageURL.URL, nil
-		}
+	request := models.OpenRouterRequest{
+		Model: model,
+		Messages: []models.OpenRouterMessage{
+			{Role: "user", Content: content},
+		},
+		Modalities: []string{"image", "text"},
 	}
 
-	return "", fmt.Errorf("响应中没有找到图片URL")
+	// 根据尺寸设置输出宽高比
+	if aspectRatio := aspectRatioForSize(params.Size); aspectRatio != "" {
+		request.ImageConfig = &models.OpenRouterImageConfig{AspectRatio: aspectRatio}
+	}
+
+	return request
 }
 
-// ValidateImageGeneration 验证图片生成参数
-func (s *OpenRouterService) ValidateImageGeneration(prompt string, params models.GenerationParams) error {
-	if prompt == "" {
-		return fmt.Errorf("提示词不能为空")
+// ExtractImages 从OpenRouter响应中提取全部图片、文本回复和用量
+func (s *OpenRouterService) ExtractImages(response *models.OpenRouterResponse) (*ImageResult, error) {
+	if len(response.Choices) == 0 {
+		return nil, fmt.Errorf("响应中没有选择项")
 	}
 
-	if len(prompt) > 1000 {
-		return fmt.Errorf("提示词长度不能超过1000个字符")
+	result := &ImageResult{
+		Usage: &models.TokenUsage{
+			PromptTokens:     response.Usage.PromptTokens,
+			CompletionTokens: response.Usage.CompletionTokens,
+			TotalTokens:      response.Usage.TotalTokens,
+		},
+	}
+
+	var texts []string
+	for _, choice := range response.Choices {
+		if choice.Message.Content != "" {
+			texts = append(texts, choice.Message.Content)
+		}
+		for _, image := range choice.Message.Images {
+			if image.ImageURL != nil && image.ImageURL.URL != "" {
+				result.Images = append(result.Images, image.ImageURL.URL)
+			}
+		}
 	}
+	result.Text = strings.Join(texts, "\n")
 
-	// 验证图片尺寸
-	validSizes := map[string]bool{
-		"256x256":   true,
-		"512x512":   true,
-		"1024x1024": true,
-		"1024x1792": true,
-		"1792x1024": true,
+	if len(result.Images) == 0 {
+		if result.Text != "" {
+			return nil, fmt.Errorf("响应中没有找到图片，模型回复: %s", result.Text)
+		}
+		return nil, fmt.Errorf("响应中没有找到图片")
 	}
 
-	if params.Size != "" && !validSizes[params.Size] {
-		return fmt.Errorf("不支持的图片尺寸: %s", params.Size)
+	return result, nil
+}
+
+// Name 服务商名称
+func (s *OpenRouterService) Name() string {
+	return "openrouter"
+}
+
+// Capabilities 服务商能力
+func (s *OpenRouterService) Capabilities() ProviderCapabilities {
+	return ProviderCapabilities{
+		Text2Img:     true,
+		Img2Img:      true,
+		DefaultModel: s.defaultModel,
+		Sizes:        []string{"256x256", "512x512", "1024x1024", "1024x1792", "1792x1024"},
+		Qualities:    []string{"standard", "hd"},
 	}
+}
+
+// Generate 文本生成图片
+func (s *OpenRouterService) Generate(ctx context.Context, prompt string, params models.GenerationParams) (*ImageResult, error) {
+	return s.generate(ctx, prompt, false, "", params)
+}
+
+// Edit 图生图
+func (s *OpenRouterService) Edit(ctx context.Context, prompt string, sourceImage string, params models.GenerationParams) (*ImageResult, error) {
+	return s.generate(ctx, prompt, true, sourceImage, params)
+}
 
-	// 验证质量参数
-	if params.Quality != "" && params.Quality != "standard" && params.Quality != "hd" {
-		return fmt.Errorf("不支持的图片质量: %s", params.Quality)
+// generate 调用OpenRouter并转换为通用结果
+func (s *OpenRouterService) generate(ctx context.Context, prompt string, isImg2Img bool, sourceImage string, params models.GenerationParams) (*ImageResult, error) {
+	response, err := s.GenerateImage(ctx, prompt, isImg2Img, sourceImage, params)
+	if err != nil {
+		return nil, err
 	}
 
-	// 验证图生图强度
-	if params.Strength < 0 || params.Strength > 1 {
-		return fmt.Errorf("图生图强度必须在0-1之间")
+	return s.ExtractImages(response)
+}
+
+// aspectRatioForSize 将 "宽x高" 尺寸换算为最简宽高比
+func aspectRatioForSize(size string) string {
+	width, height := parseImageSize(size, 0, 0)
+	if width == 0 || height == 0 {
+		return ""
 	}
 
-	return nil
+	a, b := width, height
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return fmt.Sprintf("%d:%d", width/a, height/a)
 }
 
 // min 返回两个整数的最小值
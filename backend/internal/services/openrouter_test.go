@@ -0,0 +1,150 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"nano-banana-qwen/internal/config"
+	"nano-banana-qwen/internal/models"
+)
+
+// newOpenRouterStub 启动返回录制响应的 OpenRouter 替身，记录收到的请求并返回指向它的配置
+func newOpenRouterStub(t *testing.T, fixture string, received *models.OpenRouterRequest) *config.Config {
+	t.Helper()
+
+	body, err := os.ReadFile(fixture)
+	if err != nil {
+		t.Fatalf("读取fixture失败: %v", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/chat/completions" {
+			t.Errorf("请求路径 = %s, 期望 /chat/completions", r.URL.Path)
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer test-key" {
+			t.Errorf("Authorization = %q", got)
+		}
+		if err := json.NewDecoder(r.Body).Decode(received); err != nil {
+			t.Errorf("解析请求失败: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+
+	return &config.Config{
+		OpenRouterAPIKey:    "test-key",
+		OpenRouterAPIURL:    server.URL,
+		OpenRouterModelName: "google/gemini-2.5-flash-image-preview:free",
+	}
+}
+
+func TestOpenRouterEditSendsChatMessages(t *testing.T) {
+	var received models.OpenRouterRequest
+	cfg := newOpenRouterStub(t, "testdata/openrouter_image_response.json", &received)
+
+	service := NewOpenRouterService(cfg)
+	_, err := service.Edit(context.Background(), "make it blue", "data:image/png;base64,AAAA", models.GenerationParams{Size: "1792x1024"})
+	if err != nil {
+		t.Fatalf("Edit 返回错误: %v", err)
+	}
+
+	if received.Model != "google/gemini-2.5-flash-image-preview:free" {
+		t.Errorf("model = %q", received.Model)
+	}
+	if strings.Join(received.Modalities, ",") != "image,text" {
+		t.Errorf("modalities = %v", received.Modalities)
+	}
+	if received.ImageConfig == nil || received.ImageConfig.AspectRatio != "7:4" {
+		t.Errorf("image_config = %+v", received.ImageConfig)
+	}
+	if len(received.Messages) != 1 || received.Messages[0].Role != "user" {
+		t.Fatalf("messages = %+v", received.Messages)
+	}
+
+	content := received.Messages[0].Content
+	if len(content) != 2 {
+		t.Fatalf("content 项数 = %d, 期望 2", len(content))
+	}
+	if content[0].Type != "text" || content[0].Text != "make it blue" {
+		t.Errorf("text 内容项 = %+v", content[0])
+	}
+	if content[1].Type != "image_url" || content[1].ImageURL == nil || content[1].ImageURL.URL != "data:image/png;base64,AAAA" {
+		t.Errorf("image_url 内容项 = %+v", content[1])
+	}
+}
+
+func TestOpenRouterParsesAllImagesTextAndUsage(t *testing.T) {
+	var received models.OpenRouterRequest
+	cfg := newOpenRouterStub(t, "testdata/openrouter_image_response.json", &received)
+
+	service := NewOpenRouterService(cfg)
+	result, err := service.Generate(context.Background(), "a red fox", models.GenerationParams{})
+	if err != nil {
+		t.Fatalf("Generate 返回错误: %v", err)
+	}
+
+	if len(received.Messages[0].Content) != 1 {
+		t.Errorf("文生图请求不应包含图片内容项: %+v", received.Messages[0].Content)
+	}
+
+	if len(result.Images) != 2 {
+		t.Fatalf("图片数量 = %d, 期望 2", len(result.Images))
+	}
+	for _, image := range result.Images {
+		if !strings.HasPrefix(image, "data:image/png;base64,") {
+			t.Errorf("图片不是data URL: %.40s", image)
+		}
+	}
+
+	if result.Text != "Here is a red fox and a blue variant." {
+		t.Errorf("text = %q", result.Text)
+	}
+
+	want := models.TokenUsage{PromptTokens: 12, CompletionTokens: 2580, TotalTokens: 2592}
+	if result.Usage == nil || *result.Usage != want {
+		t.Errorf("usage = %+v, 期望 %+v", result.Usage, want)
+	}
+}
+
+func TestOpenRouterCancelAbortsRequest(t *testing.T) {
+	received := make(chan struct{})
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(received)
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { close(release) })
+
+	service := NewOpenRouterService(&config.Config{OpenRouterAPIURL: server.URL})
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-received
+		cancel()
+	}()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := service.Generate(ctx, "a red fox", models.GenerationParams{})
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("取消后 Generate 应返回错误")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("取消 ctx 后请求未中止")
+	}
+}
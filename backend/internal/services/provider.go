@@ -0,0 +1,209 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"nano-banana-qwen/internal/config"
+	"nano-banana-qwen/internal/models"
+)
+
+// ImageResult 图片生成结果
+type ImageResult struct {
+	Images []string           // 生成的图片，data URL 或 HTTP URL
+	Text   string             // 模型返回的文本说明
+	Usage  *models.TokenUsage // token用量，服务商不提供时为nil
+}
+
+// ProviderCapabilities 服务商能力描述
+type ProviderCapabilities struct {
+	Text2Img     bool     `json:"text2img"`
+	Img2Img      bool     `json:"img2img"`
+	DefaultModel string   `json:"default_model"`
+	Sizes        []string `json:"sizes"`
+	Qualities    []string `json:"qualities"`
+}
+
+// ImageProvider 图片生成服务商接口
+type ImageProvider interface {
+	// Name 服务商名称，作为注册表的键
+	Name() string
+	// Generate 文本生成图片
+	Generate(ctx context.Context, prompt string, params models.GenerationParams) (*ImageResult, error)
+	// Edit 基于源图片生成图片，sourceImage 为 data URL
+	Edit(ctx context.Context, prompt string, sourceImage string, params models.GenerationParams) (*ImageResult, error)
+	// Capabilities 服务商支持的能力、尺寸和质量
+	Capabilities() ProviderCapabilities
+}
+
+// ProviderRegistry 图片生成服务商注册表
+type ProviderRegistry struct {
+	mu          sync.RWMutex
+	providers   map[string]ImageProvider
+	defaultName string
+}
+
+// NewProviderRegistry 根据配置创建注册表并注册内置服务商
+func NewProviderRegistry(cfg *config.Config) *ProviderRegistry {
+	registry := &ProviderRegistry{
+		providers:   make(map[string]ImageProvider),
+		defaultName: cfg.ImageProvider,
+	}
+
+	registry.Register(NewMockProvider())
+	if cfg.OpenRouterAPIKey != "" {
+		registry.Register(NewOpenRouterService(cfg))
+	}
+	if cfg.OpenAIAPIKey != "" {
+		registry.Register(NewOpenAIProvider(cfg))
+	}
+
+	return registry
+}
+
+// Register 注册服务商，同名服务商会被替换
+func (r *ProviderRegistry) Register(provider ImageProvider) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.providers[provider.Name()] = provider
+}
+
+// Get 根据名称获取服务商
+func (r *ProviderRegistry) Get(name string) (ImageProvider, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if name == "" {
+		name = r.defaultName
+	}
+
+	provider, ok := r.providers[name]
+	if !ok {
+		return nil, fmt.Errorf("图片生成服务商 %s 未配置", name)
+	}
+	return provider, nil
+}
+
+// Names 返回已注册的服务商名称
+func (r *ProviderRegistry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	names := make([]string, 0, len(r.providers))
+	for name := range r.providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Resolve 根据请求参数确定服务商和模型，并把结果写回 params
+//
+// Model 支持以下写法：
+//   - 空：使用 Provider（或默认服务商）的默认模型
+//   - "mock"：服务商名称，使用其默认模型
+//   - "openai:dall-e-3"：服务商:模型
+//   - "google/gemini-2.5-flash-image-preview:free"：Provider（或默认服务商）下的模型
+func (r *ProviderRegistry) Resolve(params *models.GenerationParams) (ImageProvider, error) {
+	providerName := params.Provider
+	model := params.Model
+
+	r.mu.RLock()
+	if _, ok := r.providers[model]; ok && providerName == "" {
+		providerName, model = model, ""
+	} else if prefix, rest, found := strings.Cut(model, ":"); found {
+		if _, ok := r.providers[prefix]; ok && (providerName == "" || providerName == prefix) {
+			providerName, model = prefix, rest
+		}
+	}
+	r.mu.RUnlock()
+
+	provider, err := r.Get(providerName)
+	if err != nil {
+		return nil, err
+	}
+
+	if model == "" {
+		model = provider.Capabilities().DefaultModel
+	}
+	params.Provider = provider.Name()
+	params.Model = model
+
+	return provider, nil
+}
+
+// Validate 解析服务商并校验生成参数
+func (r *ProviderRegistry) Validate(prompt string, isImg2Img bool, params *models.GenerationParams) error {
+	if prompt == "" {
+		return fmt.Errorf("提示词不能为空")
+	}
+
+	if len(prompt) > 1000 {
+		return fmt.Errorf("提示词长度不能超过1000个字符")
+	}
+
+	provider, err := r.Resolve(params)
+	if err != nil {
+		return err
+	}
+
+	capabilities := provider.Capabilities()
+	if isImg2Img && !capabilities.Img2Img {
+		return fmt.Errorf("服务商 %s 不支持图生图", provider.Name())
+	}
+	if !isImg2Img && !capabilities.Text2Img {
+		return fmt.Errorf("服务商 %s 不支持文本生成图片", provider.Name())
+	}
+
+	if params.Size != "" && len(capabilities.Sizes) > 0 && !containsString(capabilities.Sizes, params.Size) {
+		return fmt.Errorf("不支持的图片尺寸: %s", params.Size)
+	}
+
+	if params.Quality != "" && len(capabilities.Qualities) > 0 && !containsString(capabilities.Qualities, params.Quality) {
+		return fmt.Errorf("不支持的图片质量: %s", params.Quality)
+	}
+
+	// 验证图生图强度
+	if params.Strength < 0 || params.Strength > 1 {
+		return fmt.Errorf("图生图强度必须在0-1之间")
+	}
+
+	return nil
+}
+
+// GenerateWith 使用 params 指定的服务商生成图片
+func (r *ProviderRegistry) GenerateWith(ctx context.Context, prompt string, isImg2Img bool, sourceImage string, params *models.GenerationParams) (*ImageResult, error) {
+	provider, err := r.Resolve(params)
+	if err != nil {
+		return nil, err
+	}
+
+	var result *ImageResult
+	if isImg2Img {
+		result, err = provider.Edit(ctx, prompt, sourceImage, *params)
+	} else {
+		result, err = provider.Generate(ctx, prompt, *params)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(result.Images) == 0 {
+		return nil, fmt.Errorf("响应中没有找到图片")
+	}
+
+	return result, nil
+}
+
+// containsString 判断切片中是否包含指定字符串
+func containsString(values []string, target string) bool {
+	for _, value := range values {
+		if value == target {
+			return true
+		}
+	}
+	return false
+}
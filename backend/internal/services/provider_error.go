@@ -0,0 +1,153 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// ErrorKind 服务商错误分类，决定失败的生成是否值得重试
+type ErrorKind string
+
+const (
+	ErrorRateLimited    ErrorKind = "rate_limited"    // 429 限流
+	ErrorServer         ErrorKind = "server_error"    // 5xx
+	ErrorTimeout        ErrorKind = "timeout"         // 请求超时
+	ErrorNetwork        ErrorKind = "network"         // 连接失败等网络错误
+	ErrorContentPolicy  ErrorKind = "content_policy"  // 内容审核拒绝
+	ErrorInvalidRequest ErrorKind = "invalid_request" // 参数错误等其他4xx
+	ErrorUnknown        ErrorKind = "unknown"
+)
+
+// maxRetryDelay 自动重试的最长等待时间
+const maxRetryDelay = 10 * time.Minute
+
+// contentPolicyMarkers 服务商拒绝生成时错误信息中常见的关键字
+var contentPolicyMarkers = []string{"content_policy", "content policy", "safety", "moderation", "flagged", "blocked"}
+
+// ProviderError 服务商调用失败的错误
+type ProviderError struct {
+	Kind       ErrorKind
+	StatusCode int           // HTTP状态码，未收到响应时为0
+	RetryAfter time.Duration // 服务商通过 Retry-After 要求的最短等待时间
+	Message    string
+}
+
+func (e *ProviderError) Error() string {
+	return e.Message
+}
+
+// Retryable 限流、服务端错误、超时和网络错误可以重试，内容审核和参数错误重试也不会成功
+func (e *ProviderError) Retryable() bool {
+	switch e.Kind {
+	case ErrorRateLimited, ErrorServer, ErrorTimeout, ErrorNetwork:
+		return true
+	}
+	return false
+}
+
+// ClassifyError 获取错误的分类，非服务商返回的错误中超时和网络错误可以识别，其余为 unknown
+func ClassifyError(err error) *ProviderError {
+	var providerErr *ProviderError
+	if errors.As(err, &providerErr) {
+		return providerErr
+	}
+
+	classified := &ProviderError{Kind: ErrorUnknown, Message: err.Error()}
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		classified.Kind = ErrorTimeout
+	case errors.As(err, &netErr):
+		classified.Kind = ErrorNetwork
+	}
+	return classified
+}
+
+// newRequestError 请求未得到响应时的错误
+func newRequestError(err error) *ProviderError {
+	classified := ClassifyError(err)
+	if classified.Kind == ErrorUnknown {
+		classified.Kind = ErrorNetwork
+	}
+	classified.Message = fmt.Sprintf("API请求失败: %v", err)
+	return classified
+}
+
+// newResponseError 根据状态码和错误信息归类服务商返回的错误，message 为服务商给出的错误说明
+func newResponseError(resp *resty.Response, status int, message string) *ProviderError {
+	providerErr := &ProviderError{StatusCode: status, Message: message}
+
+	switch {
+	case status == http.StatusTooManyRequests:
+		providerErr.Kind = ErrorRateLimited
+		providerErr.RetryAfter = parseRetryAfter(resp.Header().Get("Retry-After"), time.Now())
+	case status >= 500:
+		providerErr.Kind = ErrorServer
+	case status == http.StatusRequestTimeout:
+		providerErr.Kind = ErrorTimeout
+	case isContentPolicyMessage(message):
+		providerErr.Kind = ErrorContentPolicy
+	case status >= 400:
+		providerErr.Kind = ErrorInvalidRequest
+	default:
+		providerErr.Kind = ErrorUnknown
+	}
+	return providerErr
+}
+
+// isContentPolicyMessage 错误信息是否表示内容审核拒绝
+func isContentPolicyMessage(message string) bool {
+	message = strings.ToLower(message)
+	for _, marker := range contentPolicyMarkers {
+		if strings.Contains(message, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRetryAfter 解析 Retry-After 头，支持秒数和HTTP日期两种格式
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
+}
+
+// retryDelay 第 attempt 次失败后的等待时间：base*2^(attempt-1) 加随机抖动（取一半固定、一半随机），
+// 不超过 maxRetryDelay，且不少于服务商要求的 Retry-After
+func retryDelay(base time.Duration, attempt int, retryAfter time.Duration) time.Duration {
+	delay := base
+	for i := 1; i < attempt && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	if half := delay / 2; half > 0 {
+		delay = half + time.Duration(rand.Int63n(int64(half)+1))
+	}
+	if retryAfter > delay {
+		delay = retryAfter
+	}
+	return delay
+}
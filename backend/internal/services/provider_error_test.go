@@ -0,0 +1,102 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"nano-banana-qwen/internal/config"
+	"nano-banana-qwen/internal/models"
+)
+
+func TestProviderErrorClassification(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		status     int
+		header     map[string]string
+		body       string
+		kind       ErrorKind
+		retryable  bool
+		retryAfter time.Duration
+	}{
+		{"限流", http.StatusTooManyRequests, map[string]string{"Retry-After": "7"}, `{"error":{"message":"rate limited","code":429}}`, ErrorRateLimited, true, 7 * time.Second},
+		{"服务端错误", http.StatusBadGateway, nil, `{"error":{"message":"upstream unavailable","code":502}}`, ErrorServer, true, 0},
+		{"内容审核", http.StatusBadRequest, nil, `{"error":{"message":"Request was flagged by moderation","code":400}}`, ErrorContentPolicy, false, 0},
+		{"参数错误", http.StatusBadRequest, nil, `{"error":{"message":"invalid model","code":400}}`, ErrorInvalidRequest, false, 0},
+		{"响应体中的错误码", http.StatusOK, nil, `{"error":{"message":"overloaded","code":503}}`, ErrorServer, true, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			requests := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				for key, value := range tc.header {
+					w.Header().Set(key, value)
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(tc.status)
+				w.Write([]byte(tc.body))
+			}))
+			defer server.Close()
+
+			service := NewOpenRouterService(&config.Config{OpenRouterAPIKey: "test-key", OpenRouterAPIURL: server.URL})
+			_, err := service.Generate(context.Background(), "a red fox", models.GenerationParams{})
+
+			var providerErr *ProviderError
+			if !errors.As(err, &providerErr) {
+				t.Fatalf("错误类型 = %T (%v), 期望 *ProviderError", err, err)
+			}
+			if providerErr.Kind != tc.kind || providerErr.Retryable() != tc.retryable || providerErr.RetryAfter != tc.retryAfter {
+				t.Errorf("分类 = %+v, 期望 %s (retryable=%v, retry_after=%v)", providerErr, tc.kind, tc.retryable, tc.retryAfter)
+			}
+			// 客户端不再自行重试，由队列决定
+			if requests != 1 {
+				t.Errorf("请求次数 = %d, 期望 1", requests)
+			}
+		})
+	}
+
+	// 连接失败归为网络错误
+	service := NewOpenRouterService(&config.Config{OpenRouterAPIKey: "test-key", OpenRouterAPIURL: "http://127.0.0.1:1"})
+	if _, err := service.Generate(context.Background(), "a red fox", models.GenerationParams{}); ClassifyError(err).Kind != ErrorNetwork {
+		t.Errorf("连接失败分类 = %s, 期望 network", ClassifyError(err).Kind)
+	}
+
+	// 超过 GenerationTimeout 未响应归为超时
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		select {
+		case <-r.Context().Done():
+		case <-time.After(3 * time.Second):
+		}
+	}))
+	defer slow.Close()
+	service = NewOpenRouterService(&config.Config{OpenRouterAPIKey: "test-key", OpenRouterAPIURL: slow.URL, GenerationTimeout: 1})
+	if _, err := service.Generate(context.Background(), "a red fox", models.GenerationParams{}); ClassifyError(err).Kind != ErrorTimeout {
+		t.Errorf("超时分类 = %s (%v), 期望 timeout", ClassifyError(err).Kind, err)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	if got := parseRetryAfter(now.Add(30*time.Second).Format(http.TimeFormat), now); got != 30*time.Second {
+		t.Errorf("HTTP日期格式的 Retry-After = %v, 期望 30s", got)
+	}
+
+	// 每次翻倍，抖动后在 [d/2, d] 之间
+	for attempt, want := range map[int]time.Duration{1: 2 * time.Second, 2: 4 * time.Second, 3: 8 * time.Second, 20: maxRetryDelay} {
+		for i := 0; i < 20; i++ {
+			if got := retryDelay(2*time.Second, attempt, 0); got < want/2 || got > want {
+				t.Fatalf("第 %d 次失败的等待时间 = %v, 期望在 [%v, %v]", attempt, got, want/2, want)
+			}
+		}
+	}
+
+	// Retry-After 比退避时间长时以它为准
+	if got := retryDelay(time.Second, 1, time.Minute); got != time.Minute {
+		t.Errorf("带 Retry-After 的等待时间 = %v, 期望 1m", got)
+	}
+}
@@ -3,34 +3,314 @@ package services
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"strconv"
 	"time"
 
+	"nano-banana-qwen/internal/config"
 	"nano-banana-qwen/internal/models"
 
 	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+const (
+	// leasePrefix 处理中任务的租约，值为持有租约的工作节点，租约到期由键过期表示
+	leasePrefix = "task_lease:"
+	// attemptsKey 任务被投递的次数
+	attemptsKey = "job_attempts"
+	// pendingQueueKey 有待处理图片的批量任务，score由优先级和入队序号组成，越小越先处理
+	pendingQueueKey = "generation_queue"
+	// priorityKey 批量任务的优先级
+	priorityKey = "job_priorities"
+	// queueSeqKey 入队序号，保证同优先级的批量任务按入队先后轮流处理
+	queueSeqKey = "queue_seq"
+	// jobTasksPrefix 每个批量任务待处理的图片任务ID列表，右端出队
+	jobTasksPrefix = "batch_tasks:"
+	// taskDataKey 图片任务ID到任务内容的映射，任务完成后删除，失败的任务保留以便重试
+	taskDataKey = "task_data"
+	// delayedKey 等待自动重试的图片任务，score为计划执行时间(毫秒)
+	delayedKey = "delayed_tasks"
+	// pausedKey 已暂停的批量任务，暂停期间不参与调度，待处理的图片任务保留在各自的列表中
+	pausedKey = "paused_jobs"
+	// completedCountKey 生成成功的图片任务累计数量
+	completedCountKey = "completed_tasks"
+	// generationQueueKey 待执行的异步生成ID，右端出队
+	generationQueueKey = "generation_task_queue"
+	// generationProcessingKey 执行中的异步生成ID，租约与批量图片任务共用 leasePrefix
+	generationProcessingKey = "task_processing_queue"
+	// delayedGenerationsKey 等待自动重试的异步生成ID，score为计划执行时间(毫秒)
+	delayedGenerationsKey = "delayed_generations"
+
+	// priorityWeight 优先级在score中的权重，远大于入队序号，保证高优先级任务总排在前面
+	priorityWeight = 1e13
+
+	// queuePollTimeout 阻塞取任务的最长等待时间，也决定了处理器响应停止信号的延迟
+	queuePollTimeout = time.Second
+)
+
+var (
+	// ErrTaskNotFound 图片任务不存在或已处理完成
+	ErrTaskNotFound = errors.New("任务不存在")
+	// ErrTaskNotFailed 图片任务不在失败队列中
+	ErrTaskNotFailed = errors.New("任务不在失败队列中")
+	// ErrJobCancelled 图片任务所属的批量任务已取消
+	ErrJobCancelled = errors.New("任务已取消")
+)
+
+// scheduleLua 将批量任务加入待处理队列，已在队列中或已暂停时不变；
+// front 为 true 时排在同优先级的最前面，否则排在最后面
+const scheduleLua = `
+local function schedule(pending, seqKey, priorities, paused, jobID, weight, front)
+	if redis.call('ZSCORE', pending, jobID) or redis.call('SISMEMBER', paused, jobID) == 1 then
+		return
+	end
+	local priority = tonumber(redis.call('HGET', priorities, jobID) or '0')
+	local seq = redis.call('INCR', seqKey)
+	if front then
+		seq = -seq
+	end
+	redis.call('ZADD', pending, -priority * weight + seq, jobID)
+end
+`
+
+// heartbeatScript 仅当租约仍属于当前节点时续期
+var heartbeatScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+redis.call('PEXPIRE', KEYS[1], ARGV[2])
+return 1
+`)
+
+// scheduleScript 将批量任务加入待处理队列，ARGV[3] 为1时排在同优先级的最前面
+var scheduleScript = redis.NewScript(scheduleLua + `
+schedule(KEYS[1], KEYS[2], KEYS[3], KEYS[4], ARGV[1], tonumber(ARGV[2]), ARGV[3] == '1')
+return 1
+`)
+
+// reapScript 回收一个租约已过期的图片任务：超过最大尝试次数则移入失败队列，否则放回所属批量任务的队首
+// 返回 -1 表示租约仍有效或已被其他节点回收，0 表示移入失败队列，大于0表示已重新入队（值为已尝试次数）
+var reapScript = redis.NewScript(scheduleLua + `
+if redis.call('EXISTS', KEYS[1]) == 1 or redis.call('LREM', KEYS[2], 0, ARGV[1]) == 0 then
+	return -1
+end
+local attempts = tonumber(redis.call('HGET', KEYS[4], ARGV[1]) or '0')
+if attempts >= tonumber(ARGV[2]) then
+	redis.call('LPUSH', KEYS[5], ARGV[1])
+	return 0
+end
+redis.call('RPUSH', KEYS[8], ARGV[1])
+schedule(KEYS[3], KEYS[7], KEYS[6], KEYS[9], ARGV[4], tonumber(ARGV[3]), true)
+return math.max(attempts, 1)
+`)
+
+// promoteScript 将一个到期的延迟任务放回所属批量任务的队首，返回0表示已被其他节点处理
+var promoteScript = redis.NewScript(scheduleLua + `
+if redis.call('ZREM', KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call('RPUSH', KEYS[2], ARGV[1])
+schedule(KEYS[3], KEYS[4], KEYS[5], KEYS[6], ARGV[2], tonumber(ARGV[3]), false)
+return 1
+`)
+
+// resumeScript 取消暂停，还有待处理的图片时重新加入待处理队列
+var resumeScript = redis.NewScript(scheduleLua + `
+redis.call('SREM', KEYS[4], ARGV[1])
+if redis.call('LLEN', KEYS[5]) > 0 then
+	schedule(KEYS[1], KEYS[2], KEYS[3], KEYS[4], ARGV[1], tonumber(ARGV[2]), false)
+end
+return 1
+`)
+
+// popGenerationScript 取出下一个异步生成移入处理中队列，同时登记租约和尝试次数，队列为空时返回nil
+var popGenerationScript = redis.NewScript(`
+local id = redis.call('RPOP', KEYS[1])
+if not id then
+	return false
+end
+redis.call('LPUSH', KEYS[2], id)
+redis.call('SET', ARGV[1] .. id, ARGV[2], 'PX', ARGV[3])
+redis.call('HINCRBY', KEYS[3], id, 1)
+return id
+`)
+
+// promoteGenerationsScript 将到达计划时间的异步生成放回队首，返回放回的数量
+var promoteGenerationsScript = redis.NewScript(`
+local due = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, 100)
+for _, id in ipairs(due) do
+	redis.call('ZREM', KEYS[1], id)
+	redis.call('RPUSH', KEYS[2], id)
+end
+return #due
+`)
+
+// reapGenerationScript 回收一个租约已过期的异步生成：超过最大尝试次数时返回0由调用方标记失败，
+// 否则放回队首并返回已尝试次数；返回 -1 表示租约仍有效或已被其他节点回收
+var reapGenerationScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 or redis.call('LREM', KEYS[2], 0, ARGV[1]) == 0 then
+	return -1
+end
+local attempts = tonumber(redis.call('HGET', KEYS[4], ARGV[1]) or '0')
+if attempts >= tonumber(ARGV[2]) then
+	redis.call('HDEL', KEYS[4], ARGV[1])
+	return 0
+end
+redis.call('RPUSH', KEYS[3], ARGV[1])
+return math.max(attempts, 1)
+`)
+
+// purgeScript 原子地清空失败队列并删除其中的任务内容，返回清除的数量
+var purgeScript = redis.NewScript(`
+local ids = redis.call('LRANGE', KEYS[1], 0, -1)
+redis.call('DEL', KEYS[1])
+for i = 1, #ids, 1000 do
+	redis.call('HDEL', KEYS[2], unpack(ids, i, math.min(i + 999, #ids)))
+end
+return #ids
+`)
+
+// popScript 从score最小的批量任务中取出一个图片任务并移入处理中队列，同时登记租约和尝试次数；
+// 该批量任务还有剩余图片时移到同优先级的末尾，使同优先级的任务轮流生成。队列为空时返回nil
+var popScript = redis.NewScript(`
+while true do
+	local jobs = redis.call('ZRANGE', KEYS[1], 0, 0)
+	if #jobs == 0 then
+		return false
+	end
+	local jobID = jobs[1]
+	local list = ARGV[1] .. jobID
+	local taskID = redis.call('RPOP', list)
+	if (not taskID) or redis.call('LLEN', list) == 0 then
+		redis.call('ZREM', KEYS[1], jobID)
+	else
+		local priority = tonumber(redis.call('HGET', KEYS[4], jobID) or '0')
+		redis.call('ZADD', KEYS[1], -priority * tonumber(ARGV[2]) + redis.call('INCR', KEYS[3]), jobID)
+	end
+	if taskID then
+		local data = redis.call('HGET', KEYS[5], taskID)
+		if data then
+			redis.call('LPUSH', KEYS[2], taskID)
+			redis.call('SET', ARGV[5] .. taskID, ARGV[4], 'PX', ARGV[3])
+			redis.call('HINCRBY', KEYS[6], taskID, 1)
+			return data
+		end
+	end
+end
+`)
+
+// priorityScript 修改任务优先级，任务仍在排队时按新优先级调整位置，同优先级内保持原入队顺序
+// 返回1表示任务在排队中
+var priorityScript = redis.NewScript(`
+local old = tonumber(redis.call('HGET', KEYS[2], ARGV[1]) or '0')
+local new = tonumber(ARGV[2])
+redis.call('HSET', KEYS[2], ARGV[1], new)
+local score = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if not score then
+	return 0
+end
+redis.call('ZADD', KEYS[1], tonumber(score) + (old - new) * tonumber(ARGV[3]), ARGV[1])
+return 1
+`)
+
+// transitionJobScript 仅当队列中的任务状态为 ARGV[7] 起列出的状态之一时改为 ARGV[2] 并推送状态事件，状态不存在时写入 ARGV[1]；
+// 返回0表示任务已处于其他状态，例如已被暂停、取消或已由其他节点开始处理
+var transitionJobScript = redis.NewScript(`
+local data = redis.call('GET', KEYS[1])
+if data then
+	local status = cjson.decode(data)
+	local allowed = false
+	for i = 7, #ARGV do
+		if status.status == ARGV[i] then
+			allowed = true
+		end
+	end
+	if not allowed then
+		return 0
+	end
+	status.status = ARGV[2]
+	status.message = ARGV[3]
+	status.updated_at = ARGV[4]
+	data = cjson.encode(status)
+else
+	data = ARGV[1]
+end
+redis.call('SET', KEYS[1], data, 'PX', ARGV[5])
+redis.call('PUBLISH', ARGV[6], data)
+return 1
+`)
+
 type QueueService struct {
-	redis *redis.Client
+	redis        *redis.Client
+	workerID     string
+	leaseTimeout time.Duration
+	maxAttempts  int
 }
 
 // NewQueueService 创建队列服务实例
-func NewQueueService() *QueueService {
+func NewQueueService(rdb *redis.Client, cfg *config.Config) *QueueService {
 	return &QueueService{
-		redis: RedisClient,
+		redis:        rdb,
+		workerID:     cfg.WorkerID,
+		leaseTimeout: cfg.LeaseTimeout(),
+		maxAttempts:  cfg.JobMaxAttempts,
+	}
+}
+
+// jobTasksKey 批量任务的图片任务列表
+func jobTasksKey(jobID string) string {
+	return jobTasksPrefix + jobID
+}
+
+// schedule 在事务中将批量任务加入待处理队列
+func (q *QueueService) schedule(ctx context.Context, pipe redis.Pipeliner, jobID string, front bool) {
+	flag := 0
+	if front {
+		flag = 1
 	}
+	scheduleScript.Eval(ctx, pipe, []string{pendingQueueKey, queueSeqKey, priorityKey, pausedKey}, jobID, priorityWeight, flag)
 }
 
-// AddBatchJob 添加批量任务到队列
-func (q *QueueService) AddBatchJob(jobID string) error {
+// AddBatchJob 按每个提示词的剩余数量将批量任务展开为图片任务，并按优先级加入队列
+func (q *QueueService) AddBatchJob(job *models.BatchJob) error {
 	ctx := context.Background()
-	
+	jobID := job.ID.Hex()
+
+	var taskIDs []interface{}
+	taskData := map[string]interface{}{}
+	for i, prompt := range job.Prompts {
+		remaining := prompt.Count - prompt.Completed - prompt.Failed
+		for n := 0; n < remaining; n++ {
+			task := models.GenerationTask{
+				ID:          primitive.NewObjectID().Hex(),
+				JobID:       jobID,
+				PromptID:    prompt.PromptID,
+				PromptIndex: i,
+				Prompt:      prompt.PromptText,
+				Status:      "pending",
+				CreatedAt:   time.Now(),
+			}
+			data, err := json.Marshal(task)
+			if err != nil {
+				return fmt.Errorf("序列化生成任务失败: %v", err)
+			}
+			taskIDs = append(taskIDs, task.ID)
+			taskData[task.ID] = data
+		}
+	}
+
 	// 添加到待处理队列
-	err := q.redis.LPush(ctx, "generation_queue", jobID).Err()
-	if err != nil {
+	pipe := q.redis.TxPipeline()
+	pipe.HSet(ctx, priorityKey, jobID, job.Priority)
+	if len(taskIDs) > 0 {
+		pipe.HSet(ctx, taskDataKey, taskData)
+		pipe.LPush(ctx, jobTasksKey(jobID), taskIDs...)
+		q.schedule(ctx, pipe, jobID, false)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
 		return fmt.Errorf("添加到队列失败: %v", err)
 	}
 
@@ -38,21 +318,125 @@ func (q *QueueService) AddBatchJob(jobID string) error {
 	jobStatus := models.JobStatus{
 		JobID:           jobID,
 		Status:          "pending",
-		TotalImages:     0,
-		CompletedImages: 0,
-		FailedImages:    0,
+		TotalImages:     job.TotalImages,
+		CompletedImages: job.CompletedImages,
+		FailedImages:    job.FailedImages,
 		Progress:        0,
 		Message:         "任务已加入队列",
 		UpdatedAt:       time.Now(),
 	}
 
-	statusData, _ := json.Marshal(jobStatus)
-	q.redis.Set(ctx, fmt.Sprintf("job_status:%s", jobID), statusData, 24*time.Hour)
+	q.UpdateJobStatus(jobID, jobStatus)
+
+	log.Printf("✅ 批量任务 %s 已添加到队列 (%d 张图片)", jobID, len(taskIDs))
+	return nil
+}
+
+// AddGenerationTask 将异步生成加入队列，队列中只保存生成记录ID，执行时再读取生成参数和源图片
+func (q *QueueService) AddGenerationTask(generationID string) error {
+	if err := q.redis.LPush(context.Background(), generationQueueKey, generationID).Err(); err != nil {
+		return fmt.Errorf("添加生成任务失败: %v", err)
+	}
+	return nil
+}
+
+// GetNextGeneration 领取下一个异步生成并登记租约，队列为空时返回空字符串
+func (q *QueueService) GetNextGeneration() (string, error) {
+	ctx := context.Background()
+
+	// 先将到期的自动重试放回队列
+	err := promoteGenerationsScript.Run(ctx, q.redis,
+		[]string{delayedGenerationsKey, generationQueueKey},
+		time.Now().UnixMilli(),
+	).Err()
+	if err != nil {
+		log.Printf("⚠️ 延迟生成重新入队失败: %v", err)
+	}
+
+	id, err := popGenerationScript.Run(ctx, q.redis,
+		[]string{generationQueueKey, generationProcessingKey, attemptsKey},
+		leasePrefix, q.workerID, q.leaseTimeout.Milliseconds(),
+	).Text()
+	if err != nil {
+		if err == redis.Nil {
+			return "", nil // 没有任务
+		}
+		return "", fmt.Errorf("获取生成任务失败: %v", err)
+	}
+	return id, nil
+}
 
-	log.Printf("✅ 批量任务 %s 已添加到队列", jobID)
+// CompleteGeneration 异步生成执行结束，移出处理中队列并释放租约
+func (q *QueueService) CompleteGeneration(generationID string) error {
+	ctx := context.Background()
+
+	pipe := q.redis.TxPipeline()
+	pipe.LRem(ctx, generationProcessingKey, 0, generationID)
+	pipe.Del(ctx, leaseKey(generationID))
+	pipe.HDel(ctx, attemptsKey, generationID)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// RequeueGeneration 将被中断的异步生成放回队首，本次投递不计入尝试次数
+func (q *QueueService) RequeueGeneration(generationID string) error {
+	ctx := context.Background()
+
+	pipe := q.redis.TxPipeline()
+	pipe.LRem(ctx, generationProcessingKey, 0, generationID)
+	pipe.Del(ctx, leaseKey(generationID))
+	pipe.RPush(ctx, generationQueueKey, generationID)
+	pipe.HIncrBy(ctx, attemptsKey, generationID, -1)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// DelayGeneration 生成失败但可以重试的异步生成移出处理中队列，到 retryAt 后重新回到队首
+func (q *QueueService) DelayGeneration(generationID string, retryAt time.Time) error {
+	ctx := context.Background()
+
+	pipe := q.redis.TxPipeline()
+	pipe.LRem(ctx, generationProcessingKey, 0, generationID)
+	pipe.Del(ctx, leaseKey(generationID))
+	pipe.HDel(ctx, attemptsKey, generationID)
+	pipe.ZAdd(ctx, delayedGenerationsKey, redis.Z{Score: float64(retryAt.UnixMilli()), Member: generationID})
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("安排重试失败: %v", err)
+	}
 	return nil
 }
 
+// ReapExpiredGenerations 将租约过期的异步生成放回队首，返回超过最大尝试次数而放弃的生成记录ID
+func (q *QueueService) ReapExpiredGenerations() ([]string, error) {
+	ctx := context.Background()
+
+	ids, err := q.redis.LRange(ctx, generationProcessingKey, 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("读取处理中队列失败: %v", err)
+	}
+
+	var abandoned []string
+	for _, id := range ids {
+		result, err := reapGenerationScript.Run(ctx, q.redis,
+			[]string{leaseKey(id), generationProcessingKey, generationQueueKey, attemptsKey},
+			id, q.maxAttempts,
+		).Int()
+		if err != nil {
+			log.Printf("❌ 回收生成 %s 失败: %v", id, err)
+			continue
+		}
+		switch {
+		case result == 0:
+			log.Printf("💀 异步生成 %s 超过最大尝试次数 (%d)", id, q.maxAttempts)
+			abandoned = append(abandoned, id)
+		case result > 0:
+			log.Printf("♻️ 异步生成 %s 租约过期，已重新入队 (已尝试 %d 次)", id, result)
+		}
+	}
+
+	return abandoned, nil
+}
+
 // GetJobStatus 获取任务状态
 func (q *QueueService) GetJobStatus(jobID string) (*models.JobStatus, error) {
 	ctx := context.Background()
@@ -87,13 +471,14 @@ func (q *QueueService) UpdateJobStatus(jobID string, status models.JobStatus) er
 		return fmt.Errorf("更新任务状态失败: %v", err)
 	}
 
+	// 推送状态变更事件
+	q.redis.Publish(ctx, JobEventChannel(jobID), statusData)
+
 	return nil
 }
 
 // UpdateJobProgress 更新任务进度
-func (q *QueueService) UpdateJobProgress(jobID string, completed, total int, message string) error {
-	ctx := context.Background()
-	
+func (q *QueueService) UpdateJobProgress(jobID string, completed, failed, total int, message string) error {
 	// 获取当前状态
 	status, err := q.GetJobStatus(jobID)
 	if err != nil {
@@ -107,9 +492,10 @@ func (q *QueueService) UpdateJobProgress(jobID string, completed, total int, mes
 
 	// 更新进度
 	status.CompletedImages = completed
+	status.FailedImages = failed
 	status.TotalImages = total
 	if total > 0 {
-		status.Progress = int((float64(completed) / float64(total)) * 100)
+		status.Progress = int((float64(completed+failed) / float64(total)) * 100)
 	}
 	status.Message = message
 	status.UpdatedAt = time.Now()
@@ -117,147 +503,660 @@ func (q *QueueService) UpdateJobProgress(jobID string, completed, total int, mes
 	return q.UpdateJobStatus(jobID, *status)
 }
 
-// CancelJob 取消任务
+// CancelJob 取消任务，尚未开始的图片任务直接删除，处理中的图片由处理器结束后丢弃
 func (q *QueueService) CancelJob(jobID string) error {
 	ctx := context.Background()
-	
+
 	// 从待处理队列中移除
-	q.redis.LRem(ctx, "generation_queue", 0, jobID)
-	
-	// 从处理中队列中移除
-	q.redis.LRem(ctx, "processing_queue", 0, jobID)
-	
-	// 更新状态为已取消
-	status, err := q.GetJobStatus(jobID)
+	taskIDs, _ := q.redis.LRange(ctx, jobTasksKey(jobID), 0, -1).Result()
+	pipe := q.redis.TxPipeline()
+	pipe.ZRem(ctx, pendingQueueKey, jobID)
+	pipe.Del(ctx, jobTasksKey(jobID))
+	if len(taskIDs) > 0 {
+		pipe.HDel(ctx, taskDataKey, taskIDs...)
+	}
+	pipe.HDel(ctx, priorityKey, jobID)
+	pipe.SRem(ctx, pausedKey, jobID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("从队列移除任务失败: %v", err)
+	}
+
+	return q.UpdateJobState(jobID, "cancelled", "任务已取消")
+}
+
+// PauseJob 暂停任务：不再领取该任务的图片，处理中的图片照常完成；
+// 待处理的图片任务保留在列表中，重试或被中断而放回的图片同样等到恢复后再处理
+func (q *QueueService) PauseJob(jobID string) error {
+	ctx := context.Background()
+
+	pipe := q.redis.TxPipeline()
+	pipe.SAdd(ctx, pausedKey, jobID)
+	pipe.ZRem(ctx, pendingQueueKey, jobID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("暂停任务失败: %v", err)
+	}
+
+	return q.UpdateJobState(jobID, "paused", "任务已暂停")
+}
+
+// ResumeJob 恢复已暂停的任务，剩余的图片按原优先级排到同优先级的末尾，state 为恢复后的任务状态
+func (q *QueueService) ResumeJob(jobID, state string) error {
+	ctx := context.Background()
+
+	err := resumeScript.Run(ctx, q.redis,
+		[]string{pendingQueueKey, queueSeqKey, priorityKey, pausedKey, jobTasksKey(jobID)},
+		jobID, priorityWeight,
+	).Err()
 	if err != nil {
-		status = &models.JobStatus{JobID: jobID}
+		return fmt.Errorf("恢复任务失败: %v", err)
 	}
-	
-	status.Status = "cancelled"
-	status.Message = "任务已取消"
-	status.UpdatedAt = time.Now()
-	
-	return q.UpdateJobStatus(jobID, *status)
+
+	return q.UpdateJobState(jobID, state, "任务已恢复")
+}
+
+// IsJobPaused 任务是否已暂停
+func (q *QueueService) IsJobPaused(jobID string) bool {
+	paused, err := q.redis.SIsMember(context.Background(), pausedKey, jobID).Result()
+	return err == nil && paused
 }
 
-// GetNextJob 获取下一个待处理的任务
-func (q *QueueService) GetNextJob() (string, error) {
+// GetNextBatchTask 领取下一个图片任务并登记租约：优先级最高的批量任务先处理，
+// 同优先级的批量任务轮流各领取一张，队列为空时返回nil
+func (q *QueueService) GetNextBatchTask() (*models.GenerationTask, error) {
 	ctx := context.Background()
-	
+
+	q.promoteDelayedTasks(ctx)
+
 	// 从待处理队列移动到处理中队列
-	result, err := q.redis.BRPopLPush(ctx, "generation_queue", "processing_queue", 5*time.Second).Result()
+	data, err := popScript.Run(ctx, q.redis,
+		[]string{pendingQueueKey, "processing_queue", queueSeqKey, priorityKey, taskDataKey, attemptsKey},
+		jobTasksPrefix, priorityWeight, q.leaseTimeout.Milliseconds(), q.workerID, leasePrefix,
+	).Text()
 	if err != nil {
 		if err == redis.Nil {
-			return "", nil // 没有任务
+			return nil, nil // 没有任务
 		}
-		return "", fmt.Errorf("获取下一个任务失败: %v", err)
+		return nil, fmt.Errorf("获取下一个任务失败: %v", err)
 	}
 
-	// 更新任务状态
-	status, _ := q.GetJobStatus(result)
-	if status != nil {
-		status.Status = "processing"
-		status.Message = "正在处理任务"
-		status.UpdatedAt = time.Now()
-		q.UpdateJobStatus(result, *status)
+	var task models.GenerationTask
+	if err := json.Unmarshal([]byte(data), &task); err != nil {
+		return nil, fmt.Errorf("解析生成任务失败: %v", err)
 	}
+	task.Status = "processing"
+	task.RetryAt = nil
 
-	return result, nil
+	return &task, nil
 }
 
-// CompleteJob 完成任务
-func (q *QueueService) CompleteJob(jobID string) error {
+// GetTask 读取图片任务，任务已完成或不存在时返回 ErrTaskNotFound
+func (q *QueueService) GetTask(taskID string) (*models.GenerationTask, error) {
+	data, err := q.redis.HGet(context.Background(), taskDataKey, taskID).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, ErrTaskNotFound
+		}
+		return nil, fmt.Errorf("读取生成任务失败: %v", err)
+	}
+
+	var task models.GenerationTask
+	if err := json.Unmarshal([]byte(data), &task); err != nil {
+		return nil, fmt.Errorf("解析生成任务失败: %v", err)
+	}
+	return &task, nil
+}
+
+// CompleteBatchTask 图片生成成功，从处理中队列移除、删除任务内容并计入完成数量
+func (q *QueueService) CompleteBatchTask(taskID string) error {
+	return q.removeBatchTask(taskID, true)
+}
+
+// DropBatchTask 丢弃所属批量任务已取消或删除的图片任务，不计入完成数量
+func (q *QueueService) DropBatchTask(taskID string) error {
+	return q.removeBatchTask(taskID, false)
+}
+
+// removeBatchTask 从处理中队列移除图片任务并删除任务内容
+func (q *QueueService) removeBatchTask(taskID string, completed bool) error {
 	ctx := context.Background()
-	
-	// 从处理中队列移除
-	q.redis.LRem(ctx, "processing_queue", 0, jobID)
-	
-	// 更新状态为已完成
-	status, err := q.GetJobStatus(jobID)
+
+	pipe := q.redis.TxPipeline()
+	q.removeProcessing(ctx, pipe, taskID)
+	pipe.HDel(ctx, attemptsKey, taskID)
+	pipe.HDel(ctx, taskDataKey, taskID)
+	if completed {
+		pipe.Incr(ctx, completedCountKey)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// FailBatchTask 图片任务生成失败，移入失败队列并保留任务内容以便重试
+func (q *QueueService) FailBatchTask(task *models.GenerationTask) error {
+	ctx := context.Background()
+
+	task.Status = "failed"
+	data, err := json.Marshal(task)
 	if err != nil {
-		status = &models.JobStatus{JobID: jobID}
+		return fmt.Errorf("序列化生成任务失败: %v", err)
 	}
-	
-	status.Status = "completed"
-	status.Progress = 100
-	status.Message = "任务已完成"
-	status.UpdatedAt = time.Now()
-	
-	return q.UpdateJobStatus(jobID, *status)
+
+	pipe := q.redis.TxPipeline()
+	q.removeProcessing(ctx, pipe, task.ID)
+	pipe.HDel(ctx, attemptsKey, task.ID)
+	pipe.HSet(ctx, taskDataKey, task.ID, data)
+	pipe.LPush(ctx, "failed_queue", task.ID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("移入失败队列失败: %v", err)
+	}
+	return nil
 }
 
-// FailJob 标记任务失败
-func (q *QueueService) FailJob(jobID string, errorMsg string) error {
+// RequeueBatchTask 将被中断的图片任务放回所属批量任务的队首，本次投递不计入尝试次数
+func (q *QueueService) RequeueBatchTask(task *models.GenerationTask) error {
 	ctx := context.Background()
-	
-	// 从处理中队列移除
-	q.redis.LRem(ctx, "processing_queue", 0, jobID)
-	
-	// 移到失败队列
-	q.redis.LPush(ctx, "failed_queue", jobID)
-	
-	// 更新状态为失败
+
+	pipe := q.redis.TxPipeline()
+	q.removeProcessing(ctx, pipe, task.ID)
+	pipe.HIncrBy(ctx, attemptsKey, task.ID, -1)
+	pipe.RPush(ctx, jobTasksKey(task.JobID), task.ID)
+	q.schedule(ctx, pipe, task.JobID, true)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("任务重新入队失败: %v", err)
+	}
+	return nil
+}
+
+// DelayBatchTask 生成失败但可以重试的图片任务移出处理中队列，到 retryAt 后重新回到所属批量任务的队首
+func (q *QueueService) DelayBatchTask(task *models.GenerationTask, retryAt time.Time) error {
+	ctx := context.Background()
+
+	task.Status = "delayed"
+	task.RetryAt = &retryAt
+	data, err := json.Marshal(task)
+	if err != nil {
+		return fmt.Errorf("序列化生成任务失败: %v", err)
+	}
+
+	pipe := q.redis.TxPipeline()
+	q.removeProcessing(ctx, pipe, task.ID)
+	pipe.HDel(ctx, attemptsKey, task.ID)
+	pipe.HSet(ctx, taskDataKey, task.ID, data)
+	pipe.ZAdd(ctx, delayedKey, redis.Z{Score: float64(retryAt.UnixMilli()), Member: task.ID})
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("安排重试失败: %v", err)
+	}
+	return nil
+}
+
+// promoteDelayedTasks 将到达计划时间的延迟任务放回待处理队列
+func (q *QueueService) promoteDelayedTasks(ctx context.Context) {
+	due, err := q.redis.ZRangeByScore(ctx, delayedKey, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(time.Now().UnixMilli(), 10),
+		Count: 100,
+	}).Result()
+	if err != nil {
+		log.Printf("⚠️ 查询延迟任务失败: %v", err)
+		return
+	}
+
+	for _, taskID := range due {
+		task, err := q.GetTask(taskID)
+		if err != nil {
+			// 任务内容已删除（所属批量任务已取消）
+			q.redis.ZRem(ctx, delayedKey, taskID)
+			continue
+		}
+		err = promoteScript.Run(ctx, q.redis,
+			[]string{delayedKey, jobTasksKey(task.JobID), pendingQueueKey, queueSeqKey, priorityKey, pausedKey},
+			taskID, task.JobID, priorityWeight,
+		).Err()
+		if err != nil {
+			log.Printf("⚠️ 延迟任务 %s 重新入队失败: %v", taskID, err)
+		}
+	}
+}
+
+// RetryFailedTask 将失败队列中的图片任务重新加入所属批量任务的队尾，不在失败队列中时返回 ErrTaskNotFailed
+func (q *QueueService) RetryFailedTask(taskID string) (*models.GenerationTask, error) {
+	ctx := context.Background()
+
+	// 从失败队列移除，同一任务只能被重试一次
+	removed, err := q.redis.LRem(ctx, "failed_queue", 1, taskID).Result()
+	if err != nil {
+		return nil, fmt.Errorf("从失败队列移除任务失败: %v", err)
+	}
+	if removed == 0 {
+		return nil, ErrTaskNotFailed
+	}
+
+	task, err := q.GetTask(taskID)
+	if err != nil {
+		return nil, err
+	}
+	task.Status = "pending"
+	task.RetryCount++
+	task.Attempts = 0
+	data, err := json.Marshal(task)
+	if err != nil {
+		return nil, fmt.Errorf("序列化生成任务失败: %v", err)
+	}
+
+	// 重置尝试次数后重新添加到待处理队列
+	pipe := q.redis.TxPipeline()
+	pipe.HSet(ctx, taskDataKey, taskID, data)
+	pipe.HDel(ctx, attemptsKey, taskID)
+	pipe.LPush(ctx, jobTasksKey(task.JobID), taskID)
+	q.schedule(ctx, pipe, task.JobID, false)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("重新添加到队列失败: %v", err)
+	}
+
+	return task, nil
+}
+
+// removeProcessing 在事务中将图片任务移出处理中队列并释放租约
+func (q *QueueService) removeProcessing(ctx context.Context, pipe redis.Pipeliner, taskID string) {
+	pipe.LRem(ctx, "processing_queue", 0, taskID)
+	pipe.Del(ctx, leaseKey(taskID))
+}
+
+// SetJobPriority 修改任务优先级，返回任务是否仍在排队
+func (q *QueueService) SetJobPriority(jobID string, priority int) (bool, error) {
+	queued, err := priorityScript.Run(context.Background(), q.redis,
+		[]string{pendingQueueKey, priorityKey},
+		jobID, priority, priorityWeight,
+	).Int()
+	if err != nil {
+		return false, fmt.Errorf("修改任务优先级失败: %v", err)
+	}
+	return queued == 1, nil
+}
+
+// TakeLegacyJobs 取出旧版本以整个批量任务为单位排队的任务ID（generation_queue 列表和处理中队列里的批量任务ID），
+// 由调用方按数据库中的剩余数量重新展开入队
+func (q *QueueService) TakeLegacyJobs() ([]string, error) {
+	ctx := context.Background()
+	var jobIDs []string
+
+	keyType, err := q.redis.Type(ctx, pendingQueueKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("读取待处理队列失败: %v", err)
+	}
+	if keyType == "list" {
+		ids, err := q.redis.LRange(ctx, pendingQueueKey, 0, -1).Result()
+		if err != nil {
+			return nil, fmt.Errorf("读取待处理队列失败: %v", err)
+		}
+		// 列表从右端出队，右端的任务最先处理
+		for i := len(ids) - 1; i >= 0; i-- {
+			jobIDs = append(jobIDs, ids[i])
+		}
+		q.redis.Del(ctx, pendingQueueKey)
+	}
+
+	processing, err := q.redis.LRange(ctx, "processing_queue", 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("读取处理中队列失败: %v", err)
+	}
+	for _, id := range processing {
+		if exists, err := q.redis.HExists(ctx, taskDataKey, id).Result(); err != nil || exists {
+			continue
+		}
+		pipe := q.redis.TxPipeline()
+		q.removeProcessing(ctx, pipe, id)
+		pipe.HDel(ctx, attemptsKey, id)
+		pipe.Exec(ctx)
+		jobIDs = append(jobIDs, id)
+	}
+
+	return jobIDs, nil
+}
+
+// Heartbeat 为当前节点持有的任务续租，返回false表示租约已丢失（任务已被回收或转交其他节点）
+func (q *QueueService) Heartbeat(taskID string) (bool, error) {
+	ctx := context.Background()
+
+	result, err := heartbeatScript.Run(ctx, q.redis,
+		[]string{leaseKey(taskID)},
+		q.workerID, q.leaseTimeout.Milliseconds(),
+	).Int()
+	if err != nil {
+		return false, fmt.Errorf("任务续租失败: %v", err)
+	}
+
+	return result == 1, nil
+}
+
+// KeepLease 处理期间定期续租，直到 ctx 结束；租约丢失时关闭 leaseLost 并调用 cancel 中断处理
+func (q *QueueService) KeepLease(ctx context.Context, taskID string, cancel context.CancelFunc, leaseLost chan struct{}) {
+	ticker := time.NewTicker(q.leaseTimeout / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			ok, err := q.Heartbeat(taskID)
+			if err != nil {
+				log.Printf("⚠️ 任务 %s 续租失败: %v", taskID, err)
+				continue
+			}
+			if !ok {
+				close(leaseLost)
+				cancel()
+				return
+			}
+		}
+	}
+}
+
+// ReapExpiredTasks 将租约过期的图片任务放回所属批量任务的队首，
+// 返回超过最大尝试次数而移入失败队列的任务，由调用方计入失败数量
+func (q *QueueService) ReapExpiredTasks() ([]*models.GenerationTask, error) {
+	ctx := context.Background()
+
+	taskIDs, err := q.redis.LRange(ctx, "processing_queue", 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("读取处理中队列失败: %v", err)
+	}
+
+	var failed []*models.GenerationTask
+	for _, taskID := range taskIDs {
+		if n, err := q.redis.Exists(ctx, leaseKey(taskID)).Result(); err != nil || n > 0 {
+			continue
+		}
+		if task := q.reapTask(ctx, taskID); task != nil {
+			failed = append(failed, task)
+		}
+	}
+
+	return failed, nil
+}
+
+// RecoverProcessingTasks 启动时的恢复：回收上次运行遗留的租约已过期的图片任务，
+// 租约仍有效的任务可能属于正在运行的其他进程，等到过期后再由定期回收处理。
+// 返回超过最大尝试次数而移入失败队列的任务
+func (q *QueueService) RecoverProcessingTasks() ([]*models.GenerationTask, error) {
+	return q.ReapExpiredTasks()
+}
+
+// reapTask 回收单个图片任务，任务被移入失败队列时返回该任务
+func (q *QueueService) reapTask(ctx context.Context, taskID string) *models.GenerationTask {
+	task, err := q.GetTask(taskID)
+	if err != nil {
+		// 任务内容已删除（所属批量任务已取消），直接清理
+		if n, err := q.redis.Exists(ctx, leaseKey(taskID)).Result(); err != nil || n > 0 {
+			return nil
+		}
+		pipe := q.redis.TxPipeline()
+		q.removeProcessing(ctx, pipe, taskID)
+		pipe.HDel(ctx, attemptsKey, taskID)
+		pipe.Exec(ctx)
+		return nil
+	}
+
+	result, err := reapScript.Run(ctx, q.redis,
+		[]string{leaseKey(taskID), "processing_queue", pendingQueueKey, attemptsKey, "failed_queue", priorityKey, queueSeqKey, jobTasksKey(task.JobID), pausedKey},
+		taskID, q.maxAttempts, priorityWeight, task.JobID,
+	).Int()
+	if err != nil {
+		log.Printf("❌ 回收任务 %s 失败: %v", taskID, err)
+		return nil
+	}
+	if result < 0 {
+		return nil
+	}
+
+	if result == 0 {
+		task.Status = "failed"
+		task.LastError = fmt.Sprintf("任务租约多次过期，超过最大尝试次数 (%d)", q.maxAttempts)
+		if data, err := json.Marshal(task); err == nil {
+			q.redis.HSet(ctx, taskDataKey, taskID, data)
+		}
+		log.Printf("💀 批量任务 %s 的图片任务 %s 超过最大尝试次数 (%d)，已移入失败队列", task.JobID, taskID, q.maxAttempts)
+		return task
+	}
+
+	log.Printf("♻️ 批量任务 %s 的图片任务 %s 租约过期，已重新入队 (已尝试 %d 次)", task.JobID, taskID, result)
+	return nil
+}
+
+// leaseKey 处理中任务的租约键
+func leaseKey(taskID string) string {
+	return leasePrefix + taskID
+}
+
+// UpdateJobState 更新批量任务在队列中的状态和提示信息
+func (q *QueueService) UpdateJobState(jobID, state, message string) error {
 	status, err := q.GetJobStatus(jobID)
 	if err != nil {
 		status = &models.JobStatus{JobID: jobID}
 	}
-	
-	status.Status = "failed"
-	status.Message = errorMsg
+
+	status.Status = state
+	status.Message = message
 	status.UpdatedAt = time.Now()
-	
+	if state == "completed" {
+		status.Progress = 100
+	}
+
 	return q.UpdateJobStatus(jobID, *status)
 }
 
+// MarkJobStarted 将等待中或已中断的批量任务在队列中标记为处理中，其他状态不变，返回是否已更新
+func (q *QueueService) MarkJobStarted(jobID, message string) (bool, error) {
+	return q.transitionJobState(jobID, []string{"pending", "interrupted"}, "processing", message)
+}
+
+// MarkJobInterrupted 将等待中或处理中的批量任务在队列中标记为已中断，已暂停、取消或结束的任务不变，返回是否已更新
+func (q *QueueService) MarkJobInterrupted(jobID, message string) (bool, error) {
+	return q.transitionJobState(jobID, []string{"pending", "processing"}, "interrupted", message)
+}
+
+// transitionJobState 原子地将队列中处于 from 之一的任务状态改为 to，状态不存在时直接写入
+func (q *QueueService) transitionJobState(jobID string, from []string, to, message string) (bool, error) {
+	now := time.Now()
+	initial, err := json.Marshal(models.JobStatus{JobID: jobID, Status: to, Message: message, UpdatedAt: now})
+	if err != nil {
+		return false, fmt.Errorf("序列化任务状态失败: %v", err)
+	}
+
+	args := []interface{}{initial, to, message, now.Format(time.RFC3339Nano), (24 * time.Hour).Milliseconds(), JobEventChannel(jobID)}
+	for _, status := range from {
+		args = append(args, status)
+	}
+	updated, err := transitionJobScript.Run(context.Background(), q.redis,
+		[]string{fmt.Sprintf("job_status:%s", jobID)}, args...,
+	).Int()
+	if err != nil {
+		return false, fmt.Errorf("更新任务状态失败: %v", err)
+	}
+	return updated == 1, nil
+}
+
+// CompleteJob 标记任务完成
+func (q *QueueService) CompleteJob(jobID string) error {
+	return q.UpdateJobState(jobID, "completed", "任务已完成")
+}
+
+// FailJob 标记任务失败
+func (q *QueueService) FailJob(jobID string, errorMsg string) error {
+	return q.UpdateJobState(jobID, "failed", errorMsg)
+}
+
 // GetQueueStats 获取队列统计信息
 func (q *QueueService) GetQueueStats() (*models.QueueStats, error) {
 	ctx := context.Background()
-	
-	// 获取各队列长度
-	pendingCount, _ := q.redis.LLen(ctx, "generation_queue").Result()
+
+	// 待处理数量为各批量任务剩余图片任务之和
+	jobIDs, _ := q.redis.ZRange(ctx, pendingQueueKey, 0, -1).Result()
+	pendingCount := 0
+	if len(jobIDs) > 0 {
+		pipe := q.redis.Pipeline()
+		cmds := make([]*redis.IntCmd, len(jobIDs))
+		for i, jobID := range jobIDs {
+			cmds[i] = pipe.LLen(ctx, jobTasksKey(jobID))
+		}
+		pipe.Exec(ctx)
+		for _, cmd := range cmds {
+			pendingCount += int(cmd.Val())
+		}
+	}
 	processingCount, _ := q.redis.LLen(ctx, "processing_queue").Result()
 	failedCount, _ := q.redis.LLen(ctx, "failed_queue").Result()
+	delayedCount, _ := q.redis.ZCard(ctx, delayedKey).Result()
+	completedCount, _ := q.redis.Get(ctx, completedCountKey).Int()
 
 	stats := &models.QueueStats{
-		PendingJobs:    int(pendingCount),
+		PendingJobs:    pendingCount,
 		ProcessingJobs: int(processingCount),
 		FailedJobs:     int(failedCount),
+		DelayedJobs:    int(delayedCount),
+		CompletedJobs:  completedCount,
 		UpdatedAt:      time.Now(),
 	}
 
 	return stats, nil
 }
 
-// RetryFailedJob 重试失败的任务
-func (q *QueueService) RetryFailedJob(jobID string) error {
+// ListPendingJobs 按领取顺序列出 generation_queue 中的批量任务及其待处理图片
+func (q *QueueService) ListPendingJobs() ([]models.PendingJobEntry, error) {
 	ctx := context.Background()
-	
-	// 从失败队列移除
-	removed, err := q.redis.LRem(ctx, "failed_queue", 1, jobID).Result()
+
+	jobIDs, err := q.redis.ZRange(ctx, pendingQueueKey, 0, -1).Result()
 	if err != nil {
-		return fmt.Errorf("从失败队列移除任务失败: %v", err)
+		return nil, fmt.Errorf("读取待处理队列失败: %v", err)
 	}
-	
-	if removed == 0 {
-		return fmt.Errorf("任务不在失败队列中")
+	priorities, err := q.redis.HGetAll(ctx, priorityKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("读取任务优先级失败: %v", err)
 	}
-	
-	// 重新添加到待处理队列
-	err = q.redis.LPush(ctx, "generation_queue", jobID).Err()
+
+	entries := make([]models.PendingJobEntry, 0, len(jobIDs))
+	for _, jobID := range jobIDs {
+		pipe := q.redis.Pipeline()
+		length := pipe.LLen(ctx, jobTasksKey(jobID))
+		head := pipe.LRange(ctx, jobTasksKey(jobID), -100, -1)
+		if _, err := pipe.Exec(ctx); err != nil {
+			return nil, fmt.Errorf("读取待处理图片失败: %v", err)
+		}
+
+		// 列表从右端出队，翻转后按领取顺序排列
+		taskIDs := head.Val()
+		for i, j := 0, len(taskIDs)-1; i < j; i, j = i+1, j-1 {
+			taskIDs[i], taskIDs[j] = taskIDs[j], taskIDs[i]
+		}
+		priority, _ := strconv.Atoi(priorities[jobID])
+		entries = append(entries, models.PendingJobEntry{
+			JobID:        jobID,
+			Priority:     priority,
+			PendingTasks: int(length.Val()),
+			TaskIDs:      taskIDs,
+		})
+	}
+	return entries, nil
+}
+
+// ListProcessingTasks 列出处理中的图片任务及其租约
+func (q *QueueService) ListProcessingTasks() ([]models.QueueEntry, error) {
+	ctx := context.Background()
+
+	taskIDs, err := q.redis.LRange(ctx, "processing_queue", 0, -1).Result()
 	if err != nil {
-		return fmt.Errorf("重新添加到队列失败: %v", err)
+		return nil, fmt.Errorf("读取处理中队列失败: %v", err)
 	}
-	
-	// 重置状态
-	status, _ := q.GetJobStatus(jobID)
-	if status != nil {
-		status.Status = "pending"
-		status.Message = "任务已重新加入队列"
-		status.UpdatedAt = time.Now()
-		q.UpdateJobStatus(jobID, *status)
+	entries, err := q.queueEntries(ctx, taskIDs)
+	if err != nil {
+		return nil, err
 	}
-	
-	return nil
+
+	for i := range entries {
+		id := entries[i].ID
+		entries[i].Owner, _ = q.redis.Get(ctx, leaseKey(id)).Result()
+		entries[i].Deliveries, _ = q.redis.HGet(ctx, attemptsKey, id).Int()
+		if ttl, err := q.redis.PTTL(ctx, leaseKey(id)).Result(); err == nil && ttl > 0 {
+			expiresAt := time.Now().Add(ttl)
+			entries[i].LeaseExpiresAt = &expiresAt
+		}
+	}
+	return entries, nil
+}
+
+// ListDelayedTasks 按计划执行时间列出等待自动重试的图片任务
+func (q *QueueService) ListDelayedTasks() ([]models.QueueEntry, error) {
+	ctx := context.Background()
+
+	taskIDs, err := q.redis.ZRange(ctx, delayedKey, 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("读取延迟队列失败: %v", err)
+	}
+	return q.queueEntries(ctx, taskIDs)
+}
+
+// ListFailedTasks 分页列出失败队列，最近失败的在前
+func (q *QueueService) ListFailedTasks(page, pageSize int) ([]models.QueueEntry, int64, error) {
+	ctx := context.Background()
+
+	total, err := q.redis.LLen(ctx, "failed_queue").Result()
+	if err != nil {
+		return nil, 0, fmt.Errorf("读取失败队列失败: %v", err)
+	}
+	start := int64((page - 1) * pageSize)
+	taskIDs, err := q.redis.LRange(ctx, "failed_queue", start, start+int64(pageSize)-1).Result()
+	if err != nil {
+		return nil, 0, fmt.Errorf("读取失败队列失败: %v", err)
+	}
+
+	entries, err := q.queueEntries(ctx, taskIDs)
+	return entries, total, err
+}
+
+// FailedTaskIDs 失败队列中的全部ID
+func (q *QueueService) FailedTaskIDs() ([]string, error) {
+	taskIDs, err := q.redis.LRange(context.Background(), "failed_queue", 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("读取失败队列失败: %v", err)
+	}
+	return taskIDs, nil
+}
+
+// PurgeFailedTasks 清空失败队列并删除其中的任务内容，返回清除的数量；已计入的失败数量不变
+func (q *QueueService) PurgeFailedTasks() (int, error) {
+	purged, err := purgeScript.Run(context.Background(), q.redis,
+		[]string{"failed_queue", taskDataKey},
+	).Int()
+	if err != nil {
+		return 0, fmt.Errorf("清空失败队列失败: %v", err)
+	}
+	return purged, nil
+}
+
+// queueEntries 批量读取图片任务内容
+func (q *QueueService) queueEntries(ctx context.Context, taskIDs []string) ([]models.QueueEntry, error) {
+	entries := make([]models.QueueEntry, len(taskIDs))
+	if len(taskIDs) == 0 {
+		return entries, nil
+	}
+
+	values, err := q.redis.HMGet(ctx, taskDataKey, taskIDs...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("读取生成任务失败: %v", err)
+	}
+	for i, value := range values {
+		entries[i].ID = taskIDs[i]
+		data, ok := value.(string)
+		if !ok {
+			continue
+		}
+		var task models.GenerationTask
+		if err := json.Unmarshal([]byte(data), &task); err == nil {
+			entries[i].Task = &task
+		}
+	}
+	return entries, nil
 }
 
 // CleanupExpiredJobs 清理过期任务
@@ -287,6 +1186,8 @@ func (q *QueueService) CleanupExpiredJobs(maxAge time.Duration) error {
 		if (status.Status == "completed" || status.Status == "failed" || status.Status == "cancelled") &&
 			status.UpdatedAt.Before(cutoff) {
 			q.redis.Del(ctx, key)
+			q.redis.HDel(ctx, priorityKey, status.JobID)
+			q.redis.SRem(ctx, pausedKey, status.JobID)
 			log.Printf("清理过期任务状态: %s", status.JobID)
 		}
 	}
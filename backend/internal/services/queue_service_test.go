@@ -0,0 +1,204 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"nano-banana-qwen/internal/config"
+	"nano-banana-qwen/internal/models"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestQueueServiceLeaseExpiry(t *testing.T) {
+	db := newTestDatabase(t)
+	mr := db.embeddedRedis
+	owner := NewQueueService(db.Redis, &config.Config{WorkerID: "worker-1", JobLeaseTimeout: 10, JobMaxAttempts: 2})
+	other := NewQueueService(db.Redis, &config.Config{WorkerID: "worker-2", JobLeaseTimeout: 10, JobMaxAttempts: 2})
+
+	job := &models.BatchJob{ID: primitive.NewObjectID(), Prompts: []models.BatchPrompt{{PromptText: "cat", Count: 1}}, TotalImages: 1}
+	if err := owner.AddBatchJob(job); err != nil {
+		t.Fatalf("任务入队失败: %v", err)
+	}
+	task, err := owner.GetNextBatchTask()
+	if err != nil || task == nil {
+		t.Fatalf("领取图片任务 = %v, %v", task, err)
+	}
+
+	// 另一个进程启动时不回收租约仍有效的任务，也不能替别人续租
+	if failed, err := other.RecoverProcessingTasks(); err != nil || len(failed) != 0 {
+		t.Fatalf("RecoverProcessingTasks = %v, %v", failed, err)
+	}
+	if next, _ := other.GetNextBatchTask(); next != nil {
+		t.Fatalf("租约有效的任务被重新投递: %+v", next)
+	}
+	if ok, err := other.Heartbeat(task.ID); err != nil || ok {
+		t.Errorf("其他节点续租 = %v, %v, 期望 false", ok, err)
+	}
+
+	// 续租后租约从续租时刻重新计算
+	mr.FastForward(6 * time.Second)
+	if ok, err := owner.Heartbeat(task.ID); err != nil || !ok {
+		t.Fatalf("续租 = %v, %v", ok, err)
+	}
+	mr.FastForward(6 * time.Second)
+	if failed, err := other.ReapExpiredTasks(); err != nil || len(failed) != 0 {
+		t.Fatalf("ReapExpiredTasks = %v, %v", failed, err)
+	}
+	if count, _ := owner.GetActiveJobsCount(); count != 1 {
+		t.Fatalf("续租后处理中任务数 = %d, 期望 1", count)
+	}
+
+	// 租约过期后被回收并重新投递，原节点续租失败
+	mr.FastForward(5 * time.Second)
+	if ok, _ := owner.Heartbeat(task.ID); ok {
+		t.Error("租约过期后续租成功")
+	}
+	if failed, err := other.ReapExpiredTasks(); err != nil || len(failed) != 0 {
+		t.Fatalf("ReapExpiredTasks = %v, %v", failed, err)
+	}
+	next, err := other.GetNextBatchTask()
+	if err != nil || next == nil || next.ID != task.ID {
+		t.Fatalf("重新投递 = %+v, %v", next, err)
+	}
+
+	// 第二次过期时超过最大投递次数，移入失败队列
+	mr.FastForward(11 * time.Second)
+	failed, err := owner.ReapExpiredTasks()
+	if err != nil || len(failed) != 1 || failed[0].ID != task.ID || failed[0].Status != "failed" || failed[0].LastError == "" {
+		t.Fatalf("超过最大尝试次数 = %+v, %v", failed, err)
+	}
+	stats, _ := owner.GetQueueStats()
+	if stats.ProcessingJobs != 0 || stats.FailedJobs != 1 {
+		t.Errorf("队列统计 = %+v", stats)
+	}
+	if stored, err := owner.GetTask(task.ID); err != nil || stored.Status != "failed" {
+		t.Errorf("失败任务内容 = %+v, %v", stored, err)
+	}
+}
+
+func TestQueueServiceKeepLease(t *testing.T) {
+	db := newTestDatabase(t)
+	queue := NewQueueService(db.Redis, &config.Config{WorkerID: "worker-1", JobLeaseTimeout: 3, JobMaxAttempts: 5})
+
+	job := &models.BatchJob{ID: primitive.NewObjectID(), Prompts: []models.BatchPrompt{{PromptText: "cat", Count: 1}}, TotalImages: 1}
+	if err := queue.AddBatchJob(job); err != nil {
+		t.Fatalf("任务入队失败: %v", err)
+	}
+	task, err := queue.GetNextBatchTask()
+	if err != nil || task == nil {
+		t.Fatalf("领取图片任务 = %v, %v", task, err)
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	taskCtx, cancel := context.WithCancel(context.Background())
+	leaseLost := make(chan struct{})
+	go queue.KeepLease(ctx, task.ID, cancel, leaseLost)
+
+	// 处理期间定期续租，租约不会过期
+	time.Sleep(1500 * time.Millisecond)
+	if ttl := db.embeddedRedis.TTL(leaseKey(task.ID)); ttl <= 2*time.Second {
+		t.Errorf("续租后剩余租约 = %v", ttl)
+	}
+
+	// 租约被其他节点回收后中断生成
+	db.embeddedRedis.Del(leaseKey(task.ID))
+	select {
+	case <-leaseLost:
+	case <-time.After(3 * time.Second):
+		t.Fatal("租约丢失后未中断生成")
+	}
+	if taskCtx.Err() == nil {
+		t.Error("租约丢失后生成的 ctx 未取消")
+	}
+}
+
+func TestGenerationQueueLease(t *testing.T) {
+	db := newTestDatabase(t)
+	mr := db.embeddedRedis
+	owner := NewQueueService(db.Redis, &config.Config{WorkerID: "worker-1", JobLeaseTimeout: 10, JobMaxAttempts: 2})
+	other := NewQueueService(db.Redis, &config.Config{WorkerID: "worker-2", JobLeaseTimeout: 10, JobMaxAttempts: 2})
+
+	id := primitive.NewObjectID().Hex()
+	if err := owner.AddGenerationTask(id); err != nil {
+		t.Fatalf("生成入队失败: %v", err)
+	}
+
+	// 被中断后重新入队不计入尝试次数
+	if got, err := owner.GetNextGeneration(); err != nil || got != id {
+		t.Fatalf("领取生成 = %q, %v", got, err)
+	}
+	if err := owner.RequeueGeneration(id); err != nil {
+		t.Fatalf("重新入队失败: %v", err)
+	}
+	if got, _ := owner.GetNextGeneration(); got != id {
+		t.Fatalf("重新领取 = %q", got)
+	}
+
+	// 租约有效时不回收，过期后放回队列由其他节点领取
+	if abandoned, err := other.ReapExpiredGenerations(); err != nil || len(abandoned) != 0 {
+		t.Fatalf("ReapExpiredGenerations = %v, %v", abandoned, err)
+	}
+	if got, _ := other.GetNextGeneration(); got != "" {
+		t.Fatalf("租约有效的生成被重新投递: %q", got)
+	}
+	mr.FastForward(11 * time.Second)
+	if abandoned, err := other.ReapExpiredGenerations(); err != nil || len(abandoned) != 0 {
+		t.Fatalf("ReapExpiredGenerations = %v, %v", abandoned, err)
+	}
+	if got, _ := other.GetNextGeneration(); got != id {
+		t.Fatalf("过期后重新投递 = %q", got)
+	}
+	if ok, _ := owner.Heartbeat(id); ok {
+		t.Error("租约转交后原节点续租成功")
+	}
+
+	// 第二次过期时超过最大尝试次数，交由调用方标记失败
+	mr.FastForward(11 * time.Second)
+	abandoned, err := owner.ReapExpiredGenerations()
+	if err != nil || len(abandoned) != 1 || abandoned[0] != id {
+		t.Fatalf("超过最大尝试次数 = %v, %v", abandoned, err)
+	}
+	if got, _ := owner.GetNextGeneration(); got != "" {
+		t.Errorf("放弃的生成仍在队列中: %q", got)
+	}
+	if n, _ := db.Redis.LLen(context.Background(), generationProcessingKey).Result(); n != 0 {
+		t.Errorf("处理中队列长度 = %d", n)
+	}
+}
+
+func TestQueueServiceMarkJobStarted(t *testing.T) {
+	db := newTestDatabase(t)
+	queue := NewQueueService(db.Redis, &config.Config{WorkerID: "worker-1", JobLeaseTimeout: 10, JobMaxAttempts: 2})
+
+	// 等待中的任务标记为处理中，保留进度
+	queue.UpdateJobStatus("job-1", models.JobStatus{JobID: "job-1", Status: "pending", TotalImages: 4, CompletedImages: 1, Progress: 25})
+	if started, err := queue.MarkJobStarted("job-1", "正在处理任务"); err != nil || !started {
+		t.Fatalf("MarkJobStarted = %v, %v", started, err)
+	}
+	status, err := queue.GetJobStatus("job-1")
+	if err != nil || status.Status != "processing" || status.Message != "正在处理任务" || status.TotalImages != 4 || status.Progress != 25 || status.UpdatedAt.IsZero() {
+		t.Fatalf("任务状态 = %+v, %v", status, err)
+	}
+
+	// 已处理中、暂停或取消的任务不被覆盖
+	for _, state := range []string{"processing", "paused", "cancelled"} {
+		queue.UpdateJobState("job-1", state, state)
+		if started, err := queue.MarkJobStarted("job-1", "正在处理任务"); err != nil || started {
+			t.Errorf("%s: MarkJobStarted = %v, %v", state, started, err)
+		}
+		if status, _ := queue.GetJobStatus("job-1"); status.Status != state {
+			t.Errorf("%s: 状态被覆盖为 %s", state, status.Status)
+		}
+	}
+
+	// 状态不存在时直接写入处理中
+	if started, err := queue.MarkJobStarted("job-2", "正在处理任务"); err != nil || !started {
+		t.Fatalf("MarkJobStarted = %v, %v", started, err)
+	}
+	if status, err := queue.GetJobStatus("job-2"); err != nil || status.Status != "processing" || status.JobID != "job-2" {
+		t.Errorf("任务状态 = %+v, %v", status, err)
+	}
+}
@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"path"
+	"strings"
+	"time"
+
+	"nano-banana-qwen/internal/config"
+)
+
+// 文件key的命名空间，本地存储时分别对应配置中的目录，URL 为 /api/v1/files/<key>
+const (
+	GeneratedPrefix = "generated"
+	ThumbnailPrefix = "thumbnails"
+	UploadPrefix    = "uploads"
+)
+
+var (
+	// ErrNotFound 文件不存在
+	ErrNotFound = errors.New("文件不存在")
+	// ErrInvalidKey 文件key为空、是绝对路径或跳出了命名空间
+	ErrInvalidKey = errors.New("文件key无效")
+	// ErrPresignNotSupported 存储后端不支持预签名URL，需要由服务端转发文件内容
+	ErrPresignNotSupported = errors.New("存储后端不支持预签名URL")
+)
+
+// BlobInfo 文件元信息
+type BlobInfo struct {
+	Size        int64
+	ContentType string
+	ModTime     time.Time
+}
+
+// Blob 读取中的文件，支持 Seek 以便按 Range 返回部分内容
+type Blob interface {
+	io.ReadSeekCloser
+}
+
+// BlobStore 图片文件存储后端，key 为与后端无关的相对路径，如 generated/xxx.png
+type BlobStore interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	Get(ctx context.Context, key string) (Blob, *BlobInfo, error)
+	Delete(ctx context.Context, key string) error
+	// PresignedURL 生成有效期为 expiry 的直接下载地址，filename 非空时以附件形式下载
+	PresignedURL(ctx context.Context, key string, expiry time.Duration, filename string) (string, error)
+}
+
+// New 根据配置创建文件存储后端
+func New(cfg *config.Config) (BlobStore, error) {
+	switch cfg.BlobBackend {
+	case "", "local":
+		return NewLocalStore(map[string]string{
+			GeneratedPrefix: cfg.GeneratedPath,
+			ThumbnailPrefix: cfg.ThumbnailPath,
+			UploadPrefix:    cfg.UploadPath,
+		}), nil
+	case "s3":
+		return NewS3Store(S3Options{
+			Endpoint:  cfg.S3Endpoint,
+			Region:    cfg.S3Region,
+			Bucket:    cfg.S3Bucket,
+			AccessKey: cfg.S3AccessKey,
+			SecretKey: cfg.S3SecretKey,
+			UseSSL:    cfg.S3UseSSL,
+		})
+	default:
+		return nil, fmt.Errorf("不支持的文件存储后端: %s", cfg.BlobBackend)
+	}
+}
+
+// Key 拼接文件key
+func Key(prefix, filename string) string {
+	return prefix + "/" + filename
+}
+
+// cleanKey 校验并规范化key，拒绝绝对路径和跳出命名空间的路径
+func cleanKey(key string) (string, error) {
+	cleaned := path.Clean(strings.TrimPrefix(key, "/"))
+	if cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("%w: %s", ErrInvalidKey, key)
+	}
+	return cleaned, nil
+}
+
+// AttachmentDisposition 以附件形式下载的 Content-Disposition，文件名中的引号和非ASCII字符按 RFC 2231 编码
+func AttachmentDisposition(filename string) string {
+	return mime.FormatMediaType("attachment", map[string]string{"filename": filename})
+}
+
+// contentTypeOf 根据扩展名推断内容类型
+func contentTypeOf(key string) string {
+	if contentType := mime.TypeByExtension(path.Ext(key)); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
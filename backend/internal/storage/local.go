@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// LocalStore 本地文件系统存储，key 的第一段决定所在目录
+type LocalStore struct {
+	dirs map[string]string
+}
+
+// NewLocalStore 创建本地存储，dirs 为命名空间到目录的映射
+func NewLocalStore(dirs map[string]string) *LocalStore {
+	return &LocalStore{dirs: dirs}
+}
+
+// resolve 将key映射为本地文件路径，兼容旧版本记录中保存的本地文件路径
+func (s *LocalStore) resolve(key string) (string, error) {
+	cleaned, err := cleanKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	prefix, name, ok := strings.Cut(cleaned, "/")
+	dir, known := s.dirs[prefix]
+	if !ok || !known {
+		if filePath, legacy := s.legacyPath(key); legacy {
+			return filePath, nil
+		}
+		return "", fmt.Errorf("%w: %s", ErrInvalidKey, key)
+	}
+	return filepath.Join(dir, filepath.FromSlash(name)), nil
+}
+
+// legacyPath 旧版本的 file_path/thumbnail_path 保存的是本地文件路径（如 ./data/images/generated/x.png），
+// 只接受位于已配置目录内的路径
+func (s *LocalStore) legacyPath(key string) (string, bool) {
+	filePath := filepath.Clean(filepath.FromSlash(key))
+	for _, dir := range s.dirs {
+		rel, err := filepath.Rel(filepath.Clean(dir), filePath)
+		if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		return filePath, true
+	}
+	return "", false
+}
+
+func (s *LocalStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	filePath, err := s.resolve(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return fmt.Errorf("创建目录失败: %v", err)
+	}
+
+	// 先写临时文件再重命名，读取方不会看到写了一半的文件
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filePath)
+}
+
+func (s *LocalStore) Get(ctx context.Context, key string) (Blob, *BlobInfo, error) {
+	filePath, err := s.resolve(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil, ErrNotFound
+		}
+		return nil, nil, err
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	return file, &BlobInfo{
+		Size:        stat.Size(),
+		ContentType: contentTypeOf(key),
+		ModTime:     stat.ModTime(),
+	}, nil
+}
+
+func (s *LocalStore) Delete(ctx context.Context, key string) error {
+	filePath, err := s.resolve(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(filePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *LocalStore) PresignedURL(ctx context.Context, key string, expiry time.Duration, filename string) (string, error) {
+	return "", ErrPresignNotSupported
+}
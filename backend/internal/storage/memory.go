@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// MemoryStore 纯内存的文件存储，进程退出后数据丢失，主要用于测试
+type MemoryStore struct {
+	mu    sync.RWMutex
+	blobs map[string]memoryBlob
+}
+
+type memoryBlob struct {
+	data []byte
+	info BlobInfo
+}
+
+// memoryReader 为内存数据补上 Close
+type memoryReader struct {
+	*bytes.Reader
+}
+
+func (memoryReader) Close() error { return nil }
+
+// NewMemoryStore 创建内存文件存储
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{blobs: make(map[string]memoryBlob)}
+}
+
+func (s *MemoryStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	cleaned, err := cleanKey(key)
+	if err != nil {
+		return err
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if contentType == "" {
+		contentType = contentTypeOf(cleaned)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.blobs[cleaned] = memoryBlob{
+		data: data,
+		info: BlobInfo{Size: int64(len(data)), ContentType: contentType, ModTime: time.Now()},
+	}
+	return nil
+}
+
+func (s *MemoryStore) Get(ctx context.Context, key string) (Blob, *BlobInfo, error) {
+	cleaned, err := cleanKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	blob, ok := s.blobs[cleaned]
+	if !ok {
+		return nil, nil, ErrNotFound
+	}
+
+	info := blob.info
+	return memoryReader{bytes.NewReader(blob.data)}, &info, nil
+}
+
+func (s *MemoryStore) Delete(ctx context.Context, key string) error {
+	cleaned, err := cleanKey(key)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.blobs, cleaned)
+	return nil
+}
+
+func (s *MemoryStore) PresignedURL(ctx context.Context, key string, expiry time.Duration, filename string) (string, error) {
+	return "", ErrPresignNotSupported
+}
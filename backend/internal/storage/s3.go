@@ -0,0 +1,130 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3Options S3兼容对象存储的连接参数，Endpoint 为 host:port，不含协议
+type S3Options struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	UseSSL    bool
+}
+
+// S3Store S3兼容对象存储（AWS S3、MinIO等），key 直接作为对象名
+type S3Store struct {
+	client *minio.Client
+	bucket string
+}
+
+// NewS3Store 连接对象存储，bucket 不存在时自动创建
+func NewS3Store(opts S3Options) (*S3Store, error) {
+	client, err := minio.New(opts.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(opts.AccessKey, opts.SecretKey, ""),
+		Secure: opts.UseSSL,
+		Region: opts.Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("创建对象存储客户端失败: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	exists, err := client.BucketExists(ctx, opts.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("对象存储连接失败: %v", err)
+	}
+	if !exists {
+		if err := client.MakeBucket(ctx, opts.Bucket, minio.MakeBucketOptions{Region: opts.Region}); err != nil {
+			return nil, fmt.Errorf("创建存储桶失败: %v", err)
+		}
+		log.Printf("🪣 已创建存储桶: %s", opts.Bucket)
+	}
+
+	log.Printf("✅ 对象存储连接成功: %s/%s", opts.Endpoint, opts.Bucket)
+	return &S3Store{client: client, bucket: opts.Bucket}, nil
+}
+
+func (s *S3Store) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	cleaned, err := cleanKey(key)
+	if err != nil {
+		return err
+	}
+	if contentType == "" {
+		contentType = contentTypeOf(cleaned)
+	}
+
+	_, err = s.client.PutObject(ctx, s.bucket, cleaned, r, size, minio.PutObjectOptions{ContentType: contentType})
+	return err
+}
+
+func (s *S3Store) Get(ctx context.Context, key string) (Blob, *BlobInfo, error) {
+	cleaned, err := cleanKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	object, err := s.client.GetObject(ctx, s.bucket, cleaned, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, nil, s.translateError(err)
+	}
+
+	// GetObject 不发请求，Stat 时才能知道对象是否存在
+	stat, err := object.Stat()
+	if err != nil {
+		object.Close()
+		return nil, nil, s.translateError(err)
+	}
+
+	return object, &BlobInfo{
+		Size:        stat.Size,
+		ContentType: stat.ContentType,
+		ModTime:     stat.LastModified,
+	}, nil
+}
+
+func (s *S3Store) Delete(ctx context.Context, key string) error {
+	cleaned, err := cleanKey(key)
+	if err != nil {
+		return err
+	}
+	return s.client.RemoveObject(ctx, s.bucket, cleaned, minio.RemoveObjectOptions{})
+}
+
+func (s *S3Store) PresignedURL(ctx context.Context, key string, expiry time.Duration, filename string) (string, error) {
+	cleaned, err := cleanKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	params := url.Values{}
+	if filename != "" {
+		params.Set("response-content-disposition", AttachmentDisposition(filename))
+	}
+
+	presigned, err := s.client.PresignedGetObject(ctx, s.bucket, cleaned, expiry, params)
+	if err != nil {
+		return "", err
+	}
+	return presigned.String(), nil
+}
+
+// translateError 将对象不存在的错误转换为 ErrNotFound
+func (s *S3Store) translateError(err error) error {
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return ErrNotFound
+	}
+	return err
+}
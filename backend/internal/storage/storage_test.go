@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+)
+
+// newFakeS3Store 基于进程内S3替身创建对象存储
+func newFakeS3Store(t *testing.T) *S3Store {
+	t.Helper()
+
+	server := httptest.NewServer(gofakes3.New(s3mem.New()).Server())
+	t.Cleanup(server.Close)
+
+	endpoint, _ := url.Parse(server.URL)
+	store, err := NewS3Store(S3Options{
+		Endpoint:  endpoint.Host,
+		Region:    "us-east-1",
+		Bucket:    "images",
+		AccessKey: "test",
+		SecretKey: "test-secret",
+	})
+	if err != nil {
+		t.Fatalf("连接对象存储失败: %v", err)
+	}
+	return store
+}
+
+func TestBlobStores(t *testing.T) {
+	dir := t.TempDir()
+	stores := map[string]BlobStore{
+		"memory": NewMemoryStore(),
+		"local":  NewLocalStore(map[string]string{GeneratedPrefix: dir + "/generated", ThumbnailPrefix: dir + "/thumbnails"}),
+		"s3":     newFakeS3Store(t),
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			key := Key(GeneratedPrefix, "a.png")
+			content := "fake png content"
+
+			if err := store.Put(ctx, key, strings.NewReader(content), int64(len(content)), "image/png"); err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+
+			blob, info, err := store.Get(ctx, key)
+			if err != nil {
+				t.Fatalf("Get: %v", err)
+			}
+			// 支持 Seek 才能按 Range 返回
+			blob.Seek(5, io.SeekStart)
+			data, _ := io.ReadAll(blob)
+			blob.Close()
+			if string(data) != content[5:] || info.Size != int64(len(content)) || info.ContentType != "image/png" {
+				t.Errorf("Get = %q, info = %+v", data, info)
+			}
+
+			if err := store.Delete(ctx, key); err != nil {
+				t.Fatalf("Delete: %v", err)
+			}
+			if _, _, err := store.Get(ctx, key); !errors.Is(err, ErrNotFound) {
+				t.Errorf("删除后 Get: err = %v, 期望 ErrNotFound", err)
+			}
+
+			if _, _, err := store.Get(ctx, "../etc/passwd"); !errors.Is(err, ErrInvalidKey) {
+				t.Errorf("越界key: err = %v, 期望 ErrInvalidKey", err)
+			}
+		})
+	}
+}
+
+func TestLocalStoreLegacyPaths(t *testing.T) {
+	t.Chdir(t.TempDir())
+	store := NewLocalStore(map[string]string{GeneratedPrefix: "./data/images/generated", ThumbnailPrefix: "./data/images/thumbnails"})
+	ctx := context.Background()
+
+	content := "fake png content"
+	if err := store.Put(ctx, Key(GeneratedPrefix, "a.png"), strings.NewReader(content), int64(len(content)), "image/png"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	// 旧版本记录中保存的本地文件路径按原路径读取和删除
+	for _, legacy := range []string{"./data/images/generated/a.png", "data/images/generated/a.png"} {
+		blob, info, err := store.Get(ctx, legacy)
+		if err != nil {
+			t.Fatalf("Get(%q): %v", legacy, err)
+		}
+		blob.Close()
+		if info.Size != int64(len(content)) || info.ContentType != "image/png" {
+			t.Errorf("Get(%q) info = %+v", legacy, info)
+		}
+	}
+	if _, _, err := store.Get(ctx, "./data/other/a.png"); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("配置目录以外的路径: err = %v, 期望 ErrInvalidKey", err)
+	}
+	if err := store.Delete(ctx, "./data/images/generated/a.png"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, _, err := store.Get(ctx, Key(GeneratedPrefix, "a.png")); !errors.Is(err, ErrNotFound) {
+		t.Errorf("删除后 Get: err = %v, 期望 ErrNotFound", err)
+	}
+}
+
+func TestAttachmentDisposition(t *testing.T) {
+	for name, want := range map[string]string{
+		"a.png":     "attachment; filename=a.png",
+		`a "b".png`: `attachment; filename="a \"b\".png"`,
+		"猫.png":     "attachment; filename*=utf-8''%E7%8C%AB.png",
+	} {
+		if got := AttachmentDisposition(name); got != want {
+			t.Errorf("AttachmentDisposition(%q) = %q, 期望 %q", name, got, want)
+		}
+	}
+}
+
+func TestS3PresignedURL(t *testing.T) {
+	store := newFakeS3Store(t)
+	ctx := context.Background()
+
+	key := Key(ThumbnailPrefix, "thumb.png")
+	store.Put(ctx, key, strings.NewReader("thumbnail"), 9, "image/png")
+
+	presigned, err := store.PresignedURL(ctx, key, time.Minute, "thumb.png")
+	if err != nil {
+		t.Fatalf("生成预签名URL失败: %v", err)
+	}
+
+	resp, err := http.Get(presigned)
+	if err != nil {
+		t.Fatalf("请求预签名URL失败: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "thumbnail" {
+		t.Errorf("预签名URL响应 = %d %q", resp.StatusCode, body)
+	}
+
+	if _, err := NewMemoryStore().PresignedURL(ctx, key, time.Minute, ""); !errors.Is(err, ErrPresignNotSupported) {
+		t.Errorf("内存存储预签名: err = %v", err)
+	}
+}
@@ -58,7 +58,8 @@ export interface Text2ImgRequest {
 
 export interface Img2ImgRequest {
   prompt: string
-  source_image: string
+  source_image?: string
+  source_image_id?: string
   count?: number
   params?: GenerationParams
 }
@@ -81,9 +82,13 @@ export interface Generation {
   prompt_text: string
   image_url: string
   thumbnail_url: string
+  image_id?: string
+  image_ids?: string[]
+  image_urls?: string[]
   generation_params: GenerationParams
   status: string
   error_message?: string
+  attempts?: GenerationAttempt[]
   generation_time: number
   batch_job_id?: string
   is_img2img: boolean
@@ -91,6 +96,15 @@ export interface Generation {
   created_at: string
 }
 
+// 一次失败的模型调用，retry_at 为安排的自动重试时间
+export interface GenerationAttempt {
+  error: string
+  error_kind: 'rate_limited' | 'server_error' | 'timeout' | 'network' | 'content_policy' | 'invalid_request' | 'unknown'
+  status_code?: number
+  failed_at: string
+  retry_at?: string
+}
+
 export interface BatchJob {
   id: string
   name: string
@@ -99,6 +113,7 @@ export interface BatchJob {
   completed_images: number
   failed_images: number
   status: string
+  priority: number
   started_at?: string
   completed_at?: string
   created_at: string
@@ -112,6 +127,45 @@ export interface BatchPrompt {
   failed: number
 }
 
+// 批量任务中单张图片的队列项，id 即生成记录ID
+export interface GenerationTask {
+  id: string
+  job_id: string
+  prompt_id?: string
+  prompt_index: number
+  prompt: string
+  status: string
+  retry_count: number
+  attempts: number
+  last_error?: string
+  retry_at?: string
+  created_at: string
+}
+
+export interface QueueStats {
+  pending_jobs: number
+  processing_jobs: number
+  failed_jobs: number
+  delayed_jobs: number
+  completed_jobs: number
+  updated_at: string
+}
+
+export interface QueueEntry {
+  id: string
+  task?: GenerationTask
+  owner?: string
+  lease_expires_at?: string
+  deliveries?: number
+}
+
+export interface PendingJobEntry {
+  job_id: string
+  priority: number
+  pending_tasks: number
+  task_ids: string[]
+}
+
 export interface Image {
   id: string
   filename: string
@@ -119,9 +173,14 @@ export interface Image {
   file_path: string
   thumbnail_path: string
   file_size: number
+  sha256: string
+  phash: string
   width: number
   height: number
   format: string
+  variants: ImageVariant[]
+  uploaded: boolean
+  imported_metadata?: ImageMetadata
   generation_id?: string
   prompt_text: string
   is_img2img: boolean
@@ -129,6 +188,46 @@ export interface Image {
   created_at: string
 }
 
+// 下载时写入图片文件的生成信息，导入后据此恢复提示词和参数
+export interface ImageMetadata {
+  generation_id?: string
+  prompt: string
+  params: GenerationParams
+}
+
+// 保持宽高比的衍生图，从小到大，第一张即缩略图
+export interface ImageVariant {
+  width: number
+  height: number
+  format: string
+  path: string
+}
+
+export interface ImageLineageNode {
+  image: Image
+  generation_params?: GenerationParams
+  distance: number
+  children?: ImageLineageNode[]
+}
+
+export interface ImageLineage {
+  ancestors: ImageLineageNode[]
+  root: ImageLineageNode
+}
+
+export interface SimilarImage {
+  image: Image
+  distance: number
+}
+
+export interface BatchDedupeReport {
+  batch_job_id: string
+  max_distance: number
+  total_images: number
+  duplicate_images: number
+  groups: { images: SimilarImage[] }[]
+}
+
 // API函数
 export const apiService = {
   // 健康检查
@@ -175,13 +274,21 @@ export const apiService = {
     get: (id: string) =>
       api.get(`/generations/${id}`) as Promise<APIResponse<Generation>>,
     
+    images: (id: string) =>
+      api.get(`/generations/${id}/images`) as Promise<APIResponse<Image[]>>,
+    
+    // 订阅生成状态(SSE)，事件名为 status
+    events: (id: string) =>
+      new EventSource(`${API_BASE_URL}/generations/${id}/events`),
+    
     delete: (id: string) =>
       api.delete(`/generations/${id}`) as Promise<APIResponse<null>>,
   },
 
   // 批量任务
   batch: {
-    create: (data: { name?: string; prompts: BatchPrompt[] }) =>
+    // priority 范围 -10 到 10，默认0，越大越先处理
+    create: (data: { name?: string; prompts: BatchPrompt[]; priority?: number }) =>
       api.post('/batch', data) as Promise<APIResponse<BatchJob>>,
     
     list: (params?: { page?: number; page_size?: number; status?: string }) =>
@@ -190,9 +297,40 @@ export const apiService = {
     get: (id: string) =>
       api.get(`/batch/${id}`) as Promise<APIResponse<BatchJob>>,
     
+    // 修改未结束任务的优先级
+    update: (id: string, data: { priority: number }) =>
+      api.patch(`/batch/${id}`, data) as Promise<APIResponse<BatchJob>>,
+    
     getStatus: (id: string) =>
       api.get(`/batch/${id}/status`) as Promise<APIResponse<{ job_id: string; status: string; total_images: number; completed_images: number; failed_images: number; progress: number; message: string; updated_at: string }>>,
     
+    // 订阅任务进度(SSE)，事件名为 status
+    events: (id: string) =>
+      new EventSource(`${API_BASE_URL}/batch/${id}/events`),
+    
+    // 任务内近似图片报告，maxDistance 为感知哈希的最大汉明距离
+    dedupe: (id: string, maxDistance?: number) =>
+      api.get(`/batch/${id}/dedupe`, { params: { max_distance: maxDistance } }) as Promise<APIResponse<BatchDedupeReport>>,
+    
+    // 导出任务的全部图片为ZIP (含 manifest.json/manifest.csv)，thumbnails 为 true 时包含缩略图
+    exportUrl: (id: string, thumbnails = false) =>
+      `${API_BASE_URL}/batch/${id}/export.zip${thumbnails ? '?thumbnails=true' : ''}`,
+    
+    // 任务中已开始生成的图片，status 可按生成状态过滤
+    tasks: (id: string, status?: string) =>
+      api.get(`/batch/${id}/tasks`, { params: { status } }) as Promise<APIResponse<Generation[]>>,
+    
+    // 重新生成一张失败的图片
+    retryTask: (id: string, taskId: string) =>
+      api.post(`/batch/${id}/tasks/${taskId}/retry`) as Promise<APIResponse<GenerationTask>>,
+    
+    // 暂停后不再开始新的图片，恢复后继续生成剩余的图片
+    pause: (id: string) =>
+      api.post(`/batch/${id}/pause`) as Promise<APIResponse<BatchJob>>,
+    
+    resume: (id: string) =>
+      api.post(`/batch/${id}/resume`) as Promise<APIResponse<BatchJob>>,
+    
     cancel: (id: string) =>
       api.delete(`/batch/${id}/cancel`) as Promise<APIResponse<null>>,
     
@@ -200,25 +338,95 @@ export const apiService = {
       api.delete(`/batch/${id}`) as Promise<APIResponse<null>>,
   },
 
+  // 队列管理
+  queue: {
+    stats: () =>
+      api.get('/queue/stats') as Promise<APIResponse<QueueStats>>,
+    
+    pending: () =>
+      api.get('/queue/pending') as Promise<APIResponse<PendingJobEntry[]>>,
+    
+    processing: () =>
+      api.get('/queue/processing') as Promise<APIResponse<QueueEntry[]>>,
+    
+    delayed: () =>
+      api.get('/queue/delayed') as Promise<APIResponse<QueueEntry[]>>,
+    
+    failed: (params?: { page?: number; page_size?: number }) =>
+      api.get('/queue/failed', { params }) as Promise<APIResponse<{ entries: QueueEntry[]; total: number; page: number; page_size: number; total_pages: number }>>,
+    
+    retry: (taskId: string) =>
+      api.post(`/queue/failed/${taskId}/retry`) as Promise<APIResponse<GenerationTask>>,
+    
+    retryAll: () =>
+      api.post('/queue/failed/retry') as Promise<APIResponse<{ retried: number; skipped: number }>>,
+    
+    purge: () =>
+      api.delete('/queue/failed') as Promise<APIResponse<{ purged: number }>>,
+  },
+
   // 图片管理
   images: {
-    list: (params?: { page?: number; page_size?: number; prompt?: string }) =>
+    list: (params?: { page?: number; page_size?: number; prompt?: string; sha256?: string }) =>
       api.get('/images', { params }) as Promise<APIResponse<{ images: Image[]; total: number; page: number; page_size: number; total_pages: number }>>,
     
     get: (id: string) =>
       api.get(`/images/${id}`) as Promise<APIResponse<Image>>,
     
-    delete: (id: string) =>
-      api.delete(`/images/${id}`) as Promise<APIResponse<null>>,
+    upload: (file: File) => {
+      const form = new FormData()
+      form.append('file', file)
+      return api.post('/images/upload', form, { headers: { 'Content-Type': 'multipart/form-data' } }) as Promise<APIResponse<Image>>
+    },
+    
+    // 导入之前下载的图片，返回的 imported_metadata 可用于重新生成
+    import: (file: File) => {
+      const form = new FormData()
+      form.append('file', file)
+      return api.post('/images/import', form, { headers: { 'Content-Type': 'multipart/form-data' } }) as Promise<APIResponse<Image>>
+    },
+    
+    // 按ID列表或过滤条件导出ZIP，单次最多1000张
+    export: (params: { image_ids?: string[]; filter?: { prompt?: string; generation_id?: string; sha256?: string }; thumbnails?: boolean }) =>
+      api.post('/images/export', params, { responseType: 'blob' }) as Promise<Blob>,
+    
+    generation: (id: string) =>
+      api.get(`/images/${id}/generation`) as Promise<APIResponse<Generation>>,
+    
+    // 图生图血缘：祖先链和后代树
+    lineage: (id: string) =>
+      api.get(`/images/${id}/lineage`) as Promise<APIResponse<ImageLineage>>,
+    
+    // 按感知哈希查找近似图片
+    similar: (id: string, maxDistance?: number) =>
+      api.get(`/images/${id}/similar`, { params: { max_distance: maxDistance } }) as Promise<APIResponse<SimilarImage[]>>,
+    
+    // permanent 为 true 时永久删除，文件在没有其他图片引用后移除
+    delete: (id: string, permanent = false) =>
+      api.delete(`/images/${id}`, { params: permanent ? { permanent: true } : undefined }) as Promise<APIResponse<null>>,
     
     download: (id: string) =>
       `${API_BASE_URL}/images/${id}/download`,
     
+    // path 为图片记录中的文件key，如 generated/xxx.png
     getUrl: (path: string) =>
-      `${API_BASE_URL}/files${path}`,
+      `${API_BASE_URL}/files/${path}`,
     
     getThumbnailUrl: (path: string) =>
-      `${API_BASE_URL}/files${path}`,
+      `${API_BASE_URL}/files/${path}`,
+    
+    // 按需渲染任意尺寸，fit: contain | cover | fill，format: jpeg | png | webp
+    getRenderUrl: (id: string, params: { w?: number; h?: number; fit?: 'contain' | 'cover' | 'fill'; format?: 'jpeg' | 'png' | 'webp'; q?: number }) => {
+      const query = new URLSearchParams()
+      Object.entries(params).forEach(([key, value]) => {
+        if (value !== undefined) query.set(key, String(value))
+      })
+      return `${API_BASE_URL}/images/${id}/render?${query}`
+    },
+    
+    // 由衍生图生成 <img srcset>，如 "…_200.jpg 200w, …_512.jpg 512w"
+    getSrcSet: (image: Image) =>
+      (image.variants || []).map((v) => `${API_BASE_URL}/files/${v.path} ${v.width}w`).join(', '),
   },
 }
 